@@ -1,5 +1,45 @@
 // JavaScript for Squid Proxy List Editor
 
+// Send the session's CSRF token with every state-changing request and
+// return to the login page when the session has expired
+const nativeFetch = window.fetch.bind(window);
+window.fetch = function(url, options = {}) {
+    const method = (options.method || 'GET').toUpperCase();
+    if (method !== 'GET' && method !== 'HEAD') {
+        const meta = document.querySelector('meta[name="csrf-token"]');
+        options.headers = Object.assign({}, options.headers, { 'X-CSRF-Token': meta ? meta.content : '' });
+    }
+    return nativeFetch(url, options).then(res => {
+        if (res.status === 401) {
+            window.location = '/login?next=' + encodeURIComponent(window.location.pathname);
+        }
+        return res;
+    });
+};
+
+// Permissions that hide UI controls when the current user lacks them
+const UI_PERMISSIONS = ['whitelist:edit', 'blacklist:edit', 'logs:clear', 'squid:reload', 'users:manage', 'profiles:manage'];
+
+// Mark the body with a cannot-* class per missing permission; the stylesheet hides those controls
+function applyPermissions() {
+    return fetch('/me')
+        .then(res => res.json())
+        .then(me => {
+            const granted = new Set(me.permissions || []);
+            UI_PERMISSIONS.forEach(perm => {
+                document.body.classList.toggle('cannot-' + perm.replace(':', '-'), !granted.has(perm));
+            });
+        })
+        .catch(err => {
+            console.error('Error loading permissions:', err);
+        });
+}
+
+function logout() {
+    fetch('/logout', { method: 'POST' })
+        .then(() => { window.location = '/login'; });
+}
+
 // Emoji constants
 const EMOJI = {
     WHITELIST: '✅',
@@ -7,7 +47,9 @@ const EMOJI = {
     UNKNOWN: '❓',
     TRASH: '🗑️',
     AI: '💡',
-    LINK: '🔗'
+    LINK: '🔗',
+    DEPS: '🧩',
+    EDIT: '✏️'
 };
 
 // Action button constants
@@ -33,16 +75,29 @@ function buildChatGPTUrl(domain, note = '') {
 }
 
 function clearAllLogs() {
-    if (!confirm('Clear all access logs (WL, BL, and RG)? This cannot be undone.')) {
+    const category = document.getElementById('clearCategory').value;
+    const label = category ? `the ${category} log` : 'all access logs (WL, BL, and RG)';
+    const reason = prompt(`Clear ${label}? Entries are moved to a compressed archive.\n\nReason (optional):`, '');
+    if (reason === null) {
         return;
     }
     
-    fetch('/clear-all-logs', { method: 'POST' })
+    const data = new FormData();
+    data.append('category', category);
+    data.append('reason', reason.trim());
+    
+    fetch('/clear-all-logs', { method: 'POST', body: data })
         .then(res => res.json())
         .then(data => {
-            alert(data.status || 'All logs cleared');
+            if (data.status === 'error') {
+                alert('Error clearing logs: ' + data.error);
+                return;
+            }
+            const archived = data.archive ? ` (archived as ${data.archive.id})` : '';
+            alert((data.status || 'All logs cleared') + archived);
             updateSummary();
             updateLog();
+            updateArchives();
         })
         .catch(err => {
             console.error('Error clearing logs:', err);
@@ -50,61 +105,176 @@ function clearAllLogs() {
         });
 }
 
+function toggleArchives() {
+    const list = document.getElementById('archive-list');
+    list.style.display = list.style.display === 'none' ? 'block' : 'none';
+    updateArchives();
+}
+
+function updateArchives() {
+    const list = document.getElementById('archive-list');
+    if (list.style.display === 'none') {
+        return;
+    }
+    fetch('/log-archives')
+        .then(res => res.json())
+        .then(data => {
+            if (!data.archives || data.archives.length === 0) {
+                list.textContent = 'No archives yet';
+                return;
+            }
+            list.innerHTML = data.archives.map(a => {
+                const count = Object.values(a.entries || {}).reduce((sum, n) => sum + n, 0);
+                const reason = a.reason ? ` – ${escapeHtml(a.reason)}` : '';
+                return `<div><a href="/log-archives/${encodeURIComponent(a.id)}">${escapeHtml(a.id)}</a> ${count} lines${reason}</div>`;
+            }).join('');
+        })
+        .catch(err => {
+            console.error('Error loading archives:', err);
+        });
+}
+
+// Rolled-up summary groups the user expanded, kept across refreshes
+const expandedGroups = new Set();
+
 function updateSummary() {
-    fetch('/summary-data')
+    const grouped = document.getElementById('groupRegistrable').checked;
+    const category = document.getElementById('filterCategory').value;
+    const params = new URLSearchParams();
+    if (grouped) params.set('group', 'registrable');
+    if (category === '-') {
+        params.set('uncategorized', 'true');
+    } else if (category) {
+        params.set('category', category);
+    }
+    fetch('/summary-data?' + params)
         .then(res => res.json())
         .then(data => {
-            renderFilteredSummary(data.rows);
+            updateCategoryFilter(data.categories || {});
+            if (grouped) {
+                renderGroupedSummary(data.groups || []);
+            } else {
+                renderFilteredSummary(data.rows);
+            }
         });
 }
 
-function renderFilteredSummary(rows) {
-    const showWL = document.getElementById('filterWL').checked;
-    const showBL = document.getElementById('filterBL').checked;
-    const showRG = document.getElementById('filterRG').checked;
+// updateCategoryFilter offers the categories seen in the log, keeping the selection
+function updateCategoryFilter(counts) {
+    const select = document.getElementById('filterCategory');
+    const selected = select.value;
+    const names = Object.keys(counts).sort();
+    if (selected && selected !== '-' && !names.includes(selected)) {
+        names.push(selected);
+    }
+    const options = ['<option value="">All categories</option>', '<option value="-">Uncategorized</option>'];
+    names.forEach(name => {
+        const n = counts[name] || 0;
+        options.push(`<option value="${escapeHtml(name)}">${escapeHtml(name)} (${n})</option>`);
+    });
+    select.innerHTML = options.join('');
+    select.value = selected;
+}
+
+// rowVisible applies the status filter checkboxes
+function rowVisible(row) {
+    if (row.status === EMOJI.WHITELIST) return document.getElementById('filterWL').checked;
+    if (row.status === EMOJI.BLACKLIST) return document.getElementById('filterBL').checked;
+    return document.getElementById('filterRG').checked;
+}
+
+// summaryRowHtml renders one domain row with the actions its status allows
+function summaryRowHtml(row, attrs = '') {
+    let cls = "unknown";
+    if (row.status === EMOJI.WHITELIST) {
+        cls = "whitelist";
+    } else if (row.status === EMOJI.BLACKLIST) {
+        cls = "blacklist";
+    }
     
-    // Filter rows based on checkbox states
-    const filteredRows = rows.filter(row => {
-        if (row.status === EMOJI.WHITELIST && !showWL) return false;
-        if (row.status === EMOJI.BLACKLIST && !showBL) return false;
-        if (row.status === EMOJI.UNKNOWN && !showRG) return false;
-        return true;
+    // Generate action buttons based on current status
+    let actions = "";
+    const domain = escapeHtml(row.domain);
+    if (row.status === EMOJI.WHITELIST) {
+        // Whitelisted: can move to blacklist, or look for the hosts its pages also need
+        actions = `<button onclick="moveDomain('${domain}', 'blacklist')" class="action-btn bl">${ACTION_BUTTONS.TO_BLACKLIST}</button> <button type="button" class="inline-btn deps" title="What else does this site need?" onclick="showDependencies('${domain}')">${EMOJI.DEPS}</button>`;
+    } else if (row.status === EMOJI.BLACKLIST) {
+        // Blacklisted: can move to whitelist
+        actions = `<button onclick="moveDomain('${domain}', 'whitelist')" class="action-btn wl">${ACTION_BUTTONS.TO_WHITELIST}</button>`;
+    } else {
+        // Unknown: can move to whitelist or blacklist
+        actions = `<button onclick="moveDomain('${domain}', 'whitelist')" class="action-btn wl">${ACTION_BUTTONS.TO_WHITELIST}</button> <button onclick="moveDomain('${domain}', 'blacklist')" class="action-btn bl">${ACTION_BUTTONS.TO_BLACKLIST}</button>`;
+    }
+    
+    let label = row.display ? `<span title="${domain}">${escapeHtml(row.display)}</span>` : domain;
+    if (row.range) {
+        label += ` <small title="IP list range deciding this address">(${escapeHtml(row.range)})</small>`;
+    }
+    (row.categories || []).forEach(category => {
+        label += ` <span class="category">${escapeHtml(category)}</span>`;
     });
+    if (row.note) {
+        label += ` <small class="rule-note" title="Note left by a rule">${escapeHtml(row.note)}</small>`;
+    }
+    const domainWithButtons = `${label} <button type="button" class="inline-btn ai" title="${buildAITooltip(domain)}" onclick="window.open(buildChatGPTUrl('${domain}'), '_blank')">${EMOJI.AI}</button> <button type="button" class="inline-btn link" title="${domain}" onclick="window.open('https://${domain}', '_blank')">${EMOJI.LINK}</button>`;
     
+    return `<tr${attrs}><td>${actions}</td><td class="status ${cls}">${row.status}</td><td>${domainWithButtons}</td><td>${row.count}</td></tr>`;
+}
+
+function renderFilteredSummary(rows) {
     // Build HTML table
     let html = '<table class="summary-table"><tr><th>Actions</th><th></th><th>Domain</th><th>Count</th></tr>';
-    
-    filteredRows.forEach(row => {
-        let cls = "unknown";
-        if (row.status === EMOJI.WHITELIST) {
-            cls = "whitelist";
-        } else if (row.status === EMOJI.BLACKLIST) {
-            cls = "blacklist";
+    rows.filter(rowVisible).forEach(row => {
+        html += summaryRowHtml(row);
+    });
+    html += '</table>';
+    document.getElementById('summary-content').innerHTML = html;
+}
+
+// renderGroupedSummary shows one row per registrable domain with its hosts as expandable children
+function renderGroupedSummary(groups) {
+    let html = '<table class="summary-table"><tr><th>Actions</th><th></th><th>Domain</th><th>Count</th></tr>';
+    groups.forEach(group => {
+        const children = group.children.filter(rowVisible);
+        if (children.length === 0) return;
+        const domain = escapeHtml(group.domain);
+        const expanded = expandedGroups.has(group.domain);
+        const count = children.reduce((sum, row) => sum + row.count, 0);
+        let actions = '';
+        if (!group.list) {
+            actions = `<button onclick="whitelistRegistrable('${domain}')" class="action-btn wl" title="Whitelist .${domain} and every host below it">${ACTION_BUTTONS.TO_WHITELIST} .${domain}</button>`;
         }
-        
-        // Generate action buttons based on current status
-        let actions = "";
-        const domain = escapeHtml(row.domain);
-        if (row.status === EMOJI.WHITELIST) {
-            // Whitelisted: can move to blacklist
-            actions = `<button onclick="moveDomain('${domain}', 'blacklist')" class="action-btn bl">${ACTION_BUTTONS.TO_BLACKLIST}</button>`;
-        } else if (row.status === EMOJI.BLACKLIST) {
-            // Blacklisted: can move to whitelist
-            actions = `<button onclick="moveDomain('${domain}', 'whitelist')" class="action-btn wl">${ACTION_BUTTONS.TO_WHITELIST}</button>`;
-        } else {
-            // Unknown: can move to whitelist or blacklist
-            actions = `<button onclick="moveDomain('${domain}', 'whitelist')" class="action-btn wl">${ACTION_BUTTONS.TO_WHITELIST}</button> <button onclick="moveDomain('${domain}', 'blacklist')" class="action-btn bl">${ACTION_BUTTONS.TO_BLACKLIST}</button>`;
+        const hosts = `${group.children.length} host${group.children.length === 1 ? '' : 's'}`;
+        const listed = group.list ? ` <span class="status ${group.list}">(.${domain} on ${group.list})</span>` : '';
+        html += `<tr class="group-row"><td>${actions}</td><td class="status">${group.status || '…'}</td>` +
+            `<td><button type="button" class="inline-btn expand" onclick="toggleGroup('${domain}')">${expanded ? '▼' : '▶'}</button> <strong title="${domain}">${group.display ? escapeHtml(group.display) : domain}</strong> <small>${hosts}</small>${listed}</td><td>${count}</td></tr>`;
+        if (expanded) {
+            children.forEach(row => {
+                html += summaryRowHtml(row, ' class="group-child"');
+            });
         }
-        
-        const domainWithButtons = `${domain} <button type="button" class="inline-btn ai" title="${buildAITooltip(domain)}" onclick="window.open(buildChatGPTUrl('${domain}'), '_blank')">${EMOJI.AI}</button> <button type="button" class="inline-btn link" title="${domain}" onclick="window.open('https://${domain}', '_blank')">${EMOJI.LINK}</button>`;
-        
-        html += `<tr><td>${actions}</td><td class="status ${cls}">${row.status}</td><td>${domainWithButtons}</td><td>${row.count}</td></tr>`;
     });
-    
     html += '</table>';
     document.getElementById('summary-content').innerHTML = html;
 }
 
+function toggleGroup(domain) {
+    if (expandedGroups.has(domain)) {
+        expandedGroups.delete(domain);
+    } else {
+        expandedGroups.add(domain);
+    }
+    updateSummary();
+}
+
+// whitelistRegistrable writes a ".example.co.uk" entry covering the whole registrable domain
+function whitelistRegistrable(domain) {
+    if (!confirm(`Whitelist .${domain}, including every subdomain?`)) {
+        return;
+    }
+    moveDomain('.' + domain, 'whitelist');
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
@@ -140,20 +310,175 @@ function updateLog() {
         });
 }
 
+function updateHealth() {
+    fetch('/squid/health')
+        .then(res => res.json())
+        .then(data => {
+            const el = document.getElementById('squidHealth');
+            let text = data.status;
+            if (data.status === 'UP') {
+                text += ` (${data.latency_ms} ms)`;
+            }
+            if (data.reload && !data.reload.verified) {
+                text += data.reload.error ? ' – reload failed' : ' – reload unverified';
+            }
+            el.textContent = text;
+            el.title = data.error || '';
+            el.className = 'health ' + data.status.toLowerCase();
+        })
+        .catch(err => {
+            console.error('Error loading squid health:', err);
+        });
+}
+
+function updateSquidStats() {
+    fetch('/squid/stats')
+        .then(res => res.json())
+        .then(data => {
+            const el = document.getElementById('squid-stats');
+            const parts = [];
+            if (data.info) {
+                parts.push(`<div><strong>${escapeHtml(data.info.version)}</strong> • clients: ${data.info.clients} • requests: ${data.info.http_requests} (${data.info.requests_per_minute}/min avg) • FDs: ${data.info.file_descriptors_in_use}/${data.info.max_file_descriptors}</div>`);
+            }
+            if (data.five_min && data.five_min.length) {
+                const rows = data.five_min.map(w =>
+                    `<tr><td>${escapeHtml(w.worker)}</td><td>${w.requests_per_sec.toFixed(2)}</td><td>${w.cpu_usage_percent.toFixed(2)}%</td></tr>`).join('');
+                parts.push(`<table class="summary-table"><tr><th>Worker</th><th>Req/s (5 min)</th><th>CPU</th></tr>${rows}</table>`);
+            }
+            if (data.fqdncache) {
+                const fq = data.fqdncache;
+                const ratio = fq.requests ? (100 * fq.hits / fq.requests).toFixed(1) : '0.0';
+                parts.push(`<div>DNS cache: ${fq.entries_in_use} entries • ${fq.hits}/${fq.requests} hits (${ratio}%) • ${fq.misses} misses</div>`);
+            }
+            if (data.errors) {
+                parts.push(`<div class="stats-error">Unavailable: ${escapeHtml(Object.keys(data.errors).join(', '))}</div>`);
+            }
+            el.innerHTML = parts.join('');
+        })
+        .catch(err => {
+            console.error('Error loading squid stats:', err);
+        });
+}
+
+function updateAccessRequests() {
+    fetch('/access-requests')
+        .then(res => res.json())
+        .then(data => {
+            const el = document.getElementById('access-requests');
+            const requests = data.requests || [];
+            if (!requests.length) {
+                el.textContent = '(no pending requests)';
+                return;
+            }
+            const rows = requests.map(r => `<tr>
+                <td>${escapeHtml(r.domain)}</td>
+                <td>${escapeHtml(r.requester)}<br><small>${escapeHtml(r.client_ip)}</small></td>
+                <td>${escapeHtml(r.justification)}</td>
+                <td>${new Date(r.created_at).toLocaleString()}</td>
+                <td class="request-actions">
+                    <button type="button" onclick="decideAccessRequest('${r.id}', 'approve')">${EMOJI.WHITELIST} Approve</button>
+                    <button type="button" onclick="decideAccessRequest('${r.id}', 'deny')">Deny</button>
+                </td></tr>`).join('');
+            el.innerHTML = `<table class="summary-table"><tr><th>Domain</th><th>Requester</th><th>Justification</th><th>Filed</th><th></th></tr>${rows}</table>`;
+        })
+        .catch(err => {
+            console.error('Error loading access requests:', err);
+        });
+}
+
+function decideAccessRequest(id, decision) {
+    const note = prompt(decision === 'approve' ? 'Note for the whitelist entry (optional):' : 'Reason shown to the requester (optional):');
+    if (note === null) {
+        return;
+    }
+    const data = new FormData();
+    data.append('note', note);
+    postConfirmed(`/access-requests/${encodeURIComponent(id)}/${decision}`, data)
+        .then(data => {
+            if (data.status !== 'success' && data.status !== 'cancelled') {
+                alert('Error: ' + (data.error || 'Failed to update request'));
+            }
+            updateAccessRequests();
+            updateLists();
+            updateSummary();
+        })
+        .catch(err => {
+            console.error('Error deciding access request:', err);
+        });
+}
+
 function updateLists() {
     fetch('/lists')
         .then(res => res.json())
         .then(data => {
             // Update table displays
-            renderListTable('whitelist', data.whitelist);
-            renderListTable('blacklist', data.blacklist);
+            // IP addresses and ranges are listed after the domains of their list
+            const metadata = data.metadata || {};
+            renderListTable('whitelist', data.whitelist + '\n' + (data.whitelist_ip || ''), data.unicode || {}, metadata.whitelist || {});
+            renderListTable('blacklist', data.blacklist + '\n' + (data.blacklist_ip || ''), data.unicode || {}, metadata.blacklist || {});
+            renderNamedLists(data.lists || [], data.unicode || {}, metadata);
         })
         .catch(err => {
             console.error('Error updating lists:', err);
         });
 }
 
-function renderListTable(listType, content) {
+// renderNamedLists shows a table per named list below the whitelist and blacklist,
+// in squid's order. The add inputs keep what was typed across refreshes.
+function renderNamedLists(lists, unicodeForms, metadata) {
+    const container = document.getElementById('named-lists');
+    const names = lists.map(l => l.name);
+    Array.from(container.children).forEach(child => {
+        if (!names.includes(child.dataset.list)) {
+            child.remove();
+        }
+    });
+    lists.forEach(list => {
+        let section = container.querySelector(`[data-list="${list.name}"]`);
+        if (!section) {
+            section = document.createElement('div');
+            section.dataset.list = list.name;
+            section.innerHTML = `<h2></h2>
+                <div id="${list.name}-table-container">
+                    <table class="list-table" id="${list.name}-table">
+                        <tr><th>Actions</th><th>Domain</th><th>Note</th></tr>
+                    </table>
+                    <div style="margin-top:8px;">
+                        <input type="text" id="new-${list.name}-domain" placeholder="Add domain..." style="padding:4px;margin-right:4px;width:200px;">
+                        <input type="text" id="new-${list.name}-note" placeholder="Note (optional)..." style="padding:4px;margin-right:4px;width:150px;">
+                        <input type="text" id="new-${list.name}-tags" placeholder="Tags, comma-separated..." style="padding:4px;margin-right:4px;width:150px;">
+                        <button type="button" style="padding:4px 8px;">Add</button>
+                    </div>
+                </div>`;
+            section.querySelector('button').onclick = () => addToList(list.name);
+            container.appendChild(section);
+        }
+        // Allow lists are edited with whitelist:edit, deny lists with blacklist:edit
+        section.className = list.action === 'allow' ? 'allow-list' : 'deny-list';
+        const heading = section.querySelector('h2');
+        heading.textContent = `${list.action === 'allow' ? EMOJI.WHITELIST : EMOJI.BLACKLIST} ${list.name}`;
+        heading.title = `${list.description || ''} (${list.action}, priority ${list.priority})`.trim();
+        renderListTable(list.name, list.content + '\n' + (list.ip || ''), unicodeForms, metadata[list.name] || {});
+    });
+}
+
+// groupByTag orders entries under each of their tags (untagged entries last), returning
+// the tag heading before the first entry of each group
+function groupByTag(entries, metadata) {
+    const groups = {};
+    entries.forEach(entry => {
+        const tags = (metadata[entry.domain] || {}).tags || [''];
+        tags.forEach(tag => (groups[tag] = groups[tag] || []).push(entry));
+    });
+    const tags = Object.keys(groups).filter(tag => tag).sort();
+    if (groups['']) {
+        tags.push('');
+    }
+    return tags.flatMap(tag => groups[tag].map((entry, i) => Object.assign({}, entry, { heading: i === 0 ? (tag || 'untagged') : null })));
+}
+
+// renderListTable shows internationalized entries in Unicode, with the stored punycode as tooltip
+function renderListTable(listType, content, unicodeForms = {}, metadata = {}) {
     const tableId = listType + '-table';
     const table = document.getElementById(tableId);
     
@@ -163,10 +488,19 @@ function renderListTable(listType, content) {
     }
     
     // Parse content into entries
-    const entries = parseListContent(content);
+    let entries = parseListContent(content);
+    if (document.getElementById('groupListsByTag').checked) {
+        entries = groupByTag(entries, metadata);
+    }
     
     // Add rows for each entry
     entries.forEach(entry => {
+        if (entry.heading) {
+            const heading = table.insertRow();
+            heading.className = 'tag-group';
+            heading.innerHTML = `<th colspan="3">${escapeHtml(entry.heading)}</th>`;
+        }
+        const meta = metadata[entry.domain] || {};
         const row = table.insertRow();
         
         // Create cells
@@ -180,7 +514,8 @@ function renderListTable(listType, content) {
         noteCell.className = 'note-col';
         
         // Set content
-        domainCell.textContent = entry.domain;
+        domainCell.textContent = unicodeForms[entry.domain] || entry.domain;
+        domainCell.title = entry.domain;
         
         // Add AI and Link buttons right after the domain text
         const aiBtn = document.createElement('button');
@@ -197,19 +532,50 @@ function renderListTable(listType, content) {
         linkBtn.title = entry.domain;
         linkBtn.onclick = () => window.open(`https://${entry.domain}`, '_blank');
         
+        const editBtn = document.createElement('button');
+        editBtn.type = 'button';
+        editBtn.className = 'inline-btn edit';
+        editBtn.textContent = EMOJI.EDIT;
+        editBtn.title = 'Edit tags, owner and ticket';
+        editBtn.onclick = () => editMetadata(listType, entry.domain, meta);
+        
         domainCell.appendChild(document.createTextNode(' '));
         domainCell.appendChild(aiBtn);
         domainCell.appendChild(document.createTextNode(' '));
         domainCell.appendChild(linkBtn);
+        domainCell.appendChild(document.createTextNode(' '));
+        domainCell.appendChild(editBtn);
         
         noteCell.textContent = entry.note;
+        (meta.tags || []).forEach(tag => {
+            const badge = document.createElement('span');
+            badge.className = 'entry-tag';
+            badge.textContent = tag;
+            noteCell.appendChild(document.createTextNode(' '));
+            noteCell.appendChild(badge);
+        });
+        const details = [meta.owner && `owner: ${meta.owner}`, meta.ticket && `ticket: ${meta.ticket}`].filter(Boolean);
+        if (details.length) {
+            const small = document.createElement('div');
+            small.className = 'entry-meta';
+            small.textContent = details.join(' • ');
+            noteCell.appendChild(small);
+        }
+        if (meta.created_by) {
+            noteCell.title = `Added by ${meta.created_by} on ${new Date(meta.created_at).toLocaleString()}, last changed by ${meta.updated_by} on ${new Date(meta.updated_at).toLocaleString()}`;
+        }
         
         // Create buttons programmatically to avoid escaping issues
-        const moveBtn = document.createElement('button');
-        moveBtn.type = 'button';  // Prevent form submission
-        moveBtn.className = listType === 'whitelist' ? 'action-btn bl' : 'action-btn wl';
-        moveBtn.textContent = listType === 'whitelist' ? ACTION_BUTTONS.TO_BLACKLIST : ACTION_BUTTONS.TO_WHITELIST;
-        moveBtn.onclick = () => moveFromList(entry.domain, listType, listType === 'whitelist' ? 'blacklist' : 'whitelist', entry.note);
+        // Named lists only offer removal; their entries move with /move-domain
+        if (listType === 'whitelist' || listType === 'blacklist') {
+            const moveBtn = document.createElement('button');
+            moveBtn.type = 'button';  // Prevent form submission
+            moveBtn.className = listType === 'whitelist' ? 'action-btn bl' : 'action-btn wl';
+            moveBtn.textContent = listType === 'whitelist' ? ACTION_BUTTONS.TO_BLACKLIST : ACTION_BUTTONS.TO_WHITELIST;
+            moveBtn.onclick = () => moveFromList(entry.domain, listType, listType === 'whitelist' ? 'blacklist' : 'whitelist', entry.note);
+            actionsCell.appendChild(moveBtn);
+            actionsCell.appendChild(document.createTextNode(' '));
+        }
         
         const removeBtn = document.createElement('button');
         removeBtn.type = 'button';  // Prevent form submission
@@ -217,12 +583,40 @@ function renderListTable(listType, content) {
         removeBtn.textContent = EMOJI.TRASH;
         removeBtn.onclick = () => removeFromList(entry.domain, listType);
         
-        actionsCell.appendChild(moveBtn);
-        actionsCell.appendChild(document.createTextNode(' '));
         actionsCell.appendChild(removeBtn);
     });
 }
 
+// editMetadata asks for new tags, owner and ticket of an entry; the list itself is not changed
+function editMetadata(listType, domain, meta) {
+    const tags = prompt(`Tags for ${domain} (comma-separated):`, (meta.tags || []).join(', '));
+    if (tags === null) {
+        return;
+    }
+    const owner = prompt(`Owner of ${domain}:`, meta.owner || '');
+    if (owner === null) {
+        return;
+    }
+    const ticket = prompt(`Ticket for ${domain}:`, meta.ticket || '');
+    if (ticket === null) {
+        return;
+    }
+    const body = { list: listType, domain, tags: tags.split(','), owner, ticket };
+    fetch('/metadata', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body) })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'success') {
+                updateLists();
+            } else {
+                alert('Error: ' + (data.error || 'Failed to save metadata'));
+            }
+        })
+        .catch(err => {
+            console.error('Error saving metadata:', err);
+            alert('Error saving metadata: ' + err.message);
+        });
+}
+
 function parseListContent(content) {
     const entries = [];
     const lines = content.split('\n');
@@ -242,9 +636,38 @@ function parseListContent(content) {
     return entries;
 }
 
+// postConfirmed posts a list change. When the server warns that a domain may be a
+// homograph, the user is asked and the change is resent with confirm=true.
+function postConfirmed(url, data) {
+    return fetch(url, { method: 'POST', body: data })
+        .then(res => res.json())
+        .then(result => {
+            if (result.status !== 'warning') {
+                return warnOverlaps(result);
+            }
+            const name = result.display ? `${result.display} (${result.domain})` : (result.domain || 'This domain');
+            const warnings = Array.isArray(result.warnings) ? result.warnings : Object.values(result.warnings || {}).flat();
+            if (!confirm(`${name} may be mistaken for another domain:\n\n- ${warnings.join('\n- ')}\n\nAdd it anyway?`)) {
+                return { status: 'cancelled' };
+            }
+            data.append('confirm', 'true');
+            return fetch(url, { method: 'POST', body: data }).then(res => res.json()).then(warnOverlaps);
+        });
+}
+
+// warnOverlaps tells the user when a new IP entry shares addresses with other IP entries
+function warnOverlaps(result) {
+    if (result.status === 'success' && result.overlaps && result.overlaps.length) {
+        alert(`${result.domain} overlaps with:\n\n- ${result.overlaps.join('\n- ')}\n\nThe blacklist wins where they overlap.`);
+    }
+    return result;
+}
+
 function addToList(listType) {
-    const domainInput = document.getElementById(`new-${listType === 'whitelist' ? 'wl' : 'bl'}-domain`);
-    const noteInput = document.getElementById(`new-${listType === 'whitelist' ? 'wl' : 'bl'}-note`);
+    const prefix = { whitelist: 'wl', blacklist: 'bl' }[listType] || listType;
+    const domainInput = document.getElementById(`new-${prefix}-domain`);
+    const noteInput = document.getElementById(`new-${prefix}-note`);
+    const tagsInput = document.getElementById(`new-${prefix}-tags`);
     
     const domain = domainInput.value.trim();
     const note = noteInput.value.trim();
@@ -258,23 +681,24 @@ function addToList(listType) {
     data.append('domain', domain);
     data.append('target', listType);
     data.append('note', note);
+    data.append('tags', tagsInput.value.trim());
     
-    fetch('/move-domain', { 
-        method: 'POST',
-        body: data
-    })
-    .then(res => res.json())
+    postConfirmed('/move-domain', data)
     .then(data => {
         if (data.status === 'success') {
             // Clear inputs
             domainInput.value = '';
             noteInput.value = '';
+            tagsInput.value = '';
+            if (listType === 'whitelist') {
+                showDependencies(data.domain);
+            }
             
             // Refresh displays
             updateSummary();
             updateLog();
             updateLists();
-        } else {
+        } else if (data.status !== 'cancelled') {
             alert('Error: ' + (data.error || 'Failed to add domain'));
         }
     })
@@ -290,17 +714,13 @@ function moveFromList(domain, fromList, toList, note = '') {
     data.append('target', toList);
     data.append('note', note); // Preserve existing note when moving
     
-    fetch('/move-domain', { 
-        method: 'POST',
-        body: data
-    })
-    .then(res => res.json())
+    postConfirmed('/move-domain', data)
     .then(data => {
         if (data.status === 'success') {
             updateSummary();
             updateLog();
             updateLists();
-        } else {
+        } else if (data.status !== 'cancelled') {
             alert('Error: ' + (data.error || 'Failed to move domain'));
         }
     })
@@ -316,17 +736,13 @@ function removeFromList(domain, fromList) {
     data.append('target', 'unknown'); // Remove from both lists
     data.append('note', '');
     
-    fetch('/move-domain', { 
-        method: 'POST',
-        body: data
-    })
-    .then(res => res.json())
+    postConfirmed('/move-domain', data)
     .then(data => {
         if (data.status === 'success') {
             updateSummary();
             updateLog();
             updateLists();
-        } else {
+        } else if (data.status !== 'cancelled') {
             alert('Error: ' + (data.error || 'Failed to remove domain'));
         }
     })
@@ -342,6 +758,9 @@ function setupAutoRefresh() {
     function refresh() {
         updateSummary();
         updateLog();
+        updateHealth();
+        updateSquidStats();
+        updateAccessRequests();
     }
     autoRefresh.addEventListener('change', function() {
         if (autoRefresh.checked) {
@@ -360,15 +779,35 @@ function setupFilterControls() {
     const filterBL = document.getElementById('filterBL');
     const filterRG = document.getElementById('filterRG');
     
+    const filterCategory = document.getElementById('filterCategory');
+    const savedCategory = localStorage.getItem('squidEditorFilterCategory');
+    if (savedCategory) {
+        filterCategory.innerHTML += `<option value="${escapeHtml(savedCategory)}"></option>`;
+        filterCategory.value = savedCategory;
+    }
+    filterCategory.addEventListener('change', () => {
+        localStorage.setItem('squidEditorFilterCategory', filterCategory.value);
+        updateSummary();
+    });
+    
+    const groupRegistrable = document.getElementById('groupRegistrable');
+    groupRegistrable.checked = localStorage.getItem('squidEditorGroupRegistrable') === 'true';
+    groupRegistrable.addEventListener('change', () => {
+        localStorage.setItem('squidEditorGroupRegistrable', groupRegistrable.checked);
+    });
+    
+    const groupListsByTag = document.getElementById('groupListsByTag');
+    groupListsByTag.checked = localStorage.getItem('squidEditorGroupListsByTag') === 'true';
+    groupListsByTag.addEventListener('change', () => {
+        localStorage.setItem('squidEditorGroupListsByTag', groupListsByTag.checked);
+        updateLists();
+    });
+    
     // Add event listeners to filter checkboxes
-    [filterWL, filterBL, filterRG].forEach(checkbox => {
+    [filterWL, filterBL, filterRG, groupRegistrable].forEach(checkbox => {
         checkbox.addEventListener('change', () => {
             // Re-fetch and re-render with current filter settings
-            fetch('/summary-data')
-                .then(res => res.json())
-                .then(data => {
-                    renderFilteredSummary(data.rows);
-                });
+            updateSummary();
         });
     });
 }
@@ -381,22 +820,21 @@ function moveDomain(domain, targetStatus) {
     data.append('target', targetStatus);
     data.append('note', note);
     
-    fetch('/move-domain', { 
-        method: 'POST',
-        body: data
-    })
-    .then(res => res.json())
+    postConfirmed('/move-domain', data)
     .then(data => {
         if (data.status === 'success') {
             // Refresh the summary, log, and the whitelist/blacklist textareas
             updateSummary();
             updateLog();
             updateLists();
+            if (targetStatus === 'whitelist') {
+                showDependencies(data.domain);
+            }
             
             // Optional: Clear note after successful move (uncomment if desired)
             // noteField.value = '';
             // localStorage.setItem('squidEditorDomainNote', '');
-        } else {
+        } else if (data.status !== 'cancelled') {
             alert('Error: ' + (data.error || 'Failed to move domain'));
         }
     })
@@ -406,12 +844,312 @@ function moveDomain(domain, targetStatus) {
     });
 }
 
+// showDependencies lists unknown hosts that clients requested around their visits to a
+// whitelisted domain, so the ones its pages need can be whitelisted together
+function showDependencies(domain) {
+    fetch('/dependencies?domain=' + encodeURIComponent(domain))
+        .then(res => res.json())
+        .then(report => {
+            const el = document.getElementById('dependencies');
+            const suggestions = report.suggestions || [];
+            if (!suggestions.length) {
+                el.style.display = 'none';
+                return;
+            }
+            const name = escapeHtml(report.domain);
+            const rows = suggestions.map(s => `<tr>
+                <td><input type="checkbox" class="dependency" value="${escapeHtml(s.domain)}" ${s.score >= 0.2 || s.same_site ? 'checked' : ''}></td>
+                <td title="${escapeHtml(s.domain)}">${escapeHtml(s.display || s.domain)}${s.same_site ? ' <small>(same site)</small>' : ''}</td>
+                <td>${Math.round(s.score * 100)}%</td>
+                <td>${s.visits} / ${report.visits}</td>
+                <td>${s.clients}</td></tr>`).join('');
+            el.innerHTML = `<div><strong>${EMOJI.DEPS} Unknown hosts requested around visits to ${name}</strong>
+                <small>(${report.visits} visits from ${report.clients} clients within ${report.window_seconds}s)</small>
+                <button type="button" class="inline-btn" onclick="document.getElementById('dependencies').style.display='none'">✕</button></div>
+                <table class="summary-table"><tr><th></th><th>Host</th><th title="Share of visits with the host, weighted by how specific the host is to those visits">Score</th><th>Visits</th><th>Clients</th></tr>${rows}</table>
+                <button type="button" class="action-btn wl" onclick="whitelistDependencies('${name}')">${ACTION_BUTTONS.TO_WHITELIST} Whitelist selected</button>`;
+            el.style.display = 'block';
+        })
+        .catch(err => {
+            console.error('Error loading dependencies:', err);
+        });
+}
+
+// whitelistDependencies whitelists the selected suggestions with one squid reload
+function whitelistDependencies(domain) {
+    const note = document.getElementById('domainNote').value.trim() || `needed by ${domain}`;
+    const domains = Array.from(document.querySelectorAll('#dependencies input.dependency:checked'))
+        .map(input => ({ domain: input.value, note }));
+    if (!domains.length) {
+        return;
+    }
+    postMoveDomains({ target: 'whitelist', domains })
+        .then(data => {
+            if (data.status === 'success') {
+                document.getElementById('dependencies').style.display = 'none';
+                updateSummary();
+                updateLog();
+                updateLists();
+            } else if (data.status !== 'cancelled') {
+                alert('Error: ' + (data.error || 'Failed to whitelist domains'));
+            }
+        })
+        .catch(err => {
+            console.error('Error whitelisting domains:', err);
+            alert('Error whitelisting domains: ' + err.message);
+        });
+}
+
+// postMoveDomains sends a bulk move, asking before resending it confirmed when the server
+// warns about possible homographs
+function postMoveDomains(body) {
+    return fetch('/move-domains', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body) })
+        .then(res => res.json())
+        .then(result => {
+            if (result.status !== 'warning') {
+                return result;
+            }
+            const lines = Object.entries(result.warnings || {}).map(([d, w]) => `- ${d}: ${w.join('; ')}`);
+            if (!confirm(`These domains may be mistaken for others:\n\n${lines.join('\n')}\n\nAdd them anyway?`)) {
+                return { status: 'cancelled' };
+            }
+            return postMoveDomains(Object.assign({}, body, { confirm: true }));
+        });
+}
+function toggleCategories() {
+    const list = document.getElementById('category-list');
+    list.style.display = list.style.display === 'none' ? 'block' : 'none';
+    updateCategories();
+}
+
+// updateCategories lists the loaded categories with a checkbox to blacklist each one
+function updateCategories() {
+    const list = document.getElementById('category-list');
+    if (list.style.display === 'none') {
+        return;
+    }
+    fetch('/categories')
+        .then(res => res.json())
+        .then(data => {
+            renderCategories(data);
+        })
+        .catch(err => {
+            console.error('Error loading categories:', err);
+        });
+}
+
+function renderCategories(data) {
+    const list = document.getElementById('category-list');
+    const reload = '<div class="category-reload"><button type="button" onclick="reloadCategories()">Reload datasets</button></div>';
+    const errors = (data.errors || []).map(e => `<div class="status blacklist">${escapeHtml(e)}</div>`).join('');
+    if (!data.categories || data.categories.length === 0) {
+        list.innerHTML = 'No category datasets in /data/categories' + errors + reload;
+        return;
+    }
+    const rows = data.categories.map(c =>
+        `<div><label title="Blacklist every ${escapeHtml(c.name)} domain that is not whitelisted"><input type="checkbox" class="category-blacklist" value="${escapeHtml(c.name)}"${c.blacklisted ? ' checked' : ''}> ${EMOJI.BLACKLIST} ${escapeHtml(c.name)}</label> <small>${c.domains}</small></div>`
+    ).join('');
+    list.innerHTML = `<div><small>${data.domains} domains, ${data.blocked_entries} blocked entries</small></div>` + rows + errors +
+        '<div class="category-save"><button type="button" onclick="saveCategoryBlacklist()">Save blacklist</button></div>' + reload;
+}
+
+// saveCategoryBlacklist blacklists the checked categories
+function saveCategoryBlacklist() {
+    const checked = Array.from(document.querySelectorAll('#category-list .category-blacklist:checked')).map(box => box.value);
+    fetch('/categories/blacklist', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ categories: checked })
+    })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'error') {
+                alert('Error saving the category blacklist: ' + data.error);
+                return;
+            }
+            renderCategories(data);
+            updateSummary();
+        })
+        .catch(err => {
+            console.error('Error saving the category blacklist:', err);
+            alert('Error saving the category blacklist: ' + err.message);
+        });
+}
+
+// reloadCategories rereads the datasets after they were updated on disk
+function reloadCategories() {
+    fetch('/categories/reload', { method: 'POST' })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'error') {
+                alert('Error reloading categories: ' + data.error);
+                return;
+            }
+            renderCategories(data);
+            updateSummary();
+        })
+        .catch(err => {
+            console.error('Error reloading categories:', err);
+            alert('Error reloading categories: ' + err.message);
+        });
+}
+
+// updateProfiles fills the profile selectors, keeping the current choice, and lists the
+// profiles and the recent promotions
+function updateProfiles() {
+    Promise.all([fetch('/profiles').then(res => res.json()), fetch('/profiles/history?limit=10').then(res => res.json())])
+        .then(([data, history]) => {
+            const profiles = data.profiles || [];
+            const options = profiles.map(p => `<option value="${escapeHtml(p.name)}">${escapeHtml(p.name)}${p.live ? ' (live)' : ''}</option>`).join('');
+            ['profileFrom', 'profileTo', 'new-profile-copy'].forEach(id => {
+                const select = document.getElementById(id);
+                const current = select.value;
+                select.innerHTML = (id === 'new-profile-copy' ? '<option value="">(empty lists)</option>' : '') + options;
+                if (profiles.some(p => p.name === current) || (id === 'new-profile-copy' && current === '')) {
+                    select.value = current;
+                } else if (id === 'profileTo' && profiles.length > 1) {
+                    select.value = profiles[1].name;
+                }
+            });
+            const rows = profiles.map(p => `<tr><td>${escapeHtml(p.name)}${p.live ? ' <small>(live)</small>' : ''}</td>
+                <td>${escapeHtml(p.description || '')}</td><td>${escapeHtml(p.container || '')}</td>
+                <td class="profile-manage">${p.live ? '' : `<button type="button" class="remove-btn" onclick="deleteProfile('${escapeHtml(p.name)}')">${EMOJI.TRASH}</button>`}</td></tr>`).join('');
+            document.getElementById('profile-list').innerHTML = `<table class="summary-table"><tr><th>Profile</th><th>Description</th><th>Squid container</th><th></th></tr>${rows}</table>`;
+            const promotions = (history.promotions || []).map(p => `<li>${new Date(p.time).toLocaleString()} ${escapeHtml(p.actor)}: ${escapeHtml(p.from)} → ${escapeHtml(p.to)},
+                ${p.changes.length} entries${p.lists && p.lists.length ? ', lists ' + escapeHtml(p.lists.join(', ')) : ''}${p.reload && p.reload !== 'ok' ? ' <span class="status blacklist">reload: ' + escapeHtml(p.reload) + '</span>' : ''}</li>`).join('');
+            document.getElementById('profile-history').innerHTML = promotions ? `<div><strong>Recent promotions</strong><ul>${promotions}</ul></div>` : '';
+        })
+        .catch(err => {
+            console.error('Error loading profiles:', err);
+        });
+}
+
+// compareProfiles shows what promoting from the first to the second profile would
+// change, with a checkbox per difference
+function compareProfiles() {
+    const from = document.getElementById('profileFrom').value;
+    const to = document.getElementById('profileTo').value;
+    fetch(`/profiles/diff?from=${encodeURIComponent(from)}&to=${encodeURIComponent(to)}`)
+        .then(res => res.json())
+        .then(diff => {
+            const el = document.getElementById('profile-diff');
+            if (diff.status === 'error') {
+                el.textContent = diff.error;
+                return;
+            }
+            if (!diff.changes.length && !diff.lists.length) {
+                el.textContent = `${from} and ${to} have the same lists`;
+                return;
+            }
+            const lists = diff.lists.map(l => `<tr><td><input type="checkbox" class="promote-list" value="${escapeHtml(l.name)}"></td>
+                <td>list ${escapeHtml(l.name)}</td><td>${escapeHtml(l.source.action)} (priority ${l.source.priority})</td>
+                <td>${l.target ? escapeHtml(l.target.action) + ' (priority ' + l.target.priority + ')' : '(missing)'}</td></tr>`).join('');
+            const changes = diff.changes.map(c => `<tr><td><input type="checkbox" class="promote-domain" value="${escapeHtml(c.domain)}"></td>
+                <td>${escapeHtml(c.display || c.domain)}</td>
+                <td>${escapeHtml(c.source)}${c.note ? ' <small>#' + escapeHtml(c.note) + '</small>' : ''}</td>
+                <td>${escapeHtml(c.target)}${c.target_note ? ' <small>#' + escapeHtml(c.target_note) + '</small>' : ''}</td></tr>`).join('');
+            el.innerHTML = `<table class="summary-table"><tr><th><input type="checkbox" onclick="document.querySelectorAll('#profile-diff input[type=checkbox]').forEach(box => { box.checked = this.checked; })"></th>
+                <th>Entry</th><th>In ${escapeHtml(from)}</th><th>In ${escapeHtml(to)}</th></tr>${lists}${changes}</table>`;
+        })
+        .catch(err => {
+            console.error('Error comparing profiles:', err);
+        });
+}
+
+// promoteProfileChanges copies the checked differences to the second profile
+function promoteProfileChanges() {
+    const from = document.getElementById('profileFrom').value;
+    const to = document.getElementById('profileTo').value;
+    const domains = Array.from(document.querySelectorAll('#profile-diff .promote-domain:checked')).map(box => box.value);
+    const lists = Array.from(document.querySelectorAll('#profile-diff .promote-list:checked')).map(box => box.value);
+    if (!domains.length && !lists.length) {
+        alert('Select the changes to promote first');
+        return;
+    }
+    if (!confirm(`Promote ${domains.length} entries and ${lists.length} lists from ${from} to ${to} and reload its squid?`)) {
+        return;
+    }
+    fetch('/profiles/promote', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ from: from, to: to, domains: domains, lists: lists })
+    })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'error') {
+                alert('Error promoting: ' + data.error);
+            } else if (data.reload_error) {
+                alert('Promoted, but squid could not be reloaded: ' + data.reload_error);
+            }
+            compareProfiles();
+            updateProfiles();
+            updateLists();
+        })
+        .catch(err => {
+            console.error('Error promoting:', err);
+            alert('Error promoting: ' + err.message);
+        });
+}
+
+function createProfile() {
+    const name = document.getElementById('new-profile-name').value.trim();
+    if (!name) {
+        alert('Please enter a profile name');
+        return;
+    }
+    fetch('/profiles', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            name: name,
+            container: document.getElementById('new-profile-container').value.trim(),
+            copy_from: document.getElementById('new-profile-copy').value
+        })
+    })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'error') {
+                alert('Error creating the profile: ' + data.error);
+                return;
+            }
+            document.getElementById('new-profile-name').value = '';
+            document.getElementById('new-profile-container').value = '';
+            updateProfiles();
+        })
+        .catch(err => {
+            console.error('Error creating the profile:', err);
+            alert('Error creating the profile: ' + err.message);
+        });
+}
+
+function deleteProfile(name) {
+    if (!confirm(`Delete profile ${name} and all its lists?`)) {
+        return;
+    }
+    fetch(`/profiles/${encodeURIComponent(name)}/delete`, { method: 'POST' })
+        .then(res => res.json())
+        .then(data => {
+            if (data.status === 'error') {
+                alert('Error deleting the profile: ' + data.error);
+            }
+            updateProfiles();
+        })
+        .catch(err => {
+            console.error('Error deleting the profile:', err);
+        });
+}
+
 document.addEventListener('DOMContentLoaded', function() {
+    applyPermissions();
+    setupFilterControls();
     updateSummary();
     updateLog();
     updateLists();
+    updateHealth();
+    updateSquidStats();
+    updateAccessRequests();
+    updateProfiles();
     setupAutoRefresh();
-    setupFilterControls();
     setupNotePersistence();
 });
 
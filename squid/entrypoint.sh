@@ -0,0 +1,12 @@
+#!/bin/sh
+# Seed a fresh /data volume so squid can start before the editor has written its files:
+# empty lists, and the list configuration for the built-in lists only. The editor
+# regenerates the configuration on start and reloads squid when it changes.
+set -e
+for f in whitelist.txt blacklist.txt whitelist-ip.txt blacklist-ip.txt blacklist-categories.txt; do
+	[ -e "/data/$f" ] || touch "/data/$f"
+done
+for f in lists-acl.conf lists-access.conf; do
+	[ -e "/data/$f" ] || cp "/etc/squid/defaults/$f" "/data/$f"
+done
+exec squid -N -f /etc/squid/squid.conf
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logArchive describes the log entries moved out of the live logs by a clear
+type logArchive struct {
+	ID         string         `json:"id"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Reason     string         `json:"reason,omitempty"`
+	Categories []string       `json:"categories"`
+	Since      *time.Time     `json:"since,omitempty"`
+	Until      *time.Time     `json:"until,omitempty"`
+	Entries    map[string]int `json:"entries"` // archived lines per category
+	Size       int64          `json:"size"`    // compressed archive size in bytes
+}
+
+// clearOptions restricts which entries clearLogs moves into the archive
+type clearOptions struct {
+	Category string    // whitelist, blacklist, regular (or WL/BL/RG); empty for all
+	Since    time.Time // zero for no lower bound
+	Until    time.Time // zero for no upper bound
+	Reason   string
+}
+
+// archiveIDPattern guards archive downloads against path traversal
+var archiveIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z(-[0-9]+)?$`)
+
+// archiveDir returns the directory holding log archives
+func archiveDir() string {
+	return filepath.Join(dataDir, "archives")
+}
+
+// selectLogSources returns the log sources matching a category name or tag
+func selectLogSources(category string) ([]logSource, error) {
+	if category == "" || category == "all" {
+		return logSources(), nil
+	}
+	for _, src := range logSources() {
+		if strings.EqualFold(category, src.category) || strings.EqualFold(category, src.tag) {
+			return []logSource{src}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid category: %s (use whitelist, blacklist or regular)", category)
+}
+
+// clearLogs moves matching entries from the live logs into a compressed archive. The
+// selected logs are moved aside and squid reopens them, as for rotation, so nothing squid
+// writes meanwhile is lost; entries outside the range are kept in the rotated segment.
+// When squid cannot be told to reopen its logs they are put back and cleared in place.
+// It returns nil when nothing matched.
+func clearLogs(opts clearOptions, now time.Time) (*logArchive, error) {
+	sources, err := selectLogSources(opts.Category)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && opts.Until.Before(opts.Since) {
+		return nil, fmt.Errorf("until must not be before since")
+	}
+	ranged := !opts.Since.IsZero() || !opts.Until.IsZero()
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	segments := make(map[string]string) // log path -> renamed segment
+	var errs []string
+	for _, src := range sources {
+		seg, err := renameLogForRotation(src.path, now)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		if seg != "" {
+			segments[src.path] = seg
+		}
+	}
+	inPlace := false
+	if len(segments) > 0 {
+		if err := squidBackend.Rotate(); err != nil {
+			// squid still writes to the renamed files, so they go back in place
+			if rerr := restoreRenamedLogs(segments); rerr != nil {
+				return nil, fmt.Errorf("clear logs: %v; %v", err, rerr)
+			}
+			fmt.Printf("Warning: clear logs: %v; clearing in place\n", err)
+			segments, inPlace = map[string]string{}, true
+		} else {
+			waitForLogReopen(segments)
+		}
+	}
+
+	archived := make(map[string][]string)
+	kept := make(map[string][]string)
+	total := 0
+	for _, src := range sources {
+		from := segments[src.path]
+		if inPlace {
+			from = src.path
+		}
+		content := readFile(from)
+		if content == "" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if ranged && !lineInRange(line, opts.Since, opts.Until) {
+				kept[src.path] = append(kept[src.path], line)
+				continue
+			}
+			archived[src.path] = append(archived[src.path], line)
+			total++
+		}
+	}
+
+	var archive *logArchive
+	if total > 0 {
+		archive = &logArchive{
+			CreatedAt: now.UTC(),
+			Reason:    opts.Reason,
+			Entries:   make(map[string]int),
+		}
+		for _, src := range sources {
+			archive.Categories = append(archive.Categories, src.category)
+			archive.Entries[src.category] = len(archived[src.path])
+		}
+		if !opts.Since.IsZero() {
+			since := opts.Since.UTC()
+			archive.Since = &since
+		}
+		if !opts.Until.IsZero() {
+			until := opts.Until.UTC()
+			archive.Until = &until
+		}
+		if err := writeLogArchive(archive, sources, archived); err != nil {
+			// The renamed segments stay and are compressed by the next rotation
+			return nil, err
+		}
+	}
+
+	// Only drop entries once the archive is safely on disk
+	if inPlace {
+		for _, src := range sources {
+			content := ""
+			if lines := kept[src.path]; len(lines) > 0 {
+				content = strings.Join(lines, "\n") + "\n"
+			}
+			if err := writeFile(src.path, content); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	for path, seg := range segments {
+		lines := kept[path]
+		if len(lines) == 0 {
+			if err := os.Remove(seg); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if err := writeFile(seg, strings.Join(lines, "\n")+"\n"); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if _, err := compressSegment(seg); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return archive, fmt.Errorf("errors: %s", strings.Join(errs, "; "))
+	}
+	return archive, nil
+}
+
+// restoreRenamedLogs moves segments renamed by clearLogs back to their logs. A log that
+// was written to since it was recreated is left alone, and its segment is kept for the
+// next rotation.
+func restoreRenamedLogs(segments map[string]string) error {
+	var errs []string
+	for path, seg := range segments {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			errs = append(errs, fmt.Sprintf("%s was written to meanwhile, left as %s", filepath.Base(path), filepath.Base(seg)))
+			continue
+		}
+		if err := os.Rename(seg, path); err != nil {
+			errs = append(errs, fmt.Sprintf("restore %s: %v", filepath.Base(path), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lineInRange reports whether a raw log line's timestamp lies within [since, until]
+func lineInRange(line string, since, until time.Time) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	ts, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return false
+	}
+	t := unixFloatToTime(ts)
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !until.IsZero() && t.After(until) {
+		return false
+	}
+	return true
+}
+
+// writeLogArchive writes <id>.tar.gz with one member per log plus <id>.json metadata
+func writeLogArchive(archive *logArchive, sources []logSource, archived map[string][]string) error {
+	dir := archiveDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	base := archive.CreatedAt.Format(segmentTimeFormat)
+	archive.ID = base
+	for n := 2; fileExists(archivePath(archive.ID)); n++ {
+		archive.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	path := archivePath(archive.ID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, FilePermissions)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	writeErr := func() error {
+		for _, src := range sources {
+			lines := archived[src.path]
+			if len(lines) == 0 {
+				continue
+			}
+			data := []byte(strings.Join(lines, "\n") + "\n")
+			hdr := &tar.Header{
+				Name:    filepath.Base(src.path),
+				Mode:    FilePermissions,
+				Size:    int64(len(data)),
+				ModTime: archive.CreatedAt,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(data); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return zw.Close()
+	}()
+	if closeErr := f.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(path)
+		return fmt.Errorf("write archive: %v", writeErr)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		archive.Size = info.Size()
+	}
+	meta, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(strings.TrimSuffix(path, ".tar.gz")+".json", string(meta))
+}
+
+// archivePath returns the path of an archive's tar.gz file
+func archivePath(id string) string {
+	return filepath.Join(archiveDir(), id+".tar.gz")
+}
+
+// listLogArchives returns all archives, newest first
+func listLogArchives() []logArchive {
+	matches, _ := filepath.Glob(filepath.Join(archiveDir(), "*.json"))
+	archives := make([]logArchive, 0, len(matches))
+	for _, m := range matches {
+		var a logArchive
+		if err := json.Unmarshal([]byte(readFile(m)), &a); err != nil || !archiveIDPattern.MatchString(a.ID) {
+			continue
+		}
+		archives = append(archives, a)
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].ID > archives[j].ID })
+	return archives
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited actions
+const (
+	AuditMoveDomain    = "domain.move"
+	AuditClearLogs     = "logs.clear"
+	AuditRotateLogs    = "logs.rotate"
+	AuditReload        = "squid.reload"
+	AuditUserCreate    = "user.create"
+	AuditUserRole      = "user.role"
+	AuditUserDelete    = "user.delete"
+	AuditUserPassword  = "user.password"
+	AuditTokenCreate   = "token.create"
+	AuditTokenRevoke   = "token.revoke"
+	AuditRequest       = "request.create"
+	AuditApprove       = "request.approve"
+	AuditDeny          = "request.deny"
+	AuditWebhookSave   = "webhook.save"
+	AuditWebhookDelete = "webhook.delete"
+	AuditDigestSend    = "digest.send"
+	AuditCategories    = "categories.blacklist"
+	AuditCategoryLoad  = "categories.reload"
+	AuditRuleSave      = "rule.save"
+	AuditRuleDelete    = "rule.delete"
+	AuditMetadata      = "domain.metadata"
+	AuditListSave      = "list.save"
+	AuditListDelete    = "list.delete"
+	AuditProfileSave   = "profile.save"
+	AuditProfileDelete = "profile.delete"
+	AuditPromote       = "profile.promote"
+)
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditError   = "error"
+)
+
+// AuditEntry is one line of the audit log. Hash covers every other field and the
+// previous entry's hash, so editing or removing an entry breaks the chain.
+type AuditEntry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Token    string    `json:"token,omitempty"` // API token ID when the actor used one
+	SourceIP string    `json:"source_ip"`
+	Action   string    `json:"action"`
+	Domain   string    `json:"domain,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	Covered  []string  `json:"covered,omitempty"` // entries a new wildcard entry replaced
+	Target   string    `json:"target,omitempty"`  // account, token or archive acted on
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Reload   string    `json:"reload,omitempty"` // "ok", the reload error, or empty when squid was not reloaded
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// computeHash returns the chain hash of an entry
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditQuery filters audit entries; empty fields match everything
+type auditQuery struct {
+	Actor  string
+	Action string // exact action, or a prefix such as "user."
+	Domain string // substring, in Unicode or punycode form
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// matches reports whether an entry passes the filter
+func (q auditQuery) matches(e AuditEntry) bool {
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action && !(strings.HasSuffix(q.Action, ".") && strings.HasPrefix(e.Action, q.Action)) {
+		return false
+	}
+	if q.Domain != "" && !strings.Contains(e.Domain, q.Domain) {
+		if alt := idnAlternate(q.Domain); alt == "" || !strings.Contains(e.Domain, alt) {
+			return false
+		}
+	}
+	if q.Result != "" && e.Result != q.Result {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// auditChain reports whether the stored entries still form an unbroken hash chain
+type auditChain struct {
+	Valid    bool   `json:"valid"`
+	Entries  int64  `json:"entries"`
+	Head     string `json:"head"`                // hash of the last entry; record it elsewhere to detect truncation
+	BrokenAt int64  `json:"broken_at,omitempty"` // line number of the first bad entry
+	Error    string `json:"error,omitempty"`
+}
+
+// auditLog appends hash-chained JSON lines to audit.log
+type auditLog struct {
+	mu   sync.Mutex
+	path string // file seq and head were loaded from
+	size int64  // file size after our last write; a different size means another process appended
+	seq  int64
+	head string
+}
+
+// auditTrail is the process-wide audit log
+var auditTrail = &auditLog{}
+
+// auditPath returns the location of the audit log
+func auditPath() string {
+	return filepath.Join(dataDir, "audit.log")
+}
+
+// scan reads every entry in order, calling fn for each, and checks the chain
+func (a *auditLog) scan(fn func(e AuditEntry)) (auditChain, error) {
+	chain := auditChain{Valid: true}
+	f, err := os.Open(auditPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return chain, nil
+		}
+		return chain, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), MaxFileSize)
+	var line int64
+	for scanner.Scan() {
+		line++
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			chain.fail(line, fmt.Sprintf("unreadable entry: %v", err))
+			continue
+		}
+		if chain.Valid {
+			switch {
+			case e.PrevHash != chain.Head:
+				chain.fail(line, "previous hash does not match")
+			case e.computeHash() != e.Hash:
+				chain.fail(line, "entry hash does not match its contents")
+			}
+		}
+		chain.Entries = line
+		chain.Head = e.Hash
+		if fn != nil {
+			fn(e)
+		}
+	}
+	return chain, scanner.Err()
+}
+
+// fail records the first break in the chain
+func (c *auditChain) fail(line int64, msg string) {
+	if c.Valid {
+		c.Valid = false
+		c.BrokenAt = line
+		c.Error = msg
+	}
+}
+
+// append chains an entry to the previous one and writes it. An exclusive flock on the
+// file is held from reading the head to writing, since the command-line interface
+// appends from its own process.
+func (a *auditLog) append(e AuditEntry, now time.Time) (AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(auditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return e, fmt.Errorf("lock audit log: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	info, err := f.Stat()
+	if err != nil {
+		return e, err
+	}
+	if size := info.Size(); a.path != auditPath() || a.size != size {
+		var last AuditEntry
+		chain, err := a.scan(func(e AuditEntry) { last = e })
+		if err != nil {
+			return e, err
+		}
+		a.seq, a.head, a.path, a.size = last.Seq, chain.Head, auditPath(), size
+	}
+
+	e.Seq = a.seq + 1
+	e.Time = now.UTC()
+	e.PrevHash = a.head
+	e.Hash = e.computeHash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return e, err
+	}
+	a.seq, a.head, a.size = e.Seq, e.Hash, a.size+int64(len(data))+1
+	return e, nil
+}
+
+// query returns the last q.Limit matching entries in order and the chain status
+func (a *auditLog) query(q auditQuery) ([]AuditEntry, bool, auditChain, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var matched []AuditEntry
+	truncated := false
+	chain, err := a.scan(func(e AuditEntry) {
+		if !q.matches(e) {
+			return
+		}
+		matched = append(matched, e)
+		if q.Limit > 0 && len(matched) > q.Limit {
+			matched = matched[1:]
+			truncated = true
+		}
+	})
+	if matched == nil {
+		matched = []AuditEntry{}
+	}
+	return matched, truncated, chain, err
+}
+
+// recordAudit fills in who and from where, and appends the entry. A failure to
+// write the audit log is reported but does not undo the action.
+func recordAudit(c *gin.Context, e AuditEntry) {
+	e.Actor = auditActor(c)
+	if tok := currentToken(c); tok != nil {
+		e.Token = tok.ID
+	}
+	e.SourceIP = c.ClientIP()
+	if _, err := auditTrail.append(e, time.Now()); err != nil {
+		fmt.Printf("Warning: failed to write audit log: %v\n", err)
+	}
+}
+
+// auditActor names the user behind a request
+func auditActor(c *gin.Context) string {
+	if username := c.GetString("username"); username != "" {
+		return username
+	}
+	return "anonymous"
+}
+
+// reloadOutcome describes a reload result for the audit log
+func reloadOutcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// auditResult maps an error to an audit result
+func auditResult(err error) (string, string) {
+	if err != nil {
+		return AuditError, err.Error()
+	}
+	return AuditSuccess, ""
+}
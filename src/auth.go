@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authEnabled turns on session authentication and CSRF checks.
+// main enables it unless SQUID_EDITOR_AUTH=off; tests opt in explicitly.
+var authEnabled = false
+
+// bcryptCost is the work factor for password hashes
+var bcryptCost = bcrypt.DefaultCost
+
+// usernamePattern restricts usernames to something safe to show and log
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+// User is an editor account stored in users.json. Accounts created by single
+// sign-on have a Provider and no password hash, so they cannot log in locally.
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Role         string    `json:"role"`
+	Provider     string    `json:"provider,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// userStore persists local accounts as JSON in the data directory
+type userStore struct {
+	mu sync.Mutex
+}
+
+// users is the process-wide account store
+var users = &userStore{}
+
+// usersPath returns the location of the account database
+func usersPath() string {
+	return filepath.Join(dataDir, "users.json")
+}
+
+// load reads all accounts; a missing file means no accounts
+func (s *userStore) load() ([]User, error) {
+	data, err := os.ReadFile(usersPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(usersPath()), err)
+	}
+	return list, nil
+}
+
+// save writes all accounts, readable by the editor only
+func (s *userStore) save(list []User) error {
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(usersPath(), data, 0600)
+}
+
+// get returns one account
+func (s *userStore) get(username string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Username == username {
+			return &list[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// list returns all accounts
+func (s *userStore) list() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// create adds an account with a bcrypt-hashed password
+func (s *userStore) create(username, password, role string) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("invalid username: use letters, digits, '.', '_', '@' or '-'")
+	}
+	if !validRole(role) {
+		return nil, fmt.Errorf("invalid role: %s", role)
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		if u.Username == username {
+			return nil, fmt.Errorf("user %s already exists", username)
+		}
+	}
+	u := User{Username: username, PasswordHash: string(hash), Role: role, CreatedAt: time.Now().UTC()}
+	if err := s.save(append(list, u)); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// upsertExternal creates or updates an account managed by an identity provider. The
+// role is refreshed on every login. Local accounts and accounts bound to another
+// subject are never taken over.
+func (s *userStore) upsertExternal(username, provider, subject, role string) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("invalid username from %s: %q", provider, username)
+	}
+	if !validRole(role) {
+		return nil, fmt.Errorf("invalid role: %s", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		u := &list[i]
+		if u.Username != username {
+			continue
+		}
+		if u.Provider != provider || (u.Subject != "" && u.Subject != subject) {
+			return nil, fmt.Errorf("user %s already exists and is not managed by %s", username, provider)
+		}
+		u.Role = role
+		u.Subject = subject
+		found := *u
+		return &found, s.save(list)
+	}
+	u := User{Username: username, Role: role, Provider: provider, Subject: subject, CreatedAt: time.Now().UTC()}
+	if err := s.save(append(list, u)); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// setPassword replaces an account's password
+func (s *userStore) setPassword(username, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	return s.update(username, func(u *User) { u.PasswordHash = string(hash) })
+}
+
+// setRole changes an account's role
+func (s *userStore) setRole(username, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+	return s.update(username, func(u *User) { u.Role = role })
+}
+
+// update applies fn to one account and saves
+func (s *userStore) update(username string, fn func(u *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].Username == username {
+			fn(&list[i])
+			return s.save(list)
+		}
+	}
+	return fmt.Errorf("user %s not found", username)
+}
+
+// remove deletes an account
+func (s *userStore) remove(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	kept := list[:0]
+	for _, u := range list {
+		if u.Username != username {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(list) {
+		return fmt.Errorf("user %s not found", username)
+	}
+	return s.save(kept)
+}
+
+// authenticate checks a username and password; the comparison runs even for
+// unknown users so response time does not reveal which accounts exist
+func (s *userStore) authenticate(username, password string) (*User, bool) {
+	u, err := s.get(username)
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte(randomToken(16)), bcryptCost)
+	})
+	hash := dummyHash
+	if err == nil && u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || u == nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// dummyHash is compared against when a login names an unknown user
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// validatePassword enforces the minimum password length
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	return nil
+}
+
+// ensureBootstrapAdmin creates the first account when none exist. The password comes
+// from SQUID_EDITOR_ADMIN_PASSWORD or is generated and printed once to the log.
+// Accounts created before roles existed get the viewer role, except the bootstrap
+// account, which becomes admin when nobody else is.
+func ensureBootstrapAdmin() error {
+	list, err := users.list()
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		return migrateUserRoles(list)
+	}
+	password := os.Getenv("SQUID_EDITOR_ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		password = randomToken(18)
+	}
+	if _, err := users.create(BootstrapAdminUser, password, RoleAdmin); err != nil {
+		return err
+	}
+	if generated {
+		fmt.Printf("Created bootstrap account %q with password: %s\n", BootstrapAdminUser, password)
+	} else {
+		fmt.Printf("Created bootstrap account %q from SQUID_EDITOR_ADMIN_PASSWORD\n", BootstrapAdminUser)
+	}
+	return nil
+}
+
+// migrateUserRoles assigns roles to accounts that have none
+func migrateUserRoles(list []User) error {
+	hasAdmin := false
+	for _, u := range list {
+		hasAdmin = hasAdmin || u.Role == RoleAdmin
+	}
+	for _, u := range list {
+		if u.Role != "" {
+			continue
+		}
+		role := RoleViewer
+		if u.Username == BootstrapAdminUser && !hasAdmin {
+			role = RoleAdmin
+		}
+		if err := users.setRole(u.Username, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// randomToken returns n random bytes encoded as URL-safe base64
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// session is a logged-in browser session
+type session struct {
+	ID        string
+	Username  string
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// sessionStore keeps sessions in memory; restarting the editor logs everyone out
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// sessions is the process-wide session store
+var sessions = &sessionStore{sessions: make(map[string]*session)}
+
+// create starts a session for a user
+func (s *sessionStore) create(username string, now time.Time) *session {
+	sess := &session{
+		ID:        randomToken(32),
+		Username:  username,
+		CSRFToken: randomToken(32),
+		ExpiresAt: now.Add(SessionTTL),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, old := range s.sessions {
+		if now.After(old.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sess.ID] = sess
+	return sess
+}
+
+// get returns a live session by ID
+func (s *sessionStore) get(id string, now time.Time) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if now.After(sess.ExpiresAt) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return sess
+}
+
+// delete ends one session
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// deleteUser ends every session of a user
+func (s *sessionStore) deleteUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// publicPaths are reachable without a session
+var publicPaths = map[string]bool{
+	"/login":               true,
+	"/login/oidc":          true,
+	"/login/oidc/callback": true,
+	"/squid/probe":         true, // fetched through squid by the health checker
+	"/request-access":      true, // users behind the proxy ask for domains to be whitelisted
+	"/blocked":             true, // squid redirects denied requests here
+}
+
+// isPublicPath reports whether a route needs no authentication
+func isPublicPath(path string) bool {
+	return publicPaths[path] || strings.HasPrefix(path, "/static/") || strings.HasPrefix(path, "/request-access/")
+}
+
+// authMiddleware requires a valid session on every non-public route and a
+// matching CSRF token on every state-changing request
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authEnabled || isPublicPath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		if secret := bearerToken(c); secret != "" {
+			authenticateToken(c, secret)
+			return
+		}
+
+		var sess *session
+		if id, err := c.Cookie(SessionCookieName); err == nil {
+			sess = sessions.get(id, time.Now())
+		}
+		if sess == nil {
+			rejectUnauthenticated(c)
+			return
+		}
+		// Look the account up on every request so role changes and deletions apply at once
+		u, err := users.get(sess.Username)
+		if err != nil || u == nil {
+			sessions.delete(sess.ID)
+			rejectUnauthenticated(c)
+			return
+		}
+		if !isSafeMethod(c.Request.Method) && !validCSRFToken(c, sess) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "error", "error": "invalid or missing CSRF token"})
+			return
+		}
+		c.Set("session", sess)
+		c.Set("username", sess.Username)
+		c.Set("role", u.Role)
+		c.Next()
+	}
+}
+
+// authenticateToken authenticates an API client by bearer token. Tokens are not
+// subject to CSRF checks because browsers never attach them automatically.
+func authenticateToken(c *gin.Context, secret string) {
+	tok, ok := tokens.authenticate(secret, c.ClientIP(), time.Now())
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "invalid, expired or revoked token"})
+		return
+	}
+	u, err := users.get(tok.Owner)
+	if err != nil || u == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "token owner no longer exists"})
+		return
+	}
+	c.Set("token", tok)
+	c.Set("username", tok.Owner)
+	c.Set("role", u.Role)
+	c.Next()
+}
+
+// rejectUnauthenticated redirects page loads to the login form and answers API calls with 401
+func rejectUnauthenticated(c *gin.Context) {
+	if c.Request.Method == http.MethodGet && c.Request.URL.Path == "/" {
+		c.Redirect(http.StatusSeeOther, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "authentication required"})
+}
+
+// isSafeMethod reports whether a request method cannot change state
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRFToken compares the X-CSRF-Token header (or csrf_token form field) with the session token
+func validCSRFToken(c *gin.Context, sess *session) bool {
+	token := c.GetHeader("X-CSRF-Token")
+	if token == "" {
+		token = c.PostForm("csrf_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) == 1
+}
+
+// currentSession returns the session attached by authMiddleware, if any
+func currentSession(c *gin.Context) *session {
+	if v, ok := c.Get("session"); ok {
+		return v.(*session)
+	}
+	return nil
+}
+
+// setSessionCookie sends the session cookie
+func setSessionCookie(c *gin.Context, sess *session) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   isHTTPS(c.Request),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSessionCookie removes the session cookie from the browser
+func clearSessionCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(c.Request),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// isHTTPS reports whether the client reached the editor over TLS (directly or via a proxy)
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// checkSameOrigin only accepts websocket upgrades from pages served by the editor itself
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// safeRedirectTarget only allows local paths as post-login redirects
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheManagerReports are the squid cache manager reports the editor understands
+var cacheManagerReports = []string{"info", "5min", "utilization", "fqdncache"}
+
+// cacheManagerClient fetches squid cache manager reports over HTTP from the proxy port
+// (http://<squid>:3128/squid-internal-mgr/<report>)
+type cacheManagerClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// cacheManager is the client used by the /squid/stats API
+var cacheManager = newCacheManagerClient("http://" + squidAddress())
+
+func newCacheManagerClient(baseURL string) *cacheManagerClient {
+	return &cacheManagerClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: CacheManagerTimeout},
+	}
+}
+
+// fetch returns the raw text of one report
+func (c *cacheManagerClient) fetch(report string) (string, error) {
+	resp, err := c.client.Get(c.baseURL + "/squid-internal-mgr/" + report)
+	if err != nil {
+		return "", fmt.Errorf("cache manager %s: %v", report, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxFileSize))
+	if err != nil {
+		return "", fmt.Errorf("cache manager %s: %v", report, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cache manager %s: %s", report, resp.Status)
+	}
+	return string(body), nil
+}
+
+// report fetches and parses one report by name
+func (c *cacheManagerClient) report(name string) (interface{}, error) {
+	text, err := c.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "info":
+		return parseSquidInfo(text), nil
+	case "5min":
+		return parseSquidFiveMin(text), nil
+	case "utilization":
+		return parseSquidUtilization(text), nil
+	case "fqdncache":
+		return parseSquidFQDNCache(text), nil
+	}
+	return nil, fmt.Errorf("unknown report: %s", name)
+}
+
+// SquidInfo holds the interesting parts of mgr:info
+type SquidInfo struct {
+	Version           string  `json:"version"`
+	StartTime         string  `json:"start_time"`
+	CurrentTime       string  `json:"current_time"`
+	Clients           int64   `json:"clients"`
+	HTTPRequests      int64   `json:"http_requests"`
+	RequestsPerMinute float64 `json:"requests_per_minute"`
+	UpTimeSeconds     float64 `json:"uptime_seconds"`
+	CPUTimeSeconds    float64 `json:"cpu_time_seconds"`
+	CPUUsagePercent   float64 `json:"cpu_usage_percent"`
+	CPUUsage5Min      float64 `json:"cpu_usage_5min_percent"`
+	MaxFileDescs      int64   `json:"max_file_descriptors"`
+	FileDescsInUse    int64   `json:"file_descriptors_in_use"`
+	MaxResidentKB     int64   `json:"max_resident_kb"`
+}
+
+// SquidCounters holds per-interval rates from mgr:5min and mgr:utilization
+type SquidCounters struct {
+	RequestsPerSec  float64 `json:"requests_per_sec"`
+	HitsPerSec      float64 `json:"hits_per_sec"`
+	ErrorsPerSec    float64 `json:"errors_per_sec"`
+	KbytesInPerSec  float64 `json:"kbytes_in_per_sec"`
+	KbytesOutPerSec float64 `json:"kbytes_out_per_sec"`
+	MedianSvcTime   float64 `json:"median_svc_time_seconds"`
+	DNSMedianTime   float64 `json:"dns_median_svc_time_seconds"`
+	CPUUsagePercent float64 `json:"cpu_usage_percent"`
+}
+
+// SquidWorkerStats is mgr:5min for one SMP worker ("kid"), or the whole process as "all"
+type SquidWorkerStats struct {
+	Worker string `json:"worker"`
+	SquidCounters
+}
+
+// SquidUtilization holds mgr:utilization counters per interval section
+type SquidUtilization struct {
+	Sections map[string]SquidCounters `json:"sections"`
+}
+
+// SquidFQDNEntry is one row of the FQDN cache contents
+type SquidFQDNEntry struct {
+	Address   string   `json:"address"`
+	Flags     string   `json:"flags,omitempty"`
+	TTL       int64    `json:"ttl"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// SquidFQDNCache holds mgr:fqdncache statistics and contents
+type SquidFQDNCache struct {
+	EntriesInUse  int64            `json:"entries_in_use"`
+	EntriesCached int64            `json:"entries_cached"`
+	Requests      int64            `json:"requests"`
+	Hits          int64            `json:"hits"`
+	NegativeHits  int64            `json:"negative_hits"`
+	Misses        int64            `json:"misses"`
+	Entries       []SquidFQDNEntry `json:"entries"`
+}
+
+// leadingNumber matches the numeric prefix of values like "12.3/sec", "0.41%" or "1.2 seconds"
+var leadingNumber = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?`)
+
+// parseNumber returns the leading number of a report value, or 0
+func parseNumber(value string) float64 {
+	m := leadingNumber.FindString(strings.TrimSpace(value))
+	f, _ := strconv.ParseFloat(m, 64)
+	return f
+}
+
+// parseColonPairs collects "key: value" lines (tab-indented or not) keyed by the trimmed key
+func parseColonPairs(text string) map[string]string {
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if _, ok := pairs[key]; !ok {
+			pairs[key] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return pairs
+}
+
+// parseSquidInfo parses mgr:info
+func parseSquidInfo(text string) SquidInfo {
+	p := parseColonPairs(text)
+	return SquidInfo{
+		Version:           p["Squid Object Cache"],
+		StartTime:         p["Start Time"],
+		CurrentTime:       p["Current Time"],
+		Clients:           int64(parseNumber(p["Number of clients accessing cache"])),
+		HTTPRequests:      int64(parseNumber(p["Number of HTTP requests received"])),
+		RequestsPerMinute: parseNumber(p["Average HTTP requests per minute since start"]),
+		UpTimeSeconds:     parseNumber(p["UP Time"]),
+		CPUTimeSeconds:    parseNumber(p["CPU Time"]),
+		CPUUsagePercent:   parseNumber(p["CPU Usage"]),
+		CPUUsage5Min:      parseNumber(p["CPU Usage, 5 minute avg"]),
+		MaxFileDescs:      int64(parseNumber(p["Maximum number of file descriptors"])),
+		FileDescsInUse:    int64(parseNumber(p["Number of file desc currently in use"])),
+		MaxResidentKB:     int64(parseNumber(p["Maximum Resident Size"])),
+	}
+}
+
+// countersFromPairs extracts SquidCounters from "key = value" pairs
+func countersFromPairs(p map[string]string) SquidCounters {
+	return SquidCounters{
+		RequestsPerSec:  parseNumber(p["client_http.requests"]),
+		HitsPerSec:      parseNumber(p["client_http.hits"]),
+		ErrorsPerSec:    parseNumber(p["client_http.errors"]),
+		KbytesInPerSec:  parseNumber(p["client_http.kbytes_in"]),
+		KbytesOutPerSec: parseNumber(p["client_http.kbytes_out"]),
+		MedianSvcTime:   parseNumber(p["client_http.all_median_svc_time"]),
+		DNSMedianTime:   parseNumber(p["dns.median_svc_time"]),
+		CPUUsagePercent: parseNumber(p["cpu_usage"]),
+	}
+}
+
+// kidBlockStart matches the "by kid1 {" header squid emits per SMP worker
+var kidBlockStart = regexp.MustCompile(`^by (kid[0-9]+) \{$`)
+
+// parseSquidFiveMin parses mgr:5min. SMP squid reports each worker in a
+// "by kidN { ... } by kidN" block; a single-process squid reports one "all" entry.
+func parseSquidFiveMin(text string) []SquidWorkerStats {
+	var workers []SquidWorkerStats
+	current := ""
+	pairs := make(map[string]string)
+	flush := func(name string) {
+		if len(pairs) > 0 {
+			workers = append(workers, SquidWorkerStats{Worker: name, SquidCounters: countersFromPairs(pairs)})
+		}
+		pairs = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := kidBlockStart.FindStringSubmatch(line); m != nil {
+			flush("all")
+			current = m[1]
+			continue
+		}
+		if current != "" && strings.HasPrefix(line, "} by "+current) {
+			flush(current)
+			current = ""
+			continue
+		}
+		if k, v, ok := strings.Cut(line, " = "); ok {
+			pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if current == "" {
+		flush("all")
+	} else {
+		flush(current)
+	}
+	return workers
+}
+
+// parseSquidUtilization parses mgr:utilization, whose "key = value" counters are
+// grouped under section headers such as "Last 5 minutes:"
+func parseSquidUtilization(text string) SquidUtilization {
+	u := SquidUtilization{Sections: make(map[string]SquidCounters)}
+	section := ""
+	pairs := make(map[string]string)
+	flush := func() {
+		if section != "" && len(pairs) > 0 {
+			u.Sections[section] = countersFromPairs(pairs)
+		}
+		pairs = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || kidBlockStart.MatchString(line) || strings.HasPrefix(line, "} by ") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, " = "); ok {
+			pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			continue
+		}
+		if strings.HasSuffix(line, ":") {
+			flush()
+			section = strings.TrimSuffix(line, ":")
+		}
+	}
+	flush()
+	return u
+}
+
+// parseSquidFQDNCache parses mgr:fqdncache statistics and the contents table
+func parseSquidFQDNCache(text string) SquidFQDNCache {
+	p := parseColonPairs(text)
+	cache := SquidFQDNCache{
+		EntriesInUse:  int64(parseNumber(p["FQDNcache Entries In Use"])),
+		EntriesCached: int64(parseNumber(p["FQDNcache Entries Cached"])),
+		Requests:      int64(parseNumber(p["FQDNcache Requests"])),
+		Hits:          int64(parseNumber(p["FQDNcache Hits"])),
+		NegativeHits:  int64(parseNumber(p["FQDNcache Negative Hits"])),
+		Misses:        int64(parseNumber(p["FQDNcache Misses"])),
+		Entries:       []SquidFQDNEntry{},
+	}
+
+	inTable := false
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "Address" {
+			inTable = true
+			continue
+		}
+		if !inTable || len(fields) < 3 {
+			continue
+		}
+		// Columns: Address [Flags] TTL Cnt Hostnames...
+		entry := SquidFQDNEntry{Address: fields[0]}
+		rest := fields[1:]
+		if _, err := strconv.ParseInt(rest[0], 10, 64); err != nil {
+			entry.Flags = rest[0]
+			rest = rest[1:]
+		}
+		if len(rest) < 2 {
+			continue
+		}
+		entry.TTL, _ = strconv.ParseInt(rest[0], 10, 64)
+		entry.Hostnames = rest[2:]
+		cache.Entries = append(cache.Entries, entry)
+	}
+	return cache
+}
+
+// squidStats gathers all reports; reports that could not be fetched are listed in Errors
+type squidStats struct {
+	FetchedAt   time.Time          `json:"fetched_at"`
+	Info        *SquidInfo         `json:"info,omitempty"`
+	FiveMin     []SquidWorkerStats `json:"five_min,omitempty"`
+	Utilization *SquidUtilization  `json:"utilization,omitempty"`
+	FQDNCache   *SquidFQDNCache    `json:"fqdncache,omitempty"`
+	Errors      map[string]string  `json:"errors,omitempty"`
+}
+
+// allStats fetches every report the editor understands
+func (c *cacheManagerClient) allStats() squidStats {
+	stats := squidStats{FetchedAt: time.Now()}
+	for _, name := range cacheManagerReports {
+		r, err := c.report(name)
+		if err != nil {
+			if stats.Errors == nil {
+				stats.Errors = make(map[string]string)
+			}
+			stats.Errors[name] = err.Error()
+			continue
+		}
+		switch v := r.(type) {
+		case SquidInfo:
+			stats.Info = &v
+		case []SquidWorkerStats:
+			stats.FiveMin = v
+		case SquidUtilization:
+			stats.Utilization = &v
+		case SquidFQDNCache:
+			stats.FQDNCache = &v
+		}
+	}
+	return stats
+}
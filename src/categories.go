@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Offline category datasets (UT1, Shallalist and similar blacklist collections, or CSV
+// exports) tag domains with categories such as "adult" or "malware". They are read from
+// <data>/categories: every file named "domains" holds the domains of the category named
+// by its directory ("adult/domains", "recreation/sports/domains"), and every *.csv file
+// holds "domain,category[,category...]" rows. A dataset domain also covers its subdomains.
+//
+// Blacklisted categories are written to blacklist-categories.txt, which squid loads as
+// part of the blacklist. Whitelist entries are left out of it, so a domain whitelisted
+// by hand stays reachable when its category is blacklisted.
+
+// categoryDB indexes the loaded category datasets by domain
+type categoryDB struct {
+	mu       sync.RWMutex
+	domains  map[string][]string // dataset domain -> categories
+	counts   map[string]int      // category -> dataset domains
+	skipped  int                 // dataset lines that are no valid domain (IP addresses, URLs)
+	errors   []string            // files that could not be read
+	loadedAt time.Time
+	blocked  map[string]string // category blacklist entry ("." for subdomains) -> category
+}
+
+// categories is the process-wide category index
+var categories = &categoryDB{}
+
+// categoriesDir returns the directory holding the category datasets
+func categoriesDir() string {
+	return filepath.Join(dataDir, "categories")
+}
+
+// categoryConfigPath returns the location of the blacklisted category settings
+func categoryConfigPath() string {
+	return filepath.Join(dataDir, "categories.json")
+}
+
+// categoryConfig is stored in categories.json
+type categoryConfig struct {
+	Blacklist []string `json:"blacklist"` // categories squid blocks entirely
+}
+
+func loadCategoryConfig() (categoryConfig, error) {
+	var cfg categoryConfig
+	data, err := os.ReadFile(categoryConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %v", filepath.Base(categoryConfigPath()), err)
+	}
+	return cfg, nil
+}
+
+func saveCategoryConfig(cfg categoryConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(categoryConfigPath(), string(data))
+}
+
+// categoryName normalizes a category as written in a dataset or a request
+func categoryName(name string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(name)), "/")
+}
+
+// categoryDomain returns the list form of a dataset domain, or "" for lines that are
+// no domain. Leading "." and "*." are dropped: dataset domains include subdomains.
+func categoryDomain(line string) string {
+	d := strings.ToLower(strings.TrimSpace(line))
+	d = strings.TrimPrefix(strings.TrimPrefix(d, "*"), ".")
+	d = strings.TrimSuffix(d, ".")
+	if d == "" || hostIP(d) != nil {
+		return ""
+	}
+	d, err := toListDomain(d)
+	if err != nil || validateHostname(d) != nil {
+		return ""
+	}
+	return d
+}
+
+// load reads every dataset below categoriesDir and replaces the index. Files that
+// cannot be read are reported in the status and skipped.
+func (db *categoryDB) load() error {
+	domains := make(map[string][]string)
+	counts := make(map[string]int)
+	single := make(map[string][]string) // shared category slices for domains with one category
+	skipped := 0
+	var errs []string
+
+	add := func(line, category string) {
+		category = categoryName(category)
+		if category == "" {
+			return
+		}
+		domain := categoryDomain(line)
+		if domain == "" {
+			skipped++
+			return
+		}
+		cats := domains[domain]
+		if containsString(cats, category) {
+			return
+		}
+		if cats == nil {
+			if single[category] == nil {
+				single[category] = []string{category}
+			}
+			domains[domain] = single[category]
+		} else {
+			domains[domain] = append(append([]string{}, cats...), category)
+		}
+		counts[category]++
+	}
+
+	root := categoriesDir()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			errs = append(errs, err.Error())
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case d.Name() == "domains":
+			category := filepath.ToSlash(filepath.Dir(rel))
+			if category == "." {
+				errs = append(errs, fmt.Sprintf("%s: a domains file must be in a directory named after its category", rel))
+				return nil
+			}
+			err = readCategoryDomains(path, func(line string) { add(line, category) })
+		case strings.EqualFold(filepath.Ext(path), ".csv"):
+			err = readCategoryCSV(path, add)
+		default:
+			return nil // urls, expressions, licenses and other files of the collections
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rel, err))
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.domains, db.counts, db.skipped, db.errors = domains, counts, skipped, errs
+	db.loadedAt = time.Now().UTC()
+	return nil
+}
+
+// readCategoryDomains calls fn for every entry of a UT1/Shallalist "domains" file
+func readCategoryDomains(path string, fn func(domain string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			fn(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// readCategoryCSV calls fn for every domain and category of a "domain,category[,category...]"
+// file. Categories may also be separated by ";" within a field; a "domain" header row is skipped.
+func readCategoryCSV(path string, fn func(domain, category string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if row == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "domain") {
+			continue
+		}
+		for _, field := range record[1:] {
+			for _, category := range strings.Split(field, ";") {
+				fn(record[0], category)
+			}
+		}
+	}
+}
+
+// lookup returns the categories of the most specific dataset domain covering host
+func (db *categoryDB) lookup(host string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.domains) == 0 || hostIP(host) != nil {
+		return nil
+	}
+	for h := strings.TrimSuffix(strings.ToLower(host), "."); h != ""; h = parentDomain(h) {
+		if cats, ok := db.domains[h]; ok {
+			return cats
+		}
+	}
+	return nil
+}
+
+// parentDomain strips the first label of a host, "" for single labels
+func parentDomain(host string) string {
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		return host[i+1:]
+	}
+	return ""
+}
+
+// blockedBy returns the category blacklist entry matching host and its category
+func (db *categoryDB) blockedBy(host string) (entry, category string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.blocked) == 0 {
+		return "", ""
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if c, ok := db.blocked[host]; ok {
+		return host, c
+	}
+	for h := host; h != ""; h = parentDomain(h) {
+		if c, ok := db.blocked["."+h]; ok {
+			return "." + h, c
+		}
+	}
+	return "", ""
+}
+
+// knows reports whether a category occurs in the loaded datasets
+func (db *categoryDB) knows(category string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.counts[category] > 0
+}
+
+// categoryStatus is the answer of GET /categories
+type categoryStatus struct {
+	LoadedAt   time.Time      `json:"loaded_at"`
+	Domains    int            `json:"domains"`
+	Skipped    int            `json:"skipped"`
+	Blocked    int            `json:"blocked_entries"` // entries in blacklist-categories.txt
+	Categories []categoryInfo `json:"categories"`
+	Blacklist  []string       `json:"blacklist"`
+	Errors     []string       `json:"errors,omitempty"`
+}
+
+// categoryInfo describes one loaded category
+type categoryInfo struct {
+	Name        string `json:"name"`
+	Domains     int    `json:"domains"`
+	Blacklisted bool   `json:"blacklisted"`
+}
+
+// status summarizes the loaded datasets and the blacklisted categories
+func (db *categoryDB) status() (categoryStatus, error) {
+	cfg, err := loadCategoryConfig()
+	if err != nil {
+		return categoryStatus{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := categoryStatus{LoadedAt: db.loadedAt, Domains: len(db.domains), Skipped: db.skipped, Blocked: len(db.blocked), Errors: db.errors}
+	s.Categories = make([]categoryInfo, 0, len(db.counts))
+	for name, n := range db.counts {
+		s.Categories = append(s.Categories, categoryInfo{Name: name, Domains: n, Blacklisted: containsString(cfg.Blacklist, name)})
+	}
+	sort.Slice(s.Categories, func(i, j int) bool { return s.Categories[i].Name < s.Categories[j].Name })
+	s.Blacklist = cfg.Blacklist
+	if s.Blacklist == nil {
+		s.Blacklist = []string{}
+	}
+	return s, nil
+}
+
+// writeBlacklist regenerates blacklist-categories.txt from the loaded datasets, the
+// blacklisted categories and the allow lists, and reports whether the file changed.
+// A domain on an allow list is left out; a domain with allowed hosts below it is only
+// blocked itself, without its subdomains. The caller holds listMu. Until the datasets
+// are loaded (as in the command-line interface) the file is left alone.
+func (db *categoryDB) writeBlacklist() (bool, error) {
+	db.mu.RLock()
+	loaded := !db.loadedAt.IsZero()
+	db.mu.RUnlock()
+	if !loaded {
+		return false, nil
+	}
+	cfg, err := loadCategoryConfig()
+	if err != nil {
+		return false, err
+	}
+	whitelisted := make(map[string]bool)
+	below := make(map[string]bool) // domains with an allow list entry below them
+	for _, l := range orderedLists() {
+		if l.Action != ListAllow {
+			continue
+		}
+		path, _ := listPath(l.Name)
+		for _, line := range parseDomainList(readFile(path)) {
+			d := parseDomainEntry(line).Domain
+			whitelisted[d] = true
+			for p := parentDomain(strings.TrimPrefix(d, ".")); p != ""; p = parentDomain(p) {
+				below[p] = true
+			}
+		}
+	}
+
+	entries := make(map[string]string)
+	db.mu.RLock()
+	if len(cfg.Blacklist) > 0 {
+		for domain, cats := range db.domains {
+			category := ""
+			for _, c := range cats {
+				if containsString(cfg.Blacklist, c) {
+					category = c
+					break
+				}
+			}
+			if category == "" || whitelistCovers(whitelisted, domain) {
+				continue
+			}
+			entry := "." + domain
+			if below[domain] {
+				entry = domain
+			}
+			entries[entry] = category
+		}
+	}
+	db.mu.RUnlock()
+	// Entries below a subdomain entry are redundant; squid warns about them
+	for entry := range entries {
+		for p := parentDomain(strings.TrimPrefix(entry, ".")); p != ""; p = parentDomain(p) {
+			if _, ok := entries["."+p]; ok {
+				delete(entries, entry)
+				break
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(entries))
+	for entry, category := range entries {
+		lines = append(lines, entry+" #"+category)
+	}
+	sort.Strings(lines)
+	content := strings.Join(lines, "\n")
+	changed := readFile(blacklistCategoryPath) != content
+	if changed {
+		if err := writeFile(blacklistCategoryPath, content); err != nil {
+			return false, err
+		}
+	}
+	db.mu.Lock()
+	db.blocked = entries
+	db.mu.Unlock()
+	return changed, nil
+}
+
+// whitelistCovers reports whether a whitelist entry matches domain
+func whitelistCovers(whitelisted map[string]bool, domain string) bool {
+	if whitelisted[domain] {
+		return true
+	}
+	for h := domain; h != ""; h = parentDomain(h) {
+		if whitelisted["."+h] {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshCategoryBlacklist regenerates the category blacklist and reloads squid when it changed
+func refreshCategoryBlacklist() (reloaded bool, err error) {
+	if err := listMu.Lock(); err != nil {
+		return false, err
+	}
+	defer listMu.Unlock()
+	changed, err := categories.writeBlacklist()
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, reloadSquid()
+}
+
+// matchesCategory reports whether a row category is selected by a filter category;
+// "recreation" also selects "recreation/sports"
+func matchesCategory(category, filter string) bool {
+	return category == filter || strings.HasPrefix(category, filter+"/")
+}
+
+// filterRowsByCategory keeps the rows in any of the categories, or without a category
+// when uncategorized is set
+func filterRowsByCategory(rows []Row, filters []string, uncategorized bool) []Row {
+	kept := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		keep := uncategorized && len(row.Categories) == 0
+		for _, c := range row.Categories {
+			for _, f := range filters {
+				if matchesCategory(c, f) {
+					keep = true
+				}
+			}
+		}
+		if keep {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+// countRowCategories returns how many rows carry each category
+func countRowCategories(rows []Row) map[string]int {
+	counts := make(map[string]int)
+	for _, row := range rows {
+		for _, c := range row.Categories {
+			counts[c]++
+		}
+	}
+	return counts
+}
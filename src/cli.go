@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cliUsage = `Usage: squid-editor [serve]
+       squid-editor <command> [flags] [arguments]
+
+Commands:
+  list [list]                         show list entries (whitelist, blacklist or a named list)
+  add <list> <domain>...              add domains that are on no list yet
+  move <domain> <list|unknown>        move a domain, wherever it is now
+  remove <domain>...                  take domains off every list
+  import <list> <file|->              move every entry of a list file to <list>
+  export <list>                       print a list in list file format
+  history [-domain d] [-limit n]      list changes from the audit log
+  reload                              reconfigure squid
+  evaluate <host|url>...              show which list decides a host
+
+Flags:
+  -data-dir dir   work on this data directory ($SQUID_EDITOR_DATA_DIR, default /data)
+  -server url     use a running editor instead ($SQUID_EDITOR_URL)
+  -token token    API token for -server ($SQUID_EDITOR_TOKEN)
+  -json           print JSON
+  -note text      note for add, move and import entries without one
+  -tags a,b       tags for add, move and import entries
+  -owner name     owner for add, move and import entries
+  -ticket ref     ticket for add, move and import entries
+  -confirm        add internationalized domains despite homograph warnings
+`
+
+// cliOptions are the flags every subcommand accepts
+type cliOptions struct {
+	dataDir string
+	server  string
+	token   string
+	json    bool
+	note    string
+	tags    string
+	owner   string
+	ticket  string
+	domain  string
+	limit   int
+	confirm bool
+}
+
+// cliMoveResult is the outcome of add, move, remove and import
+type cliMoveResult struct {
+	Target      string     `json:"target"`
+	Moved       []cliMoved `json:"moved"`
+	ReloadError string     `json:"reload_error,omitempty"`
+}
+
+// cliMoved is one domain changed by a move
+type cliMoved struct {
+	Domain   string   `json:"domain"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Covered  []string `json:"covered,omitempty"`
+	Overlaps []string `json:"overlaps,omitempty"`
+}
+
+// cliEvaluation is the policy decision for one host
+type cliEvaluation struct {
+	Host    string `json:"host"`
+	Display string `json:"display,omitempty"`
+	List    string `json:"list"`
+	Entry   string `json:"entry"`
+	Action  string `json:"action"`
+}
+
+// cliEntry is a list entry as printed by list
+type cliEntry struct {
+	Domain string `json:"domain"`
+	Note   string `json:"note,omitempty"`
+}
+
+// cliBackend performs list operations on the data directory or through the HTTP API
+type cliBackend interface {
+	lists() (map[string][]DomainEntry, error)
+	move(entries []DomainEntry, target string) (*cliMoveResult, error)
+	history(domain string, limit int) ([]AuditEntry, error)
+	reload() error
+	evaluate(host string) (*cliEvaluation, error)
+}
+
+// runCLI runs a subcommand and returns the process exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	}
+	command := args[0]
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := cliOptions{}
+	fs.StringVar(&opts.dataDir, "data-dir", envOr("SQUID_EDITOR_DATA_DIR", "/data"), "")
+	fs.StringVar(&opts.server, "server", os.Getenv("SQUID_EDITOR_URL"), "")
+	fs.StringVar(&opts.token, "token", os.Getenv("SQUID_EDITOR_TOKEN"), "")
+	fs.BoolVar(&opts.json, "json", false, "")
+	fs.StringVar(&opts.note, "note", "", "")
+	fs.StringVar(&opts.tags, "tags", "", "")
+	fs.StringVar(&opts.owner, "owner", "", "")
+	fs.StringVar(&opts.ticket, "ticket", "", "")
+	fs.StringVar(&opts.domain, "domain", "", "")
+	fs.IntVar(&opts.limit, "limit", 50, "")
+	fs.BoolVar(&opts.confirm, "confirm", false, "")
+
+	fail := func(err error) int {
+		if opts.json {
+			writeCLIJSON(stdout, map[string]string{"status": "error", "error": err.Error()})
+		} else {
+			fmt.Fprintf(stderr, "squid-editor %s: %v\n", command, err)
+		}
+		return 1
+	}
+	// Flags may come before, between or after the arguments
+	var rest []string
+	remaining := args[1:]
+	for {
+		if err := fs.Parse(remaining); err != nil {
+			return fail(fmt.Errorf("%v\n\n%s", err, cliUsage))
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		remaining = fs.Args()[1:]
+	}
+
+	var backend cliBackend
+	if opts.server != "" {
+		if opts.token == "" {
+			return fail(fmt.Errorf("-server needs an API token (-token or SQUID_EDITOR_TOKEN)"))
+		}
+		backend = &remoteCLI{server: strings.TrimRight(opts.server, "/"), token: opts.token, client: &http.Client{Timeout: 30 * time.Second}}
+	} else {
+		if _, err := os.Stat(opts.dataDir); err != nil {
+			return fail(fmt.Errorf("data directory: %v", err))
+		}
+		setDataDir(opts.dataDir)
+		backend = localCLI{actor: "cli:" + envOr("USER", "unknown")}
+		// Local moves announce list.changed like the server does
+		webhooks.start(WebhookWorkers)
+	}
+
+	out, err := runCLICommand(backend, command, rest, opts)
+	if _, ok := backend.(localCLI); ok && !webhooks.drain(CLIWebhookWait) {
+		fmt.Fprintf(stderr, "warning: webhook deliveries still pending after %s were abandoned\n", CLIWebhookWait)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if opts.json {
+		writeCLIJSON(stdout, out)
+	} else {
+		printCLIText(stdout, out)
+	}
+	if r, ok := out.(*cliMoveResult); ok && r.ReloadError != "" {
+		fmt.Fprintf(stderr, "warning: lists were written but squid did not reload: %s\n", r.ReloadError)
+		return 1
+	}
+	return 0
+}
+
+// runCLICommand runs one subcommand and returns what should be printed
+func runCLICommand(b cliBackend, command string, args []string, opts cliOptions) (interface{}, error) {
+	wantArgs := func(min, max int, usage string) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return fmt.Errorf("usage: squid-editor %s %s", command, usage)
+		}
+		return nil
+	}
+	meta, err := entryMetaFields(splitTags(opts.tags), opts.owner, opts.ticket)
+	if err != nil {
+		return nil, err
+	}
+	switch command {
+	case "list":
+		if err := wantArgs(0, 1, "[list]"); err != nil {
+			return nil, err
+		}
+		lists, err := b.lists()
+		if err != nil {
+			return nil, err
+		}
+		out := map[string][]cliEntry{}
+		for name, entries := range lists {
+			if len(args) == 1 && args[0] != name {
+				continue
+			}
+			out[name] = []cliEntry{}
+			for _, e := range entries {
+				out[name] = append(out[name], cliEntry{Domain: e.Domain, Note: e.Note})
+			}
+		}
+		if len(args) == 1 && out[args[0]] == nil {
+			return nil, fmt.Errorf("unknown list %q", args[0])
+		}
+		return out, nil
+
+	case "add":
+		if err := wantArgs(2, -1, "<list> <domain>..."); err != nil {
+			return nil, err
+		}
+		lists, err := b.lists()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := lists[args[0]]; !ok {
+			return nil, fmt.Errorf("unknown list %q", args[0])
+		}
+		var entries []DomainEntry
+		for _, arg := range args[1:] {
+			domain, err := normalizeListDomain(arg)
+			if err != nil {
+				return nil, err
+			}
+			if list := cliListOf(lists, domain); list != "" {
+				return nil, fmt.Errorf("%s is already on the %s; use move", arg, list)
+			}
+			entries = append(entries, DomainEntry{Domain: domain, Note: opts.note, Meta: meta})
+		}
+		if err := cliCheckWarnings(entries, args[0], opts.confirm); err != nil {
+			return nil, err
+		}
+		return b.move(entries, args[0])
+
+	case "move":
+		if err := wantArgs(2, 2, "<domain> <list|unknown>"); err != nil {
+			return nil, err
+		}
+		entries := []DomainEntry{{Domain: args[0], Note: opts.note, Meta: meta}}
+		if err := cliCheckWarnings(entries, args[1], opts.confirm); err != nil {
+			return nil, err
+		}
+		return b.move(entries, args[1])
+
+	case "remove":
+		if err := wantArgs(1, -1, "<domain>..."); err != nil {
+			return nil, err
+		}
+		var entries []DomainEntry
+		for _, domain := range args {
+			entries = append(entries, DomainEntry{Domain: domain})
+		}
+		return b.move(entries, "unknown")
+
+	case "import":
+		if err := wantArgs(2, 2, "<list> <file|->"); err != nil {
+			return nil, err
+		}
+		lists, err := b.lists()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := lists[args[0]]; !ok {
+			return nil, fmt.Errorf("unknown list %q", args[0])
+		}
+		var data []byte
+		if args[1] == "-" {
+			data, err = io.ReadAll(bufio.NewReader(os.Stdin))
+		} else {
+			data, err = os.ReadFile(args[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entries []DomainEntry
+		for _, line := range parseDomainList(string(data)) {
+			e := parseDomainEntry(line)
+			if e.Note == "" {
+				e.Note = opts.note
+			}
+			entries = append(entries, DomainEntry{Domain: e.Domain, Note: e.Note, Meta: meta})
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("no domains in %s", args[1])
+		}
+		if len(entries) > MaxBulkMove {
+			return nil, fmt.Errorf("%d domains; import at most %d at a time", len(entries), MaxBulkMove)
+		}
+		if err := cliCheckWarnings(entries, args[0], opts.confirm); err != nil {
+			return nil, err
+		}
+		return b.move(entries, args[0])
+
+	case "export":
+		if err := wantArgs(1, 1, "<list>"); err != nil {
+			return nil, err
+		}
+		lists, err := b.lists()
+		if err != nil {
+			return nil, err
+		}
+		entries, ok := lists[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown list %q", args[0])
+		}
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			lines = append(lines, e.Full)
+		}
+		return cliExport{List: args[0], Content: sortAndJoinDomainList(lines)}, nil
+
+	case "history":
+		if err := wantArgs(0, 0, "[-domain d] [-limit n]"); err != nil {
+			return nil, err
+		}
+		return b.history(opts.domain, opts.limit)
+
+	case "reload":
+		if err := wantArgs(0, 0, ""); err != nil {
+			return nil, err
+		}
+		if err := b.reload(); err != nil {
+			return nil, err
+		}
+		return map[string]string{"status": "reloaded"}, nil
+
+	case "evaluate":
+		if err := wantArgs(1, -1, "<host|url>..."); err != nil {
+			return nil, err
+		}
+		var out []*cliEvaluation
+		for _, host := range args {
+			ev, err := b.evaluate(host)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ev)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown command %q\n\n%s", command, cliUsage)
+}
+
+// cliExport is a list in list file format
+type cliExport struct {
+	List    string `json:"list"`
+	Content string `json:"content"`
+}
+
+// cliCheckWarnings refuses to list possible homographs unless -confirm was given.
+// The check runs here for both backends, so remote moves are sent confirmed.
+func cliCheckWarnings(entries []DomainEntry, target string, confirm bool) error {
+	if confirm || target == "unknown" {
+		return nil
+	}
+	var problems []string
+	for _, e := range entries {
+		for _, w := range domainWarnings(e.Domain) {
+			problems = append(problems, fmt.Sprintf("%s: %s", e.Domain, w))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("possible homographs, pass -confirm to add them anyway:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// cliListOf returns the list holding exactly domain, or ""
+func cliListOf(lists map[string][]DomainEntry, domain string) string {
+	var names []string
+	for name := range lists {
+		names = append(names, name)
+	}
+	for _, name := range cliListOrder(names) {
+		for _, e := range lists[name] {
+			if e.Domain == domain {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// cliListOrder puts the whitelist and the blacklist first and the named lists after
+// them, sorted
+func cliListOrder(names []string) []string {
+	var named []string
+	for _, name := range names {
+		if name != "whitelist" && name != "blacklist" {
+			named = append(named, name)
+		}
+	}
+	sort.Strings(named)
+	return append([]string{"whitelist", "blacklist"}, named...)
+}
+
+func writeCLIJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printCLIText prints a command result for people
+func printCLIText(w io.Writer, out interface{}) {
+	switch v := out.(type) {
+	case map[string][]cliEntry:
+		var names []string
+		for name := range v {
+			names = append(names, name)
+		}
+		for _, name := range cliListOrder(names) {
+			entries, ok := v[name]
+			if !ok {
+				continue
+			}
+			if len(v) > 1 {
+				fmt.Fprintf(w, "# %s (%d)\n", name, len(entries))
+			}
+			for _, e := range entries {
+				if e.Note != "" {
+					fmt.Fprintf(w, "%s  # %s\n", e.Domain, e.Note)
+				} else {
+					fmt.Fprintln(w, e.Domain)
+				}
+			}
+		}
+	case *cliMoveResult:
+		for _, m := range v.Moved {
+			fmt.Fprintf(w, "%s: %s -> %s\n", m.Domain, m.From, m.To)
+			for _, o := range m.Overlaps {
+				fmt.Fprintf(w, "  overlaps %s\n", o)
+			}
+		}
+	case cliExport:
+		if v.Content != "" {
+			fmt.Fprintln(w, v.Content)
+		}
+	case []AuditEntry:
+		for _, e := range v {
+			line := fmt.Sprintf("%s  %-12s %-8s %s: %s -> %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Actor, e.Result, e.Domain, e.From, e.To)
+			if e.Note != "" {
+				line += "  # " + e.Note
+			}
+			if e.Error != "" {
+				line += "  (" + e.Error + ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+	case []*cliEvaluation:
+		for _, e := range v {
+			host := e.Host
+			if e.Display != "" {
+				host += " (" + e.Display + ")"
+			}
+			if e.Entry != "" {
+				fmt.Fprintf(w, "%s: %s (%s by %s)\n", host, e.Action, e.List, e.Entry)
+			} else {
+				fmt.Fprintf(w, "%s: %s (on no list)\n", host, e.Action)
+			}
+		}
+	case map[string]string:
+		fmt.Fprintln(w, v["status"])
+	}
+}
+
+// localCLI works directly on the data directory, through the same code as the web handlers
+type localCLI struct {
+	actor string
+}
+
+func (l localCLI) lists() (map[string][]DomainEntry, error) {
+	out := map[string][]DomainEntry{}
+	for _, name := range listNames() {
+		out[name] = []DomainEntry{}
+		// IP addresses and ranges follow the domains of their list
+		for _, file := range []string{name, ipListFor(name)} {
+			path, _ := listPath(file)
+			content, err := os.ReadFile(path)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			for _, line := range parseDomainList(string(content)) {
+				out[name] = append(out[name], parseDomainEntry(line))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (l localCLI) move(entries []DomainEntry, target string) (*cliMoveResult, error) {
+	moves, err := commitDomainMoves(l.actor, entries, target, func(e AuditEntry) {
+		e.Actor, e.SourceIP = l.actor, "local"
+		if _, aerr := auditTrail.append(e, time.Now()); aerr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to write audit log: %v\n", aerr)
+		}
+	})
+	result := &cliMoveResult{Target: target, Moved: []cliMoved{}}
+	for _, move := range moves {
+		result.Moved = append(result.Moved, cliMoved{Domain: move.Domain, From: move.From, To: move.To, Covered: move.Covered, Overlaps: move.Overlaps})
+		if move.ReloadErr != nil {
+			result.ReloadError = move.ReloadErr.Error()
+		}
+	}
+	return result, err
+}
+
+func (l localCLI) history(domain string, limit int) ([]AuditEntry, error) {
+	entries, _, _, err := auditTrail.query(auditQuery{Action: AuditMoveDomain, Domain: domain, Limit: limit})
+	return entries, err
+}
+
+func (l localCLI) reload() error {
+	err := reloadSquid()
+	entry := AuditEntry{Actor: l.actor, SourceIP: "local", Action: AuditReload, Reload: reloadOutcome(err)}
+	entry.Result, entry.Error = auditResult(err)
+	if _, aerr := auditTrail.append(entry, time.Now()); aerr != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to write audit log: %v\n", aerr)
+	}
+	return err
+}
+
+func (l localCLI) evaluate(host string) (*cliEvaluation, error) {
+	host = strings.ToLower(extractDomain(host))
+	if host == "" {
+		return nil, fmt.Errorf("host is required")
+	}
+	host, err := toListDomain(host)
+	if err != nil {
+		return nil, err
+	}
+	list, entry := domainPolicy(host)
+	return &cliEvaluation{Host: host, Display: displayDomain(host), List: list, Entry: entry, Action: policyAction(list)}, nil
+}
+
+// remoteCLI calls a running editor's HTTP API with an API token
+type remoteCLI struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// call sends a request and decodes a JSON answer into out, turning error answers into errors
+func (r *remoteCLI) call(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, r.server+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxFileSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s (HTTP %d)", e.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("%s %s: HTTP %d", method, path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (r *remoteCLI) lists() (map[string][]DomainEntry, error) {
+	var raw struct {
+		Whitelist   string             `json:"whitelist"`
+		Blacklist   string             `json:"blacklist"`
+		WhitelistIP string             `json:"whitelist_ip"`
+		BlacklistIP string             `json:"blacklist_ip"`
+		Lists       []namedListContent `json:"lists"`
+	}
+	if err := r.call("GET", "/lists", nil, &raw); err != nil {
+		return nil, err
+	}
+	contents := map[string]string{"whitelist": raw.Whitelist + "\n" + raw.WhitelistIP, "blacklist": raw.Blacklist + "\n" + raw.BlacklistIP}
+	for _, l := range raw.Lists {
+		contents[l.Name] = l.Content + "\n" + l.IP
+	}
+	out := map[string][]DomainEntry{}
+	for name, content := range contents {
+		out[name] = []DomainEntry{}
+		for _, line := range parseDomainList(content) {
+			out[name] = append(out[name], parseDomainEntry(line))
+		}
+	}
+	return out, nil
+}
+
+func (r *remoteCLI) move(entries []DomainEntry, target string) (*cliMoveResult, error) {
+	// runCLICommand has already checked homograph warnings
+	req := bulkMoveRequest{Target: target, Confirm: true}
+	for _, e := range entries {
+		d := bulkMoveDomain{Domain: e.Domain, Note: e.Note}
+		if e.Meta != nil {
+			d.Tags, d.Owner, d.Ticket = e.Meta.Tags, e.Meta.Owner, e.Meta.Ticket
+		}
+		req.Domains = append(req.Domains, d)
+	}
+	result := &cliMoveResult{}
+	if err := r.call("POST", "/move-domains", req, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *remoteCLI) history(domain string, limit int) ([]AuditEntry, error) {
+	q := url.Values{"action": {AuditMoveDomain}, "limit": {strconv.Itoa(limit)}}
+	if domain != "" {
+		q.Set("domain", domain)
+	}
+	var out struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	if err := r.call("GET", "/api/v1/audit?"+q.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Entries, nil
+}
+
+func (r *remoteCLI) reload() error {
+	return r.call("POST", "/reload", nil, nil)
+}
+
+func (r *remoteCLI) evaluate(host string) (*cliEvaluation, error) {
+	out := &cliEvaluation{}
+	if err := r.call("GET", "/evaluate?"+url.Values{"host": {host}}.Encode(), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A page on a whitelisted host usually needs assets from other hosts (CDNs, APIs, fonts),
+// which then show up as unknown (RG) requests from the same client right around the visit.
+// findDependencies correlates the merged log by client IP and time to rank those hosts.
+
+// dependencySuggestion is an unknown host co-requested with the analyzed domain
+type dependencySuggestion struct {
+	Domain      string  `json:"domain"`
+	Display     string  `json:"display,omitempty"`
+	Score       float64 `json:"score"`       // support × specificity, between 0 and 1
+	Support     float64 `json:"support"`     // share of visits with a request to this host
+	Specificity float64 `json:"specificity"` // share of this host's requests that fell within a visit
+	Visits      int     `json:"visits"`      // visits with a request to this host
+	Clients     int     `json:"clients"`     // distinct clients among those visits
+	Requests    int     `json:"requests"`    // requests to this host within visits
+	Total       int     `json:"total"`       // requests to this host in the whole log
+	SameSite    bool    `json:"same_site"`   // shares the registrable domain of the analyzed domain
+}
+
+// dependencyReport is the answer of GET /dependencies
+type dependencyReport struct {
+	Domain      string                 `json:"domain"`
+	Window      float64                `json:"window_seconds"`
+	Visits      int                    `json:"visits"`  // bursts of requests to the domain, per client
+	Clients     int                    `json:"clients"` // clients that visited the domain
+	Suggestions []dependencySuggestion `json:"suggestions"`
+}
+
+// depRequest is a log entry reduced to what the correlation needs
+type depRequest struct {
+	ts   float64
+	host string
+}
+
+// findDependencies ranks the hosts that are still on no list and were requested by the
+// same clients within window of their requests to domain (".example.com" includes
+// subdomains). Requests to domain less than window apart form one visit.
+func findDependencies(logText, domain string, window time.Duration, limit int) dependencyReport {
+	w := window.Seconds()
+	report := dependencyReport{Domain: domain, Window: w, Suggestions: []dependencySuggestion{}}
+
+	anchors := map[string][]float64{}       // client -> times of requests to domain
+	candidates := map[string][]depRequest{} // client -> unknown requests to other hosts
+	totals := map[string]int{}
+	for _, line := range strings.Split(logText, "\n") {
+		entry, err := ParseLogEntry(line)
+		if err != nil || entry.Host == "" {
+			continue
+		}
+		ts, err := strconv.ParseFloat(entry.Timestamp, 64)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(entry.Host)
+		if matchesDstdomain(host, domain) {
+			anchors[entry.ClientIP] = append(anchors[entry.ClientIP], ts)
+			continue
+		}
+		totals[host]++
+		if entry.Tag == "RG" {
+			candidates[entry.ClientIP] = append(candidates[entry.ClientIP], depRequest{ts: ts, host: host})
+		}
+	}
+
+	type tally struct {
+		visits, requests int
+		clients          map[string]bool
+	}
+	tallies := map[string]*tally{}
+	for client, times := range anchors {
+		report.Clients++
+		reqs := candidates[client]
+		sort.Float64s(times)
+		sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].ts < reqs[j].ts })
+		counted := 0 // requests before this index already belong to an earlier visit
+		for start := 0; start < len(times); {
+			end := start
+			for end+1 < len(times) && times[end+1]-times[end] <= w {
+				end++
+			}
+			report.Visits++
+			from, to := times[start]-w, times[end]+w
+			seen := map[string]bool{}
+			i := sort.Search(len(reqs), func(i int) bool { return reqs[i].ts >= from })
+			if i < counted {
+				i = counted
+			}
+			for ; i < len(reqs) && reqs[i].ts <= to; i++ {
+				t := tallies[reqs[i].host]
+				if t == nil {
+					t = &tally{clients: map[string]bool{}}
+					tallies[reqs[i].host] = t
+				}
+				t.requests++
+				t.clients[client] = true
+				if !seen[reqs[i].host] {
+					seen[reqs[i].host] = true
+					t.visits++
+				}
+				counted = i + 1
+			}
+			start = end + 1
+		}
+	}
+
+	site := registrableDomain(strings.TrimPrefix(domain, "."))
+	for host, t := range tallies {
+		// Hosts whitelisted or blacklisted since they were logged need no suggestion
+		if list, _ := domainPolicy(host); list != "unknown" {
+			continue
+		}
+		support := float64(t.visits) / float64(report.Visits)
+		specificity := float64(t.requests) / float64(totals[host])
+		report.Suggestions = append(report.Suggestions, dependencySuggestion{
+			Domain:      host,
+			Display:     displayDomain(host),
+			Score:       round3(support * specificity),
+			Support:     round3(support),
+			Specificity: round3(specificity),
+			Visits:      t.visits,
+			Clients:     len(t.clients),
+			Requests:    t.requests,
+			Total:       totals[host],
+			SameSite:    registrableDomain(host) == site,
+		})
+	}
+	sort.Slice(report.Suggestions, func(i, j int) bool {
+		a, b := report.Suggestions[i], report.Suggestions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Visits != b.Visits {
+			return a.Visits > b.Visits
+		}
+		return a.Domain < b.Domain
+	})
+	if len(report.Suggestions) > limit {
+		report.Suggestions = report.Suggestions[:limit]
+	}
+	return report
+}
+
+func round3(f float64) float64 {
+	return math.Round(f*1000) / 1000
+}
+
+// parseWindowParam reads a time window as a Go duration ("30s") or whole seconds
+func parseWindowParam(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
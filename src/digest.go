@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Digest schedules
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+// digestConfig configures the email digest. It is read from SQUID_EDITOR_SMTP_* and
+// SQUID_EDITOR_DIGEST_* variables; the digest is sent only when a server and recipients are set.
+type digestConfig struct {
+	SMTPAddr  string // host:port; STARTTLS is used when the server offers it
+	Username  string // SMTP AUTH PLAIN user, empty for no authentication
+	Password  string
+	From      string
+	To        []string
+	Schedule  string // hourly or daily
+	Hour      int    // local hour of the daily digest
+	Subject   string // text/template for the subject line
+	Body      string // template for the body
+	HTML      bool   // the body template is HTML (a .html template file)
+	SendEmpty bool   // send even when nothing new was seen
+}
+
+// enabled reports whether digests can be mailed
+func (c *digestConfig) enabled() bool {
+	return c.SMTPAddr != "" && len(c.To) > 0
+}
+
+// period is the time covered by one scheduled digest
+func (c *digestConfig) period() time.Duration {
+	if c.Schedule == DigestHourly {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// nextRun returns when the next scheduled digest is due after now
+func (c *digestConfig) nextRun(now time.Time) time.Time {
+	if c.Schedule == DigestHourly {
+		return now.Truncate(time.Hour).Add(time.Hour)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), c.Hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+const defaultDigestSubject = `[squid] {{len .NewUnknown}} new unknown, {{len .Blocked}} blocked domains ({{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "15:04"}})`
+
+const defaultDigestBody = `Squid proxy digest for {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04 MST"}}
+
+{{.UnknownRequests}} requests to domains on neither list, {{.BlockedRequests}} blocked requests.
+{{- if .Truncated}}
+Only the newest log entries were counted; the period had more.
+{{- end}}
+
+New unknown domains ({{len .NewUnknown}}):
+{{- range .NewUnknown}}
+  {{printf "%6d" .Count}}  {{.Domain}}  ({{.Clients}} client{{if ne .Clients 1}}s{{end}})
+{{- else}}
+  none
+{{- end}}
+
+Other unknown domains still not on a list ({{len .Unknown}}):
+{{- range .Unknown}}
+  {{printf "%6d" .Count}}  {{.Domain}}
+{{- else}}
+  none
+{{- end}}
+
+Blocked domains ({{len .Blocked}}):
+{{- range .Blocked}}
+  {{printf "%6d" .Count}}  {{.Domain}}  ({{.Clients}} client{{if ne .Clients 1}}s{{end}})
+{{- else}}
+  none
+{{- end}}
+
+By client:
+{{- range .Clients}}
+  {{.ClientIP}}: {{.Count}} requests
+{{- range .Domains}}
+    {{printf "%6d" .Count}}  {{.Domain}} [{{.Tag}}]
+{{- end}}
+{{- else}}
+  none
+{{- end}}
+`
+
+// defaultDigestConfig is used for previews when nothing is configured
+func defaultDigestConfig() digestConfig {
+	return digestConfig{Schedule: DigestDaily, Hour: 8, Subject: defaultDigestSubject, Body: defaultDigestBody}
+}
+
+// digestConfigFromEnv reads the digest configuration
+func digestConfigFromEnv() (digestConfig, error) {
+	cfg := defaultDigestConfig()
+	cfg.SMTPAddr = os.Getenv("SQUID_EDITOR_SMTP_ADDR")
+	cfg.Username = os.Getenv("SQUID_EDITOR_SMTP_USERNAME")
+	cfg.Password = os.Getenv("SQUID_EDITOR_SMTP_PASSWORD")
+	cfg.From = envOr("SQUID_EDITOR_SMTP_FROM", "squid-editor@localhost")
+	for _, to := range strings.Split(os.Getenv("SQUID_EDITOR_DIGEST_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			cfg.To = append(cfg.To, to)
+		}
+	}
+	cfg.Schedule = envOr("SQUID_EDITOR_DIGEST_SCHEDULE", DigestDaily)
+	if cfg.Schedule != DigestHourly && cfg.Schedule != DigestDaily {
+		return cfg, fmt.Errorf("SQUID_EDITOR_DIGEST_SCHEDULE must be hourly or daily")
+	}
+	hour, err := strconv.Atoi(envOr("SQUID_EDITOR_DIGEST_HOUR", "8"))
+	if err != nil || hour < 0 || hour > 23 {
+		return cfg, fmt.Errorf("SQUID_EDITOR_DIGEST_HOUR must be 0-23")
+	}
+	cfg.Hour = hour
+	cfg.Subject = envOr("SQUID_EDITOR_DIGEST_SUBJECT", defaultDigestSubject)
+	if path := os.Getenv("SQUID_EDITOR_DIGEST_TEMPLATE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("digest template: %v", err)
+		}
+		cfg.Body, cfg.HTML = string(data), strings.HasSuffix(path, ".html")
+	}
+	cfg.SendEmpty = os.Getenv("SQUID_EDITOR_DIGEST_SEND_EMPTY") == "true"
+	if cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			return cfg, fmt.Errorf("SQUID_EDITOR_SMTP_ADDR must be host:port")
+		}
+	}
+	// Render a sample so template errors show at startup rather than at the first digest
+	if _, _, err := renderDigest(&cfg, &digestReport{Since: time.Now(), Until: time.Now()}); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// digestDomain is one domain's requests in a digest
+type digestDomain struct {
+	Domain  string `json:"domain"`
+	Tag     string `json:"tag"` // RG or BL
+	Count   int    `json:"count"`
+	Clients int    `json:"clients"`
+	URL     string `json:"url"` // latest URL requested
+}
+
+// digestClient is the unknown and blocked requests of one client
+type digestClient struct {
+	ClientIP string         `json:"client_ip"`
+	Count    int            `json:"count"`
+	Domains  []digestDomain `json:"domains"` // Clients is always 1
+}
+
+// digestReport is the data rendered by the digest templates
+type digestReport struct {
+	Since           time.Time      `json:"since"`
+	Until           time.Time      `json:"until"`
+	NewUnknown      []digestDomain `json:"new_unknown"` // first seen by the ingester in this period
+	Unknown         []digestDomain `json:"unknown"`     // seen before, still on neither list
+	Blocked         []digestDomain `json:"blocked"`
+	Clients         []digestClient `json:"clients"`
+	UnknownRequests int            `json:"unknown_requests"`
+	BlockedRequests int            `json:"blocked_requests"`
+	Truncated       bool           `json:"truncated"`
+}
+
+// empty reports whether the period had nothing worth mailing
+func (r *digestReport) empty() bool {
+	return len(r.NewUnknown) == 0 && len(r.Blocked) == 0
+}
+
+// buildDigestReport summarizes unknown and blocked requests in [since, until], grouped by
+// domain and by client and sorted by count. Unknown domains that have been put on a list
+// since are left out.
+func buildDigestReport(since, until time.Time) (*digestReport, error) {
+	seen, err := loadSeenDomains()
+	if err != nil {
+		return nil, err
+	}
+	report := &digestReport{Since: since, Until: until}
+	type counter struct {
+		domain  digestDomain
+		clients map[string]bool
+	}
+	domains := map[string]*counter{}
+	clients := map[string]map[string]*digestDomain{}
+	policy := map[string]string{} // host -> list it is on now
+	for _, tag := range []string{"RG", "BL"} {
+		lines, truncated := searchLogs(logQuery{Tag: tag, Since: since, Until: until, Limit: DigestMaxLogEntries})
+		report.Truncated = report.Truncated || truncated
+		for _, line := range lines {
+			entry, err := ParseLogEntry(line)
+			if err != nil || entry.Host == "" {
+				continue
+			}
+			if tag == "RG" {
+				list, ok := policy[entry.Host]
+				if !ok {
+					list, _ = domainPolicy(entry.Host)
+					policy[entry.Host] = list
+				}
+				if list != "unknown" {
+					continue
+				}
+				report.UnknownRequests++
+			} else {
+				report.BlockedRequests++
+			}
+			key := tag + " " + entry.Host
+			c := domains[key]
+			if c == nil {
+				c = &counter{domain: digestDomain{Domain: entry.Host, Tag: tag}, clients: map[string]bool{}}
+				domains[key] = c
+			}
+			c.domain.Count++
+			c.domain.URL = entry.URL
+			c.clients[entry.ClientIP] = true
+
+			if clients[entry.ClientIP] == nil {
+				clients[entry.ClientIP] = map[string]*digestDomain{}
+			}
+			d := clients[entry.ClientIP][key]
+			if d == nil {
+				d = &digestDomain{Domain: entry.Host, Tag: tag, Clients: 1}
+				clients[entry.ClientIP][key] = d
+			}
+			d.Count++
+			d.URL = entry.URL
+		}
+	}
+
+	for _, c := range domains {
+		c.domain.Clients = len(c.clients)
+		switch {
+		case c.domain.Tag == "BL":
+			report.Blocked = append(report.Blocked, c.domain)
+		default:
+			// Hosts the ingester has not caught up with yet are new as well
+			if first, ok := seen.hosts[c.domain.Domain]; !ok || !first.Before(since) {
+				report.NewUnknown = append(report.NewUnknown, c.domain)
+			} else {
+				report.Unknown = append(report.Unknown, c.domain)
+			}
+		}
+	}
+	for ip, byDomain := range clients {
+		client := digestClient{ClientIP: ip}
+		for _, d := range byDomain {
+			client.Count += d.Count
+			client.Domains = append(client.Domains, *d)
+		}
+		sortDigestDomains(client.Domains)
+		report.Clients = append(report.Clients, client)
+	}
+	sortDigestDomains(report.NewUnknown)
+	sortDigestDomains(report.Unknown)
+	sortDigestDomains(report.Blocked)
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.ClientIP < b.ClientIP
+	})
+	return report, nil
+}
+
+// sortDigestDomains orders by count, highest first, then by domain
+func sortDigestDomains(list []digestDomain) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return sortDomainsByParts(list[i].Domain, list[j].Domain)
+	})
+}
+
+// renderDigest renders the subject and body templates for a report
+func renderDigest(cfg *digestConfig, report *digestReport) (subject, body string, err error) {
+	subjectTmpl, err := template.New("subject").Parse(cfg.Subject)
+	if err != nil {
+		return "", "", fmt.Errorf("digest subject template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := subjectTmpl.Execute(&buf, report); err != nil {
+		return "", "", fmt.Errorf("digest subject template: %v", err)
+	}
+	subject = singleLine(buf.String(), 200)
+	buf.Reset()
+	if cfg.HTML {
+		tmpl, err := htmltemplate.New("body").Parse(cfg.Body)
+		if err == nil {
+			err = tmpl.Execute(&buf, report)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("digest template: %v", err)
+		}
+	} else {
+		tmpl, err := template.New("body").Parse(cfg.Body)
+		if err == nil {
+			err = tmpl.Execute(&buf, report)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("digest template: %v", err)
+		}
+	}
+	return subject, buf.String(), nil
+}
+
+// buildDigestMessage formats an RFC 5322 message with a quoted-printable UTF-8 body
+func buildDigestMessage(cfg *digestConfig, subject, body string, now time.Time) []byte {
+	contentType := "text/plain"
+	if cfg.HTML {
+		contentType = "text/html"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@squid-editor>\r\n", randomToken(12))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return msg.Bytes()
+}
+
+// sendDigestMail delivers a message to the configured recipients. Like smtp.SendMail it
+// upgrades to TLS when the server offers STARTTLS, but the whole session is time-limited.
+func sendDigestMail(cfg *digestConfig, msg []byte) error {
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", cfg.SMTPAddr, DigestSMTPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DigestSMTPTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		// PlainAuth refuses to send the password unencrypted except to localhost
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// digestState remembers the end of the last scheduled digest so restarts neither skip
+// nor repeat a period
+type digestState struct {
+	LastUntil   time.Time `json:"last_until"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSkipped bool      `json:"last_skipped,omitempty"` // nothing new, no mail sent
+}
+
+// digestStatePath returns the location of the digest schedule state
+func digestStatePath() string {
+	return filepath.Join(dataDir, "digest-state.json")
+}
+
+// digestMailer builds and sends digests on a schedule
+type digestMailer struct {
+	mu  sync.Mutex
+	cfg digestConfig
+}
+
+// digest is the process-wide digest mailer; main replaces it with the configured one
+var digest = newDigestMailer(defaultDigestConfig())
+
+func newDigestMailer(cfg digestConfig) *digestMailer {
+	return &digestMailer{cfg: cfg}
+}
+
+func (m *digestMailer) loadState() (digestState, error) {
+	var state digestState
+	data, err := os.ReadFile(digestStatePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse %s: %v", filepath.Base(digestStatePath()), err)
+	}
+	return state, nil
+}
+
+func (m *digestMailer) saveState(state digestState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(digestStatePath(), data, 0600)
+}
+
+// start sends scheduled digests in the background
+func (m *digestMailer) start() {
+	go func() {
+		for {
+			next := m.cfg.nextRun(time.Now())
+			time.Sleep(time.Until(next))
+			if err := m.runScheduled(time.Now()); err != nil {
+				fmt.Printf("Warning: digest: %v\n", err)
+			}
+		}
+	}()
+}
+
+// runScheduled sends the digest for the period since the last scheduled one (at most
+// one schedule period back). Empty digests are skipped unless SendEmpty is set.
+func (m *digestMailer) runScheduled(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	since := now.Add(-m.cfg.period())
+	if state.LastUntil.After(since) && state.LastUntil.Before(now) {
+		since = state.LastUntil
+	}
+	report, err := buildDigestReport(since, now)
+	if err == nil {
+		state.LastSkipped = report.empty() && !m.cfg.SendEmpty
+		if !state.LastSkipped {
+			err = m.send(report, now)
+		}
+	}
+	state.LastAttempt, state.LastError = now.UTC(), ""
+	if err != nil {
+		state.LastError = err.Error()
+	} else {
+		state.LastUntil = now.UTC()
+	}
+	if serr := m.saveState(state); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// send renders and mails a report
+func (m *digestMailer) send(report *digestReport, now time.Time) error {
+	if !m.cfg.enabled() {
+		return fmt.Errorf("digest is not configured: set SQUID_EDITOR_SMTP_ADDR and SQUID_EDITOR_DIGEST_TO")
+	}
+	subject, body, err := renderDigest(&m.cfg, report)
+	if err != nil {
+		return err
+	}
+	return sendDigestMail(&m.cfg, buildDigestMessage(&m.cfg, subject, body, now))
+}
+
+// status describes the configuration (without the SMTP password) and the last scheduled run
+func (m *digestMailer) status(now time.Time) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, err := m.loadState()
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]interface{}{
+		"enabled":    m.cfg.enabled(),
+		"schedule":   m.cfg.Schedule,
+		"recipients": m.cfg.To,
+		"smtp":       m.cfg.SMTPAddr,
+		"from":       m.cfg.From,
+		"html":       m.cfg.HTML,
+		"send_empty": m.cfg.SendEmpty,
+		"state":      state,
+	}
+	if m.cfg.enabled() {
+		status["next_run"] = m.cfg.nextRun(now)
+	}
+	return status, nil
+}
@@ -35,3 +35,9 @@ func readFileWithLimit(path string, maxSize int64) (string, error) {
 	}
 	return string(data), nil
 }
+
+// fileExists reports whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
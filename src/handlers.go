@@ -3,14 +3,19 @@ package main
 import (
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+var upgrader = websocket.Upgrader{CheckOrigin: checkSameOrigin}
 
 // noCacheMiddleware adds strict no-cache headers to all responses
 func noCacheMiddleware() gin.HandlerFunc {
@@ -24,30 +29,1343 @@ func noCacheMiddleware() gin.HandlerFunc {
 
 // registerRoutes sets up all HTTP routes
 func registerRoutes(r *gin.Engine) {
+	// Gin trusts every proxy unless told otherwise
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		panic("Invalid SQUID_EDITOR_TRUSTED_PROXIES: " + err.Error())
+	}
 	// Apply no-cache middleware to all routes
 	r.Use(noCacheMiddleware())
+	r.Use(metricsMiddleware())
+	r.Use(authMiddleware())
 	
 	r.Static("/static", "html")
-	r.POST("/clear-all-logs", handleClearAllLogs)
-	r.POST("/move-domain", handleMoveDomain)
-	r.GET("/", handleHome)
-	r.GET("/summary", handleSummary)
-	r.GET("/summary-data", handleSummaryData)
-	r.GET("/log", handleLog)
-	r.GET("/lists", handleLists)
+	r.GET("/login", handleLoginPage)
+	r.POST("/login", handleLogin)
+	r.GET("/login/oidc", handleOIDCLogin)
+	r.GET("/login/oidc/callback", handleOIDCCallback)
+	r.POST("/logout", handleLogout)
+	r.GET("/me", handleMe)
+	r.POST("/account/password", requireSession(), handleChangePassword)
+	r.GET("/tokens", requireSession(), handleListTokens)
+	r.POST("/tokens", requireSession(), handleCreateToken)
+	r.POST("/tokens/revoke", requireSession(), handleRevokeToken)
+	r.GET("/users", requirePermission(PermManageUsers), handleListUsers)
+	r.POST("/users", requirePermission(PermManageUsers), handleCreateUser)
+	r.POST("/users/role", requirePermission(PermManageUsers), handleSetUserRole)
+	r.POST("/users/delete", requirePermission(PermManageUsers), handleDeleteUser)
+	r.POST("/clear-all-logs", requirePermission(PermClearLogs), handleClearAllLogs)
+	r.POST("/rotate-logs", requirePermission(PermClearLogs), handleRotateLogs)
+	r.GET("/log-archives", requirePermission(PermView), handleListArchives)
+	r.GET("/log-archives/:id", requirePermission(PermView), handleDownloadArchive)
+	// handleMoveDomain and handleMoveDomains check whitelist/blacklist permissions per target
+	r.POST("/move-domain", requirePermission(PermView), handleMoveDomain)
+	r.POST("/move-domains", requirePermission(PermView), handleMoveDomains)
+	r.POST("/reload", requirePermission(PermReload), handleReload)
+	r.GET("/", requirePermission(PermView), handleHome)
+	r.GET("/summary", requirePermission(PermView), handleSummary)
+	r.GET("/summary-data", requirePermission(PermView), handleSummaryData)
+	r.GET("/log", requirePermission(PermView), handleLog)
+	r.GET("/log/search", requirePermission(PermView), handleLogSearch)
+	r.GET("/lists", requirePermission(PermView), handleLists)
+	r.GET("/entries", requirePermission(PermView), handleListEntries)
+	r.GET("/named-lists", requirePermission(PermView), handleNamedLists)
+	r.POST("/named-lists", requirePermission(PermLists), handleSaveNamedList)
+	r.POST("/named-lists/:name/delete", requirePermission(PermLists), handleDeleteNamedList)
+	r.GET("/profiles", requirePermission(PermView), handleListProfiles)
+	r.POST("/profiles", requirePermission(PermProfiles), handleSaveProfile)
+	r.POST("/profiles/:name/delete", requirePermission(PermProfiles), handleDeleteProfile)
+	r.GET("/profiles/:name/lists", requirePermission(PermView), handleProfileLists)
+	r.GET("/profiles/diff", requirePermission(PermView), handleProfileDiff)
+	r.POST("/profiles/promote", requirePermission(PermProfiles), handlePromote)
+	r.GET("/profiles/history", requirePermission(PermView), handlePromotionHistory)
+	r.POST("/metadata", requirePermission(PermView), handleSetMetadata)
+	r.GET("/evaluate", requirePermission(PermView), handleEvaluate)
+	r.GET("/dependencies", requirePermission(PermView), handleDependencies)
+	r.GET("/categories", requirePermission(PermView), handleCategories)
+	r.POST("/categories/reload", requirePermission(PermReload), handleReloadCategories)
+	r.POST("/categories/blacklist", requirePermission(PermBlacklist), handleBlacklistCategories)
+	r.GET("/metrics", requirePermission(PermMetrics), handleMetrics())
+	r.GET("/squid/health", requirePermission(PermView), handleSquidHealth)
+	r.GET("/squid/probe", handleSquidProbe)
+	r.GET("/squid/stats", requirePermission(PermView), handleSquidStats)
+	r.GET("/squid/stats/:report", requirePermission(PermView), handleSquidStatsReport)
+	r.GET("/api/v1/audit", requirePermission(PermAudit), handleAudit)
+	r.GET("/rules", requirePermission(PermView), handleListRules)
+	r.POST("/rules", requirePermission(PermRules), handleSaveRule)
+	r.POST("/rules/:id/delete", requirePermission(PermRules), handleDeleteRule)
+	r.GET("/rules/dry-run", requirePermission(PermView), handleRulesDryRun)
+	r.GET("/webhooks", requirePermission(PermWebhooks), handleListWebhooks)
+	r.POST("/webhooks", requirePermission(PermWebhooks), handleSaveWebhook)
+	r.POST("/webhooks/:id/delete", requirePermission(PermWebhooks), handleDeleteWebhook)
+	r.POST("/webhooks/:id/test", requirePermission(PermWebhooks), handleTestWebhook)
+	r.GET("/webhooks/deliveries", requirePermission(PermWebhooks), handleWebhookDeliveries)
+	r.GET("/digest", requirePermission(PermDigest), handleDigestStatus)
+	r.GET("/digest/preview", requirePermission(PermDigest), handleDigestPreview)
+	r.POST("/digest/send", requirePermission(PermDigest), handleDigestSend)
+	r.GET("/blocked", handleBlocked)
+	r.GET("/request-access", handleRequestAccessPage)
+	r.POST("/request-access", handleRequestAccess)
+	r.GET("/request-access/:id", handleRequestStatus)
+	// Approve and deny check whitelist permissions like /move-domain
+	r.GET("/access-requests", requirePermission(PermView), handleListAccessRequests)
+	r.POST("/access-requests/:id/approve", requirePermission(PermView), handleApproveAccessRequest)
+	r.POST("/access-requests/:id/deny", requirePermission(PermView), handleDenyAccessRequest)
+}
+
+// handleClearAllLogs moves log entries into a compressed archive and clears them from the live logs.
+// Optional form fields: category (whitelist/blacklist/regular), since/until (unix or RFC3339), reason
+func handleClearAllLogs(c *gin.Context) {
+	since, err := parseTimeParam(c.PostForm("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	until, err := parseTimeParam(c.PostForm("until"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	opts := clearOptions{
+		Category: strings.TrimSpace(c.PostForm("category")),
+		Since:    since,
+		Until:    until,
+		Reason:   strings.TrimSpace(c.PostForm("reason")),
+	}
+	if _, err := selectLogSources(opts.Category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+
+	archive, err := clearLogs(opts, time.Now())
+	category := opts.Category
+	if category == "" {
+		category = "all"
+	}
+	entry := AuditEntry{Action: AuditClearLogs, Note: opts.Reason, Target: category + " logs"}
+	entry.Result, entry.Error = auditResult(err)
+	if archive != nil {
+		entry.Target += ", archive " + archive.ID
+	}
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	status := "all logs cleared"
+	if (opts.Category != "" && opts.Category != "all") || !since.IsZero() || !until.IsZero() {
+		status = "logs cleared"
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "archive": archive})
+}
+
+// handleListArchives lists the log archives created by clearing logs
+func handleListArchives(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"archives": listLogArchives()})
+}
+
+// handleDownloadArchive sends one archive as a tar.gz attachment
+func handleDownloadArchive(c *gin.Context) {
+	id := c.Param("id")
+	if !archiveIDPattern.MatchString(id) || !fileExists(archivePath(id)) {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "archive not found"})
+		return
+	}
+	c.FileAttachment(archivePath(id), "squid-logs-"+id+".tar.gz")
+}
+
+// handleRotateLogs rotates all non-empty logs immediately
+func handleRotateLogs(c *gin.Context) {
+	segments, err := rotateLogs(time.Now(), true)
+	entry := AuditEntry{Action: AuditRotateLogs, Target: strings.Join(segments, ",")}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error(), "segments": segments})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "logs rotated", "segments": segments})
+}
+
+// handleLogSearch searches the live and rotated logs
+// Query parameters: q (substring), tag (WL/BL/RG), since/until (unix or RFC3339), limit
+func handleLogSearch(c *gin.Context) {
+	since, err := parseTimeParam(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	until, err := parseTimeParam(c.Query("until"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	limit := MaxSearchResults
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxSearchResults {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("limit must be between 1 and %d", MaxSearchResults)})
+			return
+		}
+		limit = n
+	}
+	lines, truncated := searchLogs(logQuery{
+		Text:  c.Query("q"),
+		Tag:   strings.ToUpper(c.Query("tag")),
+		Since: since,
+		Until: until,
+		Limit: limit,
+	})
+	c.JSON(http.StatusOK, gin.H{"lines": lines, "count": len(lines), "truncated": truncated})
+}
+
+// handleReload asks squid to reconfigure; the health checker then verifies squid still answers
+func handleReload(c *gin.Context) {
+	err := reloadSquid()
+	entry := AuditEntry{Action: AuditReload, Reload: reloadOutcome(err)}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "ERROR", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "RELOADED", "reload": health.snapshot().Reload})
+}
+
+// handleAudit returns audit log entries and whether the hash chain is intact.
+// Query parameters: actor, action (exact or prefix ending in "."), domain (substring),
+// result, since/until (unix or RFC3339), limit
+func handleAudit(c *gin.Context) {
+	since, err := parseTimeParam(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	until, err := parseTimeParam(c.Query("until"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	limit := MaxSearchResults
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxSearchResults {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("limit must be between 1 and %d", MaxSearchResults)})
+			return
+		}
+		limit = n
+	}
+	entries, truncated, chain, err := auditTrail.query(auditQuery{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Domain: c.Query("domain"),
+		Result: c.Query("result"),
+		Since:  since,
+		Until:  until,
+		Limit:  limit,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "count": len(entries), "truncated": truncated, "chain": chain})
+}
+
+// renderRequestPage renders html/request.html: the request form, or the status of a request
+func renderRequestPage(c *gin.Context, code int, req *AccessRequest, domain, message string) {
+	tmpl, err := template.ParseFiles("html/request.html")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "template error: %v", err)
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(code)
+	data := struct {
+		Request *AccessRequest
+		Domain  string
+		Error   string
+	}{Request: req, Domain: domain, Error: message}
+	if err := tmpl.Execute(c.Writer, data); err != nil {
+		c.String(http.StatusInternalServerError, "template exec error: %v", err)
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "application/json")
+}
+
+// handleListWebhooks lists webhooks with their secrets masked and the known events
+func handleListWebhooks(c *gin.Context) {
+	list, err := webhookConfig.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	out := make([]Webhook, 0, len(list))
+	for _, w := range list {
+		out = append(out, w.redacted())
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": out, "events": webhookEvents})
+}
+
+// handleSaveWebhook creates a webhook, or updates it when the JSON body has an id
+func handleSaveWebhook(c *gin.Context) {
+	var w Webhook
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	saved, err := webhookConfig.put(w)
+	entry := AuditEntry{Action: AuditWebhookSave, Target: w.Name + " " + w.URL}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "webhook": saved.redacted()})
+}
+
+// handleDeleteWebhook removes a webhook
+func handleDeleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+	err := webhookConfig.remove(id)
+	entry := AuditEntry{Action: AuditWebhookDelete, Target: id}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "id": id})
+}
+
+// handleTestWebhook queues a test event for one webhook, even when it is disabled
+func handleTestWebhook(c *gin.Context) {
+	w, err := webhookConfig.get(c.Param("id"))
+	if err != nil || w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "webhook not found"})
+		return
+	}
+	event := webhookEvent{
+		ID:   randomToken(9),
+		Type: EventTest,
+		Time: time.Now().UTC(),
+		Text: "test notification from the squid editor",
+		Data: map[string]string{"actor": c.GetString("username")},
+	}
+	id := webhooks.enqueue(*w, event)
+	c.JSON(http.StatusOK, gin.H{"status": "queued", "delivery_id": id})
+}
+
+// handleListRules lists the rules in evaluation order, the known actions and the
+// newest rule actions (?limit=N, default 100)
+func handleListRules(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > RuleHistorySize {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("limit must be between 1 and %d", RuleHistorySize)})
+			return
+		}
+		limit = n
+	}
+	list, err := ruleConfig.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	history, err := rulesEngine.history(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if list == nil {
+		list = []Rule{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": list, "actions": ruleActions, "history": history})
+}
+
+// handleSaveRule creates a rule, or updates it when the JSON body has an id
+func handleSaveRule(c *gin.Context) {
+	var r Rule
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	saved, err := ruleConfig.put(r)
+	entry := AuditEntry{Action: AuditRuleSave, Target: r.Name + " " + strings.Join(r.Actions, ",")}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "rule": saved})
+}
+
+// handleDeleteRule removes a rule
+func handleDeleteRule(c *gin.Context) {
+	id := c.Param("id")
+	err := ruleConfig.remove(id)
+	entry := AuditEntry{Action: AuditRuleDelete, Target: id}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "id": id})
+}
+
+// handleNamedLists returns every list in squid's order with its entry count
+func handleNamedLists(c *gin.Context) {
+	lists, err := listInfos()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lists": lists, "actions": []string{ListAllow, ListDeny}})
+}
+
+// handleSaveNamedList creates a named list or changes its action, priority and
+// description (JSON body) and reloads squid with the regenerated configuration
+func handleSaveNamedList(c *gin.Context) {
+	var d ListDef
+	if err := c.ShouldBindJSON(&d); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	d.BuiltIn, d.CreatedAt, d.CreatedBy = false, time.Time{}, ""
+	entry := AuditEntry{Action: AuditListSave, Target: fmt.Sprintf("%s %s %d", d.Name, d.Action, d.Priority)}
+	if err := d.validate(); err != nil {
+		entry.Result, entry.Error = AuditError, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	saved, changed, err := saveNamedList(d, auditActor(c), time.Now())
+	var reloadErr error
+	if err == nil && changed {
+		reloadErr = reloadSquid()
+		entry.Reload = reloadOutcome(reloadErr)
+	}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	response := gin.H{"status": "success", "list": saved}
+	if reloadErr != nil {
+		response["reload_error"] = reloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleDeleteNamedList removes a named list and reloads squid. A list holding entries
+// is only removed with force=true.
+func handleDeleteNamedList(c *gin.Context) {
+	name := c.Param("name")
+	d, err := listDefinitions.get(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if d == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "list not found"})
+		return
+	}
+	entry := AuditEntry{Action: AuditListDelete, Target: name}
+	if d.BuiltIn {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("the %s cannot be deleted", name)})
+		return
+	}
+	// Deleting drops the entries, which needs the list's edit permission
+	if !canEditList(c, name) {
+		err := fmt.Errorf("permission denied: cannot change %s", name)
+		entry.Result, entry.Error = AuditDenied, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	entries, err := deleteNamedList(name, c.Query("force") == "true" || c.PostForm("force") == "true")
+	if entries > 0 {
+		entry.Note = fmt.Sprintf("%d entries", entries)
+	}
+	if err != nil {
+		entry.Result, entry.Error = AuditError, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": err.Error(), "entries": entries})
+		return
+	}
+	reloadErr := reloadSquid()
+	entry.Result, entry.Reload = AuditSuccess, reloadOutcome(reloadErr)
+	recordAudit(c, entry)
+	response := gin.H{"status": "success", "name": name, "entries": entries}
+	if reloadErr != nil {
+		response["reload_error"] = reloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleListProfiles returns the profiles, the live one first
+func handleListProfiles(c *gin.Context) {
+	list, err := profiles.all()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profiles": list, "live": liveProfile})
+}
+
+// saveProfileRequest is the JSON body of POST /profiles
+type saveProfileRequest struct {
+	Profile
+	CopyFrom string `json:"copy_from,omitempty"` // profile whose lists a new profile starts with
+}
+
+// handleSaveProfile creates a profile or changes its description and container
+func handleSaveProfile(c *gin.Context) {
+	var req saveProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	entry := AuditEntry{Action: AuditProfileSave, Target: req.Name}
+	var copyFrom *Profile
+	if req.CopyFrom != "" {
+		p, err := profiles.get(req.CopyFrom)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+			return
+		}
+		if p == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("unknown profile %q", req.CopyFrom)})
+			return
+		}
+		copyFrom, entry.From = p, p.Name
+	}
+	req.Live, req.CreatedAt, req.CreatedBy = false, time.Time{}, ""
+	if err := req.Profile.validate(); err != nil {
+		entry.Result, entry.Error = AuditError, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	saved, err := profiles.put(req.Profile, copyFrom, auditActor(c), time.Now())
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "profile": saved})
+}
+
+// handleDeleteProfile removes a profile and its lists
+func handleDeleteProfile(c *gin.Context) {
+	name := c.Param("name")
+	if name == liveProfile {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "the live profile cannot be deleted"})
+		return
+	}
+	p, err := profiles.get(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if p == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "profile not found"})
+		return
+	}
+	err = profiles.remove(name)
+	entry := AuditEntry{Action: AuditProfileDelete, Target: name}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "name": name})
+}
+
+// profileParam looks up the profile named by a path or query parameter, answering the
+// request when there is none
+func profileParam(c *gin.Context, name string) *Profile {
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "profile is required"})
+		return nil
+	}
+	p, err := profiles.get(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return nil
+	}
+	if p == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": fmt.Sprintf("profile %s not found", name)})
+	}
+	return p
+}
+
+// handleProfileLists returns every list of a profile in squid's order with its content
+func handleProfileLists(c *gin.Context) {
+	p := profileParam(c, c.Param("name"))
+	if p == nil {
+		return
+	}
+	set, err := loadListSet(p.dir())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	lists := []namedListContent{}
+	for _, d := range set.defs {
+		lists = append(lists, namedListContent{ListDef: d, Content: readFile(listFileIn(set.dir, d.Name)), IP: readFile(listFileIn(set.dir, ipListFor(d.Name)))})
+	}
+	c.JSON(http.StatusOK, gin.H{"profile": p, "lists": lists, "metadata": set.meta})
+}
+
+// handleProfileDiff returns what promoting everything from one profile (from) to
+// another (to) would change
+func handleProfileDiff(c *gin.Context) {
+	from := profileParam(c, c.Query("from"))
+	if from == nil {
+		return
+	}
+	to := profileParam(c, c.Query("to"))
+	if to == nil {
+		return
+	}
+	diff, err := diffProfiles(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// handlePromote copies selected differences from one profile to another (JSON body)
+// and reloads the target's squid. Every promoted entry is audited; promotions to the
+// live profile also send list.changed webhooks.
+func handlePromote(c *gin.Context) {
+	var req promoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	from := profileParam(c, req.From)
+	if from == nil {
+		return
+	}
+	to := profileParam(c, req.To)
+	if to == nil {
+		return
+	}
+	target := from.Name + " -> " + to.Name
+	p, moves, err := promote(auditActor(c), from, to, req, time.Now())
+	if err != nil && len(moves) == 0 {
+		recordAudit(c, AuditEntry{Action: AuditPromote, Target: target, Result: AuditError, Error: err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	reload := ""
+	if p != nil {
+		reload = p.Reload
+		for _, name := range p.Lists {
+			recordAudit(c, AuditEntry{Action: AuditPromote, Target: target + " list " + name, Result: AuditSuccess})
+		}
+	}
+	for _, move := range moves {
+		entry := AuditEntry{Action: AuditPromote, Domain: move.Domain, From: move.From, To: move.To, Note: move.Note, Covered: move.Covered, Target: target, Result: AuditSuccess, Reload: reload}
+		if p == nil {
+			entry.Result, entry.Error, entry.Reload = AuditError, err.Error(), ""
+		}
+		recordAudit(c, entry)
+		if p != nil && to.Live {
+			notifyListChange(auditActor(c), move)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	response := gin.H{"status": "success", "promotion": p}
+	if len(moves) > 0 && moves[0].ReloadErr != nil {
+		response["reload_error"] = moves[0].ReloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handlePromotionHistory returns the newest promotions first (limit, default 50)
+func handlePromotionHistory(c *gin.Context) {
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > PromotionHistorySize {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("limit must be between 1 and %d", PromotionHistorySize)})
+			return
+		}
+		limit = n
+	}
+	list, err := loadPromotions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	out := []Promotion{}
+	for i := len(list) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, list[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"promotions": out})
+}
+
+// handleRulesDryRun shows what each rule would do with the unknown hosts of the live logs
+func handleRulesDryRun(c *gin.Context) {
+	list, err := ruleConfig.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, dryRunRules(mergeLogFiles(), list))
+}
+
+// handleWebhookDeliveries returns recent deliveries, newest first (?webhook=<id>&limit=N)
+func handleWebhookDeliveries(c *gin.Context) {
+	limit := WebhookDeliveryLogSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": webhooks.recent(c.Query("webhook"), limit)})
+}
+
+// handleDigestStatus shows the digest configuration and the last scheduled run
+func handleDigestStatus(c *gin.Context) {
+	status, err := digest.status(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// digestReportFor builds the report for since/until (unix or RFC3339) read by param,
+// defaulting to one schedule period up to now
+func digestReportFor(param func(string) string) (*digestReport, error) {
+	since, err := parseTimeParam(param("since"))
+	if err != nil {
+		return nil, err
+	}
+	until, err := parseTimeParam(param("until"))
+	if err != nil {
+		return nil, err
+	}
+	if until.IsZero() {
+		until = time.Now()
+	}
+	if since.IsZero() {
+		since = until.Add(-digest.cfg.period())
+	}
+	if !since.Before(until) {
+		return nil, fmt.Errorf("since must be before until")
+	}
+	return buildDigestReport(since, until)
+}
+
+// handleDigestPreview renders the digest without sending it
+func handleDigestPreview(c *gin.Context) {
+	report, err := digestReportFor(c.Query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	subject, body, err := renderDigest(&digest.cfg, report)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subject": subject, "body": body, "html": digest.cfg.HTML, "report": report})
+}
+
+// handleDigestSend mails a digest now, even when it is empty. It does not move the
+// scheduled digest's period.
+func handleDigestSend(c *gin.Context) {
+	report, err := digestReportFor(c.PostForm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	err = digest.send(report, time.Now())
+	entry := AuditEntry{Action: AuditDigestSend, Target: strings.Join(digest.cfg.To, ",")}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "recipients": digest.cfg.To, "since": report.Since, "until": report.Until})
+}
+
+// handleBlocked renders the block page squid redirects denied requests to
+// (deny_info with %u and %H). It explains why the host is blocked and links to an
+// access request, or to the pending one this client already filed.
+func handleBlocked(c *gin.Context) {
+	rawURL := c.Query("url")
+	host := strings.ToLower(strings.TrimSpace(c.Query("host")))
+	if host == "" {
+		host = extractDomain(rawURL)
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	list, entry := "unknown", ""
+	if host != "" {
+		list, entry = domainPolicy(host)
+	}
+	var pending *AccessRequest
+	if host != "" {
+		if reqs, err := accessRequests.list(RequestPending); err == nil {
+			for i := range reqs {
+				if reqs[i].Domain == host && reqs[i].ClientIP == c.ClientIP() {
+					pending = &reqs[i]
+					break
+				}
+			}
+		}
+	}
+	now := time.Now().UTC()
+	details := fmt.Sprintf("Blocked: %s\nURL: %s\nReason: %s\nClient: %s\nTime: %s",
+		host, rawURL, blockReason(list, entry), c.ClientIP(), now.Format(time.RFC3339))
+
+	tmpl, err := template.ParseFiles("html/blocked.html")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "template error: %v", err)
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusForbidden)
+	data := struct {
+		Host    string
+		URL     string
+		List    string
+		Reason  string
+		Pending *AccessRequest
+		Details string
+	}{host, rawURL, list, blockReason(list, entry), pending, details}
+	if err := tmpl.Execute(c.Writer, data); err != nil {
+		c.String(http.StatusInternalServerError, "template exec error: %v", err)
+	}
+}
+
+// blockReason explains a block page decision
+func blockReason(list, entry string) string {
+	switch list {
+	case "blacklist":
+		return fmt.Sprintf("blacklisted (%s)", entry)
+	case "whitelist":
+		return fmt.Sprintf("whitelisted (%s), but the request was refused, e.g. for its port", entry)
+	case "unknown":
+		return "not on the whitelist"
+	}
+	if listAction(list) == ListDeny {
+		return fmt.Sprintf("blocked by the %s list (%s)", list, entry)
+	}
+	return fmt.Sprintf("allowed by the %s list (%s), but the request was refused, e.g. for its port", list, entry)
+}
+
+// handleRequestAccessPage shows the public access request form (domain may be prefilled)
+func handleRequestAccessPage(c *gin.Context) {
+	renderRequestPage(c, http.StatusOK, nil, c.Query("domain"), "")
+}
+
+// handleRequestAccess files an access request. Form fields: domain, requester, justification.
+// It needs no login: users behind the proxy usually have no editor account.
+func handleRequestAccess(c *gin.Context) {
+	req, created, err := accessRequests.create(AccessRequest{
+		Domain:        c.PostForm("domain"),
+		Requester:     c.PostForm("requester"),
+		Justification: c.PostForm("justification"),
+		ClientIP:      c.ClientIP(),
+	}, time.Now())
+	if err != nil {
+		if wantsJSON(c) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+			return
+		}
+		renderRequestPage(c, http.StatusBadRequest, nil, c.PostForm("domain"), err.Error())
+		return
+	}
+	if created {
+		recordAudit(c, AuditEntry{Action: AuditRequest, Domain: req.Domain, To: "whitelist", Note: req.Justification,
+			Target: fmt.Sprintf("request %s from %s", req.ID, req.Requester), Result: AuditSuccess})
+	}
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"status": "success", "request": req, "status_url": "/request-access/" + req.ID})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/request-access/"+req.ID)
+}
+
+// handleRequestStatus shows a request's status to the requester. The random ID is the only key.
+func handleRequestStatus(c *gin.Context) {
+	req, err := accessRequests.get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if req == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "request not found"})
+		return
+	}
+	// Requesters see the outcome, not who decided it or from which address they asked
+	req.ClientIP, req.DecidedBy = "", ""
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"request": req})
+		return
+	}
+	renderRequestPage(c, http.StatusOK, req, req.Domain, "")
+}
+
+// handleListAccessRequests returns access requests, pending ones by default (?status=all for every request)
+func handleListAccessRequests(c *gin.Context) {
+	status := c.DefaultQuery("status", RequestPending)
+	if status == "all" {
+		status = ""
+	}
+	list, err := accessRequests.list(status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": list, "count": len(list)})
+}
+
+// pendingAccessRequest loads a request for a decision, writing the error response itself
+func pendingAccessRequest(c *gin.Context) *AccessRequest {
+	req, err := accessRequests.get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return nil
+	}
+	if req == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "request not found"})
+		return nil
+	}
+	if req.Status != RequestPending {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": "request is already " + req.Status})
+		return nil
+	}
+	for _, list := range moveLists("whitelist", domainLists(req.Domain)) {
+		if !canEditList(c, list) {
+			c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "permission denied: cannot change " + list})
+			return nil
+		}
+	}
+	return req
+}
+
+// handleApproveAccessRequest whitelists the requested domain through the same path as
+// /move-domain and marks the request approved. Optional form field: note (used as the list note).
+func handleApproveAccessRequest(c *gin.Context) {
+	req := pendingAccessRequest(c)
+	if req == nil {
+		return
+	}
+	note := strings.TrimSpace(c.PostForm("note"))
+	if warnings := domainWarnings(req.Domain); len(warnings) > 0 && c.PostForm("confirm") != "true" {
+		c.JSON(http.StatusConflict, gin.H{"status": "warning", "error": homographError, "domain": req.Domain, "display": displayDomain(req.Domain), "warnings": warnings})
+		return
+	}
+	move, err := moveDomain(auditActor(c), req.Domain, "whitelist", req.listNote(note))
+	entry := AuditEntry{Action: AuditApprove, Domain: req.Domain, To: "whitelist", Note: note, Target: "request " + req.ID}
+	if move != nil {
+		entry.From = move.From
+	}
+	if err != nil {
+		entry.Result, entry.Error = AuditError, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	entry.Reload = reloadOutcome(move.ReloadErr)
+	decided, err := accessRequests.decide(req.ID, RequestApproved, c.GetString("username"), note, time.Now())
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	notifyListChange(auditActor(c), move)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	response := gin.H{"status": "success", "request": decided}
+	if move.ReloadErr != nil {
+		response["reload_error"] = move.ReloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleDenyAccessRequest refuses a request. Optional form field: note (shown to the requester).
+func handleDenyAccessRequest(c *gin.Context) {
+	req := pendingAccessRequest(c)
+	if req == nil {
+		return
+	}
+	note := strings.TrimSpace(c.PostForm("note"))
+	decided, err := accessRequests.decide(req.ID, RequestDenied, c.GetString("username"), note, time.Now())
+	entry := AuditEntry{Action: AuditDeny, Domain: req.Domain, Note: note, Target: "request " + req.ID}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "request": decided})
+}
+
+// handleSquidHealth returns the current squid health, the last reload and the up/down history
+func handleSquidHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, health.snapshot())
+}
+
+// handleSquidProbe is the target the health checker fetches through squid
+func handleSquidProbe(c *gin.Context) {
+	c.String(http.StatusOK, probeBody)
+}
+
+// handleSquidStats returns all parsed cache manager reports
+func handleSquidStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cacheManager.allStats())
+}
+
+// handleSquidStatsReport returns one parsed cache manager report (info, 5min, utilization, fqdncache)
+func handleSquidStatsReport(c *gin.Context) {
+	name := c.Param("report")
+	known := false
+	for _, r := range cacheManagerReports {
+		known = known || r == name
+	}
+	if !known {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "unknown report: " + name})
+		return
+	}
+	report, err := cacheManager.report(name)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": name, "data": report})
+}
+
+// handleLoginPage serves the login form
+func handleLoginPage(c *gin.Context) {
+	renderLogin(c, http.StatusOK, "")
+}
+
+// renderLogin renders html/login.html with an optional error message
+func renderLogin(c *gin.Context, code int, message string) {
+	tmpl, err := template.ParseFiles("html/login.html")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "template error: %v", err)
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(code)
+	data := struct {
+		Error string
+		Next  string
+		SSO   bool
+	}{
+		Error: message,
+		Next:  safeRedirectTarget(c.Query("next")),
+		SSO:   oidc != nil,
+	}
+	if err := tmpl.Execute(c.Writer, data); err != nil {
+		c.String(http.StatusInternalServerError, "template exec error: %v", err)
+	}
 }
 
-// handleClearAllLogs clears all access logs (whitelist, blacklist, and regular)
-func handleClearAllLogs(c *gin.Context) {
-	err1 := writeFile(accessLogWhitelistPath, "")
-	err2 := writeFile(accessLogBlacklistPath, "")
-	err3 := writeFile(accessLogRegularPath, "")
-	
-	if err1 != nil || err2 != nil || err3 != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": fmt.Sprintf("errors: %v %v %v", err1, err2, err3)})
+// handleLogin checks the submitted credentials and starts a session
+func handleLogin(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	password := c.PostForm("password")
+	next := safeRedirectTarget(c.PostForm("next"))
+
+	u, ok := users.authenticate(username, password)
+	if !ok {
+		if strings.Contains(c.GetHeader("Accept"), "application/json") {
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "error", "error": "invalid username or password"})
+			return
+		}
+		c.Request.URL.RawQuery = "next=" + url.QueryEscape(next)
+		renderLogin(c, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	sess := sessions.create(u.Username, time.Now())
+	setSessionCookie(c, sess)
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, gin.H{"status": "success", "username": u.Username, "csrf_token": sess.CSRFToken})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+// handleLogout ends the current session
+func handleLogout(c *gin.Context) {
+	if sess := currentSession(c); sess != nil {
+		sessions.delete(sess.ID)
+	}
+	clearSessionCookie(c)
+	c.JSON(http.StatusOK, gin.H{"status": "logged out"})
+}
+
+// handleOIDCLogin redirects the browser to the identity provider. The state value
+// is also set in a short-lived cookie so a callback only completes in the browser
+// that started the login.
+func handleOIDCLogin(c *gin.Context) {
+	if oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "single sign-on is not configured"})
+		return
+	}
+	target, state, err := oidc.authURL(safeRedirectTarget(c.Query("next")), time.Now())
+	if err != nil {
+		renderLogin(c, http.StatusBadGateway, "Single sign-on is unavailable: "+err.Error())
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     OIDCStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(OIDCLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(c.Request),
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusFound, target)
+}
+
+// handleOIDCCallback completes single sign-on and starts the same session a local login does
+func handleOIDCCallback(c *gin.Context) {
+	if oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": "single sign-on is not configured"})
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: OIDCStateCookieName, Path: "/login/oidc", MaxAge: -1, HttpOnly: true})
+	if msg := c.Query("error"); msg != "" {
+		renderLogin(c, http.StatusUnauthorized, "Single sign-on failed: "+msg)
+		return
+	}
+	state := c.Query("state")
+	if cookie, err := c.Cookie(OIDCStateCookieName); err != nil || state == "" || cookie != state {
+		renderLogin(c, http.StatusBadRequest, "Single sign-on failed: login was not started in this browser")
+		return
+	}
+	id, next, err := oidc.exchange(c.Query("code"), state, time.Now())
+	if err != nil {
+		renderLogin(c, http.StatusUnauthorized, "Single sign-on failed: "+err.Error())
+		return
+	}
+	role, err := oidc.roleFor(id)
+	if err != nil {
+		renderLogin(c, http.StatusForbidden, err.Error())
+		return
+	}
+	u, err := users.upsertExternal(id.Username, "oidc", id.Subject, role)
+	if err != nil {
+		renderLogin(c, http.StatusForbidden, err.Error())
+		return
+	}
+	sess := sessions.create(u.Username, time.Now())
+	setSessionCookie(c, sess)
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+// handleListUsers lists local accounts without their password hashes
+func handleListUsers(c *gin.Context) {
+	list, err := users.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	out := make([]gin.H, 0, len(list))
+	for _, u := range list {
+		out = append(out, gin.H{"username": u.Username, "role": u.Role, "provider": u.Provider, "created_at": u.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"users": out, "roles": roleNames()})
+}
+
+// handleCreateUser adds a local account (role defaults to viewer)
+func handleCreateUser(c *gin.Context) {
+	role := strings.TrimSpace(c.PostForm("role"))
+	if role == "" {
+		role = RoleViewer
+	}
+	username := strings.TrimSpace(c.PostForm("username"))
+	u, err := users.create(username, c.PostForm("password"), role)
+	entry := AuditEntry{Action: AuditUserCreate, Target: username, To: role}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "username": u.Username, "role": u.Role})
+}
+
+// handleSetUserRole changes another account's role
+func handleSetUserRole(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	role := strings.TrimSpace(c.PostForm("role"))
+	if username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "you cannot change your own role"})
+		return
+	}
+	from := ""
+	if u, _ := users.get(username); u != nil {
+		from = u.Role
+	}
+	err := users.setRole(username, role)
+	entry := AuditEntry{Action: AuditUserRole, Target: username, From: from, To: role}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "username": username, "role": role})
+}
+
+// handleListTokens lists the caller's API tokens (all tokens for user managers)
+func handleListTokens(c *gin.Context) {
+	owner := c.GetString("username")
+	if hasPermission(c, PermManageUsers) && c.Query("all") == "1" {
+		owner = ""
+	}
+	list, err := tokens.list(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	for i := range list {
+		list[i].Hash = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": list})
+}
+
+// handleCreateToken issues an API token. Form fields: name, permission (repeated),
+// list (repeated, optional), expires_in_days (optional). The secret is shown only once.
+func handleCreateToken(c *gin.Context) {
+	perms := c.PostFormArray("permission")
+	for _, p := range perms {
+		if !hasPermission(c, p) {
+			c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": fmt.Sprintf("cannot grant %s: you do not hold it", p)})
+			return
+		}
+	}
+	tok := APIToken{
+		Name:        strings.TrimSpace(c.PostForm("name")),
+		Owner:       c.GetString("username"),
+		Permissions: perms,
+		Lists:       c.PostFormArray("list"),
+	}
+	if v := strings.TrimSpace(c.PostForm("expires_in_days")); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "expires_in_days must be a positive number"})
+			return
+		}
+		at := time.Now().UTC().Add(time.Duration(days) * 24 * time.Hour)
+		tok.ExpiresAt = &at
+	}
+	created, secret, err := tokens.create(tok)
+	entry := AuditEntry{Action: AuditTokenCreate, Target: tok.Name, To: strings.Join(perms, ",")}
+	if created != nil {
+		entry.Target = created.ID + " (" + created.Name + ")"
+	}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	created.Hash = ""
+	c.JSON(http.StatusOK, gin.H{"status": "success", "token": secret, "details": created})
+}
+
+// handleRevokeToken revokes one of the caller's tokens (any token for user managers)
+func handleRevokeToken(c *gin.Context) {
+	owner := c.GetString("username")
+	if hasPermission(c, PermManageUsers) {
+		owner = ""
+	}
+	id := strings.TrimSpace(c.PostForm("id"))
+	err := tokens.revoke(id, owner, time.Now())
+	entry := AuditEntry{Action: AuditTokenRevoke, Target: id}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "revoked", "id": id})
+}
+
+// handleMe returns the current user, role and permissions so the UI can hide unavailable actions
+func handleMe(c *gin.Context) {
+	role := c.GetString("role")
+	if !authEnabled {
+		role = RoleAdmin
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"username":    c.GetString("username"),
+		"role":        role,
+		"permissions": currentPermissions(c),
+	})
+}
+
+// handleDeleteUser removes a local account and ends its sessions
+func handleDeleteUser(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	if username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "you cannot delete your own account"})
+		return
+	}
+	err := users.remove(username)
+	entry := AuditEntry{Action: AuditUserDelete, Target: username}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	sessions.deleteUser(username)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "username": username})
+}
+
+// handleChangePassword changes the logged-in user's password after checking the current one
+func handleChangePassword(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "not logged in"})
+		return
+	}
+	if _, ok := users.authenticate(username, c.PostForm("current_password")); !ok {
+		recordAudit(c, AuditEntry{Action: AuditUserPassword, Target: username, Result: AuditDenied, Error: "current password is incorrect"})
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "current password is incorrect"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "all logs cleared"})
+	err := users.setPassword(username, c.PostForm("new_password"))
+	entry := AuditEntry{Action: AuditUserPassword, Target: username}
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
 }
 
 // handleHome serves the main page with whitelist/blacklist editor
@@ -63,10 +1381,16 @@ func handleHome(c *gin.Context) {
 	data := struct {
 		Whitelist string
 		Blacklist string
+		Username  string
+		CSRFToken string
 	}{
 		Whitelist: wl,
 		Blacklist: bl,
 	}
+	if sess := currentSession(c); sess != nil {
+		data.Username = sess.Username
+		data.CSRFToken = sess.CSRFToken
+	}
 	if err := tmpl.Execute(c.Writer, data); err != nil {
 		c.String(http.StatusInternalServerError, "template exec error: %v", err)
 	}
@@ -80,11 +1404,31 @@ func handleSummary(c *gin.Context) {
 	c.String(http.StatusOK, summary)
 }
 
-// handleSummaryData provides summary data as JSON for filtering
+// handleSummaryData provides summary data as JSON for filtering.
+// ?category=adult,news (repeatable) keeps the rows in those categories and
+// ?uncategorized=true the rows without one; "categories" counts the rows of every
+// category before filtering.
 func handleSummaryData(c *gin.Context) {
 	log := mergeLogFiles()
 	rows := computeSummaryRows(log)
-	c.JSON(http.StatusOK, gin.H{"rows": rows})
+	counts := countRowCategories(rows)
+	var filters []string
+	for _, v := range c.QueryArray("category") {
+		for _, f := range strings.Split(v, ",") {
+			if f = categoryName(f); f != "" {
+				filters = append(filters, f)
+			}
+		}
+	}
+	if uncategorized := c.Query("uncategorized") == "true"; len(filters) > 0 || uncategorized {
+		rows = filterRowsByCategory(rows, filters, uncategorized)
+	}
+	// ?group=registrable adds the rows rolled up by registrable domain
+	if c.Query("group") == "registrable" {
+		c.JSON(http.StatusOK, gin.H{"rows": rows, "groups": groupSummaryRows(rows), "categories": counts})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": rows, "categories": counts})
 }
 
 // handleLog provides live log tail
@@ -99,7 +1443,8 @@ func handleLog(c *gin.Context) {
 	c.String(http.StatusOK, tail)
 }
 
-// handleMoveDomain moves a domain between whitelist, blacklist, or unknown status
+// handleMoveDomain moves a domain between whitelist, blacklist, or unknown status.
+// Optional form fields tags (comma-separated), owner and ticket set the entry metadata.
 func handleMoveDomain(c *gin.Context) {
 	domain := strings.TrimSpace(c.PostForm("domain"))
 	target := strings.TrimSpace(c.PostForm("target"))
@@ -110,50 +1455,280 @@ func handleMoveDomain(c *gin.Context) {
 		return
 	}
 	
-	if target != "whitelist" && target != "blacklist" && target != "unknown" {
-		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "target must be whitelist, blacklist, or unknown"})
+	if target != "unknown" && !knownList(target) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "target must be whitelist, blacklist, a named list, or unknown"})
+		return
+	}
+	domain, err := listDomainFor(domain, target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	// Possible homographs are only listed once the caller confirms them
+	if warnings := domainWarnings(domain); target != "unknown" && len(warnings) > 0 && c.PostForm("confirm") != "true" {
+		c.JSON(http.StatusConflict, gin.H{"status": "warning", "error": homographError, "domain": domain, "display": displayDomain(domain), "warnings": warnings})
 		return
 	}
 	
-	// Read current whitelist and blacklist
-	whitelistContent := readFile(whitelistPath)
-	blacklistContent := readFile(blacklistPath)
-	
-	// Parse into slices
-	whitelistDomains := parseDomainList(whitelistContent)
-	blacklistDomains := parseDomainList(blacklistContent)
+	for _, list := range moveLists(target, domainLists(domain)) {
+		if !canEditList(c, list) {
+			err := fmt.Errorf("permission denied: cannot change %s", list)
+			recordAudit(c, AuditEntry{Action: AuditMoveDomain, Domain: domain, To: target, Note: note, Result: AuditDenied, Error: err.Error()})
+			c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": err.Error()})
+			return
+		}
+	}
 	
-	// Remove domain from both lists first (strip any existing notes when removing)
-	whitelistDomains = removeDomainFromList(whitelistDomains, domain)
-	blacklistDomains = removeDomainFromList(blacklistDomains, domain)
+	meta, err := entryMetaFields(splitTags(c.PostForm("tags")), c.PostForm("owner"), c.PostForm("ticket"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	moves, err := commitDomainMoves(auditActor(c), []DomainEntry{{Domain: domain, Note: note, Meta: meta}}, target, func(e AuditEntry) { recordAudit(c, e) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	move := moves[0]
 	
-	// Add to target list if not unknown
-	switch target {
-	case "whitelist":
-		entry := domain
-		if note != "" {
-			entry = fmt.Sprintf("%s #%s", domain, note)
+	response := gin.H{"status": "success", "domain": domain, "display": displayDomain(domain), "target": target, "from": move.From, "covered": move.Covered, "overlaps": move.Overlaps}
+	if move.ReloadErr != nil {
+		response["reload_error"] = move.ReloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// homographError explains the 409 returned for domains that may imitate another one
+const homographError = "domain may be mistaken for another one; resend with confirm to add it anyway"
+
+// bulkMoveRequest is the JSON body of POST /move-domains
+type bulkMoveRequest struct {
+	Target  string           `json:"target"`
+	Domains []bulkMoveDomain `json:"domains"`
+	Confirm bool             `json:"confirm,omitempty"` // add domains with homograph warnings anyway
+}
+
+// bulkMoveDomain is one domain of a bulk move, with an optional list note and metadata
+type bulkMoveDomain struct {
+	Domain string   `json:"domain"`
+	Note   string   `json:"note,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Owner  string   `json:"owner,omitempty"`
+	Ticket string   `json:"ticket,omitempty"`
+}
+
+// handleMoveDomains moves several domains to one target with a single squid reload.
+// Nothing is changed when the caller may not edit a list involved for any of them.
+func handleMoveDomains(c *gin.Context) {
+	var req bulkMoveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	if req.Target != "unknown" && !knownList(req.Target) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "target must be whitelist, blacklist, a named list, or unknown"})
+		return
+	}
+	if len(req.Domains) == 0 || len(req.Domains) > MaxBulkMove {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("domains must list 1 to %d domains", MaxBulkMove)})
+		return
+	}
+	entries := make([]DomainEntry, 0, len(req.Domains))
+	seen := make(map[string]bool)
+	for _, d := range req.Domains {
+		domain := strings.TrimSpace(d.Domain)
+		if domain == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "domain is required"})
+			return
 		}
-		whitelistDomains = append(whitelistDomains, entry)
-	case "blacklist":
-		entry := domain
-		if note != "" {
-			entry = fmt.Sprintf("%s #%s", domain, note)
+		domain, err := listDomainFor(domain, req.Target)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error(), "domain": d.Domain})
+			return
+		}
+		if seen[domain] {
+			continue
 		}
-		blacklistDomains = append(blacklistDomains, entry)
-	// "unknown" means just remove from both lists (already done above)
+		seen[domain] = true
+		meta, err := entryMetaFields(d.Tags, d.Owner, d.Ticket)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error(), "domain": d.Domain})
+			return
+		}
+		entries = append(entries, DomainEntry{Domain: domain, Note: singleLine(d.Note, MaxJustificationLength), Meta: meta})
 	}
-	
-	// Write using centralized functions
-	err1 := writeDomainList("whitelist", whitelistDomains)
-	err2 := writeDomainList("blacklist", blacklistDomains)
-	
-	if err1 != nil || err2 != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": fmt.Sprintf("write error: %v %v", err1, err2)})
+
+	if req.Target != "unknown" && !req.Confirm {
+		warnings := make(map[string][]string)
+		for _, e := range entries {
+			if w := domainWarnings(e.Domain); len(w) > 0 {
+				warnings[e.Domain] = w
+			}
+		}
+		if len(warnings) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"status": "warning", "error": homographError, "warnings": warnings})
+			return
+		}
+	}
+
+	var denied []string
+	for _, e := range entries {
+		for _, list := range moveLists(req.Target, domainLists(e.Domain)) {
+			if !canEditList(c, list) {
+				err := fmt.Errorf("permission denied: cannot change %s", list)
+				recordAudit(c, AuditEntry{Action: AuditMoveDomain, Domain: e.Domain, To: req.Target, Note: e.Note, Result: AuditDenied, Error: err.Error()})
+				denied = append(denied, e.Domain)
+				break
+			}
+		}
+	}
+	if len(denied) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": "permission denied", "denied": denied})
 		return
 	}
-	
-	c.JSON(http.StatusOK, gin.H{"status": "success", "domain": domain, "target": target})
+
+	moves, err := commitDomainMoves(auditActor(c), entries, req.Target, func(e AuditEntry) { recordAudit(c, e) })
+	moved := make([]gin.H, 0, len(moves))
+	for _, move := range moves {
+		moved = append(moved, gin.H{"domain": move.Domain, "display": displayDomain(move.Domain), "from": move.From, "to": move.To, "covered": move.Covered, "overlaps": move.Overlaps})
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	response := gin.H{"status": "success", "target": req.Target, "moved": moved}
+	if len(moves) > 0 && moves[0].ReloadErr != nil {
+		response["reload_error"] = moves[0].ReloadErr.Error()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleEvaluate reports which list decides a host (or URL) and whether squid allows it
+func handleEvaluate(c *gin.Context) {
+	host := strings.ToLower(extractDomain(c.Query("host")))
+	if host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "host is required"})
+		return
+	}
+	host, err := toListDomain(host)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	list, entry := domainPolicy(host)
+	c.JSON(http.StatusOK, gin.H{"host": host, "display": displayDomain(host), "list": list, "entry": entry, "action": policyAction(list)})
+}
+
+// handleDependencies suggests unknown hosts that clients requested together with a domain.
+// Query parameters: domain (required, ".example.com" includes subdomains), window (seconds
+// or a duration such as "30s"), limit. The suggestions can be whitelisted with /move-domains.
+func handleDependencies(c *gin.Context) {
+	domain, err := normalizeListDomain(c.Query("domain"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	window, err := parseWindowParam(c.Query("window"), DependencyWindow)
+	if err != nil || window <= 0 || window > MaxDependencyWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("window must be between 1s and %s", MaxDependencyWindow)})
+		return
+	}
+	limit := DependencySuggestions
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxDependencySuggestions {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("limit must be between 1 and %d", MaxDependencySuggestions)})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, findDependencies(mergeLogFiles(), domain, window, limit))
+}
+
+// handleCategories reports the loaded category datasets and the blacklisted categories
+func handleCategories(c *gin.Context) {
+	status, err := categories.status()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// handleReloadCategories rereads the category datasets (after updating them on disk)
+// and regenerates the category blacklist
+func handleReloadCategories(c *gin.Context) {
+	entry := AuditEntry{Action: AuditCategoryLoad}
+	err := categories.load()
+	var reloaded bool
+	if err == nil {
+		reloaded, err = refreshCategoryBlacklist()
+	}
+	entry.Result, entry.Error = auditResult(err)
+	if reloaded {
+		entry.Reload = reloadOutcome(err)
+	}
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	status, err := categories.status()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// categoryBlacklistRequest is the JSON body of POST /categories/blacklist
+type categoryBlacklistRequest struct {
+	Categories []string `json:"categories"` // the complete set of blacklisted categories
+}
+
+// handleBlacklistCategories sets the categories squid blocks entirely. Every domain of
+// those categories is blacklisted unless the whitelist holds it.
+func handleBlacklistCategories(c *gin.Context) {
+	var req categoryBlacklistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	blacklist := []string{}
+	for _, name := range req.Categories {
+		name = categoryName(name)
+		if name == "" || containsString(blacklist, name) {
+			continue
+		}
+		if !categories.knows(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("unknown category %q", name)})
+			return
+		}
+		blacklist = append(blacklist, name)
+	}
+	sort.Strings(blacklist)
+
+	entry := AuditEntry{Action: AuditCategories, Target: strings.Join(blacklist, ",")}
+	err := saveCategoryConfig(categoryConfig{Blacklist: blacklist})
+	var reloaded bool
+	if err == nil {
+		reloaded, err = refreshCategoryBlacklist()
+	}
+	entry.Result, entry.Error = auditResult(err)
+	if reloaded {
+		entry.Reload = reloadOutcome(err)
+	}
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	status, err := categories.status()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
 }
 
 // parseDomainList parses a domain list content into a slice of domains
@@ -181,12 +1756,132 @@ func removeDomainFromList(domains []string, target string) []string {
 	return result
 }
 
-// handleLists returns the current whitelist and blacklist content as JSON
+// namedListContent is a named list with its file contents, as returned by GET /lists
+type namedListContent struct {
+	ListDef
+	Content string `json:"content"`
+	IP      string `json:"ip"`
+}
+
+// handleLists returns the current whitelist and blacklist content as JSON. IP addresses
+// and ranges are returned separately as whitelist_ip and blacklist_ip; named lists are
+// returned in squid's order as lists.
 func handleLists(c *gin.Context) {
+	meta, err := loadListMetadata()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
 	wl := readFile(whitelistPath)
 	bl := readFile(blacklistPath)
+	named := []namedListContent{}
+	domainLines := append(parseDomainList(wl), parseDomainList(bl)...)
+	for _, d := range orderedLists() {
+		if !d.BuiltIn {
+			content := readFile(namedListPath(d.Name))
+			named = append(named, namedListContent{ListDef: d, Content: content, IP: readFile(namedListPath(ipListFor(d.Name)))})
+			domainLines = append(domainLines, parseDomainList(content)...)
+		}
+	}
+	// unicode maps the punycode entries of every list to their Unicode form for display
+	unicodeForms := make(map[string]string)
+	for _, line := range domainLines {
+		d := parseDomainEntry(line).Domain
+		if display := displayDomain(d); display != "" {
+			unicodeForms[d] = display
+		}
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"whitelist": wl,
-		"blacklist": bl,
+		"whitelist":    wl,
+		"blacklist":    bl,
+		"whitelist_ip": readFile(whitelistIPPath),
+		"blacklist_ip": readFile(blacklistIPPath),
+		"lists":        named,
+		"unicode":      unicodeForms,
+		"metadata":     meta,
 	})
 }
+
+// handleListEntries returns the list entries with their metadata. Query parameters: list,
+// tag (repeatable or comma-separated; entries must carry all of them), owner, and
+// group=tag to add the entries grouped by tag.
+func handleListEntries(c *gin.Context) {
+	q := entryQuery{List: c.Query("list"), Owner: strings.TrimSpace(c.Query("owner"))}
+	if q.List != "" && !knownList(q.List) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("unknown list %q", q.List)})
+		return
+	}
+	var tags []string
+	for _, v := range c.QueryArray("tag") {
+		tags = append(tags, splitTags(v)...)
+	}
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	q.Tags = tags
+	entries, err := listEntries(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if c.Query("group") == "tag" {
+		c.JSON(http.StatusOK, gin.H{"entries": entries, "groups": groupEntriesByTag(entries)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// metadataRequest is the JSON body of POST /metadata
+type metadataRequest struct {
+	List   string   `json:"list"`
+	Domain string   `json:"domain"`
+	Tags   []string `json:"tags"`
+	Owner  string   `json:"owner"`
+	Ticket string   `json:"ticket"`
+}
+
+// handleSetMetadata replaces the tags, owner and ticket of a list entry. The squid lists
+// are not written, so squid is not reloaded.
+func handleSetMetadata(c *gin.Context) {
+	var req metadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": "invalid JSON: " + err.Error()})
+		return
+	}
+	if !knownList(req.List) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": fmt.Sprintf("unknown list %q", req.List)})
+		return
+	}
+	domain, err := listDomainFor(strings.TrimSpace(req.Domain), req.List)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	fields := EntryMeta{Tags: req.Tags, Owner: req.Owner, Ticket: req.Ticket}
+	if err := fields.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	if !containsString(domainLists(domain), req.List) {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "error": fmt.Sprintf("%s is not on the %s", domain, req.List)})
+		return
+	}
+	entry := AuditEntry{Action: AuditMetadata, Domain: domain, To: req.List, Note: describeMetadata(fields)}
+	if !canEditList(c, req.List) {
+		err := fmt.Errorf("permission denied: cannot change %s", req.List)
+		entry.Result, entry.Error = AuditDenied, err.Error()
+		recordAudit(c, entry)
+		c.JSON(http.StatusForbidden, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	meta, err := setEntryMetadata(req.List, domain, auditActor(c), fields, time.Now())
+	entry.Result, entry.Error = auditResult(err)
+	recordAudit(c, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "list": req.List, "domain": domain, "metadata": meta})
+}
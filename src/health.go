@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeBody is returned by /squid/probe so a proxied probe can tell the editor's
+// answer apart from a squid error page
+const probeBody = "squid-editor-probe-ok"
+
+// healthProbe is the outcome of one squid health check
+type healthProbe struct {
+	TCP     bool
+	Proxy   bool
+	Latency time.Duration
+	Err     error
+}
+
+// healthTransition records squid changing between UP and DOWN
+type healthTransition struct {
+	At        time.Time `json:"at"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// reloadRecord tracks the most recent reload and whether squid answered after it
+type reloadRecord struct {
+	At         time.Time  `json:"at"`
+	Error      string     `json:"error,omitempty"`
+	Verified   bool       `json:"verified"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+// healthStatus is the JSON view of the checker state served on /squid/health
+type healthStatus struct {
+	Status    string             `json:"status"` // UP, DOWN or UNKNOWN before the first check
+	TCP       bool               `json:"tcp"`
+	Proxy     bool               `json:"proxy"`
+	LatencyMs int64              `json:"latency_ms"`
+	LastCheck time.Time          `json:"last_check"`
+	Since     time.Time          `json:"since"`
+	Error     string             `json:"error,omitempty"`
+	Reload    *reloadRecord      `json:"reload,omitempty"`
+	History   []healthTransition `json:"history"`
+}
+
+// squidHealthChecker periodically probes squid and keeps a history of up/down transitions
+type squidHealthChecker struct {
+	mu      sync.Mutex
+	state   healthStatus
+	probe   func() healthProbe
+	trigger chan struct{}
+}
+
+// health is the process-wide squid health checker
+var health = newSquidHealthChecker(probeSquid)
+
+func newSquidHealthChecker(probe func() healthProbe) *squidHealthChecker {
+	return &squidHealthChecker{
+		state:   healthStatus{Status: "UNKNOWN", History: []healthTransition{}},
+		probe:   probe,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// start runs checks every interval, or sooner when a reload asks for verification
+func (h *squidHealthChecker) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			h.checkOnce()
+			select {
+			case <-ticker.C:
+			case <-h.trigger:
+			}
+		}
+	}()
+}
+
+// checkOnce runs a probe and records the result
+func (h *squidHealthChecker) checkOnce() {
+	started := time.Now()
+	result := h.probe()
+	if t := h.record(started, result); t != nil && (t.To == "DOWN" || t.From == "DOWN") {
+		event, text := EventSquidUp, "squid is UP again"
+		if t.To == "DOWN" {
+			event, text = EventSquidDown, "squid is DOWN: "+t.Error
+		}
+		webhooks.notify(event, text, map[string]string{
+			"from":       t.From,
+			"to":         t.To,
+			"error":      t.Error,
+			"latency_ms": fmt.Sprint(t.LatencyMs),
+		})
+	}
+}
+
+// record stores a probe result, appending a transition when the status changed
+// and verifying a pending reload that happened before the probe started.
+// It returns the transition, if any.
+func (h *squidHealthChecker) record(started time.Time, result healthProbe) *healthTransition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := "DOWN"
+	if result.TCP && result.Proxy {
+		status = "UP"
+	}
+	errText := ""
+	if result.Err != nil {
+		errText = result.Err.Error()
+	}
+	var transition *healthTransition
+	if status != h.state.Status {
+		transition = &healthTransition{
+			At:        started,
+			From:      h.state.Status,
+			To:        status,
+			LatencyMs: result.Latency.Milliseconds(),
+			Error:     errText,
+		}
+		h.state.History = append(h.state.History, *transition)
+		if len(h.state.History) > HealthHistorySize {
+			h.state.History = h.state.History[len(h.state.History)-HealthHistorySize:]
+		}
+		h.state.Since = started
+	}
+	h.state.Status = status
+	h.state.TCP = result.TCP
+	h.state.Proxy = result.Proxy
+	h.state.LatencyMs = result.Latency.Milliseconds()
+	h.state.LastCheck = started
+	h.state.Error = errText
+
+	if r := h.state.Reload; status == "UP" && r != nil && !r.Verified && r.Error == "" && !started.Before(r.At) {
+		at := started
+		r.Verified = true
+		r.VerifiedAt = &at
+	}
+	return transition
+}
+
+// recordReload marks a reload as unverified until squid answers a later probe
+func (h *squidHealthChecker) recordReload(at time.Time, err error) {
+	h.mu.Lock()
+	rec := &reloadRecord{At: at}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.state.Reload = rec
+	h.mu.Unlock()
+
+	if err == nil {
+		select {
+		case h.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// snapshot returns a copy of the current state
+func (h *squidHealthChecker) snapshot() healthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.state
+	s.History = make([]healthTransition, len(h.state.History))
+	copy(s.History, h.state.History)
+	if h.state.Reload != nil {
+		r := *h.state.Reload
+		s.Reload = &r
+	}
+	return s
+}
+
+// isUp reports whether the last probe succeeded
+func (h *squidHealthChecker) isUp() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state.Status == "UP"
+}
+
+// probeSquid checks the squid port and then fetches the editor's probe page through squid
+func probeSquid() healthProbe {
+	start := time.Now()
+	if squidStatus() != "UP" {
+		return healthProbe{Latency: time.Since(start), Err: fmt.Errorf("squid port %s is not accepting connections", SquidPort)}
+	}
+	result := healthProbe{TCP: true}
+	result.Err = probeSquidProxy("http://"+squidAddress(), SquidProbeURL, HealthProbeTimeout)
+	result.Proxy = result.Err == nil
+	result.Latency = time.Since(start)
+	return result
+}
+
+// probeSquidProxy performs a real proxied GET of target through the proxy and checks the answer
+func probeSquidProxy(proxy, target string, timeout time.Duration) error {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return fmt.Errorf("proxied probe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), probeBody) {
+		return fmt.Errorf("proxied probe returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile maps and validates hosts the way browsers look them up (UTS #46, nontransitional),
+// but allows underscores, which squid and real hostnames accept
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.Transitional(false), idna.StrictDomainName(false))
+
+// idnaDisplay converts punycode back to Unicode for display
+var idnaDisplay = idna.New(idna.Transitional(false))
+
+// toASCIIDomain converts a host or list entry to the lowercase punycode form squid matches
+// against. A leading "." (subdomain wildcard) is kept.
+func toASCIIDomain(domain string) (string, error) {
+	wildcard := strings.HasPrefix(domain, ".")
+	host := strings.TrimPrefix(domain, ".")
+	ascii, err := idnaProfile.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized domain %q: %v", domain, err)
+	}
+	if wildcard {
+		ascii = "." + ascii
+	}
+	return ascii, nil
+}
+
+// toUnicodeDomain returns the Unicode form of a punycode host, or the host unchanged
+// when it has no valid punycode labels
+func toUnicodeDomain(domain string) string {
+	if !strings.Contains(domain, "xn--") {
+		return domain
+	}
+	wildcard := strings.HasPrefix(domain, ".")
+	display, err := idnaDisplay.ToUnicode(strings.TrimPrefix(domain, "."))
+	if err != nil {
+		return domain
+	}
+	if wildcard {
+		display = "." + display
+	}
+	return display
+}
+
+// displayDomain returns the Unicode form when it differs from the stored form, else ""
+func displayDomain(domain string) string {
+	if d := toUnicodeDomain(domain); d != domain {
+		return d
+	}
+	return ""
+}
+
+// idnAlternate returns the other form of a search term (punycode for Unicode input,
+// Unicode for punycode input), or "" when there is none
+func idnAlternate(term string) string {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return ""
+	}
+	var alt string
+	if isASCII(term) {
+		alt = toUnicodeDomain(term)
+	} else if a, err := toASCIIDomain(term); err == nil {
+		alt = a
+	}
+	if alt == term {
+		return ""
+	}
+	return alt
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptTables are the scripts homograph checks tell apart
+var scriptTables = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Hebrew", unicode.Hebrew},
+	{"Arabic", unicode.Arabic},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul},
+	{"Bopomofo", unicode.Bopomofo},
+	{"Thai", unicode.Thai},
+	{"Devanagari", unicode.Devanagari},
+	{"Georgian", unicode.Georgian},
+	{"Cherokee", unicode.Cherokee},
+}
+
+// allowedScriptMixes are combinations that are normal in one label (as in Chrome's IDN policy)
+var allowedScriptMixes = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// latinLookalikes maps Cyrillic, Greek and other letters to the Latin letter they are
+// easily mistaken for
+var latinLookalikes = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k',
+	'ӏ': 'l', 'м': 'm', 'п': 'n', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'т': 't', 'ц': 'u',
+	'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ɡ': 'g',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'γ': 'y',
+	// Armenian and Cherokee
+	'օ': 'o', 'ս': 'u', 'հ': 'h', 'Ꭺ': 'a', 'Ꭼ': 'e',
+}
+
+// labelScripts returns the scripts of the letters in a label, sorted
+func labelScripts(label string) []string {
+	seen := map[string]bool{}
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		name := "Other"
+		for _, s := range scriptTables {
+			if unicode.Is(s.table, r) {
+				name = s.name
+				break
+			}
+		}
+		seen[name] = true
+	}
+	scripts := make([]string, 0, len(seen))
+	for s := range seen {
+		scripts = append(scripts, s)
+	}
+	sort.Strings(scripts)
+	return scripts
+}
+
+// scriptsAllowed reports whether a set of scripts may share a label
+func scriptsAllowed(scripts []string) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+	for _, mix := range allowedScriptMixes {
+		ok := true
+		for _, s := range scripts {
+			if !containsString(mix, s) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// domainWarnings explains why an internationalized domain could be a homograph of
+// another one: labels mixing scripts, or labels made only of letters that look Latin.
+// ASCII domains never get warnings.
+func domainWarnings(domain string) []string {
+	display := strings.TrimPrefix(toUnicodeDomain(domain), ".")
+	if isASCII(display) {
+		return nil
+	}
+	var warnings []string
+	for _, label := range strings.Split(display, ".") {
+		if isASCII(label) {
+			continue
+		}
+		scripts := labelScripts(label)
+		if !scriptsAllowed(scripts) {
+			warnings = append(warnings, fmt.Sprintf("%q mixes %s scripts", label, strings.Join(scripts, " and ")))
+		}
+		var skeleton strings.Builder
+		lookalike := true
+		for _, r := range label {
+			if l, ok := latinLookalikes[r]; ok {
+				skeleton.WriteRune(l)
+			} else if r < utf8.RuneSelf {
+				skeleton.WriteRune(r)
+			} else {
+				lookalike = false
+				break
+			}
+		}
+		if lookalike {
+			warnings = append(warnings, fmt.Sprintf("%q looks like the Latin %q", label, skeleton.String()))
+		}
+	}
+	return warnings
+}
+
+// toListDomain returns the form of a domain stored in the squid lists: ASCII domains
+// unchanged, internationalized ones as lowercase punycode
+func toListDomain(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	return toASCIIDomain(domain)
+}
+
+// asciiListLine converts the domain of a list line to punycode, keeping its note.
+// Lines whose domain cannot be converted are kept as they are.
+func asciiListLine(line string) string {
+	if isASCII(line) {
+		return line
+	}
+	e := parseDomainEntry(line)
+	domain, err := toListDomain(e.Domain)
+	if err != nil || domain == e.Domain {
+		return line
+	}
+	if e.Note != "" {
+		return domain + " #" + e.Note
+	}
+	return domain
+}
+
+// normalizeDomainLists rewrites list entries typed in Unicode (by hand or by older
+// versions) to punycode and reloads squid when anything changed
+func normalizeDomainLists() error {
+	if err := listMu.Lock(); err != nil {
+		return err
+	}
+	defer listMu.Unlock()
+	changed := false
+	for _, l := range orderedLists() {
+		path, _ := listPath(l.Name)
+		domains := parseDomainList(readFile(path))
+		converted := false
+		for _, line := range domains {
+			if asciiListLine(line) != line {
+				converted = true
+				break
+			}
+		}
+		if !converted {
+			continue
+		}
+		if err := saveDomainList(l.Name, domains); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		return reloadSquid()
+	}
+	return nil
+}
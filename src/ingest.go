@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logIngester follows the categorized logs incrementally, the way tail -F would.
+// It remembers how far each log has been read and starts over when a log is
+// rotated or truncated, feeding every new entry into the metrics.
+type logIngester struct {
+	mu        sync.Mutex
+	offsets   map[string]int64
+	files     map[string]os.FileInfo
+	unknown   map[string]time.Time // RG hosts and when they were first seen
+	lastEntry time.Time           // timestamp of the newest entry ingested
+	seen      *seenDomains        // RG hosts ever seen, persisted across restarts
+	sightings []firstSighting     // first sightings found by the current pass
+	hits      []ruleHit           // RG requests found by the current pass, for the rules
+}
+
+// firstSighting is an RG host appearing in the logs for the first time ever
+type firstSighting struct {
+	Host     string
+	URL      string
+	ClientIP string
+	At       time.Time
+}
+
+// seenDomains remembers every RG host ever ingested so a first sighting is
+// reported once, even across restarts
+type seenDomains struct {
+	path    string
+	hosts   map[string]time.Time
+	dirty   bool
+	seeding bool // no file yet: the first pass records existing hosts without reporting them
+}
+
+// seenDomainsPath returns the location of the seen RG host database
+func seenDomainsPath() string {
+	return filepath.Join(dataDir, "seen-domains.json")
+}
+
+// loadSeenDomains reads the seen host set
+func loadSeenDomains() (*seenDomains, error) {
+	s := &seenDomains{path: seenDomainsPath(), hosts: make(map[string]time.Time)}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.seeding = true
+		s.dirty = true
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.hosts); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(s.path), err)
+	}
+	return s, nil
+}
+
+// save writes the set when it changed
+func (s *seenDomains) save() error {
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s.hosts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, data, FilePermissions); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// onFirstSighting is called, outside the ingester lock, for every new RG host
+func onFirstSighting(s firstSighting) {
+	webhooks.notify(EventDomainFirstSeen, fmt.Sprintf("first request to unknown domain %s from %s", s.Host, s.ClientIP), map[string]string{
+		"domain":     s.Host,
+		"url":        s.URL,
+		"client_ip":  s.ClientIP,
+		"first_seen": s.At.UTC().Format(time.RFC3339),
+	})
+}
+
+// ingester is the process-wide log ingester started by main
+var ingester = newLogIngester()
+
+func newLogIngester() *logIngester {
+	return &logIngester{
+		offsets: make(map[string]int64),
+		files:   make(map[string]os.FileInfo),
+		unknown: make(map[string]time.Time),
+	}
+}
+
+// startLogIngester polls the logs for new entries in the background
+func startLogIngester(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := ingester.ingestOnce(time.Now()); err != nil {
+				fmt.Printf("Warning: log ingest: %v\n", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// ingestOnce reads whatever was appended to each log since the previous call,
+// reports RG hosts seen for the first time and applies the rules to RG hosts
+func (li *logIngester) ingestOnce(now time.Time) error {
+	sightings, hits, err := li.ingestPass(now)
+	for _, s := range sightings {
+		onFirstSighting(s)
+	}
+	if rerr := rulesEngine.observe(hits, now); rerr != nil {
+		rerr = fmt.Errorf("rules: %v", rerr)
+		if err == nil {
+			return rerr
+		}
+		return fmt.Errorf("%v; %v", err, rerr)
+	}
+	return err
+}
+
+// ingestPass does the work of ingestOnce under the ingester lock
+func (li *logIngester) ingestPass(now time.Time) ([]firstSighting, []ruleHit, error) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	var errs []string
+	if li.seen == nil || li.seen.path != seenDomainsPath() {
+		seen, err := loadSeenDomains()
+		if err != nil {
+			return nil, nil, err
+		}
+		li.seen = seen
+	}
+	li.sightings, li.hits = nil, nil
+	for _, src := range logSources() {
+		if err := li.ingestFile(src); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if !li.lastEntry.IsZero() {
+		metrics.ingestLag.Set(now.Sub(li.lastEntry).Seconds())
+	}
+	metrics.unknownDomains.Set(float64(len(li.unknown)))
+	if err := li.seen.save(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	li.seen.seeding = false
+	sightings, hits := li.sightings, li.hits
+	li.sightings, li.hits = nil, nil
+	if len(errs) > 0 {
+		return sightings, hits, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return sightings, hits, nil
+}
+
+// ingestFile consumes complete lines appended to one log since the stored offset
+func (li *logIngester) ingestFile(src logSource) error {
+	info, err := os.Stat(src.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	offset := li.offsets[src.path]
+	if prev, ok := li.files[src.path]; !ok || !os.SameFile(prev, info) || info.Size() < offset {
+		// New, rotated or truncated log: start from the beginning
+		offset = 0
+	}
+	li.files[src.path] = info
+	if info.Size() == offset {
+		li.offsets[src.path] = offset
+		return nil
+	}
+
+	f, err := os.Open(src.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, MaxFileSize))
+	if err != nil {
+		return err
+	}
+	// Leave a trailing partial line for the next pass
+	end := strings.LastIndexByte(string(data), '\n') + 1
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		li.ingestLine(src, line)
+	}
+	li.offsets[src.path] = offset + int64(end)
+	return nil
+}
+
+// ingestLine parses one raw log line and records it
+func (li *logIngester) ingestLine(src logSource, line string) {
+	ts, tagged, ok := tagLogLine(line, src.tag)
+	if !ok {
+		return
+	}
+	entry, err := ParseLogEntry(tagged)
+	if err != nil || ts == 0 {
+		metrics.logParseErrors.Inc()
+		return
+	}
+	metrics.proxyRequests.WithLabelValues(entry.Tag, entry.StatusCode, entry.Method).Inc()
+
+	seenAt := unixFloatToTime(ts)
+	if seenAt.After(li.lastEntry) {
+		li.lastEntry = seenAt
+	}
+	if entry.Tag == "RG" && entry.Host != "" {
+		if _, ok := li.unknown[entry.Host]; !ok {
+			li.unknown[entry.Host] = seenAt
+		}
+		li.hits = append(li.hits, ruleHit{Host: entry.Host, URL: entry.URL, ClientIP: entry.ClientIP})
+		if li.seen != nil {
+			if _, ok := li.seen.hosts[entry.Host]; !ok {
+				li.seen.hosts[entry.Host] = seenAt
+				li.seen.dirty = true
+				if !li.seen.seeding {
+					li.sightings = append(li.sightings, firstSighting{Host: entry.Host, URL: entry.URL, ClientIP: entry.ClientIP, At: seenAt})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IP addresses and CIDR ranges cannot be matched by squid's dstdomain ACL, so they are kept
+// in separate files used by "dst" ACLs (whitelist-ip.txt, blacklist-ip.txt). To users they
+// are part of the whitelist and blacklist: moving "10.0.0.0/8" to the whitelist writes it
+// to whitelist-ip.txt.
+
+// ipListFor returns the IP list file name ("whitelist-ip", "blacklist-ip") behind a list
+func ipListFor(list string) string {
+	return list + "-ip"
+}
+
+// listPath returns the file of a list (whitelist, blacklist or a named list) or of its
+// IP list (whitelist-ip, ...)
+func listPath(name string) (string, error) {
+	switch name {
+	case "whitelist":
+		return whitelistPath, nil
+	case "blacklist":
+		return blacklistPath, nil
+	case "whitelist-ip":
+		return whitelistIPPath, nil
+	case "blacklist-ip":
+		return blacklistIPPath, nil
+	}
+	if list := strings.TrimSuffix(name, "-ip"); knownList(list) {
+		return namedListPath(name), nil
+	}
+	return "", fmt.Errorf("invalid list type: %s", name)
+}
+
+// ipRange parses a list entry holding an IP address or CIDR range; nil for domains
+func ipRange(entry string) *net.IPNet {
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if _, n, err := net.ParseCIDR(entry); err == nil {
+		return n
+	}
+	return nil
+}
+
+// isIPEntry reports whether a list entry belongs on an IP list
+func isIPEntry(entry string) bool {
+	return ipRange(entry) != nil
+}
+
+// normalizeIPEntry returns the canonical form of an address or range: the address
+// itself for single hosts, the network address and prefix length for ranges
+func normalizeIPEntry(input string) (string, error) {
+	if ip := net.ParseIP(input); ip != nil {
+		return ip.String(), nil
+	}
+	ip, n, err := net.ParseCIDR(input)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR range %q", input)
+	}
+	if !ip.Equal(n.IP) {
+		return "", fmt.Errorf("invalid CIDR range %q: host bits are set, the network is %s", input, n)
+	}
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String(), nil
+	}
+	return n.String(), nil
+}
+
+// rangeContains reports whether outer includes every address of inner
+func rangeContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// rangesOverlap reports whether two ranges share any address
+func rangesOverlap(a, b *net.IPNet) bool {
+	return rangeContains(a, b) || rangeContains(b, a)
+}
+
+// compareIPEntries orders IP entries by address, then by prefix length (wider first);
+// IPv4 sorts before IPv6
+func compareIPEntries(a, b *net.IPNet) int {
+	if len(a.IP) != len(b.IP) {
+		return len(a.IP) - len(b.IP)
+	}
+	if c := bytes.Compare(a.IP, b.IP); c != 0 {
+		return c
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes - bOnes
+}
+
+// removeCoveredRanges drops the entries inside a new range (squid warns about them when
+// loading a dst list) and returns them
+func removeCoveredRanges(entries []string, entry string) (kept []string, covered []string) {
+	n := ipRange(entry)
+	for _, line := range entries {
+		d := parseDomainEntry(line).Domain
+		if r := ipRange(d); r != nil && d != entry && rangeContains(n, r) {
+			covered = append(covered, d)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept, covered
+}
+
+// overlappingRanges lists the entries of an IP list that share addresses with entry,
+// as "list entry" strings
+func overlappingRanges(list string, entries []string, entry string) []string {
+	n := ipRange(entry)
+	var overlaps []string
+	for _, line := range entries {
+		d := parseDomainEntry(line).Domain
+		if r := ipRange(d); r != nil && d != entry && rangesOverlap(n, r) {
+			overlaps = append(overlaps, list+" "+d)
+		}
+	}
+	return overlaps
+}
+
+// ipListEntry is a parsed entry of an IP list
+type ipListEntry struct {
+	list  string // whitelist, blacklist or a named list
+	entry string
+	net   *net.IPNet
+}
+
+// loadIPLists reads the IP lists in squid's order (by list priority)
+func loadIPLists() []ipListEntry {
+	var entries []ipListEntry
+	for _, d := range orderedLists() {
+		name := d.Name
+		path, _ := listPath(ipListFor(name))
+		for _, line := range parseDomainList(readFile(path)) {
+			d := parseDomainEntry(line).Domain
+			if r := ipRange(d); r != nil {
+				entries = append(entries, ipListEntry{list: name, entry: d, net: r})
+			}
+		}
+	}
+	return entries
+}
+
+// matchIPLists returns the list and entry deciding a destination address, or "unknown"
+func matchIPLists(entries []ipListEntry, ip net.IP) (list string, entry string) {
+	host := ipRange(ip.String())
+	for _, e := range entries {
+		if rangeContains(e.net, host) {
+			return e.list, e.entry
+		}
+	}
+	return "unknown", ""
+}
+
+// ipPolicy returns which IP list decides a destination address and the matching entry
+func ipPolicy(ip net.IP) (list string, entry string) {
+	return matchIPLists(loadIPLists(), ip)
+}
+
+// hostIP returns the address of an IP-literal host ("10.0.0.1", "[2001:db8::1]"), or nil
+func hostIP(host string) net.IP {
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// migrateIPEntries moves IP addresses and ranges found in the domain lists (added by hand
+// or by older versions) to the IP lists and reloads squid when anything moved
+func migrateIPEntries() error {
+	if err := listMu.Lock(); err != nil {
+		return err
+	}
+	defer listMu.Unlock()
+	changed := false
+	for _, name := range listNames() {
+		domainPath, _ := listPath(name)
+		ipPath, _ := listPath(ipListFor(name))
+		var domains, ips []string
+		for _, line := range parseDomainList(readFile(domainPath)) {
+			if isIPEntry(parseDomainEntry(line).Domain) {
+				ips = append(ips, line)
+			} else {
+				domains = append(domains, line)
+			}
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		if err := saveDomainList(ipListFor(name), append(parseDomainList(readFile(ipPath)), ips...)); err != nil {
+			return err
+		}
+		if err := saveDomainList(name, domains); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		return reloadSquid()
+	}
+	return nil
+}
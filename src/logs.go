@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // computeSummaryRows builds summary rows from log entries with embedded tags
@@ -62,65 +66,237 @@ func computeSummaryRows(logText string) []Row {
 	})
 	
 	rows := make([]Row, 0, len(arr))
+	notes := rulesEngine.notes()
+	var ipLists []ipListEntry
+	ipListsLoaded := false
 	for _, kv := range arr {
-		rows = append(rows, Row{Domain: kv.k, Count: kv.v.count, Status: kv.v.status, Url: latestUrl[kv.k]})
+		row := Row{Domain: kv.k, Display: displayDomain(kv.k), Count: kv.v.count, Status: kv.v.status, Url: latestUrl[kv.k], Categories: categories.lookup(kv.k)}
+		if kv.v.status == EmojiUnknown {
+			row.Note = notes[kv.k].Note
+		}
+		// IP destinations show the range of an IP list that decides them
+		if ip := hostIP(kv.k); ip != nil {
+			if !ipListsLoaded {
+				ipLists, ipListsLoaded = loadIPLists(), true
+			}
+			row.IP = true
+			if _, entry := matchIPLists(ipLists, ip); strings.Contains(entry, "/") {
+				row.Range = entry
+			}
+		}
+		rows = append(rows, row)
 	}
 	return rows
 }
 
+// groupSummaryRows rolls summary rows up to their registrable domain. Groups are sorted
+// like rows; children keep the order of rows.
+func groupSummaryRows(rows []Row) []RowGroup {
+	wildcards := map[string]string{} // ".example.com" entry -> first list in squid's order
+	for _, l := range orderedLists() {
+		path, _ := listPath(l.Name)
+		for _, line := range parseDomainList(readFile(path)) {
+			if d := parseDomainEntry(line).Domain; strings.HasPrefix(d, ".") {
+				if _, ok := wildcards[d]; !ok {
+					wildcards[d] = l.Name
+				}
+			}
+		}
+	}
+
+	index := map[string]int{}
+	var groups []RowGroup
+	for _, row := range rows {
+		domain := registrableDomain(row.Domain)
+		i, ok := index[domain]
+		if !ok {
+			i = len(groups)
+			index[domain] = i
+			groups = append(groups, RowGroup{Domain: domain, Display: displayDomain(domain), Status: row.Status, List: wildcards["."+domain]})
+		}
+		g := &groups[i]
+		g.Count += row.Count
+		if g.Status != row.Status {
+			g.Status = ""
+		}
+		g.Children = append(g.Children, row)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return sortDomainsByParts(groups[i].Domain, groups[j].Domain)
+	})
+	return groups
+}
+
+// logSource describes one categorized squid access log and the tag injected for it
+type logSource struct {
+	path     string
+	tag      string
+	category string
+}
+
+// logSources returns the categorized access logs written by squid
+func logSources() []logSource {
+	return []logSource{
+		{accessLogWhitelistPath, "WL", "whitelist"},
+		{accessLogBlacklistPath, "BL", "blacklist"},
+		{accessLogRegularPath, "RG", "regular"},
+	}
+}
+
+// tagLogLine parses the timestamp of a raw squid log line and injects the category tag
+// as the second field. ok is false for blank lines and connection failures (status 0).
+func tagLogLine(line, tag string) (ts float64, tagged string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return 0, "", false
+	}
+	f := strings.Fields(line)
+	// Skip lines where the status code is "0"
+	// Original squid format: timestamp client-ip method status host url
+	// Status code 0 indicates connection errors/failures, not actual requests
+	if len(f) >= 4 && f[3] == "0" {
+		return 0, "", false
+	}
+	ts, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, line, true
+	}
+	// Inject tag as second field (after timestamp) for categorization
+	// Preserve original spacing after first token
+	rest := strings.TrimPrefix(line, f[0])
+	return ts, f[0] + " " + tag + rest, true
+}
+
 // mergeLogFiles reads the three categorized logs, parses first field as timestamp,
 // merges and returns them in chronological order as a single string (ending with \n if any records).
+// Only the live logs are read; rotated segments are available through searchLogs.
 func mergeLogFiles() string {
 	type rec struct {
 		ts   float64
 		line string
 	}
 	var recs []rec
-	type fileTag struct{ path, tag string }
-	files := []fileTag{
-		{accessLogWhitelistPath, "WL"}, 
-		{accessLogBlacklistPath, "BL"}, 
-		{accessLogRegularPath, "RG"},
-	}
-	
-	for _, ft := range files {
-		content := readFile(ft.path)
-		if content == "" {
+
+	for _, src := range logSources() {
+		content, err := readFileWithLimit(src.path, MaxFileSize)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				// The rotator keeps logs below MaxFileSize; skip until it catches up
+				fmt.Printf("Warning: skipping %s: %v\n", src.path, err)
+			}
 			continue
 		}
 		for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
-			f := strings.Fields(line)
-			if len(f) == 0 {
+			ts, tagged, ok := tagLogLine(line, src.tag)
+			if !ok {
 				continue
 			}
-			// Skip lines where the status code is "0" 
-			// Original squid format: timestamp client-ip method status host url
-			// Status code 0 indicates connection errors/failures, not actual requests
-			if len(f) >= 4 && f[3] == "0" {
+			recs = append(recs, rec{ts: ts, line: tagged})
+		}
+	}
+
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].ts < recs[j].ts })
+	var b strings.Builder
+	for _, r := range recs {
+		b.WriteString(r.line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// logQuery filters entries for searchLogs. Zero values match everything.
+type logQuery struct {
+	Text  string    // case-insensitive substring of the tagged line, in Unicode or punycode form
+	Tag   string    // WL, BL or RG
+	Since time.Time // inclusive
+	Until time.Time // inclusive
+	Limit int       // newest entries returned, defaults to MaxSearchResults
+}
+
+// searchLogs searches the live logs and all rotated (compressed) segments.
+// Results are returned oldest first; truncated is set when more than Limit entries matched.
+func searchLogs(q logQuery) (lines []string, truncated bool) {
+	type rec struct {
+		ts   float64
+		line string
+	}
+	if q.Limit <= 0 {
+		q.Limit = MaxSearchResults
+	}
+	text := strings.ToLower(q.Text)
+	// Logs hold punycode hosts; a Unicode search term also matches its punycode form and vice versa
+	alt := idnAlternate(text)
+	var recs []rec
+
+	for _, src := range logSources() {
+		if q.Tag != "" && !strings.EqualFold(q.Tag, src.tag) {
+			continue
+		}
+		paths := []string{}
+		for _, seg := range listLogSegments(src.path) {
+			// A segment only holds entries written before it was rotated
+			if !q.Since.IsZero() && seg.RotatedAt.Before(q.Since) {
 				continue
 			}
-			ts, err := strconv.ParseFloat(f[0], 64)
+			paths = append(paths, seg.Path)
+		}
+		paths = append(paths, src.path)
+
+		for _, path := range paths {
+			rc, err := openLogSegment(path)
 			if err != nil {
-				recs = append(recs, rec{ts: 0, line: line})
 				continue
 			}
-			// Inject tag as second field (after timestamp) for categorization
-			// Preserve original spacing after first token
-			rest := strings.TrimPrefix(line, f[0])
-			taggedLine := f[0] + " " + ft.tag + rest
-			recs = append(recs, rec{ts: ts, line: taggedLine})
+			scanner := bufio.NewScanner(rc)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				ts, tagged, ok := tagLogLine(scanner.Text(), src.tag)
+				if !ok {
+					continue
+				}
+				if !q.Since.IsZero() && unixFloatToTime(ts).Before(q.Since) {
+					continue
+				}
+				if !q.Until.IsZero() && unixFloatToTime(ts).After(q.Until) {
+					continue
+				}
+				if text != "" {
+					lower := strings.ToLower(tagged)
+					if !strings.Contains(lower, text) && (alt == "" || !strings.Contains(lower, alt)) {
+						continue
+					}
+				}
+				recs = append(recs, rec{ts: ts, line: tagged})
+			}
+			rc.Close()
 		}
 	}
-	
-	sort.Slice(recs, func(i, j int) bool { return recs[i].ts < recs[j].ts })
-	var b strings.Builder
+
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].ts < recs[j].ts })
+	if len(recs) > q.Limit {
+		recs = recs[len(recs)-q.Limit:]
+		truncated = true
+	}
+	lines = make([]string, 0, len(recs))
 	for _, r := range recs {
-		b.WriteString(r.line)
-		b.WriteByte('\n')
+		lines = append(lines, r.line)
 	}
-	return b.String()
+	return lines, truncated
+}
+
+// parseTimeParam accepts a unix timestamp (squid style, fractional allowed) or RFC3339 time.
+// An empty value yields the zero time.
+func parseTimeParam(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ts, err := strconv.ParseFloat(value, 64); err == nil {
+		return unixFloatToTime(ts), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: use unix seconds or RFC3339", value)
+	}
+	return t, nil
 }
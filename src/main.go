@@ -1,15 +1,67 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Any argument other than "serve" runs a command-line subcommand
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+	}
 	// Ensure required files exist on startup
 	ensureRequiredFilesExist()
+	if err := normalizeDomainLists(); err != nil {
+		fmt.Printf("Warning: converting Unicode list entries to punycode: %v\n", err)
+	}
+	// squid.conf includes the generated list configuration
+	if _, err := writeListConfig(); err != nil {
+		fmt.Printf("Warning: writing the squid list configuration: %v\n", err)
+	}
+	if err := migrateIPEntries(); err != nil {
+		fmt.Printf("Warning: moving IP entries to the IP lists: %v\n", err)
+	}
+	if err := categories.load(); err != nil {
+		fmt.Printf("Warning: loading category datasets: %v\n", err)
+	}
+	if _, err := refreshCategoryBlacklist(); err != nil {
+		fmt.Printf("Warning: writing the category blacklist: %v\n", err)
+	}
+	trustedProxies = trustedProxiesFromEnv()
+	authEnabled = os.Getenv("SQUID_EDITOR_AUTH") != "off"
+	if authEnabled {
+		if err := ensureBootstrapAdmin(); err != nil {
+			panic("Failed to create bootstrap admin: " + err.Error())
+		}
+		cfg, err := oidcConfigFromEnv()
+		if err != nil {
+			panic("Invalid single sign-on configuration: " + err.Error())
+		}
+		if cfg != nil {
+			oidc = newOIDCProvider(*cfg)
+			fmt.Printf("Single sign-on enabled with issuer %s\n", cfg.Issuer)
+		}
+	} else {
+		fmt.Println("Warning: authentication disabled by SQUID_EDITOR_AUTH=off")
+	}
+	startLogRotator(LogRotateCheckInterval)
+	startLogIngester(LogIngestInterval)
+	health.start(HealthCheckInterval)
+	webhooks.start(WebhookWorkers)
+	digestCfg, err := digestConfigFromEnv()
+	if err != nil {
+		panic("Invalid digest configuration: " + err.Error())
+	}
+	digest = newDigestMailer(digestCfg)
+	if digestCfg.enabled() {
+		digest.start()
+		fmt.Printf("Sending %s digests to %s\n", digestCfg.Schedule, strings.Join(digestCfg.To, ", "))
+	}
 	
 	r := setupRouter()
 	r.Run(ServerPort)
@@ -36,6 +88,39 @@ func ensureRequiredFilesExist() {
 			panic("Failed to create blacklist.txt: " + err.Error())
 		}
 	}
+	
+	// squid refuses to start when an ACL file is missing
+	paths := []string{whitelistIPPath, blacklistIPPath, blacklistCategoryPath}
+	for _, d := range orderedLists() {
+		if !d.BuiltIn {
+			paths = append(paths, namedListPath(d.Name), namedListPath(ipListFor(d.Name)))
+		}
+	}
+	if err := os.MkdirAll(namedListsDir(), 0755); err != nil {
+		panic("Failed to create lists directory: " + err.Error())
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := writeFile(path, ""); err != nil {
+				panic("Failed to create " + filepath.Base(path) + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// trustedProxies are the addresses (IPs or CIDRs) whose X-Forwarded-For header is believed
+// for the client IP; none by default, so c.ClientIP() is the connection's address
+var trustedProxies []string
+
+// trustedProxiesFromEnv reads SQUID_EDITOR_TRUSTED_PROXIES (comma separated)
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("SQUID_EDITOR_TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
 }
 
 func setupRouter() *gin.Engine {
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func min(a, b int) int {
@@ -21,11 +40,6 @@ func min(a, b int) int {
 	return b
 }
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
-
 func TestExtractDomain(t *testing.T) {
 	cases := []struct{ in, want string }{
 		{"http://example.com/path", "example.com"},
@@ -92,6 +106,9 @@ func setupTestFiles(t *testing.T) (cleanup func()) {
 	// Store original paths
 	origWhitelistPath := whitelistPath
 	origBlacklistPath := blacklistPath
+	origWhitelistIPPath := whitelistIPPath
+	origBlacklistIPPath := blacklistIPPath
+	origBlacklistCategoryPath := blacklistCategoryPath
 	origAccessLogRegularPath := accessLogRegularPath
 	origAccessLogWhitelistPath := accessLogWhitelistPath
 	origAccessLogBlacklistPath := accessLogBlacklistPath
@@ -134,6 +151,9 @@ func setupTestFiles(t *testing.T) (cleanup func()) {
 		// Restore original paths
 		whitelistPath = origWhitelistPath
 		blacklistPath = origBlacklistPath
+		whitelistIPPath = origWhitelistIPPath
+		blacklistIPPath = origBlacklistIPPath
+		blacklistCategoryPath = origBlacklistCategoryPath
 		accessLogRegularPath = origAccessLogRegularPath
 		accessLogWhitelistPath = origAccessLogWhitelistPath
 		accessLogBlacklistPath = origAccessLogBlacklistPath
@@ -254,6 +274,7 @@ func TestPostReload(t *testing.T) {
 func TestPostClearAllLogs(t *testing.T) {
 	cleanup := setupTestFiles(t)
 	defer cleanup()
+	useFakeSquid(t)
 	
 	router := setupTestRouter()
 	
@@ -488,3 +509,2958 @@ func TestMoveDomainEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+// fakeSquid records calls instead of signalling a squid container
+type fakeSquid struct {
+	reconfigures int
+	rotates      int
+	err          error
+}
+
+func (f *fakeSquid) Reconfigure() error { f.reconfigures++; return f.err }
+func (f *fakeSquid) Rotate() error      { f.rotates++; return f.err }
+
+// useFakeSquid installs a fakeSquid as the reload backend for the duration of a test
+func useFakeSquid(t *testing.T) *fakeSquid {
+	fake := &fakeSquid{}
+	orig, wait := squidBackend, logReopenWait
+	squidBackend, logReopenWait = fake, 0
+	t.Cleanup(func() { squidBackend, logReopenWait = orig, wait })
+	return fake
+}
+
+func TestRotateLogs(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+
+	now := time.Unix(1712175200, 0)
+	// Only the regular log is old enough to rotate
+	writeFile(accessLogWhitelistPath, "1712175190.000 192.168.1.1 GET 200 example.com example.com:80\n")
+	writeFile(accessLogBlacklistPath, "")
+	segments, err := rotateLogs(now.Add(LogRotateMaxAge), false)
+	if err != nil {
+		t.Fatalf("rotateLogs: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments (whitelist and regular), got %v", segments)
+	}
+	if fake.rotates != 1 {
+		t.Errorf("expected squid to be asked to rotate once, got %d", fake.rotates)
+	}
+	if readFile(accessLogRegularPath) != "" {
+		t.Error("regular log should be empty after rotation")
+	}
+
+	// Nothing left to rotate; the segments squid reopened its logs after are compressed
+	segments, _ = rotateLogs(now.Add(LogRotateMaxAge), false)
+	if len(segments) != 0 || fake.rotates != 1 {
+		t.Errorf("unexpected rotation of empty logs: %v", segments)
+	}
+	for _, seg := range listLogSegments(accessLogRegularPath) {
+		if !strings.HasSuffix(seg.Path, ".gz") {
+			t.Errorf("segment %s was not compressed", seg.Path)
+		}
+	}
+
+	// Segments stay uncompressed until squid confirms a rotation
+	writeFile(accessLogRegularPath, "1712175300.000 192.168.1.1 GET 200 later.com later.com:80\n")
+	fake.err = fmt.Errorf("docker unavailable")
+	later := now.Add(2 * LogRotateMaxAge)
+	if segments, err = rotateLogs(later, true); err == nil || len(segments) != 1 {
+		t.Fatalf("expected the failed rotation to be reported, got %v %v", segments, err)
+	}
+	fake.err = nil
+	rotateLogs(later.Add(time.Minute), false)
+	if fake.rotates != 3 || !fileExists(segments[0]) {
+		t.Errorf("expected squid to be asked again before compressing, got %d rotations", fake.rotates)
+	}
+	rotateLogs(later.Add(2*time.Minute), false)
+	if fileExists(segments[0]) || !fileExists(segments[0]+".gz") || fake.rotates != 3 {
+		t.Errorf("segment not compressed after a confirmed rotation")
+	}
+
+	// Rotations within the same second get their own segments
+	same := later.Add(3 * time.Minute)
+	for _, host := range []string{"first.com", "second.com", "third.com"} {
+		writeFile(accessLogRegularPath, "1712175400.000 192.168.1.1 GET 200 "+host+" "+host+":80\n")
+		rotateLogs(same, true)
+	}
+	rotateLogs(same, false)
+	var names, content []string
+	for _, seg := range listLogSegments(accessLogRegularPath) {
+		if !seg.RotatedAt.Equal(same.Truncate(time.Second)) {
+			continue
+		}
+		names = append(names, filepath.Base(seg.Path))
+		r, _ := openLogSegment(seg.Path)
+		data, _ := io.ReadAll(r)
+		r.Close()
+		content = append(content, string(data))
+	}
+	stamp := "access-regular.log." + same.UTC().Format(segmentTimeFormat)
+	if strings.Join(names, " ") != stamp+".gz "+stamp+"-2.gz "+stamp+"-3.gz" || !containsAll(strings.Join(content, ""), []string{"first.com", "second.com", "third.com"}) {
+		t.Errorf("segments of the same second overwrote each other: %v", names)
+	}
+}
+
+func TestPruneLogSegments(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+
+	now := time.Date(2024, 4, 3, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < LogRetentionSegments+3; i++ {
+		stamp := now.Add(-time.Duration(i) * time.Hour).Format(segmentTimeFormat)
+		writeFile(accessLogRegularPath+"."+stamp+".gz", "")
+	}
+	old := now.Add(-LogRetentionMaxAge - time.Hour).Format(segmentTimeFormat)
+	writeFile(accessLogWhitelistPath+"."+old+".gz", "")
+
+	if err := pruneLogSegments(accessLogRegularPath, now); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if err := pruneLogSegments(accessLogWhitelistPath, now); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got := len(listLogSegments(accessLogRegularPath)); got != LogRetentionSegments {
+		t.Errorf("expected %d segments kept, got %d", LogRetentionSegments, got)
+	}
+	if got := len(listLogSegments(accessLogWhitelistPath)); got != 0 {
+		t.Errorf("expected expired segment to be removed, %d left", got)
+	}
+}
+
+func TestGetLogSearchReadsRotatedSegments(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+
+	if _, err := rotateLogs(time.Unix(1712175200, 0), true); err != nil {
+		t.Fatalf("rotateLogs: %v", err)
+	}
+	writeFile(accessLogRegularPath, "1712175300.000 192.168.1.1 GET 200 later.com later.com:80\n")
+
+	router := setupTestRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/log/search?tag=RG", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Lines []string `json:"lines"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Lines) != 2 {
+		t.Fatalf("expected rotated and live RG entries, got %v", response.Lines)
+	}
+	if !strings.Contains(response.Lines[0], "unknown.com") || !strings.Contains(response.Lines[1], "later.com") {
+		t.Errorf("unexpected order or content: %v", response.Lines)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/log/search?q=EXAMPLE&since=1712175000", nil)
+	router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Lines) != 1 || !strings.Contains(response.Lines[0], " WL ") {
+		t.Errorf("expected one WL match for example, got %v", response.Lines)
+	}
+}
+
+func TestClearAllLogsCreatesArchive(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+
+	router := setupTestRouter()
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("reason", "end of term")
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/clear-all-logs", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	archives := listLogArchives()
+	if len(archives) != 1 {
+		t.Fatalf("expected one archive, got %d", len(archives))
+	}
+	a := archives[0]
+	if a.Reason != "end of term" || a.Entries["regular"] != 1 || a.Entries["whitelist"] != 1 {
+		t.Errorf("unexpected archive metadata: %+v", a)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/log-archives/"+a.ID, nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 downloading archive, got %d", w.Code)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("archive is not gzip: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	members := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := io.ReadAll(tr)
+		members[hdr.Name] = string(data)
+	}
+	if !strings.Contains(members["access-regular.log"], "unknown.com") {
+		t.Errorf("archive missing regular log entries: %v", members)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/log-archives/..%2Fwhitelist", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for invalid archive id, got %d", w.Code)
+	}
+}
+
+func TestClearLogsByCategoryAndRange(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+
+	writeFile(accessLogRegularPath, ""+
+		"1712175102.000 192.168.1.1 GET 200 old.com old.com:80\n"+
+		"1712175200.000 192.168.1.1 GET 200 new.com new.com:80\n")
+
+	archive, err := clearLogs(clearOptions{Category: "RG", Until: time.Unix(1712175150, 0)}, time.Now())
+	if err != nil {
+		t.Fatalf("clearLogs: %v", err)
+	}
+	if archive == nil || archive.Entries["regular"] != 1 {
+		t.Fatalf("expected one archived entry, got %+v", archive)
+	}
+	// Entries outside the range are kept in a rotated segment
+	segments := listLogSegments(accessLogRegularPath)
+	if readFile(accessLogRegularPath) != "" || fake.rotates != 1 || len(segments) != 1 || !strings.HasSuffix(segments[0].Path, ".gz") {
+		t.Fatalf("expected the regular log to be rotated, got %v", segments)
+	}
+	r, _ := openLogSegment(segments[0].Path)
+	rg, _ := io.ReadAll(r)
+	r.Close()
+	if strings.Contains(string(rg), "old.com") || !strings.Contains(string(rg), "new.com") {
+		t.Errorf("unexpected kept entries after ranged clear: %q", rg)
+	}
+	if readFile(accessLogWhitelistPath) == "" {
+		t.Error("whitelist log should not be cleared when clearing RG only")
+	}
+
+	if _, err := clearLogs(clearOptions{Category: "bogus"}, time.Now()); err == nil {
+		t.Error("expected error for invalid category")
+	}
+
+	// Without squid the logs are put back and cleared in place
+	fake.err = fmt.Errorf("docker unavailable")
+	writeFile(accessLogWhitelistPath, ""+
+		"1712175100.000 192.168.1.1 GET 200 example.com example.com:80\n"+
+		"1712175200.000 192.168.1.1 GET 200 docs.example.com docs.example.com:443\n")
+	archive, err = clearLogs(clearOptions{Category: "WL", Until: time.Unix(1712175150, 0)}, time.Now())
+	if err != nil || archive == nil || archive.Entries["whitelist"] != 1 || len(listLogSegments(accessLogWhitelistPath)) != 0 {
+		t.Fatalf("expected the whitelist log to be cleared in place, got %+v %v", archive, err)
+	}
+	if kept := readFile(accessLogWhitelistPath); kept != "1712175200.000 192.168.1.1 GET 200 docs.example.com docs.example.com:443\n" {
+		t.Errorf("unexpected whitelist log after clearing in place: %q", kept)
+	}
+
+	// A log squid wrote to meanwhile is not overwritten by the restore
+	writeFile(accessLogBlacklistPath, "1712175102.000 192.168.1.1 GET 403 bad.com bad.com:80\n")
+	seg, _ := renameLogForRotation(accessLogBlacklistPath, time.Now())
+	writeFile(accessLogBlacklistPath, "1712175300.000 192.168.1.1 GET 403 later.com later.com:80\n")
+	if err := restoreRenamedLogs(map[string]string{accessLogBlacklistPath: seg}); err == nil || !fileExists(seg) || !strings.Contains(readFile(accessLogBlacklistPath), "later.com") {
+		t.Errorf("expected the failed restore to be reported and both files kept: %v", err)
+	}
+}
+
+func TestLogIngesterFollowsLogs(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+
+	li := newLogIngester()
+	writeFile(accessLogRegularPath, ""+
+		"1712175102.000 192.168.1.1 GET 200 unknown.com unknown.com:80\n"+
+		"garbage\n"+
+		"1712175103.000 192.168.1.1 GET 200 partial")
+	before := testutil.ToFloat64(metrics.logParseErrors)
+	if err := li.ingestOnce(time.Unix(1712175110, 0)); err != nil {
+		t.Fatalf("ingestOnce: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.logParseErrors) - before; got != 1 {
+		t.Errorf("expected 1 parse error, got %v", got)
+	}
+	if _, ok := li.unknown["unknown.com"]; !ok {
+		t.Error("expected unknown.com to be recorded as an unknown domain")
+	}
+	if got := testutil.ToFloat64(metrics.ingestLag); got != 8 {
+		t.Errorf("expected ingest lag of 8s, got %v", got)
+	}
+
+	// Completing the partial line makes it available on the next pass
+	f, _ := os.OpenFile(accessLogRegularPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(".com partial.com:80\n")
+	f.Close()
+	li.ingestOnce(time.Unix(1712175110, 0))
+	if _, ok := li.unknown["partial.com"]; !ok {
+		t.Error("expected partial.com after the line was completed")
+	}
+
+	// A truncated log is read again from the start
+	writeFile(accessLogRegularPath, "1712175104.000 192.168.1.1 GET 200 fresh.com fresh.com:80\n")
+	li.ingestOnce(time.Unix(1712175110, 0))
+	if _, ok := li.unknown["fresh.com"]; !ok {
+		t.Error("expected fresh.com after truncation")
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+
+	router := setupTestRouter()
+	if err := reloadSquid(); err != nil {
+		t.Fatalf("reloadSquid: %v", err)
+	}
+	// Generate one handler observation before scraping
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/lists", nil)
+	router.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`squid_editor_list_entries{list="whitelist"} 2`,
+		`squid_editor_list_entries{list="blacklist"} 2`,
+		`squid_editor_squid_reloads_total{result="success"}`,
+		`squid_editor_http_request_duration_seconds_count{code="200",method="GET",route="/lists"} `,
+		`squid_editor_squid_up`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
+
+func TestSquidHealthTransitionsAndReloadVerification(t *testing.T) {
+	up := true
+	h := newSquidHealthChecker(func() healthProbe {
+		if up {
+			return healthProbe{TCP: true, Proxy: true, Latency: 5 * time.Millisecond}
+		}
+		return healthProbe{TCP: true, Err: fmt.Errorf("proxied probe returned 503")}
+	})
+
+	h.checkOnce()
+	up = false
+	h.checkOnce()
+	h.checkOnce()
+	s := h.snapshot()
+	if s.Status != "DOWN" || s.Error == "" {
+		t.Fatalf("expected DOWN with error, got %+v", s)
+	}
+	if len(s.History) != 2 || s.History[0].To != "UP" || s.History[1].To != "DOWN" {
+		t.Fatalf("expected UNKNOWN→UP→DOWN history, got %+v", s.History)
+	}
+
+	h.recordReload(time.Now(), nil)
+	h.checkOnce()
+	if r := h.snapshot().Reload; r == nil || r.Verified {
+		t.Fatalf("reload must stay unverified while squid is down: %+v", r)
+	}
+	up = true
+	h.checkOnce()
+	if r := h.snapshot().Reload; !r.Verified || r.VerifiedAt == nil {
+		t.Errorf("reload should be verified once squid answers: %+v", r)
+	}
+
+	h.recordReload(time.Now(), fmt.Errorf("docker unavailable"))
+	h.checkOnce()
+	if r := h.snapshot().Reload; r.Verified || r.Error == "" {
+		t.Errorf("a failed reload must never be verified: %+v", r)
+	}
+}
+
+func TestProbeSquidProxy(t *testing.T) {
+	// A forward proxy stand-in: answers absolute-form requests for the probe target
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "squid-editor:8080" && r.URL.Path == "/squid/probe" {
+			io.WriteString(w, probeBody)
+			return
+		}
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	if err := probeSquidProxy(proxy.URL, SquidProbeURL, time.Second); err != nil {
+		t.Errorf("expected probe through proxy to succeed: %v", err)
+	}
+	if err := probeSquidProxy(proxy.URL, "http://elsewhere.test/squid/probe", time.Second); err == nil {
+		t.Error("expected probe to fail when the proxy denies the request")
+	}
+}
+
+func TestGetSquidHealth(t *testing.T) {
+	router := setupTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/squid/health", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response["status"] == nil || response["history"] == nil {
+		t.Errorf("expected status and history in response: %v", response)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/squid/probe", nil)
+	router.ServeHTTP(w, req)
+	if w.Body.String() != probeBody {
+		t.Errorf("unexpected probe body %q", w.Body.String())
+	}
+}
+
+// fakeCacheManager serves canned squid-internal-mgr reports
+func fakeCacheManager() *httptest.Server {
+	reports := map[string]string{
+		"info": "Squid Object Cache: Version 5.7\n" +
+			"Start Time:\tWed, 03 Apr 2024 20:00:00 GMT\n" +
+			"Connection information for squid:\n" +
+			"\tNumber of clients accessing cache:\t7\n" +
+			"\tNumber of HTTP requests received:\t1234\n" +
+			"\tAverage HTTP requests per minute since start:\t20.5\n" +
+			"Resource usage for squid:\n" +
+			"\tUP Time:\t3600.123 seconds\n" +
+			"\tCPU Usage:\t0.34%\n" +
+			"\tCPU Usage, 5 minute avg:\t0.50%\n" +
+			"File descriptor usage for squid:\n" +
+			"\tMaximum number of file descriptors:   65536\n" +
+			"\tNumber of file desc currently in use:   15\n",
+		"5min": "by kid1 {\n" +
+			"sample_start_time = 1712175100.000 (Wed, 03 Apr 2024 20:11:40 GMT)\n" +
+			"client_http.requests = 12.5/sec\n" +
+			"cpu_usage = 1.25%\n" +
+			"} by kid1\n" +
+			"by kid2 {\n" +
+			"client_http.requests = 3.0/sec\n" +
+			"cpu_usage = 0.75%\n" +
+			"} by kid2\n",
+		"utilization": "Current:\n" +
+			"client_http.requests = 2\n" +
+			"Last 5 minutes:\n" +
+			"client_http.requests = 15.500000/sec\n" +
+			"dns.median_svc_time = 0.004 seconds\n" +
+			"cpu_usage = 2.000000%\n",
+		"fqdncache": "FQDN Cache Statistics:\n" +
+			"FQDNcache Entries In Use: 3\n" +
+			"FQDNcache Requests: 100\n" +
+			"FQDNcache Hits: 80\n" +
+			"FQDNcache Misses: 20\n" +
+			"FQDN Cache Contents:\n\n" +
+			"Address                                       Flg TTL Cnt Hostnames\n" +
+			"127.0.0.1                                       H -001   1 localhost\n" +
+			"93.184.216.34                                      2000   1 example.com\n",
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		text, ok := reports[strings.TrimPrefix(r.URL.Path, "/squid-internal-mgr/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, text)
+	}))
+}
+
+func TestCacheManagerReports(t *testing.T) {
+	server := fakeCacheManager()
+	defer server.Close()
+	client := newCacheManagerClient(server.URL)
+
+	stats := client.allStats()
+	if len(stats.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", stats.Errors)
+	}
+	if stats.Info.Version != "Version 5.7" || stats.Info.Clients != 7 || stats.Info.HTTPRequests != 1234 ||
+		stats.Info.CPUUsage5Min != 0.5 || stats.Info.FileDescsInUse != 15 {
+		t.Errorf("unexpected info: %+v", stats.Info)
+	}
+	if len(stats.FiveMin) != 2 || stats.FiveMin[0].Worker != "kid1" || stats.FiveMin[0].RequestsPerSec != 12.5 ||
+		stats.FiveMin[1].CPUUsagePercent != 0.75 {
+		t.Errorf("unexpected per-worker stats: %+v", stats.FiveMin)
+	}
+	last5 := stats.Utilization.Sections["Last 5 minutes"]
+	if last5.RequestsPerSec != 15.5 || last5.DNSMedianTime != 0.004 || last5.CPUUsagePercent != 2 {
+		t.Errorf("unexpected utilization: %+v", stats.Utilization)
+	}
+	fq := stats.FQDNCache
+	if fq.Hits != 80 || len(fq.Entries) != 2 || fq.Entries[0].Flags != "H" || fq.Entries[1].TTL != 2000 ||
+		fq.Entries[1].Hostnames[0] != "example.com" {
+		t.Errorf("unexpected fqdncache: %+v", fq)
+	}
+}
+
+func TestGetSquidStatsReport(t *testing.T) {
+	server := fakeCacheManager()
+	defer server.Close()
+	orig := cacheManager
+	cacheManager = newCacheManagerClient(server.URL)
+	defer func() { cacheManager = orig }()
+
+	router := setupTestRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/squid/stats/5min", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"worker":"kid2"`) {
+		t.Errorf("unexpected 5min response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/squid/stats/bogus", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown report, got %d", w.Code)
+	}
+
+	server.Close()
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/squid/stats", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"errors"`) {
+		t.Errorf("expected per-report errors when squid is unreachable: %s", w.Body.String())
+	}
+}
+
+// enableAuth turns on authentication for one test and creates an account
+func enableAuth(t *testing.T, username, password, role string) {
+	t.Helper()
+	authEnabled = true
+	origCost := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	t.Cleanup(func() {
+		authEnabled = false
+		bcryptCost = origCost
+	})
+	if _, err := users.create(username, password, role); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+}
+
+// login posts credentials and returns the session cookie and CSRF token
+func login(t *testing.T, router *gin.Engine, username, password string) (*http.Cookie, string) {
+	t.Helper()
+	form := url.Values{"username": {username}, "password": {password}}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login failed with %d: %s", w.Code, w.Body.String())
+	}
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookieName {
+			return c, response["csrf_token"]
+		}
+	}
+	t.Fatal("login did not set a session cookie")
+	return nil, ""
+}
+
+// postForm sends an urlencoded POST with an optional session cookie and CSRF token
+func postForm(router *gin.Engine, path string, form url.Values, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:40000"
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if csrf != "" {
+		req.Header.Set("X-CSRF-Token", csrf)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthRequiresSessionAndCSRF(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	enableAuth(t, "alice", "correct-horse", RoleAdmin)
+	router := setupTestRouter()
+
+	// The login form is rendered from html/
+	originalWd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(originalWd)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login") {
+		t.Errorf("expected redirect to login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = postForm(router, "/move-domain", url.Values{"domain": {"x.com"}, "target": {"whitelist"}}, nil, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without session, got %d", w.Code)
+	}
+
+	w = postForm(router, "/login", url.Values{"username": {"alice"}, "password": {"wrong-password"}}, nil, "")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid username or password") {
+		t.Errorf("expected login form with error for bad password, got %d", w.Code)
+	}
+
+	cookie, csrf := login(t, router, "alice", "correct-horse")
+	w = postForm(router, "/clear-all-logs", url.Values{}, cookie, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without CSRF token, got %d", w.Code)
+	}
+	w = postForm(router, "/clear-all-logs", url.Values{}, cookie, "not-the-token")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 with wrong CSRF token, got %d", w.Code)
+	}
+	w = postForm(router, "/clear-all-logs", url.Values{}, cookie, csrf)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with session and CSRF token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/squid/probe", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("probe target must stay public, got %d", w.Code)
+	}
+
+	w = postForm(router, "/logout", url.Values{}, cookie, csrf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout failed: %d", w.Code)
+	}
+	w = postForm(router, "/clear-all-logs", url.Values{}, cookie, csrf)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after logout, got %d", w.Code)
+	}
+}
+
+func TestUserStoreAndBootstrapAdmin(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	origCost := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	defer func() { bcryptCost = origCost }()
+
+	t.Setenv("SQUID_EDITOR_ADMIN_PASSWORD", "bootstrap-secret")
+	if err := ensureBootstrapAdmin(); err != nil {
+		t.Fatalf("ensureBootstrapAdmin: %v", err)
+	}
+	if _, ok := users.authenticate(BootstrapAdminUser, "bootstrap-secret"); !ok {
+		t.Fatal("bootstrap admin cannot log in")
+	}
+	if strings.Contains(readFile(usersPath()), "bootstrap-secret") {
+		t.Fatal("password stored in clear text")
+	}
+	// A second start must not reset the password
+	t.Setenv("SQUID_EDITOR_ADMIN_PASSWORD", "another-secret")
+	ensureBootstrapAdmin()
+	if _, ok := users.authenticate(BootstrapAdminUser, "bootstrap-secret"); !ok {
+		t.Error("bootstrap admin was recreated on second start")
+	}
+
+	if _, err := users.create("bob", "short", RoleViewer); err == nil {
+		t.Error("expected short password to be rejected")
+	}
+	if _, err := users.create("../bob", "long-enough", RoleViewer); err == nil {
+		t.Error("expected invalid username to be rejected")
+	}
+	if _, err := users.create(BootstrapAdminUser, "long-enough", RoleViewer); err == nil {
+		t.Error("expected duplicate username to be rejected")
+	}
+	if _, err := users.create("carol", "long-enough", "superuser"); err == nil {
+		t.Error("expected unknown role to be rejected")
+	}
+	if _, ok := users.authenticate("nobody", "bootstrap-secret"); ok {
+		t.Error("unknown user authenticated")
+	}
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://editor.local:8080/ws", nil)
+	req.Host = "editor.local:8080"
+	req.Header.Set("Origin", "http://editor.local:8080")
+	if !checkSameOrigin(req) {
+		t.Error("same origin rejected")
+	}
+	req.Header.Set("Origin", "http://evil.example")
+	if checkSameOrigin(req) {
+		t.Error("foreign origin accepted")
+	}
+}
+
+func TestRoleBasedAccess(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	enableAuth(t, "rita", "requester-pass", RoleRequester)
+	for _, u := range []struct{ name, role string }{{"vera", RoleViewer}, {"ed", RoleEditor}} {
+		if _, err := users.create(u.name, "password-"+u.name, u.role); err != nil {
+			t.Fatalf("create %s: %v", u.name, err)
+		}
+	}
+	router := setupTestRouter()
+
+	viewer, viewerCSRF := login(t, router, "vera", "password-vera")
+	requester, requesterCSRF := login(t, router, "rita", "requester-pass")
+	editor, editorCSRF := login(t, router, "ed", "password-ed")
+
+	move := func(cookie *http.Cookie, csrf, domain, target string) int {
+		return postForm(router, "/move-domain", url.Values{"domain": {domain}, "target": {target}}, cookie, csrf).Code
+	}
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		csrf   string
+		domain string
+		target string
+		want   int
+	}{
+		{"viewer cannot blacklist", viewer, viewerCSRF, "ads.com", "blacklist", http.StatusForbidden},
+		{"requester may blacklist", requester, requesterCSRF, "ads.com", "blacklist", http.StatusOK},
+		{"requester may not whitelist", requester, requesterCSRF, "new.com", "whitelist", http.StatusForbidden},
+		{"requester may not remove from whitelist", requester, requesterCSRF, "example.com", "unknown", http.StatusForbidden},
+		{"requester may remove from blacklist", requester, requesterCSRF, "ads.com", "unknown", http.StatusOK},
+		{"requester may not move a whitelisted domain to the blacklist", requester, requesterCSRF, "example.com", "blacklist", http.StatusForbidden},
+		{"editor may whitelist", editor, editorCSRF, "new.com", "whitelist", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := move(tt.cookie, tt.csrf, tt.domain, tt.target); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, got)
+		}
+	}
+	if !strings.Contains(readFile(whitelistPath), "example.com") {
+		t.Error("a refused move must leave the whitelist alone")
+	}
+
+	if w := postForm(router, "/clear-all-logs", url.Values{}, editor, editorCSRF); w.Code != http.StatusForbidden {
+		t.Errorf("editor must not clear logs, got %d", w.Code)
+	}
+	if w := postForm(router, "/users", url.Values{"username": {"x"}, "password": {"long-enough"}}, editor, editorCSRF); w.Code != http.StatusForbidden {
+		t.Errorf("editor must not manage users, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(requester)
+	router.ServeHTTP(w, req)
+	var me struct {
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &me)
+	if me.Role != RoleRequester || len(me.Permissions) != 3 {
+		t.Errorf("unexpected /me response: %s", w.Body.String())
+	}
+
+	// Role changes apply to existing sessions
+	if err := users.setRole("vera", RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	if got := move(viewer, viewerCSRF, "promoted.com", "whitelist"); got != http.StatusOK {
+		t.Errorf("expected promoted viewer to whitelist, got %d", got)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	enableAuth(t, "ed", "editor-pass", RoleEditor)
+	router := setupTestRouter()
+	cookie, csrf := login(t, router, "ed", "editor-pass")
+
+	create := func(form url.Values) (string, string) {
+		t.Helper()
+		w := postForm(router, "/tokens", form, cookie, csrf)
+		if w.Code != http.StatusOK {
+			t.Fatalf("create token failed with %d: %s", w.Code, w.Body.String())
+		}
+		var response struct {
+			Token   string   `json:"token"`
+			Details APIToken `json:"details"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if !strings.HasPrefix(response.Token, apiTokenPrefix) || response.Details.Hash != "" {
+			t.Fatalf("unexpected create response: %s", w.Body.String())
+		}
+		return response.Token, response.Details.ID
+	}
+	withToken := func(method, path string, form url.Values, secret string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.RemoteAddr = "192.0.2.10:40000"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Tokens cannot hold permissions their creator lacks
+	if w := postForm(router, "/tokens", url.Values{"name": {"ci"}, "permission": {PermManageUsers}}, cookie, csrf); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an ungrantable permission, got %d", w.Code)
+	}
+
+	secret, id := create(url.Values{"name": {"ci"}, "permission": {PermView, PermBlacklist, PermWhitelist}, "list": {"blacklist"}})
+
+	// Bearer requests skip CSRF but stay within the token's list scope
+	if w := withToken("POST", "/move-domain", url.Values{"domain": {"ads.com"}, "target": {"blacklist"}}, secret); w.Code != http.StatusOK {
+		t.Errorf("expected token to blacklist, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := withToken("POST", "/move-domain", url.Values{"domain": {"new.com"}, "target": {"whitelist"}}, secret); w.Code != http.StatusForbidden {
+		t.Errorf("expected token to be limited to the blacklist, got %d", w.Code)
+	}
+	if w := withToken("POST", "/reload", nil, secret); w.Code != http.StatusForbidden {
+		t.Errorf("expected token without squid:reload to be refused, got %d", w.Code)
+	}
+	if w := withToken("GET", "/tokens", nil, secret); w.Code != http.StatusForbidden {
+		t.Errorf("tokens must not manage tokens, got %d", w.Code)
+	}
+	if w := withToken("GET", "/lists", nil, "sqe_bogus"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", w.Code)
+	}
+
+	list, _ := tokens.list("ed")
+	if len(list) != 1 || list[0].LastUsedAt == nil || list[0].LastUsedIP != "192.0.2.10" {
+		t.Errorf("expected last use to be recorded, got %+v", list)
+	}
+
+	// A role downgrade limits existing tokens
+	if err := users.setRole("ed", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if w := withToken("POST", "/move-domain", url.Values{"domain": {"more-ads.com"}, "target": {"blacklist"}}, secret); w.Code != http.StatusForbidden {
+		t.Errorf("expected token to follow the owner's role, got %d", w.Code)
+	}
+	users.setRole("ed", RoleEditor)
+
+	if w := postForm(router, "/tokens/revoke", url.Values{"id": {id}}, cookie, csrf); w.Code != http.StatusOK {
+		t.Fatalf("revoke failed with %d: %s", w.Code, w.Body.String())
+	}
+	if w := withToken("GET", "/lists", nil, secret); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be refused, got %d", w.Code)
+	}
+
+	// Expired tokens are refused
+	expired := time.Now().Add(-time.Hour)
+	_, old, err := tokens.create(APIToken{Name: "old", Owner: "ed", Permissions: []string{PermView}, ExpiresAt: &expired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := withToken("GET", "/lists", nil, old); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected expired token to be refused, got %d", w.Code)
+	}
+
+	// Prometheus scrapes /metrics with a metrics:read token; anonymous scrapes are refused
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous metrics scrape to be refused, got %d", w.Code)
+	}
+	_, scraper, err := tokens.create(APIToken{Name: "prometheus", Owner: "ed", Permissions: []string{PermMetrics}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := withToken("GET", "/metrics", nil, scraper); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "squid_editor_") {
+		t.Errorf("expected the metrics token to scrape, got %d", w.Code)
+	}
+	if w := withToken("GET", "/lists", nil, scraper); w.Code != http.StatusForbidden {
+		t.Errorf("a metrics token must not read lists, got %d", w.Code)
+	}
+}
+
+// mockOIDC is a minimal OpenID provider: discovery, JWKS and a token endpoint that
+// checks the PKCE verifier and returns an RS256 ID token with the configured claims
+type mockOIDC struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	clientID  string
+	challenge string // code_challenge from the authorization request
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{key: key, clientID: "editor"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if user != m.clientID || secret != "s3cret" || r.PostForm.Get("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]interface{}{
+			"iss": m.server.URL, "aud": m.clientID, "nonce": m.nonce,
+			"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, claims), "token_type": "Bearer"})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// sign encodes claims as an RS256 JWT
+func (m *mockOIDC) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// startLogin follows /login/oidc and records what the editor sent to the provider
+func (m *mockOIDC) startLogin(t *testing.T, router *gin.Engine) (state string, cookie *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/login/oidc?next=/summary", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got %d: %s", w.Code, w.Body.String())
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	if !strings.HasPrefix(loc.String(), m.server.URL+"/authorize") || q.Get("code_challenge_method") != "S256" ||
+		q.Get("client_id") != m.clientID || !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("unexpected authorization request: %s", loc)
+	}
+	m.challenge = q.Get("code_challenge")
+	m.nonce = q.Get("nonce")
+	for _, c := range w.Result().Cookies() {
+		if c.Name == OIDCStateCookieName {
+			cookie = c
+		}
+	}
+	return q.Get("state"), cookie
+}
+
+func TestOIDCLogin(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	enableAuth(t, "admin", "local-admin-pass", RoleAdmin)
+	m := newMockOIDC(t)
+	oidc = newOIDCProvider(oidcConfig{
+		Issuer: m.server.URL, ClientID: m.clientID, ClientSecret: "s3cret",
+		RedirectURL: "http://editor.test/login/oidc/callback", Scopes: []string{"profile"},
+		UsernameClaim: "preferred_username", GroupsClaim: "groups",
+		RoleMap: map[string]string{"proxy-admins": RoleEditor, "helpdesk": RoleRequester},
+	})
+	defer func() { oidc = nil }()
+	router := setupTestRouter()
+
+	// The login page is rendered from html/
+	originalWd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(originalWd)
+
+	callback := func(state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	m.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "sam", "groups": []string{"staff", "helpdesk", "proxy-admins"}}
+	state, cookie := m.startLogin(t, router)
+	w := callback(state, "good-code", cookie)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/summary" {
+		t.Fatalf("expected redirect after login, got %d: %s", w.Code, w.Body.String())
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookieName {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("SSO login did not set a session cookie")
+	}
+	u, _ := users.get("sam")
+	if u == nil || u.Role != RoleEditor || u.Provider != "oidc" || u.PasswordHash != "" {
+		t.Fatalf("unexpected SSO account: %+v", u)
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me", nil)
+	req.AddCookie(session)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"role":"editor"`) {
+		t.Errorf("SSO session not accepted: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := users.authenticate("sam", ""); ok {
+		t.Error("SSO accounts must not log in with a password")
+	}
+
+	// A state is single use and must match the browser's cookie
+	if w := callback(state, "good-code", cookie); w.Code == http.StatusSeeOther {
+		t.Error("expected a replayed state to be refused")
+	}
+	state, _ = m.startLogin(t, router)
+	if w := callback(state, "good-code", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without the state cookie, got %d", w.Code)
+	}
+
+	// The provider refuses a wrong code
+	state, cookie = m.startLogin(t, router)
+	if w := callback(state, "bad-code", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a rejected code, got %d", w.Code)
+	}
+
+	// Group changes update the role; unmapped users are refused without a default role
+	m.claims["groups"] = []string{"helpdesk"}
+	state, cookie = m.startLogin(t, router)
+	callback(state, "good-code", cookie)
+	if u, _ := users.get("sam"); u == nil || u.Role != RoleRequester {
+		t.Errorf("expected role to follow groups, got %+v", u)
+	}
+	m.claims = map[string]interface{}{"sub": "u-2", "preferred_username": "guest", "groups": []string{"staff"}}
+	state, cookie = m.startLogin(t, router)
+	if w := callback(state, "good-code", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unmapped user, got %d", w.Code)
+	}
+
+	// SSO never takes over a local account
+	m.claims = map[string]interface{}{"sub": "u-3", "preferred_username": "admin", "groups": []string{"proxy-admins"}}
+	state, cookie = m.startLogin(t, router)
+	if w := callback(state, "good-code", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a local username, got %d", w.Code)
+	}
+
+	// Tokens signed by another key are rejected
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged := &mockOIDC{key: other}
+	raw := forged.sign(t, map[string]interface{}{"iss": m.server.URL, "aud": m.clientID, "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := oidc.verifyIDToken(raw, "", time.Now()); err == nil {
+		t.Error("expected a forged ID token to be rejected")
+	}
+}
+
+func TestAuditLogConcurrentWriters(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+
+	// Separate logs stand in for the server and the command-line interface
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			writer := &auditLog{}
+			for i := 0; i < 50; i++ {
+				if _, err := writer.append(AuditEntry{Actor: fmt.Sprintf("writer%d", w), Action: AuditReload, Result: AuditSuccess}, time.Now()); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	chain, err := (&auditLog{}).scan(nil)
+	if err != nil || !chain.Valid || chain.Entries != 400 {
+		t.Errorf("concurrent appends forked the chain: %+v %v", chain, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	enableAuth(t, "root", "admin-password", RoleAdmin)
+	if _, err := users.create("rita", "requester-pass", RoleRequester); err != nil {
+		t.Fatal(err)
+	}
+	router := setupTestRouter()
+	admin, adminCSRF := login(t, router, "root", "admin-password")
+	requester, requesterCSRF := login(t, router, "rita", "requester-pass")
+
+	postForm(router, "/move-domain", url.Values{"domain": {"ads.com"}, "target": {"blacklist"}, "note": {"tracking"}}, requester, requesterCSRF)
+	postForm(router, "/move-domain", url.Values{"domain": {"new.com"}, "target": {"whitelist"}}, requester, requesterCSRF)
+	postForm(router, "/move-domain", url.Values{"domain": {"ads.com"}, "target": {"whitelist"}}, admin, adminCSRF)
+	postForm(router, "/clear-all-logs", url.Values{"reason": {"cleanup"}}, admin, adminCSRF)
+
+	audit := func(cookie *http.Cookie, query string) (int, []AuditEntry, auditChain) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/audit?"+query, nil)
+		req.AddCookie(cookie)
+		router.ServeHTTP(w, req)
+		var response struct {
+			Entries []AuditEntry `json:"entries"`
+			Chain   auditChain   `json:"chain"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Entries, response.Chain
+	}
+
+	if code, _, _ := audit(requester, ""); code != http.StatusForbidden {
+		t.Errorf("requester must not read the audit log, got %d", code)
+	}
+	code, entries, chain := audit(admin, "")
+	if code != http.StatusOK || len(entries) != 4 || !chain.Valid || chain.Head != entries[3].Hash {
+		t.Fatalf("unexpected audit response %d: %+v %+v", code, entries, chain)
+	}
+	first := entries[0]
+	if first.Actor != "rita" || first.Action != AuditMoveDomain || first.Domain != "ads.com" || first.From != "unknown" ||
+		first.To != "blacklist" || first.Note != "tracking" || first.Result != AuditSuccess || first.Reload != "ok" || first.SourceIP != "192.0.2.1" {
+		t.Errorf("unexpected first entry: %+v", first)
+	}
+	if entries[1].Result != AuditDenied || entries[1].Reload != "" {
+		t.Errorf("expected denied entry without reload, got %+v", entries[1])
+	}
+	if entries[2].From != "blacklist" || entries[2].To != "whitelist" || entries[2].PrevHash != entries[1].Hash {
+		t.Errorf("unexpected move entry: %+v", entries[2])
+	}
+	if entries[3].Action != AuditClearLogs || entries[3].Note != "cleanup" || !strings.Contains(entries[3].Target, "archive ") {
+		t.Errorf("unexpected clear entry: %+v", entries[3])
+	}
+
+	if _, got, _ := audit(admin, "actor=rita&result=denied"); len(got) != 1 || got[0].Domain != "new.com" {
+		t.Errorf("actor/result filter returned %+v", got)
+	}
+	if _, got, _ := audit(admin, "action=domain.&domain=ads"); len(got) != 2 {
+		t.Errorf("action prefix/domain filter returned %d entries", len(got))
+	}
+	if _, got, _ := audit(admin, "limit=1"); len(got) != 1 || got[0].Action != AuditClearLogs {
+		t.Errorf("limit should keep the newest entry, got %+v", got)
+	}
+
+	// Editing an entry breaks the chain from that line on
+	data, _ := os.ReadFile(auditPath())
+	os.WriteFile(auditPath(), bytes.Replace(data, []byte(`"note":"tracking"`), []byte(`"note":"approved"`), 1), 0600)
+	if _, _, chain := audit(admin, ""); chain.Valid || chain.BrokenAt != 1 {
+		t.Errorf("expected tampering to be detected at line 1, got %+v", chain)
+	}
+}
+
+func TestAccessRequestWorkflow(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	enableAuth(t, "ed", "editor-pass", RoleEditor)
+	if _, err := users.create("rita", "requester-pass", RoleRequester); err != nil {
+		t.Fatal(err)
+	}
+	router := setupTestRouter()
+
+	// Pages are rendered from html/
+	originalWd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(originalWd)
+
+	request := func(form url.Values) (int, AccessRequest) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/request-access", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.RemoteAddr = "10.1.2.3:5555"
+		router.ServeHTTP(w, req)
+		var response struct {
+			Request AccessRequest `json:"request"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Request
+	}
+	status := func(id string) AccessRequest {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/request-access/"+id, nil)
+		req.Header.Set("Accept", "application/json")
+		router.ServeHTTP(w, req)
+		var response struct {
+			Request AccessRequest `json:"request"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Request
+	}
+
+	// The form and requests need no login
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/request-access?domain=docs.example.org", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="docs.example.org"`) {
+		t.Fatalf("expected prefilled request form, got %d", w.Code)
+	}
+	code, first := request(url.Values{"domain": {"https://Docs.Example.org/guide"}, "requester": {"pat@example.org"}, "justification": {"vendor\ndocumentation"}})
+	if code != http.StatusOK || first.Domain != "docs.example.org" || first.Status != RequestPending || first.Justification != "vendor documentation" {
+		t.Fatalf("unexpected request %d: %+v", code, first)
+	}
+	if _, again := request(url.Values{"domain": {"docs.example.org"}, "requester": {"pat"}, "justification": {"again"}}); again.ID != first.ID {
+		t.Errorf("expected a repeated request to return the pending one")
+	}
+	if code, _ := request(url.Values{"domain": {"not a domain"}, "requester": {"pat"}, "justification": {"x"}}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid domain, got %d", code)
+	}
+	_, second := request(url.Values{"domain": {"games.example.net"}, "requester": {"pat"}, "justification": {"team event"}})
+	if got := status(first.ID); got.Status != RequestPending || got.ClientIP != "" {
+		t.Errorf("unexpected status lookup: %+v", got)
+	}
+
+	editor, editorCSRF := login(t, router, "ed", "editor-pass")
+	requester, requesterCSRF := login(t, router, "rita", "requester-pass")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/access-requests", nil)
+	req.AddCookie(editor)
+	router.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"count":2`) {
+		t.Errorf("expected two pending requests, got %s", w.Body.String())
+	}
+
+	if w := postForm(router, "/access-requests/"+first.ID+"/approve", nil, requester, requesterCSRF); w.Code != http.StatusForbidden {
+		t.Errorf("requester must not approve, got %d", w.Code)
+	}
+	if w := postForm(router, "/access-requests/"+first.ID+"/approve", nil, editor, editorCSRF); w.Code != http.StatusOK {
+		t.Fatalf("approve failed with %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(readFile(whitelistPath), "docs.example.org") || !strings.Contains(readFile(whitelistPath), "requested by pat@example.org") {
+		t.Errorf("approved domain not whitelisted: %q", readFile(whitelistPath))
+	}
+	if got := status(first.ID); got.Status != RequestApproved || got.DecidedAt == nil || got.DecidedBy != "" {
+		t.Errorf("unexpected approved status: %+v", got)
+	}
+	if w := postForm(router, "/access-requests/"+first.ID+"/deny", nil, editor, editorCSRF); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a decided request, got %d", w.Code)
+	}
+
+	if w := postForm(router, "/access-requests/"+second.ID+"/deny", url.Values{"note": {"not work related"}}, editor, editorCSRF); w.Code != http.StatusOK {
+		t.Fatalf("deny failed with %d: %s", w.Code, w.Body.String())
+	}
+	if got := status(second.ID); got.Status != RequestDenied || got.DecisionNote != "not work related" {
+		t.Errorf("unexpected denied status: %+v", got)
+	}
+	if strings.Contains(readFile(whitelistPath), "games.example.net") {
+		t.Error("denied domain must not be whitelisted")
+	}
+
+	entries, _, _, _ := auditTrail.query(auditQuery{Action: "request."})
+	if len(entries) != 4 || entries[2].Action != AuditApprove || entries[2].Reload != "ok" || entries[2].Actor != "ed" {
+		t.Errorf("unexpected request audit entries: %+v", entries)
+	}
+}
+
+func TestAccessRequestStorage(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+
+	// Free text is cut on a character boundary
+	if got := singleLine("ab\u00fc\u00fc", 3); got != "ab" {
+		t.Errorf("singleLine cut inside a character: %q", got)
+	}
+	if got := singleLine("  caf\u00e9  au  lait ", 7); got != "caf\u00e9 a" {
+		t.Errorf("unexpected singleLine result %q", got)
+	}
+
+	// Pending requests are kept, decided ones only up to the retention limit
+	base := time.Date(2024, 4, 3, 12, 0, 0, 0, time.UTC)
+	var list []AccessRequest
+	for i := 0; i < DecidedRequestRetention+5; i++ {
+		at := base.Add(time.Duration(i) * time.Minute)
+		list = append(list, AccessRequest{ID: fmt.Sprint(i), Domain: "d.example", Status: RequestDenied, CreatedAt: at, DecidedAt: &at})
+	}
+	list = append(list, AccessRequest{ID: "pending", Domain: "p.example", Status: RequestPending, CreatedAt: base})
+	if err := accessRequests.save(list); err != nil {
+		t.Fatal(err)
+	}
+	all, _ := accessRequests.list("")
+	pending, _ := accessRequests.list(RequestPending)
+	if len(all) != DecidedRequestRetention+1 || len(pending) != 1 {
+		t.Errorf("expected %d requests after pruning, got %d", DecidedRequestRetention+1, len(all))
+	}
+	if r, _ := accessRequests.get("4"); r != nil {
+		t.Error("the oldest decided requests should be pruned")
+	}
+}
+
+func TestForwardedForNeedsTrustedProxy(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	originalProxies := trustedProxies
+	defer func() { trustedProxies = originalProxies }()
+
+	sourceIP := func(router *gin.Engine, domain string) string {
+		form := url.Values{"domain": {domain}, "target": {"blacklist"}}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/move-domain", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "10.9.9.9")
+		req.RemoteAddr = "172.28.0.2:5555"
+		router.ServeHTTP(w, req)
+		entries, _, _, err := auditTrail.query(auditQuery{Domain: domain})
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("expected one audit entry for %s: %v %+v", domain, err, entries)
+		}
+		return entries[0].SourceIP
+	}
+
+	trustedProxies = nil
+	if got := sourceIP(setupTestRouter(), "one.example.org"); got != "172.28.0.2" {
+		t.Errorf("forwarded address used without a trusted proxy: %q", got)
+	}
+	trustedProxies = []string{"172.28.0.2"}
+	if got := sourceIP(setupTestRouter(), "two.example.org"); got != "10.9.9.9" {
+		t.Errorf("forwarded address of a trusted proxy ignored: %q", got)
+	}
+
+	// A forged header cannot get around the per-client limit
+	trustedProxies = []string{"172.28.0.2"}
+	router := setupTestRouter()
+	codes := []int{}
+	for i := 0; i < MaxPendingRequestsPerClient+1; i++ {
+		form := url.Values{"domain": {fmt.Sprintf("site%d.example.org", i)}, "requester": {"pat"}, "justification": {"work"}}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/request-access", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.0.%d, 10.7.7.7", i))
+		req.RemoteAddr = "172.28.0.2:5555"
+		router.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if codes[MaxPendingRequestsPerClient-1] != http.StatusOK || codes[MaxPendingRequestsPerClient] != http.StatusBadRequest {
+		t.Errorf("expected the per-client limit despite forged addresses, got %v", codes)
+	}
+
+	trustedProxies = []string{"not-an-address"}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected invalid trusted proxies to be refused")
+		}
+	}()
+	setupTestRouter()
+}
+
+func TestMatchesDstdomain(t *testing.T) {
+	tests := []struct {
+		host, entry string
+		want        bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", false},
+		{"www.example.com", ".example.com", true},
+		{"example.com", ".example.com", true},
+		{"badexample.com", ".example.com", false},
+		{"Example.COM.", "example.com", true},
+	}
+	for _, tt := range tests {
+		if got := matchesDstdomain(tt.host, tt.entry); got != tt.want {
+			t.Errorf("matchesDstdomain(%q, %q) = %v, want %v", tt.host, tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestBlockedPage(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	enableAuth(t, "admin", "admin-password", RoleAdmin)
+	writeFile(blacklistPath, ".ads.example")
+	router := setupTestRouter()
+
+	// The page is rendered from html/
+	originalWd, _ := os.Getwd()
+	os.Chdir("..")
+	defer os.Chdir(originalWd)
+
+	blocked := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/blocked?"+query, nil)
+		req.RemoteAddr = "10.0.0.7:5000"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := blocked(url.Values{"url": {"http://track.ads.example/pixel?a=1"}, "host": {"track.ads.example"}}.Encode())
+	if w.Code != http.StatusForbidden || !containsAll(w.Body.String(), []string{"blacklisted (.ads.example)", "track.ads.example/pixel", "Client: 10.0.0.7"}) {
+		t.Errorf("unexpected blacklisted block page %d: %s", w.Code, w.Body.String())
+	}
+
+	// Without a host parameter the URL is used
+	w = blocked(url.Values{"url": {"http://new.example.org:8080/x"}}.Encode())
+	if !containsAll(w.Body.String(), []string{"not on the whitelist", `href="/request-access?domain=new.example.org"`}) {
+		t.Errorf("unexpected unknown block page: %s", w.Body.String())
+	}
+
+	// A client with a pending request gets a link to its status instead
+	req, _, err := accessRequests.create(AccessRequest{Domain: "new.example.org", Requester: "pat", Justification: "docs", ClientIP: "10.0.0.7"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = blocked("host=new.example.org")
+	if !strings.Contains(w.Body.String(), "/request-access/"+req.ID) || strings.Contains(w.Body.String(), "?domain=") {
+		t.Errorf("expected link to the pending request: %s", w.Body.String())
+	}
+}
+
+// useWebhookDispatcher installs a dispatcher with fast retries and one worker for the duration of a test
+func useWebhookDispatcher(t *testing.T) *webhookDispatcher {
+	d := newWebhookDispatcher()
+	d.retryBase = time.Millisecond
+	d.start(1)
+	orig := webhooks
+	webhooks = d
+	t.Cleanup(func() {
+		webhooks = orig
+		close(d.queue)
+	})
+	return d
+}
+
+// waitForDelivery polls the delivery log until a delivery leaves the pending state
+func waitForDelivery(t *testing.T, d *webhookDispatcher, webhookID, event string) webhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, r := range d.recent(webhookID, 0) {
+			if r.Event == event && r.Status != DeliveryPending {
+				return r
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no finished %s delivery for webhook %s", event, webhookID)
+	return webhookDelivery{}
+}
+
+func TestWebhooks(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	d := useWebhookDispatcher(t)
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var got []received
+	failures := 1 // the first signed delivery fails once
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/signed" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		got = append(got, received{r.Header.Clone(), body})
+	}))
+	defer receiver.Close()
+	router := setupTestRouter()
+
+	save := func(hook map[string]interface{}) (*httptest.ResponseRecorder, Webhook) {
+		data, _ := json.Marshal(hook)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/webhooks", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response struct {
+			Webhook Webhook `json:"webhook"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response.Webhook
+	}
+
+	if w, _ := save(map[string]interface{}{"name": "bad", "url": receiver.URL, "template": `{"text": {{.Text}}}`, "enabled": true}); w.Code != http.StatusBadRequest {
+		t.Errorf("a template producing invalid JSON must be rejected, got %d", w.Code)
+	}
+	if w, _ := save(map[string]interface{}{"name": "bad", "url": receiver.URL, "events": []string{"nope"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown event must be rejected, got %d", w.Code)
+	}
+	_, chat := save(map[string]interface{}{"name": "chat", "url": receiver.URL + "/chat", "events": []string{EventListChanged}, "template": `{"text": {{json .Text}}}`, "enabled": true})
+	_, signed := save(map[string]interface{}{"name": "signed", "url": receiver.URL + "/signed", "secret": "s3cret", "enabled": true})
+	if chat.ID == "" || signed.Secret != "********" {
+		t.Fatalf("unexpected saved webhooks: %+v %+v", chat, signed)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/webhooks", nil)
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("webhook secrets must not be listed: %s", w.Body.String())
+	}
+
+	// Saving a webhook as listed, masked secret included, keeps its secret
+	var listed struct {
+		Webhooks []map[string]interface{} `json:"webhooks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	for _, hook := range listed.Webhooks {
+		if hook["id"] == signed.ID {
+			hook["name"] = "signed again"
+			if w, _ := save(hook); w.Code != http.StatusOK {
+				t.Fatalf("saving a listed webhook failed: %d %s", w.Code, w.Body.String())
+			}
+		}
+	}
+	if stored, _ := webhookConfig.get(signed.ID); stored == nil || stored.Name != "signed again" || stored.Secret != "s3cret" {
+		t.Errorf("secret not kept when saving a listed webhook: %+v", stored)
+	}
+
+	postForm(router, "/move-domain", url.Values{"domain": {"new.com"}, "target": {"whitelist"}, "note": {"vendor"}}, nil, "")
+	chatDelivery := waitForDelivery(t, d, chat.ID, EventListChanged)
+	signedDelivery := waitForDelivery(t, d, signed.ID, EventListChanged)
+	if chatDelivery.Status != DeliveryDelivered || chatDelivery.Attempts != 1 {
+		t.Errorf("unexpected chat delivery: %+v", chatDelivery)
+	}
+	if signedDelivery.Status != DeliveryDelivered || signedDelivery.Attempts != 2 {
+		t.Errorf("expected the signed delivery to succeed on the retry: %+v", signedDelivery)
+	}
+
+	mu.Lock()
+	for _, r := range got {
+		if r.header.Get("X-Squid-Editor-Event") != EventListChanged {
+			t.Errorf("unexpected event header %q", r.header.Get("X-Squid-Editor-Event"))
+		}
+		if sig := r.header.Get("X-Squid-Editor-Signature"); sig != "" {
+			if want := signWebhook("s3cret", r.header.Get("X-Squid-Editor-Timestamp"), r.body); sig != want {
+				t.Errorf("bad signature %s, want %s", sig, want)
+			}
+			var event webhookEvent
+			json.Unmarshal(r.body, &event)
+			if event.Data["domain"] != "new.com" || event.Data["from"] != "unknown" || event.Data["to"] != "whitelist" || event.Data["note"] != "vendor" {
+				t.Errorf("unexpected default payload: %s", r.body)
+			}
+		} else if !strings.HasPrefix(string(r.body), `{"text": "`) || !strings.Contains(string(r.body), "moved new.com from unknown to whitelist (vendor)") {
+			t.Errorf("unexpected templated payload: %s", r.body)
+		}
+	}
+	if len(got) != 2 {
+		t.Errorf("expected 2 successful deliveries, got %d", len(got))
+	}
+	mu.Unlock()
+
+	// The delivery log is filtered by webhook
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/webhooks/deliveries?webhook="+signed.ID, nil)
+	router.ServeHTTP(w, req)
+	var log struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &log)
+	if len(log.Deliveries) != 1 || log.Deliveries[0].ID != signedDelivery.ID {
+		t.Errorf("unexpected delivery log: %s", w.Body.String())
+	}
+
+	// The first pass over existing logs seeds the seen set; later RG hosts are announced once
+	li := newLogIngester()
+	li.ingestOnce(time.Now())
+	f, _ := os.OpenFile(accessLogRegularPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("1712175200.000 10.0.0.9 GET 200 brand-new.org brand-new.org:443\n")
+	f.Close()
+	li.ingestOnce(time.Now())
+	li.ingestOnce(time.Now())
+	first := waitForDelivery(t, d, signed.ID, EventDomainFirstSeen)
+	if first.Status != DeliveryDelivered {
+		t.Errorf("unexpected first sighting delivery: %+v", first)
+	}
+	sightings := 0
+	for _, r := range d.recent("", 0) {
+		if r.Event == EventDomainFirstSeen {
+			sightings++
+		}
+	}
+	if sightings != 1 {
+		t.Errorf("expected one first sighting (only the subscribed webhook, only once), got %d", sightings)
+	}
+
+	// Squid going down notifies subscribers of every event
+	up := true
+	h := newSquidHealthChecker(func() healthProbe {
+		if up {
+			return healthProbe{TCP: true, Proxy: true}
+		}
+		return healthProbe{Err: fmt.Errorf("connection refused")}
+	})
+	h.checkOnce()
+	up = false
+	h.checkOnce()
+	if r := waitForDelivery(t, d, signed.ID, EventSquidDown); r.Status != DeliveryDelivered {
+		t.Errorf("unexpected squid.down delivery: %+v", r)
+	}
+
+	// A payload that fails to render is recorded as failed, never left pending
+	broken := Webhook{ID: "broken", Name: "broken", URL: receiver.URL, Template: `{"text": {{.Text}}}`, Enabled: true}
+	for i := 0; i < 20; i++ {
+		d.enqueue(broken, webhookEvent{ID: fmt.Sprint(i), Type: EventListChanged, Text: "moved"})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending := 0
+		for _, r := range d.recent("broken", 0) {
+			if r.Status == DeliveryPending {
+				pending++
+			} else if r.Status != DeliveryFailed || !strings.Contains(r.Error, "template") {
+				t.Fatalf("unexpected broken delivery: %+v", r)
+			}
+		}
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deliveries left pending", pending)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// smtpMessage is one message accepted by fakeSMTP
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP is a minimal SMTP server accepting every message, standing in for a mail relay
+func fakeSMTP(t *testing.T) (addr string, messages chan smtpMessage) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages = make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 fake ESMTP")
+				var msg smtpMessage
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(line)
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						tp.PrintfLine("250 fake")
+					case strings.HasPrefix(cmd, "MAIL FROM:"):
+						msg = smtpMessage{From: strings.Trim(line[10:], "<>")}
+						tp.PrintfLine("250 ok")
+					case strings.HasPrefix(cmd, "RCPT TO:"):
+						msg.To = append(msg.To, strings.Trim(line[8:], "<>"))
+						tp.PrintfLine("250 ok")
+					case cmd == "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, err := tp.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						msg.Data = string(data)
+						messages <- msg
+						tp.PrintfLine("250 queued")
+					case cmd == "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestEmailDigest(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	addr, messages := fakeSMTP(t)
+	cfg := defaultDigestConfig()
+	cfg.SMTPAddr, cfg.From, cfg.To = addr, "proxy@example.org", []string{"admins@example.org", "sec@example.org"}
+	orig := digest
+	digest = newDigestMailer(cfg)
+	defer func() { digest = orig }()
+
+	// old.example was first seen long before the period; allowed.org has been whitelisted since
+	os.WriteFile(seenDomainsPath(), []byte(`{"old.example":"2024-01-01T00:00:00Z"}`), 0644)
+	writeFile(accessLogRegularPath, ""+
+		"1712100000.000 10.0.0.1 GET 200 before.example before.example:80\n"+
+		"1712175102.000 10.0.0.1 GET 200 new.example new.example:443\n"+
+		"1712175103.000 10.0.0.1 GET 200 new.example new.example:443\n"+
+		"1712175104.000 10.0.0.2 GET 200 new.example new.example:443\n"+
+		"1712175105.000 10.0.0.1 GET 200 old.example old.example:80\n"+
+		"1712175106.000 10.0.0.2 GET 200 allowed.org allowed.org:443\n")
+	writeFile(accessLogBlacklistPath, "1712175107.000 10.0.0.2 GET 403 blocked.com blocked.com:443\n")
+
+	since, until := time.Unix(1712170000, 0), time.Unix(1712180000, 0)
+	report, err := buildDigestReport(since, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.NewUnknown) != 1 || report.NewUnknown[0].Domain != "new.example" || report.NewUnknown[0].Count != 3 || report.NewUnknown[0].Clients != 2 {
+		t.Errorf("unexpected new unknown domains: %+v", report.NewUnknown)
+	}
+	if len(report.Unknown) != 1 || report.Unknown[0].Domain != "old.example" {
+		t.Errorf("unexpected unknown domains: %+v", report.Unknown)
+	}
+	if len(report.Blocked) != 1 || report.Blocked[0].Domain != "blocked.com" || report.UnknownRequests != 4 || report.BlockedRequests != 1 {
+		t.Errorf("unexpected blocked domains: %+v", report)
+	}
+	if len(report.Clients) != 2 || report.Clients[0].ClientIP != "10.0.0.1" || report.Clients[0].Count != 3 || report.Clients[0].Domains[0].Domain != "new.example" {
+		t.Errorf("clients must be grouped and sorted by count: %+v", report.Clients)
+	}
+
+	router := setupTestRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/digest/preview?since=1712170000&until=1712180000", nil)
+	router.ServeHTTP(w, req)
+	var preview struct {
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if !strings.HasPrefix(preview.Subject, "[squid] 1 new unknown, 1 blocked domains") ||
+		!containsAll(preview.Body, []string{"     3  new.example  (2 clients)", "10.0.0.2: 2 requests", "blocked.com [BL]"}) {
+		t.Errorf("unexpected preview: %s", w.Body.String())
+	}
+
+	w = postForm(router, "/digest/send", url.Values{"since": {"1712170000"}, "until": {"1712180000"}}, nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("send failed: %d %s", w.Code, w.Body.String())
+	}
+	select {
+	case msg := <-messages:
+		if msg.From != "proxy@example.org" || len(msg.To) != 2 {
+			t.Errorf("unexpected envelope: %+v", msg)
+		}
+		if !containsAll(msg.Data, []string{"Subject: [squid] 1 new unknown", "To: admins@example.org, sec@example.org", "Content-Transfer-Encoding: quoted-printable", "new.example"}) {
+			t.Errorf("unexpected message:\n%s", msg.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message reached the SMTP server")
+	}
+
+	// The schedule skips empty periods and continues where the last digest ended
+	now := time.Unix(1712180000, 0)
+	if err := digest.runScheduled(now); err != nil {
+		t.Fatal(err)
+	}
+	<-messages
+	if err := digest.runScheduled(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := digest.loadState()
+	if !state.LastSkipped || !state.LastUntil.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the empty period to be skipped: %+v", state)
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("empty digest must not be mailed: %s", msg.Data)
+	default:
+	}
+
+	hourly := digestConfig{Schedule: DigestHourly}
+	daily := digestConfig{Schedule: DigestDaily, Hour: 8}
+	at := time.Date(2024, 4, 3, 9, 30, 0, 0, time.UTC)
+	if got := hourly.nextRun(at); !got.Equal(time.Date(2024, 4, 3, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next hourly run %v", got)
+	}
+	if got := daily.nextRun(at); !got.Equal(time.Date(2024, 4, 4, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next daily run %v", got)
+	}
+}
+
+// runCLIForTest runs a subcommand and returns its exit code, stdout and stderr
+func runCLIForTest(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLILocal(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+	d := useWebhookDispatcher(t)
+	dir := dataDir
+	var hooked []string
+	var hookMu sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		hookMu.Lock()
+		hooked = append(hooked, event.Data["domain"])
+		hookMu.Unlock()
+	}))
+	defer receiver.Close()
+	hook, err := webhookConfig.put(Webhook{Name: "chat", URL: receiver.URL, Events: []string{EventListChanged}, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, out, errOut := runCLIForTest("add", "whitelist", "new.com", "docs.new.com", "-note", "vendor", "-data-dir", dir, "-json")
+	var moved cliMoveResult
+	json.Unmarshal([]byte(out), &moved)
+	if code != 0 || len(moved.Moved) != 2 || moved.Moved[0].From != "unknown" || moved.Moved[0].To != "whitelist" {
+		t.Fatalf("add failed (%d): %s %s", code, out, errOut)
+	}
+	// Local moves are announced before the command returns
+	hookMu.Lock()
+	sort.Strings(hooked)
+	if len(hooked) != 2 || hooked[0] != "docs.new.com" || len(d.recent(hook.ID, 0)) != 2 {
+		t.Errorf("expected list.changed deliveries for both domains, got %v", hooked)
+	}
+	hookMu.Unlock()
+	if wl := readFile(whitelistPath); !strings.Contains(wl, "new.com") || !strings.Contains(wl, "# vendor") || fake.reconfigures != 1 {
+		t.Errorf("expected one write and one reload, got %d reloads:\n%s", fake.reconfigures, wl)
+	}
+	if code, _, errOut := runCLIForTest("add", "blacklist", "example.com", "-data-dir", dir); code != 1 || !strings.Contains(errOut, "already on the whitelist; use move") {
+		t.Errorf("add must refuse listed domains (%d): %s", code, errOut)
+	}
+
+	code, out, _ = runCLIForTest("move", "-data-dir", dir, "example.com", "blacklist")
+	if code != 0 || out != "example.com: whitelist -> blacklist\n" {
+		t.Errorf("unexpected move output (%d): %q", code, out)
+	}
+	runCLIForTest("remove", "allowed.org", "-data-dir", dir)
+
+	importFile := filepath.Join(t.TempDir(), "import.txt")
+	writeFile(importFile, "# vendor list\nads.example # tracking\nbad.site\n")
+	if code, out, _ := runCLIForTest("import", "blacklist", importFile, "-note", "imported", "-data-dir", dir); code != 0 || !strings.Contains(out, "bad.site: blacklist -> blacklist") {
+		t.Errorf("unexpected import output (%d): %s", code, out)
+	}
+
+	code, out, _ = runCLIForTest("list", "-data-dir", dir, "-json")
+	var lists map[string][]cliEntry
+	json.Unmarshal([]byte(out), &lists)
+	if code != 0 || len(lists["whitelist"]) != 2 || len(lists["blacklist"]) != 4 {
+		t.Errorf("unexpected lists: %s", out)
+	}
+	code, out, _ = runCLIForTest("export", "blacklist", "-data-dir", dir)
+	if code != 0 || !containsAll(out, []string{"ads.example  # tracking", "bad.site     # imported", "example.com\n"}) {
+		t.Errorf("unexpected export:\n%s", out)
+	}
+
+	code, out, _ = runCLIForTest("evaluate", "http://example.com/x", "docs.new.com", "other.org", "-data-dir", dir, "-json")
+	var evals []cliEvaluation
+	json.Unmarshal([]byte(out), &evals)
+	if code != 0 || len(evals) != 3 || evals[0].Action != "deny" || evals[0].List != "blacklist" || evals[1].Action != "allow" || evals[2].List != "unknown" {
+		t.Errorf("unexpected evaluation: %s", out)
+	}
+
+	// Local changes are recorded in the same audit log as the web UI's
+	code, out, _ = runCLIForTest("history", "-domain", "example.com", "-data-dir", dir, "-json")
+	var history []AuditEntry
+	json.Unmarshal([]byte(out), &history)
+	if code != 0 || len(history) != 1 || !strings.HasPrefix(history[0].Actor, "cli:") || history[0].From != "whitelist" {
+		t.Errorf("unexpected history: %s", out)
+	}
+
+	fake.err = fmt.Errorf("squid container not running")
+	code, _, errOut = runCLIForTest("remove", "new.com", "-data-dir", dir)
+	if code != 1 || !strings.Contains(errOut, "squid did not reload") || strings.Contains(readFile(whitelistPath), "new.com\n") {
+		t.Errorf("a failed reload must be reported (%d): %s", code, errOut)
+	}
+	if code, out, _ := runCLIForTest("frobnicate", "-json", "-data-dir", dir); code != 1 || !strings.Contains(out, `"error": "unknown command`) {
+		t.Errorf("unexpected output for an unknown command (%d): %s", code, out)
+	}
+}
+
+func TestListLockExcludesOtherProcesses(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+
+	// Another process (the command-line tool) holding the lock file
+	f, err := os.OpenFile(listLockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		if err := listMu.Lock(); err != nil {
+			t.Error(err)
+			return
+		}
+		close(locked)
+		listMu.Unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("listMu taken while another process holds the lock file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listMu not taken after the lock file was released")
+	}
+
+	// Lists are not written when the lock file cannot be locked
+	useFakeSquid(t)
+	f.Close()
+	os.Remove(listLockPath())
+	if err := os.Mkdir(listLockPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(listLockPath())
+	before := readFile(whitelistPath)
+	if _, err := moveDomain("test", "locked.com", "whitelist", ""); err == nil || readFile(whitelistPath) != before {
+		t.Errorf("list written without the lock (%v):\n%s", err, readFile(whitelistPath))
+	}
+}
+
+func TestCLIRemote(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+	enableAuth(t, "ed", "editor-pass", RoleEditor)
+	_, secret, err := tokens.create(APIToken{Name: "ci", Owner: "ed", Permissions: []string{PermView, PermWhitelist, PermBlacklist, PermReload}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	code, out, errOut := runCLIForTest("add", "whitelist", "new.com", "other.com", "-server", server.URL, "-token", secret, "-json")
+	var moved cliMoveResult
+	json.Unmarshal([]byte(out), &moved)
+	if code != 0 || len(moved.Moved) != 2 || fake.reconfigures != 1 {
+		t.Fatalf("remote add failed (%d): %s %s", code, out, errOut)
+	}
+	code, out, _ = runCLIForTest("list", "whitelist", "-server", server.URL, "-token", secret)
+	if code != 0 || !containsAll(out, []string{"allowed.org  # test note", "new.com", "other.com"}) || strings.Contains(out, "blocked.com") {
+		t.Errorf("unexpected remote list:\n%s", out)
+	}
+	code, out, _ = runCLIForTest("evaluate", "new.com", "-server", server.URL, "-token", secret)
+	if code != 0 || out != "new.com: allow (whitelist by new.com)\n" {
+		t.Errorf("unexpected remote evaluation (%d): %q", code, out)
+	}
+	if code, _, _ := runCLIForTest("reload", "-server", server.URL, "-token", secret); code != 0 || fake.reconfigures != 2 {
+		t.Errorf("remote reload failed (%d)", code)
+	}
+
+	// The API answers with the server's error; history needs audit:view
+	if code, _, errOut := runCLIForTest("history", "-server", server.URL, "-token", secret); code != 1 || !strings.Contains(errOut, "HTTP 403") {
+		t.Errorf("expected a permission error (%d): %s", code, errOut)
+	}
+	if code, _, errOut := runCLIForTest("list", "-server", server.URL, "-token", "sqe_wrong"); code != 1 || !strings.Contains(errOut, "401") {
+		t.Errorf("expected an authentication error (%d): %s", code, errOut)
+	}
+	if code, _, errOut := runCLIForTest("list", "-server", server.URL); code != 1 || !strings.Contains(errOut, "needs an API token") {
+		t.Errorf("expected a missing token error (%d): %s", code, errOut)
+	}
+}
+
+func TestRegistrableDomains(t *testing.T) {
+	for host, want := range map[string]string{
+		"a.b.example.co.uk":   "example.co.uk",
+		"foo.co.uk":           "foo.co.uk",
+		".example.com":        "example.com",
+		"d111.cloudfront.net": "d111.cloudfront.net", // private suffix: one customer per host
+		"co.uk":               "co.uk",
+		"localhost":           "localhost",
+		"192.168.1.1":         "192.168.1.1",
+	} {
+		if got := registrableDomain(host); got != want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", host, got, want)
+		}
+	}
+	// The public suffix is ignored like a TLD: apple.co.uk sorts by "apple", not by "co"
+	if !sortDomainsByParts("apple.co.uk", "banana.com") || sortDomainsByParts("banana.com", "apple.co.uk") {
+		t.Error("expected apple.co.uk before banana.com")
+	}
+	if !sortDomainsByParts("example.com", "cdn.example.com") || !sortDomainsByParts("10.0.0.1", "10.0.0.2") {
+		t.Error("unexpected order for subdomains or addresses")
+	}
+}
+
+func TestGroupedSummaryAndRegistrableWhitelist(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	writeFile(whitelistPath, "a.example.co.uk #old\n.other.com")
+	writeFile(accessLogBlacklistPath, "")
+	writeFile(accessLogRegularPath, ""+
+		"1712175102.000 10.0.0.1 GET 200 b.example.co.uk b.example.co.uk:443\n"+
+		"1712175103.000 10.0.0.1 GET 200 b.example.co.uk b.example.co.uk:443\n"+
+		"1712175104.000 10.0.0.1 GET 200 bar.co.uk bar.co.uk:443\n")
+	writeFile(accessLogWhitelistPath, ""+
+		"1712175105.000 10.0.0.1 GET 200 a.example.co.uk a.example.co.uk:443\n"+
+		"1712175106.000 10.0.0.1 GET 200 www.other.com www.other.com:443\n")
+	router := setupTestRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/summary-data?group=registrable", nil)
+	router.ServeHTTP(w, req)
+	var response struct {
+		Rows   []Row      `json:"rows"`
+		Groups []RowGroup `json:"groups"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	groups := map[string]RowGroup{}
+	for _, g := range response.Groups {
+		groups[g.Domain] = g
+	}
+	if len(response.Rows) != 4 || len(response.Groups) != 3 {
+		t.Fatalf("unexpected summary: %s", w.Body.String())
+	}
+	if g := groups["example.co.uk"]; g.Count != 3 || len(g.Children) != 2 || g.Status != "" || g.List != "" {
+		t.Errorf("unexpected example.co.uk group: %+v", g)
+	}
+	if g := groups["other.com"]; g.Status != EmojiWhitelist || g.List != "whitelist" {
+		t.Errorf("unexpected other.com group: %+v", g)
+	}
+	if g := groups["bar.co.uk"]; g.Count != 1 || g.Status != EmojiUnknown {
+		t.Errorf("bar.co.uk must be its own group, not part of co.uk: %+v", g)
+	}
+
+	// Whitelisting the registrable domain replaces the entries it covers
+	w = postForm(router, "/move-domain", url.Values{"domain": {".example.co.uk"}, "target": {"whitelist"}}, nil, "")
+	var moved struct {
+		Covered []string `json:"covered"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &moved)
+	if w.Code != http.StatusOK || len(moved.Covered) != 1 || moved.Covered[0] != "a.example.co.uk" {
+		t.Errorf("unexpected move response: %s", w.Body.String())
+	}
+	if wl := readFile(whitelistPath); strings.Contains(wl, "a.example.co.uk") || !strings.Contains(wl, ".example.co.uk") {
+		t.Errorf("unexpected whitelist:\n%s", wl)
+	}
+	if list, entry := domainPolicy("b.example.co.uk"); list != "whitelist" || entry != ".example.co.uk" {
+		t.Errorf("b.example.co.uk should now be whitelisted, got %s %s", list, entry)
+	}
+}
+
+func TestIDNConversionAndWarnings(t *testing.T) {
+	if got, err := toASCIIDomain(".Bücher.example"); err != nil || got != ".xn--bcher-kva.example" {
+		t.Errorf("toASCIIDomain = %q, %v", got, err)
+	}
+	if got := toUnicodeDomain("xn--bcher-kva.example"); got != "bücher.example" {
+		t.Errorf("toUnicodeDomain = %q", got)
+	}
+	if got, err := toListDomain("_dmarc.example.com"); err != nil || got != "_dmarc.example.com" {
+		t.Errorf("ASCII domains must pass unchanged, got %q, %v", got, err)
+	}
+	if _, err := toListDomain("a‍b.com"); err == nil {
+		t.Error("expected an error for a label with a joiner")
+	}
+	if !isDomainLike("bücher.example") {
+		t.Error("Unicode domains should be domain-like")
+	}
+	if alt := idnAlternate("xn--bcher-kva.example"); alt != "bücher.example" {
+		t.Errorf("idnAlternate = %q", alt)
+	}
+	for domain, want := range map[string]int{
+		"bücher.example":   0,
+		"例えtest.jp":        0, // Han, Hiragana and Latin are a normal mix
+		"пример.рф":        0,
+		"xn--pple-43d.com": 2, // Cyrillic а in "apple": mixed scripts and a lookalike
+		"аррӏе.com":        1, // all Cyrillic, but reads as "apple"
+		"google.com":       0,
+	} {
+		if got := domainWarnings(domain); len(got) != want {
+			t.Errorf("domainWarnings(%q) = %q, want %d warnings", domain, got, want)
+		}
+	}
+}
+
+func TestIDNListsAndSearch(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	writeFile(whitelistPath, "münchen.de # typed by hand\nexample.com")
+	writeFile(accessLogRegularPath, "1712175102.000 10.0.0.1 GET 200 xn--bcher-kva.example xn--bcher-kva.example:443\n")
+	router := setupTestRouter()
+
+	// Existing Unicode entries are rewritten as punycode
+	if err := normalizeDomainLists(); err != nil {
+		t.Fatal(err)
+	}
+	if wl := readFile(whitelistPath); !strings.Contains(wl, "xn--mnchen-3ya.de") || strings.Contains(wl, "münchen") || !strings.Contains(wl, "typed by hand") {
+		t.Errorf("unexpected whitelist:\n%s", wl)
+	}
+
+	// Unicode input is stored as punycode and returned in both forms
+	w := postForm(router, "/move-domain", url.Values{"domain": {"Bücher.example"}, "target": {"whitelist"}}, nil, "")
+	var moved struct {
+		Domain  string `json:"domain"`
+		Display string `json:"display"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &moved)
+	if w.Code != http.StatusOK || moved.Domain != "xn--bcher-kva.example" || moved.Display != "bücher.example" {
+		t.Errorf("unexpected move response: %d %s", w.Code, w.Body.String())
+	}
+	if list, _ := domainPolicy("xn--bcher-kva.example"); list != "whitelist" {
+		t.Errorf("punycode host should be whitelisted, got %s", list)
+	}
+
+	// Possible homographs need confirmation
+	form := url.Values{"domain": {"аpple.com"}, "target": {"whitelist"}}
+	w = postForm(router, "/move-domain", form, nil, "")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "warnings") {
+		t.Fatalf("expected a homograph warning, got %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(readFile(whitelistPath), "xn--pple-43d.com") {
+		t.Error("unconfirmed homograph must not be listed")
+	}
+	form.Set("confirm", "true")
+	if w = postForm(router, "/move-domain", form, nil, ""); w.Code != http.StatusOK {
+		t.Errorf("confirmed move failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// The API shows Unicode forms
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/lists", nil)
+	router.ServeHTTP(w, req)
+	var lists struct {
+		Unicode map[string]string `json:"unicode"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &lists)
+	if lists.Unicode["xn--mnchen-3ya.de"] != "münchen.de" || lists.Unicode["xn--pple-43d.com"] != "аpple.com" {
+		t.Errorf("unexpected unicode map: %v", lists.Unicode)
+	}
+	for _, row := range computeSummaryRows(mergeLogFiles()) {
+		if row.Domain == "xn--bcher-kva.example" && row.Display != "bücher.example" {
+			t.Errorf("summary row without display form: %+v", row)
+		}
+	}
+
+	// Search matches either form
+	for _, q := range []string{"bücher.example", "xn--bcher-kva"} {
+		if lines, _ := searchLogs(logQuery{Text: q}); len(lines) != 1 {
+			t.Errorf("search for %q found %d lines", q, len(lines))
+		}
+	}
+	if entries, _, _, err := auditTrail.query(auditQuery{Domain: "bücher.example"}); err != nil || len(entries) != 1 {
+		t.Errorf("audit search by Unicode form found %d entries (%v)", len(entries), err)
+	}
+}
+
+func TestNormalizeListDomain(t *testing.T) {
+	valid := map[string]string{
+		"Example.COM":                       "example.com",
+		"  https://Docs.Example.com:8443/a": "docs.example.com",
+		"example.com:443":                   "example.com",
+		"example.com/path?q=1":              "example.com",
+		"example.com.":                      "example.com",
+		"*.example.com":                     ".example.com",
+		".example.co.uk":                    ".example.co.uk",
+		"_dmarc.example.com":                "_dmarc.example.com",
+		"bücher.example":                    "xn--bcher-kva.example",
+		"10.0.0.1":                          "10.0.0.1",
+		"10.0.0.0/8":                        "10.0.0.0/8",
+		"10.0.0.1/32":                       "10.0.0.1",
+		"2001:DB8::/32":                     "2001:db8::/32",
+		"[2001:DB8::1]:443":                 "2001:db8::1",
+		"http://[2001:db8::1]/":             "2001:db8::1",
+		".github.io":                        ".github.io", // private suffix
+	}
+	for input, want := range valid {
+		if got, err := normalizeListDomain(input); err != nil || got != want {
+			t.Errorf("normalizeListDomain(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+	invalid := map[string]string{
+		"":                               "required",
+		"exa mple.com":                   "whitespace",
+		"example.com#note":               "note",
+		"10.0.0.1/8":                     "host bits",
+		"10.0.0.0/33":                    "invalid CIDR",
+		".10.0.0.1":                      "IP address",
+		"-bad.example.com":               "hyphen",
+		"a..example.com":                 "empty label",
+		"ex!ample.com":                   "contains",
+		strings.Repeat("a", 64) + ".com": "longer than 63",
+		"example.123":                    "numeric",
+		".com":                           "public suffix",
+		".co.uk":                         "public suffix",
+		"example.com:http":               "port",
+	}
+	for input, want := range invalid {
+		if _, err := normalizeListDomain(input); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("normalizeListDomain(%q) error = %v, want it to mention %q", input, err, want)
+		}
+	}
+}
+
+func TestMoveDomainValidation(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	writeFile(whitelistPath, "Legacy Entry.com # written by hand")
+	router := setupTestRouter()
+
+	w := postForm(router, "/move-domain", url.Values{"domain": {"HTTPS://New.Example.com/login"}, "target": {"whitelist"}, "note": {"line one\nline two"}}, nil, "")
+	if w.Code != http.StatusOK || !containsAll(readFile(whitelistPath), []string{"new.example.com ", "# line one line two\n"}) {
+		t.Errorf("unexpected result %d %s:\n%s", w.Code, w.Body.String(), readFile(whitelistPath))
+	}
+	w = postForm(router, "/move-domain", url.Values{"domain": {"bad#domain.com"}, "target": {"blacklist"}}, nil, "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "starts a note") {
+		t.Errorf("expected a validation error, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Bulk moves are all-or-nothing
+	body := `{"target": "blacklist", "domains": [{"domain": "ok.example.com"}, {"domain": "10.0.0.1/8"}]}`
+	req, _ := http.NewRequest("POST", "/move-domains", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || strings.Contains(readFile(blacklistPath), "ok.example.com") {
+		t.Errorf("expected the bulk move to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Entries that predate validation can still be removed as written
+	w = postForm(router, "/move-domain", url.Values{"domain": {"Legacy Entry.com"}, "target": {"unknown"}}, nil, "")
+	if w.Code != http.StatusOK || strings.Contains(readFile(whitelistPath), "Legacy") {
+		t.Errorf("legacy entry not removed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	writeFile(whitelistPath, "example.com\n192.168.1.10 # nas")
+	writeFile(whitelistIPPath, "10.1.2.3 # appliance")
+	writeFile(blacklistIPPath, "10.9.9.0/24 # lab")
+	writeFile(accessLogRegularPath, "1712175102.000 10.0.0.1 GET 200 10.5.5.5 10.5.5.5:443\n")
+	router := setupTestRouter()
+
+	// IP entries added to the domain lists by hand move to the IP lists
+	if err := migrateIPEntries(); err != nil {
+		t.Fatal(err)
+	}
+	if wl, wlIP := readFile(whitelistPath), readFile(whitelistIPPath); strings.Contains(wl, "192.168.1.10") || !strings.Contains(wlIP, "192.168.1.10  # nas") {
+		t.Errorf("unexpected lists after migration:\n%s\n--\n%s", wl, wlIP)
+	}
+
+	w := postForm(router, "/move-domain", url.Values{"domain": {"10.0.0.0/8"}, "target": {"whitelist"}}, nil, "")
+	var moved struct {
+		Covered  []string `json:"covered"`
+		Overlaps []string `json:"overlaps"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &moved)
+	if w.Code != http.StatusOK || len(moved.Covered) != 1 || moved.Covered[0] != "10.1.2.3" ||
+		len(moved.Overlaps) != 1 || moved.Overlaps[0] != "blacklist 10.9.9.0/24" {
+		t.Fatalf("unexpected move response: %d %s", w.Code, w.Body.String())
+	}
+	if wl, wlIP := readFile(whitelistPath), readFile(whitelistIPPath); strings.Contains(wl, "10.0.0.0/8") || wlIP != "10.0.0.0/8\n192.168.1.10  # nas" {
+		t.Errorf("unexpected lists:\n%s\n--\n%s", wl, wlIP)
+	}
+
+	for host, want := range map[string]string{"10.5.5.5": "whitelist 10.0.0.0/8", "10.9.9.5": "blacklist 10.9.9.0/24", "10.9.9.5:8443": "blacklist 10.9.9.0/24", "11.0.0.1": "unknown "} {
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/evaluate?host="+url.QueryEscape(host), nil)
+		router.ServeHTTP(w, req)
+		var ev struct{ List, Entry string }
+		json.Unmarshal(w.Body.Bytes(), &ev)
+		if got := ev.List + " " + ev.Entry; got != want {
+			t.Errorf("evaluate %s = %q, want %q", host, got, want)
+		}
+	}
+
+	for _, row := range computeSummaryRows(mergeLogFiles()) {
+		if row.Domain == "10.5.5.5" && (!row.IP || row.Range != "10.0.0.0/8") {
+			t.Errorf("unexpected IP row: %+v", row)
+		}
+	}
+	code, out, _ := runCLIForTest("list", "whitelist", "-data-dir", dataDir)
+	if code != 0 || out != "example.com\n10.0.0.0/8\n192.168.1.10  # nas\n" {
+		t.Errorf("unexpected CLI list (%d):\n%s", code, out)
+	}
+
+	if w = postForm(router, "/move-domain", url.Values{"domain": {"10.0.0.0/8"}, "target": {"unknown"}}, nil, ""); w.Code != http.StatusOK || strings.Contains(readFile(whitelistIPPath), "10.0.0.0/8") {
+		t.Errorf("range not removed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	writeFile(whitelistPath, "app.vendor.com\nexample.com")
+	writeFile(accessLogBlacklistPath, "")
+	writeFile(accessLogWhitelistPath, ""+
+		"1000.000 10.0.0.1 GET 200 app.vendor.com app.vendor.com:443\n"+
+		"1004.000 10.0.0.1 GET 200 app.vendor.com app.vendor.com:443\n"+
+		"2000.000 10.0.0.2 GET 200 app.vendor.com app.vendor.com:443\n")
+	writeFile(accessLogRegularPath, ""+
+		"1001.000 10.0.0.1 GET 200 cdn.vendor.com cdn.vendor.com:443\n"+
+		"1002.000 10.0.0.1 GET 200 tracker.ads tracker.ads:443\n"+
+		"1003.000 10.0.0.1 GET 200 example.com example.com:443\n"+ // whitelisted since
+		"1100.000 10.0.0.1 GET 200 later.example later.example:443\n"+
+		"1500.000 10.0.0.3 GET 200 tracker.ads tracker.ads:443\n"+
+		"1600.000 10.0.0.3 GET 200 tracker.ads tracker.ads:443\n"+
+		"1995.000 10.0.0.2 GET 200 api.other.net api.other.net:443\n"+
+		"2001.000 10.0.0.2 GET 200 cdn.vendor.com cdn.vendor.com:443\n"+
+		"2002.000 10.0.0.9 GET 200 other-client.example other-client.example:443\n")
+
+	report := findDependencies(mergeLogFiles(), "app.vendor.com", 10*time.Second, 10)
+	if report.Visits != 2 || report.Clients != 2 {
+		t.Fatalf("expected two visits by two clients, got %+v", report)
+	}
+	got := map[string]dependencySuggestion{}
+	var order []string
+	for _, s := range report.Suggestions {
+		got[s.Domain] = s
+		order = append(order, s.Domain)
+	}
+	if len(order) != 3 || order[0] != "cdn.vendor.com" {
+		t.Fatalf("unexpected suggestions %v", order)
+	}
+	if s := got["cdn.vendor.com"]; s.Score != 1 || s.Visits != 2 || s.Clients != 2 || !s.SameSite {
+		t.Errorf("unexpected cdn.vendor.com suggestion: %+v", s)
+	}
+	if s := got["tracker.ads"]; s.Support != 0.5 || s.Specificity != 0.333 || s.Score != 0.167 {
+		t.Errorf("a host requested everywhere should rank low: %+v", s)
+	}
+	if _, ok := got["api.other.net"]; !ok {
+		t.Error("requests just before a visit should count")
+	}
+
+	router := setupTestRouter()
+	for query, code := range map[string]int{
+		"domain=app.vendor.com&window=30s&limit=5": http.StatusOK,
+		"domain=":                         http.StatusBadRequest,
+		"domain=app.vendor.com&window=1h": http.StatusBadRequest,
+		"domain=app.vendor.com&limit=0":   http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/dependencies?"+query, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("GET /dependencies?%s = %d, want %d: %s", query, w.Code, code, w.Body.String())
+		}
+	}
+}
+
+func TestCategories(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	defer func() { categories = &categoryDB{} }()
+	os.MkdirAll(filepath.Join(categoriesDir(), "adult"), 0755)
+	os.MkdirAll(filepath.Join(categoriesDir(), "recreation", "sports"), 0755)
+	writeFile(filepath.Join(categoriesDir(), "adult", "domains"), "adult.example\nmixed.example\n10.1.1.1\n# comment\n")
+	writeFile(filepath.Join(categoriesDir(), "adult", "urls"), "adult.example/path\n")
+	writeFile(filepath.Join(categoriesDir(), "recreation", "sports", "domains"), "scores.example\n")
+	writeFile(filepath.Join(categoriesDir(), "extra.csv"), "domain,category\nnews.example,News\nmixed.example,news;adult\nblog.news.example,blog\n")
+	writeFile(whitelistPath, "example.com\nok.adult.example\nmixed.example")
+	writeFile(accessLogRegularPath, "1712175102.000 192.168.1.1 GET 200 www.news.example www.news.example:443\n"+
+		"1712175103.000 192.168.1.1 GET 200 blog.news.example blog.news.example:443\n"+
+		"1712175104.000 192.168.1.1 GET 200 live.scores.example live.scores.example:443\n"+
+		"1712175105.000 192.168.1.1 GET 200 unknown.com unknown.com:80\n")
+	if err := categories.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The most specific dataset domain decides
+	for host, want := range map[string]string{"www.news.example": "news", "blog.news.example": "blog", "mixed.example": "adult,news",
+		"live.scores.example": "recreation/sports", "unknown.com": "", "10.1.1.1": ""} {
+		if got := strings.Join(categories.lookup(host), ","); got != want {
+			t.Errorf("lookup(%s) = %q, want %q", host, got, want)
+		}
+	}
+	status, _ := categories.status()
+	if status.Domains != 5 || status.Skipped != 1 || len(status.Categories) != 4 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	router := setupTestRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/summary-data?category=recreation&category=blog", nil)
+	router.ServeHTTP(w, req)
+	var summary struct {
+		Rows       []Row          `json:"rows"`
+		Categories map[string]int `json:"categories"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &summary)
+	if len(summary.Rows) != 2 || summary.Rows[0].Domain != "blog.news.example" || summary.Rows[1].Domain != "live.scores.example" ||
+		summary.Categories["news"] != 1 || summary.Categories["blog"] != 1 {
+		t.Errorf("unexpected filtered summary: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/summary-data?uncategorized=true", nil)
+	router.ServeHTTP(w, req)
+	summary.Rows = nil
+	json.Unmarshal(w.Body.Bytes(), &summary)
+	if len(summary.Rows) != 3 {
+		t.Errorf("unexpected uncategorized summary: %s", w.Body.String())
+	}
+	for _, row := range summary.Rows {
+		if len(row.Categories) > 0 {
+			t.Errorf("categorized row in uncategorized summary: %+v", row)
+		}
+	}
+
+	blacklist := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/categories/blacklist", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w = blacklist(`{"categories":["gambling"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown category accepted: %d %s", w.Code, w.Body.String())
+	}
+	if w = blacklist(`{"categories":["Adult"]}`); w.Code != http.StatusOK {
+		t.Fatalf("blacklisting failed: %d %s", w.Code, w.Body.String())
+	}
+	// mixed.example is whitelisted and adult.example has a whitelisted host below it
+	if got := readFile(blacklistCategoryPath); got != "adult.example #adult" {
+		t.Errorf("unexpected category blacklist:\n%s", got)
+	}
+	for host, want := range map[string]string{"adult.example": "blacklist adult.example in category adult", "ok.adult.example": "whitelist ok.adult.example", "mixed.example": "whitelist mixed.example"} {
+		if list, entry := domainPolicy(host); list+" "+entry != want {
+			t.Errorf("domainPolicy(%s) = %s %s, want %s", host, list, entry, want)
+		}
+	}
+
+	// Removing the whitelist entries blocks the whole domains again
+	if _, err := moveDomains("test", []DomainEntry{{Domain: "ok.adult.example"}, {Domain: "mixed.example"}}, "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(blacklistCategoryPath); got != ".adult.example #adult\n.mixed.example #adult" {
+		t.Errorf("unexpected category blacklist after whitelist change:\n%s", got)
+	}
+	if w = blacklist(`{"categories":[]}`); w.Code != http.StatusOK || readFile(blacklistCategoryPath) != "" {
+		t.Errorf("category blacklist not cleared: %d %q", w.Code, readFile(blacklistCategoryPath))
+	}
+}
+
+func TestRules(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	useFakeSquid(t)
+	rulesEngine = newRuleEngine()
+	defer func() { rulesEngine = newRuleEngine() }()
+	router := setupTestRouter()
+	saveRule := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/rules", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, body := range []string{
+		`{"name":"everything","actions":["whitelist"]}`,
+		`{"name":"bad regex","regex":"(","actions":["notify"]}`,
+		`{"name":"both","suffix":"x.com","actions":["whitelist","blacklist"]}`,
+		`{"name":"bad clients","clients":["10.0.0.1/8"],"actions":["review"]}`,
+		`{"name":"bad action","suffix":"x.com","actions":["delete"]}`,
+	} {
+		if w := saveRule(body); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid rule accepted: %s -> %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	for _, body := range []string{
+		`{"name":"trackers","enabled":true,"priority":1,"regex":"^(ads|track)\\.","actions":["blacklist"],"note":"ad tracker"}`,
+		`{"name":"lab cdn","enabled":true,"priority":2,"suffix":"*.cdn.example","clients":["10.1.0.0/16"],"min_requests":3,"actions":["whitelist","notify"]}`,
+		`{"name":"popular","enabled":true,"priority":3,"min_requests":2,"actions":["review"]}`,
+		`{"name":"draft","enabled":false,"priority":4,"suffix":"unknown.com","actions":["blacklist"]}`,
+		`{"name":"vendor","enabled":true,"priority":5,"suffix":"unknown.com","actions":["note"],"note":"vendor portal, ask IT"}`,
+	} {
+		if w := saveRule(body); w.Code != http.StatusOK {
+			t.Fatalf("rule refused: %s -> %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	rules, _ := ruleConfig.list()
+	if len(rules) != 5 || rules[1].Suffix != "cdn.example" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	writeFile(accessLogRegularPath, ""+
+		"1712175102.000 192.168.1.1 GET 200 ads.foo.com ads.foo.com:443\n"+
+		"1712175103.000 10.1.2.3 GET 200 img.cdn.example img.cdn.example:443\n"+
+		"1712175104.000 10.1.2.3 GET 200 img.cdn.example img.cdn.example:443\n"+
+		"1712175105.000 192.168.1.1 GET 200 img.cdn.example img.cdn.example:443\n"+
+		"1712175106.000 192.168.1.1 GET 200 unknown.com unknown.com:80\n")
+
+	// The dry run shows the first matching rule per host; img.cdn.example has only two
+	// requests from the lab yet, so the popular rule takes it
+	blacklist := readFile(blacklistPath)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/rules/dry-run", nil)
+	router.ServeHTTP(w, req)
+	var dry ruleDryRun
+	json.Unmarshal(w.Body.Bytes(), &dry)
+	matched := func(i int) string {
+		var domains []string
+		for _, m := range dry.Rules[i].Matches {
+			domains = append(domains, fmt.Sprintf("%s:%d", m.Domain, m.Requests))
+		}
+		return strings.Join(domains, ",")
+	}
+	if dry.Hosts != 3 || dry.Unmatched != 0 || matched(0) != "ads.foo.com:1" || matched(1) != "" || matched(2) != "img.cdn.example:3" || matched(3) != "unknown.com:1" {
+		t.Errorf("unexpected dry run: %s", w.Body.String())
+	}
+	if readFile(blacklistPath) != blacklist {
+		t.Errorf("dry run changed the blacklist:\n%s", readFile(blacklistPath))
+	}
+
+	li := newLogIngester()
+	if err := li.ingestOnce(time.Unix(1712175110, 0)); err != nil {
+		t.Fatalf("ingestOnce: %v", err)
+	}
+	if bl := readFile(blacklistPath); !strings.Contains(bl, "ads.foo.com  # ad tracker") {
+		t.Errorf("tracker not blacklisted:\n%s", bl)
+	}
+	pending, _ := accessRequests.list(RequestPending)
+	if len(pending) != 1 || pending[0].Domain != "img.cdn.example" || pending[0].Requester != "rule:popular" || pending[0].ClientIP != "rule:"+rules[2].ID {
+		t.Errorf("unexpected review requests: %+v", pending)
+	}
+	// Reviews are not limited like the requests of one client
+	for i := 0; i < MaxPendingRequestsPerClient; i++ {
+		req := AccessRequest{Domain: fmt.Sprintf("review%d.example", i), Requester: "rule:popular", Justification: "rule popular", ClientIP: "rule:" + rules[2].ID}
+		if _, _, err := accessRequests.create(req, time.Unix(1712175110, 0)); err != nil {
+			t.Fatalf("review %d refused: %v", i, err)
+		}
+	}
+
+	// The note rule annotates unknown.com in the summary and leaves it unknown
+	if strings.Contains(readFile(whitelistPath)+readFile(blacklistPath), "unknown.com") {
+		t.Error("note rule listed its host")
+	}
+	var noted string
+	for _, row := range computeSummaryRows(mergeLogFiles()) {
+		if row.Domain == "unknown.com" {
+			noted = row.Note
+		}
+	}
+	if noted != "vendor portal, ask IT" {
+		t.Errorf("unexpected summary note: %q", noted)
+	}
+
+	// A third request from the lab lets the earlier rule match
+	f, _ := os.OpenFile(accessLogRegularPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("1712175107.000 10.1.9.9 GET 200 img.cdn.example img.cdn.example:443\n")
+	f.Close()
+	li.ingestOnce(time.Unix(1712175110, 0))
+	if wl := readFile(whitelistPath); !strings.Contains(wl, "img.cdn.example  # rule lab cdn") {
+		t.Errorf("cdn host not whitelisted:\n%s", wl)
+	}
+	history, _ := rulesEngine.history(0)
+	if len(history) != 4 || history[0].RuleName != "lab cdn" || history[0].Requests != 3 {
+		t.Errorf("unexpected history: %+v", history)
+	}
+	entries, _, _, _ := auditTrail.query(auditQuery{Actor: "rule:trackers"})
+	if len(entries) != 1 || entries[0].Domain != "ads.foo.com" || entries[0].To != "blacklist" {
+		t.Errorf("unexpected audit entries: %+v", entries)
+	}
+
+	// After a restart the logs are read again, but rules do not act twice
+	rulesEngine = newRuleEngine()
+	moveDomain("test", "ads.foo.com", "unknown", "")
+	newLogIngester().ingestOnce(time.Unix(1712175110, 0))
+	if strings.Contains(readFile(blacklistPath), "ads.foo.com") {
+		t.Error("rule applied again after restart")
+	}
+	if history, _ = rulesEngine.history(0); len(history) != 4 {
+		t.Errorf("unexpected history after restart: %d entries", len(history))
+	}
+
+	if w = postForm(router, "/rules/"+rules[3].ID+"/delete", nil, nil, ""); w.Code != http.StatusOK {
+		t.Errorf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if rules, _ = ruleConfig.list(); len(rules) != 4 {
+		t.Errorf("expected 4 rules after delete, got %d", len(rules))
+	}
+}
+
+func TestListMetadata(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+	router := setupTestRouter()
+	postJSON := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	entries := func(query string) []ListEntry {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/entries?"+query, nil)
+		router.ServeHTTP(w, req)
+		var out struct {
+			Entries []ListEntry `json:"entries"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return out.Entries
+	}
+
+	w := postForm(router, "/move-domain", url.Values{"domain": {"crm.example"}, "target": {"whitelist"}, "tags": {"SaaS, finance,saas"}, "owner": {"sales-ops"}, "ticket": {"CHG-1"}}, nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("move failed: %d %s", w.Code, w.Body.String())
+	}
+	w = postJSON("/move-domains", `{"target": "whitelist", "domains": [{"domain": "docs.example", "tags": ["saas"]}, {"domain": "10.0.0.0/24", "owner": "netops"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk move failed: %d %s", w.Code, w.Body.String())
+	}
+	w = postForm(router, "/move-domain", url.Values{"domain": {"x.example"}, "target": {"blacklist"}, "tags": {"has space"}}, nil, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid tag to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	got := entries("tag=saas&tag=finance")
+	if len(got) != 1 || got[0].Domain != "crm.example" || strings.Join(got[0].Tags, ",") != "finance,saas" ||
+		got[0].Owner != "sales-ops" || got[0].Ticket != "CHG-1" || got[0].CreatedBy != "anonymous" || got[0].CreatedAt.IsZero() {
+		t.Errorf("unexpected tagged entries: %+v", got)
+	}
+	if got := entries("owner=NetOps"); len(got) != 1 || got[0].Domain != "10.0.0.0/24" || got[0].List != "whitelist" {
+		t.Errorf("unexpected owner entries: %+v", got)
+	}
+	if got := entries("tag=saas"); len(got) != 2 {
+		t.Errorf("expected 2 saas entries, got %+v", got)
+	}
+
+	// Moving keeps tags, owner and ticket but starts a new creation record
+	created := entries("list=whitelist&tag=finance")[0].CreatedAt
+	if _, err := moveDomain("cli:bob", "crm.example", "blacklist", ""); err != nil {
+		t.Fatal(err)
+	}
+	got = entries("list=blacklist&owner=sales-ops")
+	if len(got) != 1 || got[0].Owner != "sales-ops" || got[0].CreatedBy != "cli:bob" || got[0].CreatedAt.Before(created) {
+		t.Errorf("metadata not carried over: %+v", got)
+	}
+	if got := entries("list=whitelist&owner=sales-ops"); len(got) != 0 {
+		t.Errorf("stale whitelist metadata: %+v", got)
+	}
+
+	// Metadata edits do not touch the list or reload squid
+	before := readFile(blacklistPath)
+	reloads := fake.reconfigures
+	w = postJSON("/metadata", `{"list": "blacklist", "domain": "CRM.example", "tags": ["crm"], "owner": "it"}`)
+	if w.Code != http.StatusOK || readFile(blacklistPath) != before || fake.reconfigures != reloads {
+		t.Errorf("unexpected metadata edit: %d %s", w.Code, w.Body.String())
+	}
+	if got := entries("list=blacklist&tag=crm"); len(got) != 1 || strings.Join(got[0].Tags, ",") != "crm" || got[0].Ticket != "" || got[0].CreatedBy != "cli:bob" || got[0].UpdatedBy != "anonymous" {
+		t.Errorf("unexpected edited metadata: %+v", got)
+	}
+	if w := postJSON("/metadata", `{"list": "whitelist", "domain": "crm.example"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an entry on another list, got %d", w.Code)
+	}
+
+	// Removing an entry drops its metadata
+	moveDomain("test", "crm.example", "unknown", "")
+	meta, _ := loadListMetadata()
+	if _, ok := meta["blacklist"]["crm.example"]; ok || len(meta["whitelist"]) != 2 {
+		t.Errorf("unexpected metadata after removal: %+v", meta)
+	}
+}
+
+func TestNamedLists(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	fake := useFakeSquid(t)
+	router := setupTestRouter()
+	postJSON := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The squid image seeds a fresh volume with the configuration of the built-in lists
+	defs, _ := listDefinitions.all()
+	acl, access := listConfig(defs)
+	if readFile("../squid/defaults/lists-acl.conf") != acl || readFile("../squid/defaults/lists-access.conf") != access {
+		t.Errorf("squid/defaults differ from the generated configuration:\n%s\n%s", acl, access)
+	}
+
+	for _, body := range []string{`{"name": "Bad_Name", "action": "deny", "priority": 50}`, `{"name": "whitelist", "action": "allow", "priority": 50}`,
+		`{"name": "office-ip", "action": "allow", "priority": 50}`, `{"name": "malware", "action": "block", "priority": 50}`, `{"name": "malware", "action": "deny", "priority": 0}`} {
+		if w := postJSON("/named-lists", body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w := postJSON("/named-lists", `{"name": "blacklist-malware", "action": "deny", "priority": 150, "description": "Known malware"}`); w.Code != http.StatusOK {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := postJSON("/named-lists", `{"name": "whitelist-core", "action": "allow", "priority": 10}`); w.Code != http.StatusOK {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	if fake.reconfigures != 2 {
+		t.Errorf("expected a reload per new list, got %d", fake.reconfigures)
+	}
+	aclPath, accessPath := listConfigPaths(dataDir)
+	acl, access = readFile(aclPath), readFile(accessPath)
+	if !containsAll(acl, []string{`acl list_blacklist_malware_domains dstdomain "` + namedListPath("blacklist-malware") + `"`,
+		"acl blacklisted any-of list_blacklist_malware\n", "acl whitelisted any-of list_whitelist_core\n"}) {
+		t.Errorf("unexpected ACL configuration:\n%s", acl)
+	}
+	core := strings.Index(access, "http_access allow list_whitelist_core\n")
+	bl := strings.Index(access, "http_access deny blacklist_builtin\n")
+	malware := strings.Index(access, "http_access deny list_blacklist_malware\n")
+	wl := strings.Index(access, "http_access allow whitelist_builtin\n")
+	if core < 0 || !(core < bl && bl < malware && malware < wl) || !strings.Contains(access, "deny_info "+blockPageDenyInfo+" list_blacklist_malware\n") {
+		t.Errorf("unexpected access configuration:\n%s", access)
+	}
+
+	// Entries live on exactly one list, named lists included
+	w := postForm(router, "/move-domain", url.Values{"domain": {"evil.example"}, "target": {"blacklist-malware"}, "note": {"dropper"}}, nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(readFile(namedListPath("blacklist-malware")), "evil.example") {
+		t.Fatalf("move to named list failed: %d %s", w.Code, w.Body.String())
+	}
+	postForm(router, "/move-domain", url.Values{"domain": {"203.0.113.0/24"}, "target": {"blacklist-malware"}}, nil, "")
+	if !strings.Contains(readFile(namedListPath("blacklist-malware-ip")), "203.0.113.0/24") {
+		t.Errorf("IP entry not on the named IP list: %q", readFile(namedListPath("blacklist-malware-ip")))
+	}
+	postForm(router, "/move-domain", url.Values{"domain": {".corp.example"}, "target": {"whitelist-core"}}, nil, "")
+	postForm(router, "/move-domain", url.Values{"domain": {"bad.corp.example"}, "target": {"blacklist"}}, nil, "")
+	for host, want := range map[string]string{"evil.example": "blacklist-malware deny", "203.0.113.9": "blacklist-malware deny",
+		"bad.corp.example": "whitelist-core allow", "blocked.com": "blacklist deny"} {
+		if list, _ := domainPolicy(host); list+" "+policyAction(list) != want {
+			t.Errorf("domainPolicy(%s) = %s %s, want %s", host, list, policyAction(list), want)
+		}
+	}
+
+	// Allow lists other than the whitelist count wherever the whitelist does
+	groups := groupSummaryRows([]Row{{Domain: "a.corp.example", Count: 1}})
+	if len(groups) != 1 || groups[0].List != "whitelist-core" {
+		t.Errorf("expected the wildcard on the named list to be shown: %+v", groups)
+	}
+	defer func() { categories = &categoryDB{} }()
+	os.MkdirAll(filepath.Join(categoriesDir(), "games"), 0755)
+	writeFile(filepath.Join(categoriesDir(), "games", "domains"), "play.example\nfun.example\n")
+	saveCategoryConfig(categoryConfig{Blacklist: []string{"games"}})
+	if err := categories.load(); err != nil {
+		t.Fatal(err)
+	}
+	categories.writeBlacklist()
+	if !strings.Contains(readFile(blacklistCategoryPath), ".play.example") {
+		t.Fatalf("unexpected category blacklist: %q", readFile(blacklistCategoryPath))
+	}
+	if _, err := moveDomain("test", "play.example", "whitelist-core", ""); err != nil {
+		t.Fatal(err)
+	}
+	if cat := readFile(blacklistCategoryPath); strings.Contains(cat, "play.example") || !strings.Contains(cat, ".fun.example") {
+		t.Errorf("a domain on an allow list must leave the category blacklist: %q", cat)
+	}
+	writeFile(namedListPath("whitelist-core"), readFile(namedListPath("whitelist-core"))+"\nbücher.example\n")
+	if err := normalizeDomainLists(); err != nil || !strings.Contains(readFile(namedListPath("whitelist-core")), "xn--bcher-kva.example") {
+		t.Errorf("named lists must be converted to punycode: %v %q", err, readFile(namedListPath("whitelist-core")))
+	}
+
+	move, err := moveDomain("test", "evil.example", "whitelist", "")
+	if err != nil || move.From != "blacklist-malware" || strings.Contains(readFile(namedListPath("blacklist-malware")), "evil.example") {
+		t.Errorf("unexpected move from named list: %+v %v", move, err)
+	}
+	if w := postForm(router, "/move-domain", url.Values{"domain": {"x.example"}, "target": {"nope"}}, nil, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown target to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/named-lists", nil)
+	router.ServeHTTP(w, req)
+	var infos struct {
+		Lists []namedListInfo `json:"lists"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &infos)
+	if len(infos.Lists) != 4 || infos.Lists[0].Name != "whitelist-core" || infos.Lists[2].Name != "blacklist-malware" || infos.Lists[2].Entries != 1 {
+		t.Errorf("unexpected lists: %s", w.Body.String())
+	}
+
+	// Lists holding entries are only deleted with force
+	if w := postJSON("/named-lists/blacklist-malware/delete", ``); w.Code != http.StatusConflict {
+		t.Errorf("expected a non-empty list to be kept, got %d %s", w.Code, w.Body.String())
+	}
+	if w := postJSON("/named-lists/blacklist/delete", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("expected the blacklist to be kept, got %d", w.Code)
+	}
+	if w := postJSON("/named-lists/blacklist-malware/delete?force=true", ``); w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(namedListPath("blacklist-malware-ip")); !os.IsNotExist(err) || strings.Contains(readFile(accessPath), "malware") || knownList("blacklist-malware") {
+		t.Errorf("list not fully removed: %v\n%s", err, readFile(accessPath))
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	cleanup := setupTestFiles(t)
+	defer cleanup()
+	live := useFakeSquid(t)
+	staging := &fakeSquid{}
+	orig := profileSquid
+	profileSquid = func(container string) squidController {
+		if container != "squid-staging" {
+			t.Errorf("unexpected container %q", container)
+		}
+		return staging
+	}
+	defer func() { profileSquid = orig }()
+	router := setupTestRouter()
+	postJSON := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	getDiff := func() profileDiff {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/profiles/diff?from=live&to=staging", nil)
+		router.ServeHTTP(w, req)
+		var diff profileDiff
+		if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("diff failed: %d %s", w.Code, w.Body.String())
+		}
+		return diff
+	}
+
+	for _, body := range []string{`{"name": "live"}`, `{"name": "Staging"}`, `{"name": "staging", "copy_from": "nope"}`,
+		`{"name": "staging", "container": "squid staging"}`, `{"name": "staging", "container": "-squid"}`, `{"name": "staging", "container": "squid;reboot"}`} {
+		if w := postJSON("/profiles", body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+	if w := postJSON("/profiles", `{"name": "staging", "container": "squid-staging", "copy_from": "live"}`); w.Code != http.StatusOK {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+	dir := filepath.Join(dataDir, "profiles", "staging")
+	if !strings.Contains(readFile(filepath.Join(dir, "blacklist.txt")), "blocked.com") || !fileExists(filepath.Join(dir, "lists-access.conf")) {
+		t.Errorf("profile does not start with a copy of the live lists")
+	}
+	// squid.conf loads the category blacklist from every data directory
+	if !fileExists(filepath.Join(dir, "blacklist-categories.txt")) {
+		t.Errorf("profile has no category blacklist for its squid")
+	}
+	if diff := getDiff(); len(diff.Changes) != 0 || len(diff.Lists) != 0 {
+		t.Errorf("expected no differences after copying, got %+v", diff)
+	}
+
+	// Change the live lists
+	if _, _, err := saveNamedList(ListDef{Name: "blacklist-malware", Action: ListDeny, Priority: 50}, "test", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	moveDomains("test", []DomainEntry{{Domain: "evil.example", Note: "dropper", Meta: &EntryMeta{Tags: []string{"malware"}}}}, "blacklist-malware")
+	moveDomain("test", "new.example", "whitelist", "")
+	moveDomain("test", "blocked.com", "unknown", "")
+	diff := getDiff()
+	changes := make(map[string]string)
+	for _, c := range diff.Changes {
+		changes[c.Domain] = c.Source + " " + c.Target
+	}
+	if len(changes) != 3 || changes["evil.example"] != "blacklist-malware unknown" || changes["new.example"] != "whitelist unknown" || changes["blocked.com"] != "unknown blacklist" {
+		t.Errorf("unexpected changes: %+v", diff.Changes)
+	}
+	if len(diff.Lists) != 1 || diff.Lists[0].Name != "blacklist-malware" || diff.Lists[0].Target != nil {
+		t.Errorf("unexpected list changes: %+v", diff.Lists)
+	}
+
+	// Promoting an entry creates its list in the target and reloads the target's squid only
+	reloads := live.reconfigures
+	w := postJSON("/profiles/promote", `{"from": "live", "to": "staging", "domains": ["evil.example", "blocked.com"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("promote failed: %d %s", w.Code, w.Body.String())
+	}
+	if staging.reconfigures != 1 || live.reconfigures != reloads {
+		t.Errorf("expected only the staging squid to reload, got %d and %d", staging.reconfigures, live.reconfigures-reloads)
+	}
+	set, err := loadListSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.def("blacklist-malware") == nil || !strings.Contains(readFile(filepath.Join(dir, "lists", "blacklist-malware.txt")), "evil.example") ||
+		strings.Contains(readFile(filepath.Join(dir, "blacklist.txt")), "blocked.com") || !containsString(set.meta["blacklist-malware"]["evil.example"].Tags, "malware") {
+		t.Errorf("promotion not applied: %+v", set)
+	}
+	if !strings.Contains(readFile(filepath.Join(dir, "lists-access.conf")), "http_access deny list_blacklist_malware") {
+		t.Errorf("squid configuration of the profile not regenerated")
+	}
+	if diff := getDiff(); len(diff.Changes) != 1 || diff.Changes[0].Domain != "new.example" || len(diff.Lists) != 0 {
+		t.Errorf("unexpected remaining differences: %+v", diff)
+	}
+	if w := postJSON("/profiles/promote", `{"from": "live", "to": "staging", "domains": ["evil.example"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected promoting an unchanged entry to fail, got %d", w.Code)
+	}
+
+	// Promoting everything back to the live profile removes what staging lacks
+	if w := postJSON("/profiles/promote", `{"from": "staging", "to": "live", "all": true}`); w.Code != http.StatusOK {
+		t.Fatalf("promote failed: %d %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(readFile(whitelistPath), "new.example") || live.reconfigures != reloads+1 {
+		t.Errorf("promotion to the live profile not applied: %q", readFile(whitelistPath))
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/profiles/history", nil)
+	router.ServeHTTP(w, req)
+	var history struct {
+		Promotions []Promotion `json:"promotions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history.Promotions) != 2 || history.Promotions[0].To != "live" || len(history.Promotions[1].Changes) != 2 ||
+		history.Promotions[1].Lists[0] != "blacklist-malware" || history.Promotions[1].Reload != "ok" {
+		t.Errorf("unexpected history: %s", w.Body.String())
+	}
+
+	if w := postJSON("/profiles/live/delete", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("expected the live profile to be kept, got %d", w.Code)
+	}
+	if w := postJSON("/profiles/staging/delete", ``); w.Code != http.StatusOK || fileExists(dir) {
+		t.Errorf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+}
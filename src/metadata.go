@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The squid lists only hold a domain and a free-text note per line. Structured metadata
+// (tags, owner, ticket, who added an entry and when) is kept next to them in
+// list-metadata.json, keyed by list and entry, and maintained by moveDomains.
+
+// EntryMeta is the structured metadata of one list entry
+type EntryMeta struct {
+	Tags      []string  `json:"tags,omitempty"`
+	Owner     string    `json:"owner,omitempty"`  // team or person responsible for the entry
+	Ticket    string    `json:"ticket,omitempty"` // change or issue tracker reference
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// listMetadata maps each list to its entries' metadata. IP entries are kept under the
+// list they belong to.
+type listMetadata map[string]map[string]EntryMeta
+
+// listMetadataPath returns the location of the metadata sidecar in a data directory
+func listMetadataPath(dir string) string {
+	return filepath.Join(dir, "list-metadata.json")
+}
+
+// loadListMetadata reads the sidecar; a missing file is empty metadata
+func loadListMetadata() (listMetadata, error) {
+	return loadListMetadataIn(dataDir, listNames())
+}
+
+// loadListMetadataIn reads the sidecar of a data directory holding lists
+func loadListMetadataIn(dir string, lists []string) (listMetadata, error) {
+	meta := listMetadata{}
+	data, err := os.ReadFile(listMetadataPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("parse %s: %v", filepath.Base(listMetadataPath(dir)), err)
+		}
+	}
+	for _, list := range lists {
+		if meta[list] == nil {
+			meta[list] = map[string]EntryMeta{}
+		}
+	}
+	return meta, nil
+}
+
+func saveListMetadata(meta listMetadata) error {
+	return saveListMetadataIn(dataDir, meta)
+}
+
+func saveListMetadataIn(dir string, meta listMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(listMetadataPath(dir), string(data))
+}
+
+// normalizeTags lowercases tags, drops empty and duplicate ones and sorts them
+func normalizeTags(tags []string) ([]string, error) {
+	var out []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || containsString(out, tag) {
+			continue
+		}
+		if len(tag) > MaxTagLength || strings.ContainsAny(tag, " \t#,") {
+			return nil, fmt.Errorf("invalid tag %q: at most %d characters, no spaces, commas or #", tag, MaxTagLength)
+		}
+		out = append(out, tag)
+	}
+	if len(out) > MaxTags {
+		return nil, fmt.Errorf("at most %d tags", MaxTags)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// splitTags parses a comma-separated tag list from a form field or flag
+func splitTags(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// validate normalizes the editable fields of metadata given by a caller
+func (m *EntryMeta) validate() error {
+	tags, err := normalizeTags(m.Tags)
+	if err != nil {
+		return err
+	}
+	m.Tags = tags
+	m.Owner = singleLine(m.Owner, 100)
+	m.Ticket = singleLine(m.Ticket, 100)
+	return nil
+}
+
+// entryMetaFields builds the metadata given with a move from form or JSON fields;
+// nil when none is set
+func entryMetaFields(tags []string, owner, ticket string) (*EntryMeta, error) {
+	m := &EntryMeta{Tags: tags, Owner: owner, Ticket: ticket}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if len(m.Tags) == 0 && m.Owner == "" && m.Ticket == "" {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// applyMoves updates the metadata for moves made by actor: entries taken off a list
+// lose their metadata there, entries added to a list keep their tags, owner and ticket
+// (from the list they came from) and get new creation fields. Fields given with an
+// entry replace the kept ones. Metadata of entries no longer on a list is dropped.
+func (meta listMetadata) applyMoves(actor string, moves []*domainMove, given map[string]*EntryMeta, lists map[string][]string, now time.Time) {
+	now = now.UTC()
+	for _, move := range moves {
+		var kept EntryMeta
+		existing, onTarget := meta[move.To][move.Domain]
+		for list := range meta {
+			if m, ok := meta[list][move.Domain]; ok {
+				if !onTarget || list == move.To {
+					kept = m
+				}
+				delete(meta[list], move.Domain)
+			}
+		}
+		for _, covered := range move.Covered {
+			delete(meta[move.To], covered)
+		}
+		if move.To == "unknown" {
+			continue
+		}
+		m := EntryMeta{Tags: kept.Tags, Owner: kept.Owner, Ticket: kept.Ticket, CreatedAt: now, CreatedBy: actor, UpdatedAt: now, UpdatedBy: actor}
+		if onTarget {
+			m.CreatedAt, m.CreatedBy = existing.CreatedAt, existing.CreatedBy
+		}
+		if g := given[move.Domain]; g != nil {
+			if len(g.Tags) > 0 {
+				m.Tags = g.Tags
+			}
+			if g.Owner != "" {
+				m.Owner = g.Owner
+			}
+			if g.Ticket != "" {
+				m.Ticket = g.Ticket
+			}
+		}
+		meta[move.To][move.Domain] = m
+	}
+
+	for list := range meta {
+		if _, ok := lists[list]; !ok {
+			delete(meta, list) // a deleted named list
+			continue
+		}
+		present := make(map[string]bool)
+		for _, file := range []string{list, ipListFor(list)} {
+			for _, line := range lists[file] {
+				present[parseDomainEntry(line).Domain] = true
+			}
+		}
+		for domain := range meta[list] {
+			if !present[domain] {
+				delete(meta[list], domain)
+			}
+		}
+	}
+}
+
+// setEntryMetadata replaces the tags, owner and ticket of an entry on a list without
+// touching the squid list
+func setEntryMetadata(list, domain, actor string, fields EntryMeta, now time.Time) (*EntryMeta, error) {
+	if !knownList(list) {
+		return nil, fmt.Errorf("unknown list %q", list)
+	}
+	if err := fields.validate(); err != nil {
+		return nil, err
+	}
+	if err := listMu.Lock(); err != nil {
+		return nil, err
+	}
+	defer listMu.Unlock()
+	if !containsString(domainLists(domain), list) {
+		return nil, fmt.Errorf("%s is not on the %s", domain, list)
+	}
+	meta, err := loadListMetadata()
+	if err != nil {
+		return nil, err
+	}
+	m := meta[list][domain]
+	m.Tags, m.Owner, m.Ticket = fields.Tags, fields.Owner, fields.Ticket
+	m.UpdatedAt, m.UpdatedBy = now.UTC(), actor
+	meta[list][domain] = m
+	return &m, saveListMetadata(meta)
+}
+
+// describeMetadata summarizes metadata fields for the audit log
+func describeMetadata(m EntryMeta) string {
+	return fmt.Sprintf("tags=%s owner=%s ticket=%s", strings.Join(m.Tags, ","), m.Owner, m.Ticket)
+}
+
+// ListEntry is a list entry with its note and metadata, as returned by GET /entries
+type ListEntry struct {
+	List    string `json:"list"`
+	Domain  string `json:"domain"`
+	Display string `json:"display,omitempty"`
+	Note    string `json:"note,omitempty"`
+	EntryMeta
+}
+
+// entryQuery filters list entries; empty fields match everything
+type entryQuery struct {
+	List  string
+	Tags  []string // entries carrying every one of them
+	Owner string   // case-insensitive
+}
+
+// listEntries returns the entries of every list (IP entries after the domains of
+// their list) with their metadata
+func listEntries(q entryQuery) ([]ListEntry, error) {
+	meta, err := loadListMetadata()
+	if err != nil {
+		return nil, err
+	}
+	out := []ListEntry{}
+	for _, list := range listNames() {
+		if q.List != "" && q.List != list {
+			continue
+		}
+		for _, file := range []string{list, ipListFor(list)} {
+			path, _ := listPath(file)
+			for _, line := range parseDomainList(readFile(path)) {
+				e := parseDomainEntry(line)
+				entry := ListEntry{List: list, Domain: e.Domain, Display: displayDomain(e.Domain), Note: e.Note, EntryMeta: meta[list][e.Domain]}
+				if q.Owner != "" && !strings.EqualFold(entry.Owner, q.Owner) {
+					continue
+				}
+				matched := true
+				for _, tag := range q.Tags {
+					if !containsString(entry.Tags, tag) {
+						matched = false
+						break
+					}
+				}
+				if matched {
+					out = append(out, entry)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// groupEntriesByTag groups entries under each of their tags; untagged entries are
+// grouped under ""
+func groupEntriesByTag(entries []ListEntry) map[string][]ListEntry {
+	groups := make(map[string][]ListEntry)
+	for _, e := range entries {
+		if len(e.Tags) == 0 {
+			groups[""] = append(groups[""], e)
+		}
+		for _, tag := range e.Tags {
+			groups[tag] = append(groups[tag], e)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// editorMetrics holds the Prometheus collectors exposed on /metrics
+type editorMetrics struct {
+	registry       *prometheus.Registry
+	proxyRequests  *prometheus.CounterVec
+	unknownDomains prometheus.Gauge
+	reloads        *prometheus.CounterVec
+	reloadDuration prometheus.Histogram
+	ingestLag      prometheus.Gauge
+	logParseErrors prometheus.Counter
+	httpDuration   *prometheus.HistogramVec
+}
+
+// metrics is the process-wide metrics registry
+var metrics = newEditorMetrics()
+
+func newEditorMetrics() *editorMetrics {
+	m := &editorMetrics{
+		registry: prometheus.NewRegistry(),
+		proxyRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "squid_editor_proxy_requests_total",
+			Help: "Proxy requests ingested from the squid access logs.",
+		}, []string{"tag", "status", "method"}),
+		unknownDomains: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "squid_editor_unknown_domains",
+			Help: "Distinct hosts seen in the regular (RG) log since the editor started.",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "squid_editor_squid_reloads_total",
+			Help: "Squid reconfigure attempts by result.",
+		}, []string{"result"}),
+		reloadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "squid_editor_squid_reload_duration_seconds",
+			Help:    "Time taken to signal squid to reconfigure.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+		}),
+		ingestLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "squid_editor_log_ingest_lag_seconds",
+			Help: "Age of the newest log entry at the last ingest pass.",
+		}),
+		logParseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "squid_editor_log_parse_errors_total",
+			Help: "Access log lines that could not be parsed.",
+		}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "squid_editor_http_request_duration_seconds",
+			Help:    "Latency of editor HTTP handlers.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	squidUp := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "squid_editor_squid_up",
+		Help: "Whether the last squid health check succeeded (1) or not (0).",
+	}, func() float64 {
+		if health.isUp() {
+			return 1
+		}
+		return 0
+	})
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.proxyRequests,
+		m.unknownDomains,
+		m.reloads,
+		m.reloadDuration,
+		m.ingestLag,
+		m.logParseErrors,
+		m.httpDuration,
+		squidUp,
+		listSizeCollector{desc: prometheus.NewDesc(
+			"squid_editor_list_entries",
+			"Entries in each domain list.",
+			[]string{"list"}, nil,
+		)},
+	)
+	return m
+}
+
+// observeReload records the outcome and latency of a squid reload
+func (m *editorMetrics) observeReload(start time.Time, err error) {
+	m.reloadDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.reloads.WithLabelValues("failure").Inc()
+		return
+	}
+	m.reloads.WithLabelValues("success").Inc()
+}
+
+// listSizeCollector reports the number of entries in each domain list at scrape time
+type listSizeCollector struct {
+	desc *prometheus.Desc
+}
+
+func (l listSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.desc
+}
+
+func (l listSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	lists := map[string]string{"whitelist": whitelistPath, "blacklist": blacklistPath, "whitelist-ip": whitelistIPPath, "blacklist-ip": blacklistIPPath, "blacklist-category": blacklistCategoryPath}
+	for _, d := range orderedLists() {
+		if !d.BuiltIn {
+			lists[d.Name], lists[ipListFor(d.Name)] = namedListPath(d.Name), namedListPath(ipListFor(d.Name))
+		}
+	}
+	for name, path := range lists {
+		n := len(parseDomainList(readFile(path)))
+		ch <- prometheus.MustNewConstMetric(l.desc, prometheus.GaugeValue, float64(n), name)
+	}
+}
+
+// metricsMiddleware records handler latency per gin route
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.httpDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// handleMetrics serves the Prometheus exposition format
+func handleMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+}
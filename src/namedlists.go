@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Besides the built-in whitelist and blacklist, lists can be created through the API
+// (whitelist-core, blacklist-malware, ...). Each named list has its own files in lists/
+// (<name>.txt, and <name>-ip.txt for addresses and ranges), an action and a priority.
+// squid.conf includes two generated files: lists-acl.conf defines an ACL per named list
+// and adds it to whitelisted or blacklisted (which split the logs), lists-access.conf has
+// one http_access rule per list, built-in lists included, lowest priority first.
+
+// List actions
+const (
+	ListAllow = "allow"
+	ListDeny  = "deny"
+)
+
+// blockPageDenyInfo sends requests denied by a list to the editor's block page
+const blockPageDenyInfo = "302:http://squid-editor:8080/blocked?url=%u&host=%H"
+
+// ListDef describes a list
+type ListDef struct {
+	Name        string    `json:"name"`
+	Action      string    `json:"action"`   // allow or deny
+	Priority    int       `json:"priority"` // squid evaluates lower priorities first
+	Description string    `json:"description,omitempty"`
+	BuiltIn     bool      `json:"builtin,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+}
+
+// builtinLists are the lists every installation has
+func builtinLists() []ListDef {
+	return []ListDef{
+		{Name: "whitelist", Action: ListAllow, Priority: WhitelistPriority, Description: "Allowed domains", BuiltIn: true},
+		{Name: "blacklist", Action: ListDeny, Priority: BlacklistPriority, Description: "Blocked domains and categories", BuiltIn: true},
+	}
+}
+
+var listNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validateListName checks the name of a new list; it becomes a file name and part of
+// squid ACL names
+func validateListName(name string) error {
+	if !listNamePattern.MatchString(name) || len(name) > MaxListNameLength {
+		return fmt.Errorf("list name must be 1 to %d lowercase letters, digits and inner hyphens", MaxListNameLength)
+	}
+	switch name {
+	case "whitelist", "blacklist", "unknown":
+		return fmt.Errorf("%s is reserved", name)
+	}
+	// <name>-ip holds the addresses of <name>
+	if strings.HasSuffix(name, "-ip") {
+		return fmt.Errorf("list names may not end in -ip")
+	}
+	return nil
+}
+
+// validate checks a named list before it is saved
+func (d *ListDef) validate() error {
+	if err := validateListName(d.Name); err != nil {
+		return err
+	}
+	if d.Action != ListAllow && d.Action != ListDeny {
+		return fmt.Errorf("action must be allow or deny")
+	}
+	if d.Priority < 1 || d.Priority > MaxListPriority {
+		return fmt.Errorf("priority must be between 1 and %d", MaxListPriority)
+	}
+	d.Description = singleLine(d.Description, 200)
+	return nil
+}
+
+// listDefStore persists the named lists as JSON in a data directory
+type listDefStore struct {
+	mu  sync.Mutex
+	dir string // directory holding lists.json and lists/; the data directory when empty
+}
+
+// listDefinitions is the process-wide list store
+var listDefinitions = &listDefStore{}
+
+// namedListsDir holds the files of the named lists
+func namedListsDir() string {
+	return filepath.Join(dataDir, "lists")
+}
+
+// namedListPath returns the file of a named list or of its IP list
+func namedListPath(file string) string {
+	return filepath.Join(namedListsDir(), file+".txt")
+}
+
+// listFileIn returns the file of a list or IP list in a data directory laid out like
+// the editor's own
+func listFileIn(dir, file string) string {
+	switch file {
+	case "whitelist", "blacklist", "whitelist-ip", "blacklist-ip":
+		return filepath.Join(dir, file+".txt")
+	}
+	return filepath.Join(dir, "lists", file+".txt")
+}
+
+// listConfigPaths returns the generated squid configuration files of a data directory
+func listConfigPaths(dir string) (aclPath, accessPath string) {
+	return filepath.Join(dir, "lists-acl.conf"), filepath.Join(dir, "lists-access.conf")
+}
+
+// root returns the directory the store keeps its lists in
+func (s *listDefStore) root() string {
+	if s.dir == "" {
+		return dataDir
+	}
+	return s.dir
+}
+
+func (s *listDefStore) load() ([]ListDef, error) {
+	path := filepath.Join(s.root(), "lists.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []ListDef
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(path), err)
+	}
+	return list, nil
+}
+
+func (s *listDefStore) save(list []ListDef) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.root(), "lists.json"), data, 0644)
+}
+
+// sortLists puts lists in squid's order: by priority, deny before allow on equal
+// priority, then by name
+func sortLists(defs []ListDef) []ListDef {
+	sort.SliceStable(defs, func(i, j int) bool {
+		if defs[i].Priority != defs[j].Priority {
+			return defs[i].Priority < defs[j].Priority
+		}
+		if defs[i].Action != defs[j].Action {
+			return defs[i].Action == ListDeny
+		}
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
+
+// all returns the built-in and named lists in squid's order
+func (s *listDefStore) all() ([]ListDef, error) {
+	named, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return sortLists(append(builtinLists(), named...)), nil
+}
+
+// get returns one list, or nil when it does not exist
+func (s *listDefStore) get(name string) (*ListDef, error) {
+	defs, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range defs {
+		if d.Name == name {
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// put creates a named list or changes its action, priority and description. The
+// caller holds listMu.
+func (s *listDefStore) put(d ListDef, actor string, now time.Time) (*ListDef, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for i := range list {
+		if list[i].Name == d.Name {
+			d.CreatedAt, d.CreatedBy = list[i].CreatedAt, list[i].CreatedBy
+			list[i] = d
+			found = true
+		}
+	}
+	if !found {
+		if len(list) >= MaxNamedLists {
+			return nil, fmt.Errorf("at most %d named lists", MaxNamedLists)
+		}
+		d.CreatedAt, d.CreatedBy = now.UTC(), actor
+		list = append(list, d)
+	}
+	if err := os.MkdirAll(filepath.Join(s.root(), "lists"), 0755); err != nil {
+		return nil, err
+	}
+	// squid refuses to start when an ACL file is missing
+	for _, file := range []string{d.Name, ipListFor(d.Name)} {
+		path := listFileIn(s.root(), file)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := writeFile(path, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &d, s.save(list)
+}
+
+// remove deletes a named list and its files. The caller holds listMu.
+func (s *listDefStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].Name == name {
+			if err := s.save(append(list[:i], list[i+1:]...)); err != nil {
+				return err
+			}
+			for _, file := range []string{name, ipListFor(name)} {
+				if err := os.Remove(listFileIn(s.root(), file)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("list %s not found", name)
+}
+
+// orderedLists returns the lists in squid's order. A broken lists.json leaves the
+// built-in lists, so policy lookups keep working.
+func orderedLists() []ListDef {
+	defs, err := listDefinitions.all()
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return sortLists(builtinLists())
+	}
+	return defs
+}
+
+// listNames returns the whitelist, the blacklist and then the named lists by priority
+func listNames() []string {
+	return listNamesOf(orderedLists())
+}
+
+// listNamesOf orders the names of defs like listNames
+func listNamesOf(defs []ListDef) []string {
+	names := []string{"whitelist", "blacklist"}
+	for _, d := range defs {
+		if !d.BuiltIn {
+			names = append(names, d.Name)
+		}
+	}
+	return names
+}
+
+// knownList reports whether name is a list entries can be moved to
+func knownList(name string) bool {
+	return containsString(listNames(), name)
+}
+
+// listAction returns whether squid allows or denies requests matched by a list
+func listAction(name string) string {
+	for _, d := range orderedLists() {
+		if d.Name == name {
+			return d.Action
+		}
+	}
+	return ListDeny
+}
+
+// squidACLName returns the ACL squid matches a named list's entries with
+func squidACLName(name string) string {
+	return "list_" + strings.ReplaceAll(name, "-", "_")
+}
+
+// listConfig renders the generated squid configuration for lists
+func listConfig(defs []ListDef) (acl, access string) {
+	var a, h strings.Builder
+	header := "# Generated by squid-editor from lists.json; changes are overwritten\n"
+	a.WriteString(header)
+	h.WriteString(header)
+	for _, d := range defs {
+		fmt.Fprintf(&h, "# %s (priority %d)\n", d.Name, d.Priority)
+		acl := d.Name + "_builtin"
+		if !d.BuiltIn {
+			acl = squidACLName(d.Name)
+			fmt.Fprintf(&a, "acl %s_domains dstdomain %q\n", acl, namedListPath(d.Name))
+			fmt.Fprintf(&a, "acl %s_ip dst %q\n", acl, namedListPath(ipListFor(d.Name)))
+			fmt.Fprintf(&a, "acl %s any-of %s_domains %s_ip\n", acl, acl, acl)
+			group := "whitelisted"
+			if d.Action == ListDeny {
+				group = "blacklisted"
+			}
+			fmt.Fprintf(&a, "acl %s any-of %s\n", group, acl)
+		}
+		fmt.Fprintf(&h, "http_access %s %s\n", d.Action, acl)
+		if d.Action == ListDeny {
+			fmt.Fprintf(&h, "deny_info %s %s\n", blockPageDenyInfo, acl)
+		}
+	}
+	return a.String(), h.String()
+}
+
+// writeListConfig regenerates the squid configuration for lists and reports whether
+// it changed
+func writeListConfig() (bool, error) {
+	defs, err := listDefinitions.all()
+	if err != nil {
+		return false, err
+	}
+	return writeListConfigIn(dataDir, defs)
+}
+
+// writeListConfigIn writes the squid configuration for defs into a data directory. The
+// ACL files are referenced at the editor's data directory path, where every profile's
+// squid mounts its own lists.
+func writeListConfigIn(dir string, defs []ListDef) (bool, error) {
+	acl, access := listConfig(defs)
+	aclPath, accessPath := listConfigPaths(dir)
+	changed := false
+	for path, content := range map[string]string{aclPath: acl, accessPath: access} {
+		if readFile(path) == content {
+			continue
+		}
+		if err := writeFile(path, content); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// namedListInfo is a list with its entry counts, as returned by GET /named-lists
+type namedListInfo struct {
+	ListDef
+	Entries int `json:"entries"`
+}
+
+// listInfos returns every list in squid's order with the number of entries
+func listInfos() ([]namedListInfo, error) {
+	defs, err := listDefinitions.all()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]namedListInfo, 0, len(defs))
+	for _, d := range defs {
+		info := namedListInfo{ListDef: d}
+		for _, file := range []string{d.Name, ipListFor(d.Name)} {
+			path, _ := listPath(file)
+			info.Entries += len(parseDomainList(readFile(path)))
+		}
+		out = append(out, info)
+	}
+	return out, nil
+}
+
+// saveNamedList creates or updates a named list and regenerates the squid configuration;
+// changed reports whether squid needs to be reloaded
+func saveNamedList(d ListDef, actor string, now time.Time) (saved *ListDef, changed bool, err error) {
+	if err := listMu.Lock(); err != nil {
+		return nil, false, err
+	}
+	defer listMu.Unlock()
+	if saved, err = listDefinitions.put(d, actor, now); err != nil {
+		return nil, false, err
+	}
+	changed, err = writeListConfig()
+	return saved, changed, err
+}
+
+// deleteNamedList removes a named list with its files and metadata and regenerates the
+// squid configuration. Lists that still hold entries are only removed with force.
+func deleteNamedList(name string, force bool) (entries int, err error) {
+	if err := listMu.Lock(); err != nil {
+		return 0, err
+	}
+	defer listMu.Unlock()
+	d, err := listDefinitions.get(name)
+	if err != nil {
+		return 0, err
+	}
+	if d == nil {
+		return 0, fmt.Errorf("list %s not found", name)
+	}
+	if d.BuiltIn {
+		return 0, fmt.Errorf("the %s cannot be deleted", name)
+	}
+	for _, file := range []string{name, ipListFor(name)} {
+		entries += len(parseDomainList(readFile(namedListPath(file))))
+	}
+	if entries > 0 && !force {
+		return entries, fmt.Errorf("list %s still holds %d entries; delete with force to drop them", name, entries)
+	}
+	if err := listDefinitions.remove(name); err != nil {
+		return entries, err
+	}
+	if _, err := writeListConfig(); err != nil {
+		return entries, err
+	}
+	meta, err := loadListMetadata()
+	if err != nil {
+		return entries, err
+	}
+	delete(meta, name)
+	return entries, saveListMetadata(meta)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcConfig configures OpenID Connect login. It is read from SQUID_EDITOR_OIDC_* variables.
+type oidcConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string            // e.g. https://editor.example.com/login/oidc/callback
+	Scopes        []string          // "openid" is always requested
+	UsernameClaim string            // claim used as the editor username
+	GroupsClaim   string            // claim holding the user's groups
+	RoleMap       map[string]string // group -> role; the most privileged match wins
+	DefaultRole   string            // role for users without a mapped group; empty refuses them
+}
+
+// oidcConfigFromEnv reads the SSO configuration; it returns nil when no issuer is set
+func oidcConfigFromEnv() (*oidcConfig, error) {
+	issuer := strings.TrimRight(os.Getenv("SQUID_EDITOR_OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &oidcConfig{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("SQUID_EDITOR_OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("SQUID_EDITOR_OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("SQUID_EDITOR_OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(envOr("SQUID_EDITOR_OIDC_SCOPES", "openid profile email")),
+		UsernameClaim: envOr("SQUID_EDITOR_OIDC_USERNAME_CLAIM", "preferred_username"),
+		GroupsClaim:   envOr("SQUID_EDITOR_OIDC_GROUPS_CLAIM", "groups"),
+		RoleMap:       make(map[string]string),
+		DefaultRole:   os.Getenv("SQUID_EDITOR_OIDC_DEFAULT_ROLE"),
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("SQUID_EDITOR_OIDC_CLIENT_ID and SQUID_EDITOR_OIDC_REDIRECT_URL are required")
+	}
+	// SQUID_EDITOR_OIDC_ROLE_MAP is a comma-separated list of group=role pairs
+	for _, pair := range strings.Split(os.Getenv("SQUID_EDITOR_OIDC_ROLE_MAP"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || !validRole(strings.TrimSpace(role)) {
+			return nil, fmt.Errorf("invalid role mapping %q: expected group=role", pair)
+		}
+		cfg.RoleMap[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+	if cfg.DefaultRole != "" && !validRole(cfg.DefaultRole) {
+		return nil, fmt.Errorf("invalid SQUID_EDITOR_OIDC_DEFAULT_ROLE: %s", cfg.DefaultRole)
+	}
+	return cfg, nil
+}
+
+// envOr returns an environment variable or a fallback when it is unset or empty
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// oidcMetadata is the subset of the provider discovery document the editor uses
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcPending is a login started by a redirect to the provider and not yet completed
+type oidcPending struct {
+	Verifier string // PKCE code verifier
+	Nonce    string
+	Next     string
+	Expires  time.Time
+}
+
+// oidcIdentity is a verified user returned by the provider
+type oidcIdentity struct {
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// oidcProvider runs the authorization code flow with PKCE against one issuer
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	pending     map[string]oidcPending // by state
+}
+
+// oidc is the configured SSO provider, or nil when SSO is off
+var oidc *oidcProvider
+
+func newOIDCProvider(cfg oidcConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: OIDCHTTPTimeout},
+		pending: make(map[string]oidcPending),
+	}
+}
+
+// getJSON fetches a URL and decodes its JSON body
+func (p *oidcProvider) getJSON(target string, v interface{}) error {
+	resp, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, MaxFileSize)).Decode(v)
+}
+
+// metadata returns the discovery document, fetching it on first use
+func (p *oidcProvider) metadata() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document is missing endpoints")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// pkceChallenge returns the S256 code challenge for a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authURL starts a login and returns the provider URL to redirect to and the state
+// value, which the caller binds to the browser with a cookie
+func (p *oidcProvider) authURL(next string, now time.Time) (string, string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", "", err
+	}
+	state := randomToken(24)
+	pending := oidcPending{Verifier: randomToken(32), Nonce: randomToken(24), Next: next, Expires: now.Add(OIDCLoginTimeout)}
+
+	p.mu.Lock()
+	for s, l := range p.pending {
+		if now.After(l.Expires) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[state] = pending
+	p.mu.Unlock()
+
+	scopes := p.cfg.Scopes
+	if !containsString(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {pending.Nonce},
+		"code_challenge":        {pkceChallenge(pending.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// exchange completes a login: it redeems the code with the PKCE verifier and verifies
+// the returned ID token. It returns the identity and the page to continue to.
+func (p *oidcProvider) exchange(code, state string, now time.Time) (*oidcIdentity, string, error) {
+	p.mu.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || now.After(pending.Expires) {
+		return nil, "", fmt.Errorf("login session expired, please try again")
+	}
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {pending.Verifier},
+	}
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxFileSize)).Decode(&token); err != nil {
+		return nil, "", fmt.Errorf("token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, "", fmt.Errorf("token request rejected: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	claims, err := p.verifyIDToken(token.IDToken, pending.Nonce, now)
+	if err != nil {
+		return nil, "", err
+	}
+	id := &oidcIdentity{Groups: claimStrings(claims[p.cfg.GroupsClaim])}
+	id.Subject, _ = claims["sub"].(string)
+	id.Username, _ = claims[p.cfg.UsernameClaim].(string)
+	if id.Username == "" {
+		return nil, "", fmt.Errorf("ID token has no %s claim", p.cfg.UsernameClaim)
+	}
+	return id, pending.Next, nil
+}
+
+// verifyIDToken checks an RS256-signed ID token's signature, issuer, audience,
+// expiry and nonce, and returns its claims
+func (p *oidcProvider) verifyIDToken(raw, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.signingKey(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("ID token signature is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %v", err)
+	}
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q does not match", iss)
+	}
+	if !containsString(claimStrings(claims["aud"]), p.cfg.ClientID) {
+		return nil, fmt.Errorf("ID token is not for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(OIDCClockSkew)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider key with the given ID, refetching the key set
+// (at most once per OIDCKeyRefreshInterval) when the key is unknown
+func (p *oidcProvider) signingKey(kid string, now time.Time) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := now.Sub(p.keysFetched) >= OIDCKeyRefreshInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+	}
+
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch signing keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = now
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown ID token signing key %q", kid)
+}
+
+// roleFor maps the identity's groups to the most privileged configured role
+func (p *oidcProvider) roleFor(id *oidcIdentity) (string, error) {
+	best := -1
+	for _, g := range id.Groups {
+		if role, ok := p.cfg.RoleMap[g]; ok {
+			if rank := roleRank(role); rank > best {
+				best = rank
+			}
+		}
+	}
+	if best >= 0 {
+		return roleOrder[best], nil
+	}
+	if p.cfg.DefaultRole != "" {
+		return p.cfg.DefaultRole, nil
+	}
+	return "", fmt.Errorf("%s is not in a group allowed to use the editor", id.Username)
+}
+
+// decodeJWTPart decodes one base64url JSON segment of a JWT
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings reads a claim that may be a single string or a list of strings
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		out := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profiles are separate sets of lists for the proxies of different environments (dev,
+// staging, production). The editor's own data directory is the live profile, served by
+// its squid and edited through the UI. Every other profile has a directory of the same
+// layout in profiles/<name>/ (list files, lists.json, list-metadata.json and the generated
+// squid configuration), which the profile's squid container mounts as its data directory.
+// Profiles are compared with a diff, and changes are copied between them by promotion.
+
+// Profile is one set of lists
+type Profile struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Container   string    `json:"container,omitempty"` // squid container reloaded after promotions; none when empty
+	Live        bool      `json:"live,omitempty"`      // the editor's own lists
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+}
+
+// liveProfile names the editor's own lists
+var liveProfile = envOr("SQUID_EDITOR_PROFILE", "live")
+
+// profileSquid returns the controller of a profile's squid container; tests swap it out
+var profileSquid = func(container string) squidController {
+	return dockerSquid{container: container}
+}
+
+// profileStore persists the other profiles as JSON in the data directory
+type profileStore struct {
+	mu sync.Mutex
+}
+
+// profiles is the process-wide profile store
+var profiles = &profileStore{}
+
+// profilesPath returns the location of the profile definitions
+func profilesPath() string {
+	return filepath.Join(dataDir, "profiles.json")
+}
+
+// profilesDir holds the data directories of the profiles other than the live one
+func profilesDir() string {
+	return filepath.Join(dataDir, "profiles")
+}
+
+// dir returns the data directory holding a profile's lists
+func (p *Profile) dir() string {
+	if p.Live {
+		return dataDir
+	}
+	return filepath.Join(profilesDir(), p.Name)
+}
+
+// containerNamePattern matches the container names docker accepts
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// validate checks a profile before it is saved
+func (p *Profile) validate() error {
+	if !listNamePattern.MatchString(p.Name) || len(p.Name) > MaxListNameLength {
+		return fmt.Errorf("profile name must be 1 to %d lowercase letters, digits and inner hyphens", MaxListNameLength)
+	}
+	if p.Name == liveProfile {
+		return fmt.Errorf("%s is the live profile", p.Name)
+	}
+	p.Description = singleLine(p.Description, 200)
+	p.Container = strings.TrimSpace(p.Container)
+	if p.Container != "" && (!containerNamePattern.MatchString(p.Container) || len(p.Container) > 100) {
+		return fmt.Errorf("container must be a docker container name (letters, digits, _ . -)")
+	}
+	return nil
+}
+
+// ensureCategoryBlacklist creates an empty blacklist-categories.txt in a profile's
+// directory: the shared squid.conf loads it, and category blacklists apply to the live
+// profile only
+func ensureCategoryBlacklist(dir string) error {
+	path := filepath.Join(dir, filepath.Base(blacklistCategoryPath))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	return writeFile(path, "")
+}
+
+func (s *profileStore) load() ([]Profile, error) {
+	data, err := os.ReadFile(profilesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Profile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(profilesPath()), err)
+	}
+	return list, nil
+}
+
+func (s *profileStore) save(list []Profile) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(profilesPath(), data, 0644)
+}
+
+// all returns the live profile first, then the others by name
+func (s *profileStore) all() ([]Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	live := Profile{Name: liveProfile, Description: "The editor's own lists", Container: SquidHost, Live: true}
+	return append([]Profile{live}, list...), nil
+}
+
+// get returns one profile, or nil when it does not exist
+func (s *profileStore) get(name string) (*Profile, error) {
+	list, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// put creates a profile or changes its description and container. A new profile starts
+// with a copy of the lists of copyFrom, or with empty lists when it is nil.
+func (s *profileStore) put(p Profile, copyFrom *Profile, actor string, now time.Time) (*Profile, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	p.Live = false
+	if err := listMu.Lock(); err != nil {
+		return nil, err
+	}
+	defer listMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Name == p.Name {
+			p.CreatedAt, p.CreatedBy = list[i].CreatedAt, list[i].CreatedBy
+			list[i] = p
+			// Profiles created before the file was written get it here
+			if err := ensureCategoryBlacklist(p.dir()); err != nil {
+				return nil, err
+			}
+			return &p, s.save(list)
+		}
+	}
+	if len(list) >= MaxProfiles {
+		return nil, fmt.Errorf("at most %d profiles", MaxProfiles)
+	}
+	p.CreatedAt, p.CreatedBy = now.UTC(), actor
+	set := &listSet{defs: sortLists(builtinLists()), lists: make(map[string][]string), meta: listMetadata{}}
+	if copyFrom != nil {
+		if set, err = loadListSet(copyFrom.dir()); err != nil {
+			return nil, err
+		}
+	}
+	set.dir = p.dir()
+	if err := os.MkdirAll(filepath.Join(set.dir, "lists"), 0755); err != nil {
+		return nil, err
+	}
+	var named []ListDef
+	for _, d := range set.defs {
+		if !d.BuiltIn {
+			named = append(named, d)
+		}
+	}
+	if err := (&listDefStore{dir: set.dir}).save(named); err != nil {
+		return nil, err
+	}
+	if _, err := set.save(); err != nil {
+		return nil, err
+	}
+	if err := ensureCategoryBlacklist(set.dir); err != nil {
+		return nil, err
+	}
+	return &p, s.save(append(list, p))
+}
+
+// remove deletes a profile and its lists
+func (s *profileStore) remove(name string) error {
+	if err := listMu.Lock(); err != nil {
+		return err
+	}
+	defer listMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].Name == name {
+			dir := list[i].dir()
+			if err := s.save(append(list[:i], list[i+1:]...)); err != nil {
+				return err
+			}
+			return os.RemoveAll(dir)
+		}
+	}
+	return fmt.Errorf("profile %s not found", name)
+}
+
+// listSet is the full set of lists of a data directory
+type listSet struct {
+	dir   string
+	defs  []ListDef           // built-in and named lists in squid's order
+	lists map[string][]string // lines of every list and IP list file
+	meta  listMetadata
+}
+
+// loadListSet reads the lists of a data directory. The caller holds listMu when the
+// lists are written back.
+func loadListSet(dir string) (*listSet, error) {
+	defs, err := (&listDefStore{dir: dir}).all()
+	if err != nil {
+		return nil, err
+	}
+	set := &listSet{dir: dir, defs: defs, lists: make(map[string][]string)}
+	for _, name := range set.names() {
+		for _, file := range []string{name, ipListFor(name)} {
+			set.lists[file] = parseDomainList(readFile(listFileIn(dir, file)))
+		}
+	}
+	if set.meta, err = loadListMetadataIn(dir, set.names()); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// names returns the whitelist, the blacklist and then the named lists by priority
+func (s *listSet) names() []string {
+	return listNamesOf(s.defs)
+}
+
+// def returns a list of the set, or nil
+func (s *listSet) def(name string) *ListDef {
+	for _, d := range s.defs {
+		if d.Name == name {
+			return &d
+		}
+	}
+	return nil
+}
+
+// save writes the list files, the metadata and the squid configuration of the set and
+// reports whether the configuration changed. Named list definitions are saved by the
+// list store.
+func (s *listSet) save() (bool, error) {
+	for _, name := range s.names() {
+		for _, file := range []string{name, ipListFor(name)} {
+			if err := writeFile(listFileIn(s.dir, file), formatDomainList(s.lists[file])); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := saveListMetadataIn(s.dir, s.meta); err != nil {
+		return false, err
+	}
+	return writeListConfigIn(s.dir, s.defs)
+}
+
+// profileEntry is where a profile keeps an entry
+type profileEntry struct {
+	List string
+	Note string
+}
+
+// entries maps every entry of the set to its list; an entry on several lists counts
+// for the first of them
+func (s *listSet) entries() map[string]profileEntry {
+	out := make(map[string]profileEntry)
+	for _, name := range s.names() {
+		for _, file := range []string{name, ipListFor(name)} {
+			for _, line := range s.lists[file] {
+				e := parseDomainEntry(line)
+				if _, ok := out[e.Domain]; !ok {
+					out[e.Domain] = profileEntry{List: name, Note: e.Note}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// profileChange is an entry two profiles keep differently. Promoting it moves the entry
+// in the target profile to the list it is on in the source profile, with its note.
+type profileChange struct {
+	Domain     string `json:"domain"`
+	Display    string `json:"display,omitempty"`
+	Source     string `json:"source"` // list in the source profile, or unknown
+	Target     string `json:"target"` // list in the target profile, or unknown
+	Note       string `json:"note,omitempty"`
+	TargetNote string `json:"target_note,omitempty"`
+}
+
+// listChange is a named list of the source profile that the target profile lacks or
+// defines with another action, priority or description
+type listChange struct {
+	Name   string   `json:"name"`
+	Source ListDef  `json:"source"`
+	Target *ListDef `json:"target,omitempty"`
+}
+
+// profileDiff is what promoting everything from one profile to another would change
+type profileDiff struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Changes []profileChange `json:"changes"`
+	Lists   []listChange    `json:"lists"`
+}
+
+// diffListSets compares two sets of lists. Metadata is not compared.
+func diffListSets(source, target *listSet) ([]profileChange, []listChange) {
+	changes := []profileChange{}
+	have, want := target.entries(), source.entries()
+	for domain, e := range want {
+		if t, ok := have[domain]; !ok || t.List != e.List || t.Note != e.Note {
+			c := profileChange{Domain: domain, Display: displayDomain(domain), Source: e.List, Target: "unknown", Note: e.Note}
+			if ok {
+				c.Target, c.TargetNote = t.List, t.Note
+			}
+			changes = append(changes, c)
+		}
+	}
+	for domain, t := range have {
+		if _, ok := want[domain]; !ok {
+			changes = append(changes, profileChange{Domain: domain, Display: displayDomain(domain), Source: "unknown", Target: t.List, TargetNote: t.Note})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return sortDomainsByParts(changes[i].Domain, changes[j].Domain) })
+
+	lists := []listChange{}
+	for _, d := range source.defs {
+		if d.BuiltIn {
+			continue
+		}
+		t := target.def(d.Name)
+		if t == nil || t.Action != d.Action || t.Priority != d.Priority || t.Description != d.Description {
+			lists = append(lists, listChange{Name: d.Name, Source: d, Target: t})
+		}
+	}
+	return changes, lists
+}
+
+// diffProfiles compares the lists of two profiles
+func diffProfiles(from, to *Profile) (*profileDiff, error) {
+	source, err := loadListSet(from.dir())
+	if err != nil {
+		return nil, err
+	}
+	target, err := loadListSet(to.dir())
+	if err != nil {
+		return nil, err
+	}
+	changes, lists := diffListSets(source, target)
+	return &profileDiff{From: from.Name, To: to.Name, Changes: changes, Lists: lists}, nil
+}
+
+// promoteRequest is the JSON body of POST /profiles/promote
+type promoteRequest struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Domains []string `json:"domains,omitempty"` // entries to promote
+	Lists   []string `json:"lists,omitempty"`   // named list definitions to copy
+	All     bool     `json:"all,omitempty"`     // every difference
+}
+
+// Promotion records changes promoted from one profile to another
+type Promotion struct {
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Changes []profileChange `json:"changes"`
+	Lists   []string        `json:"lists,omitempty"`
+	Reload  string          `json:"reload,omitempty"` // "ok", the reload error, or empty when no squid was reloaded
+}
+
+// promote copies the selected differences from one profile to another, records the
+// promotion and reloads the target's squid. Named lists that promoted entries go to are
+// created in the target. The moves are returned for auditing.
+func promote(actor string, from, to *Profile, req promoteRequest, now time.Time) (*Promotion, []*domainMove, error) {
+	if from.Name == to.Name {
+		return nil, nil, fmt.Errorf("cannot promote a profile to itself")
+	}
+	if err := listMu.Lock(); err != nil {
+		return nil, nil, err
+	}
+	defer listMu.Unlock()
+	source, err := loadListSet(from.dir())
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := loadListSet(to.dir())
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, lists := diffListSets(source, target)
+
+	var selected []profileChange
+	var defs []ListDef
+	if req.All {
+		selected = changes
+		for _, l := range lists {
+			defs = append(defs, l.Source)
+		}
+	} else {
+		for _, domain := range req.Domains {
+			found := false
+			for _, c := range changes {
+				if c.Domain == domain || c.Display == domain {
+					selected, found = append(selected, c), true
+					break
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("%s is the same in %s and %s", domain, from.Name, to.Name)
+			}
+		}
+		for _, name := range req.Lists {
+			found := false
+			for _, l := range lists {
+				if l.Name == name {
+					defs, found = append(defs, l.Source), true
+					break
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("list %s is the same in %s and %s", name, from.Name, to.Name)
+			}
+		}
+	}
+	// Entries need their list in the target
+	for _, c := range selected {
+		if c.Source == "unknown" || target.def(c.Source) != nil {
+			continue
+		}
+		missing := true
+		for _, d := range defs {
+			missing = missing && d.Name != c.Source
+		}
+		if missing {
+			defs = append(defs, *source.def(c.Source))
+		}
+	}
+	if len(selected) == 0 && len(defs) == 0 {
+		return nil, nil, fmt.Errorf("nothing to promote from %s to %s", from.Name, to.Name)
+	}
+
+	p := &Promotion{ID: randomToken(9), Time: now.UTC(), Actor: actor, From: from.Name, To: to.Name, Changes: selected}
+	if len(defs) > 0 {
+		store := &listDefStore{dir: to.dir()}
+		if to.Live {
+			store = listDefinitions
+		}
+		for _, d := range defs {
+			if _, err := store.put(d, actor, now); err != nil {
+				return nil, nil, fmt.Errorf("list %s: %v", d.Name, err)
+			}
+			p.Lists = append(p.Lists, d.Name)
+		}
+		if target, err = loadListSet(to.dir()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var moves []*domainMove
+	given := make(map[string]*EntryMeta)
+	allow := false // an allow list changes, only read for the live profile
+	for _, c := range selected {
+		moves = append(moves, moveEntries(target.names(), target.lists, []DomainEntry{{Domain: c.Domain, Note: c.Note}}, c.Source)...)
+		if m, ok := source.meta[c.Source][c.Domain]; ok {
+			given[c.Domain] = &m
+		}
+		allow = allow || listAction(c.Source) == ListAllow || listAction(c.Target) == ListAllow
+	}
+	target.meta.applyMoves(actor, moves, given, target.lists, now)
+	if _, err := target.save(); err != nil {
+		return nil, moves, fmt.Errorf("write error: %v", err)
+	}
+
+	var reloadErr error
+	switch {
+	case to.Live:
+		// Domains on allow lists are left out of the category blacklist
+		if allow {
+			if _, err := categories.writeBlacklist(); err != nil {
+				return nil, moves, fmt.Errorf("write error: %v", err)
+			}
+		}
+		reloadErr = reloadSquid()
+		p.Reload = reloadOutcome(reloadErr)
+	case to.Container != "":
+		reloadErr = profileSquid(to.Container).Reconfigure()
+		p.Reload = reloadOutcome(reloadErr)
+	}
+	for _, move := range moves {
+		move.ReloadErr = reloadErr
+	}
+	if err := recordPromotion(*p); err != nil {
+		return p, moves, err
+	}
+	return p, moves, nil
+}
+
+// promotionsPath returns the location of the promotion history
+func promotionsPath() string {
+	return filepath.Join(dataDir, "promotions.json")
+}
+
+// loadPromotions returns the promotion history, newest last
+func loadPromotions() ([]Promotion, error) {
+	data, err := os.ReadFile(promotionsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Promotion
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(promotionsPath()), err)
+	}
+	return list, nil
+}
+
+// recordPromotion appends to the promotion history, keeping PromotionHistorySize
+// promotions. The caller holds listMu.
+func recordPromotion(p Promotion) error {
+	list, err := loadPromotions()
+	if err != nil {
+		return err
+	}
+	list = append(list, p)
+	if n := len(list) - PromotionHistorySize; n > 0 {
+		list = list[n:]
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(promotionsPath(), data, FilePermissions)
+}
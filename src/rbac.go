@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions checked by requirePermission and the list mutation handlers
+const (
+	PermView        = "view"            // read logs, lists, health and stats
+	PermBlacklist   = "blacklist:edit"  // add to or remove from the blacklist
+	PermWhitelist   = "whitelist:edit"  // add to or remove from the whitelist
+	PermReload      = "squid:reload"    // reload squid
+	PermClearLogs   = "logs:clear"      // clear, archive and rotate logs
+	PermManageUsers = "users:manage"    // create, delete and change roles of accounts
+	PermAudit       = "audit:view"      // read the audit log
+	PermWebhooks    = "webhooks:manage" // configure outgoing webhooks
+	PermDigest      = "digest:send"     // preview and send the email digest
+	PermRules       = "rules:manage"    // configure the auto-classification rules
+	PermLists       = "lists:manage"    // create and delete named lists
+	PermProfiles    = "profiles:manage" // create profiles and promote changes between them
+	PermMetrics     = "metrics:read"    // scrape /metrics
+)
+
+// Roles, from least to most privileged
+const (
+	RoleViewer    = "viewer"
+	RoleRequester = "requester"
+	RoleEditor    = "editor"
+	RoleAdmin     = "admin"
+)
+
+// roleOrder lists the roles from least to most privileged
+var roleOrder = []string{RoleViewer, RoleRequester, RoleEditor, RoleAdmin}
+
+// roleRank returns a role's position in roleOrder, or -1 for unknown roles
+func roleRank(role string) int {
+	for i, r := range roleOrder {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// rolePermissions maps each role to what it may do
+var rolePermissions = map[string][]string{
+	RoleViewer:    {PermView, PermMetrics},
+	RoleRequester: {PermView, PermMetrics, PermBlacklist},
+	RoleEditor:    {PermView, PermMetrics, PermBlacklist, PermWhitelist, PermReload},
+	RoleAdmin:     {PermView, PermMetrics, PermBlacklist, PermWhitelist, PermReload, PermClearLogs, PermManageUsers, PermAudit, PermWebhooks, PermDigest, PermRules, PermLists, PermProfiles},
+}
+
+// validRole reports whether a role name is known
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// roleNames returns the known roles, sorted
+func roleNames() []string {
+	names := make([]string, 0, len(rolePermissions))
+	for name := range rolePermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roleHas reports whether a role grants a permission
+func roleHas(role, perm string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// currentPermissions returns the permissions of the request's user. Requests made
+// with an API token get the token's permissions, limited to what the owner's role
+// still allows. With authentication disabled everything is allowed.
+func currentPermissions(c *gin.Context) []string {
+	if !authEnabled {
+		return rolePermissions[RoleAdmin]
+	}
+	role := c.GetString("role")
+	tok := currentToken(c)
+	if tok == nil {
+		return rolePermissions[role]
+	}
+	var perms []string
+	for _, p := range tok.Permissions {
+		if roleHas(role, p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// hasPermission reports whether the request's user holds a permission
+func hasPermission(c *gin.Context, perm string) bool {
+	for _, p := range currentPermissions(c) {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission aborts with 403 unless the user holds perm
+func requirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasPermission(c, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "error", "error": fmt.Sprintf("permission denied: %s required", perm)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// listPermission returns the permission needed to change a list: whitelist:edit for the
+// whitelist and other allow lists, blacklist:edit for deny lists
+func listPermission(list string) string {
+	if listAction(list) == ListAllow {
+		return PermWhitelist
+	}
+	return PermBlacklist
+}
+
+// canEditList reports whether the request may change a list: the user needs the
+// list's edit permission and an API token must also include the list in its scope
+func canEditList(c *gin.Context, list string) bool {
+	if !hasPermission(c, listPermission(list)) {
+		return false
+	}
+	if tok := currentToken(c); tok != nil && !tok.allowsList(list) {
+		return false
+	}
+	return true
+}
+
+// moveLists returns the lists that must be editable to move a domain to target: the
+// target list, unless the domain is removed ("unknown"), and every list holding the
+// domain, since moving takes it off them (so a requester cannot blacklist a
+// whitelisted domain)
+func moveLists(target string, holding []string) []string {
+	lists := holding
+	if target != "unknown" && !containsString(holding, target) {
+		lists = append([]string{target}, holding...)
+	}
+	return lists
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Access request states
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestDenied   = "denied"
+)
+
+// AccessRequest is a user's request to have a domain whitelisted
+type AccessRequest struct {
+	ID            string     `json:"id"`
+	Domain        string     `json:"domain"`
+	Requester     string     `json:"requester"`
+	Justification string     `json:"justification"`
+	ClientIP      string     `json:"client_ip"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+	DecidedBy     string     `json:"decided_by,omitempty"`
+	DecisionNote  string     `json:"decision_note,omitempty"`
+}
+
+// accessRequestStore persists access requests as JSON in the data directory
+type accessRequestStore struct {
+	mu sync.Mutex
+}
+
+// accessRequests is the process-wide access request store
+var accessRequests = &accessRequestStore{}
+
+// accessRequestsPath returns the location of the request database
+func accessRequestsPath() string {
+	return filepath.Join(dataDir, "requests.json")
+}
+
+func (s *accessRequestStore) load() ([]AccessRequest, error) {
+	data, err := os.ReadFile(accessRequestsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []AccessRequest
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(accessRequestsPath()), err)
+	}
+	return list, nil
+}
+
+// save writes the requests, keeping every pending one and the DecidedRequestRetention
+// most recently decided ones
+func (s *accessRequestStore) save(list []AccessRequest) error {
+	var decided []time.Time
+	for _, r := range list {
+		if r.DecidedAt != nil {
+			decided = append(decided, *r.DecidedAt)
+		}
+	}
+	if len(decided) > DecidedRequestRetention {
+		sort.Slice(decided, func(i, j int) bool { return decided[i].After(decided[j]) })
+		cutoff := decided[DecidedRequestRetention-1]
+		kept := list[:0:0]
+		for _, r := range list {
+			if r.DecidedAt == nil || !r.DecidedAt.Before(cutoff) {
+				kept = append(kept, r)
+			}
+		}
+		list = kept
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(accessRequestsPath(), data, 0600)
+}
+
+// singleLine collapses whitespace so free text is safe in list notes and logs. It cuts
+// at most max bytes, never inside a UTF-8 sequence.
+func singleLine(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut]
+	}
+	return s
+}
+
+// create files a new pending request. A client asking again for a domain it
+// already has pending gets the existing request back with created false.
+func (s *accessRequestStore) create(r AccessRequest, now time.Time) (*AccessRequest, bool, error) {
+	domain, err := normalizeListDomain(r.Domain)
+	if err != nil {
+		return nil, false, err
+	}
+	r.Domain = domain
+	r.Requester = singleLine(r.Requester, 100)
+	r.Justification = singleLine(r.Justification, MaxJustificationLength)
+	if r.Requester == "" {
+		return nil, false, fmt.Errorf("requester is required")
+	}
+	if r.Justification == "" {
+		return nil, false, fmt.Errorf("justification is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, false, err
+	}
+	pending, fromClient := 0, 0
+	for i := range list {
+		if list[i].Status != RequestPending {
+			continue
+		}
+		pending++
+		if list[i].ClientIP == r.ClientIP {
+			if list[i].Domain == r.Domain {
+				existing := list[i]
+				return &existing, false, nil
+			}
+			fromClient++
+		}
+	}
+	if pending >= MaxPendingRequests {
+		return nil, false, fmt.Errorf("too many pending requests, please try again later")
+	}
+	// Rules file their reviews under "rule:<id>", which is not a client to limit
+	if fromClient >= MaxPendingRequestsPerClient && !strings.HasPrefix(r.ClientIP, "rule:") {
+		return nil, false, fmt.Errorf("you already have %d pending requests", fromClient)
+	}
+
+	r.ID = randomToken(12)
+	r.Status = RequestPending
+	r.CreatedAt = now.UTC()
+	r.DecidedAt, r.DecidedBy, r.DecisionNote = nil, "", ""
+	if err := s.save(append(list, r)); err != nil {
+		return nil, false, err
+	}
+	return &r, true, nil
+}
+
+// get returns one request, or nil when it does not exist
+func (s *accessRequestStore) get(id string) (*AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range list {
+		if r.ID == id {
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+// list returns requests with the given status (all when empty), newest first
+func (s *accessRequestStore) list(status string) ([]AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]AccessRequest, 0, len(all))
+	for _, r := range all {
+		if status == "" || r.Status == status {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// decide moves a pending request to approved or denied
+func (s *accessRequestStore) decide(id, status, by, note string, now time.Time) (*AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		r := &list[i]
+		if r.ID != id {
+			continue
+		}
+		if r.Status != RequestPending {
+			return nil, fmt.Errorf("request %s is already %s", id, r.Status)
+		}
+		at := now.UTC()
+		r.Status, r.DecidedAt, r.DecidedBy, r.DecisionNote = status, &at, by, singleLine(note, MaxJustificationLength)
+		decided := *r
+		return &decided, s.save(list)
+	}
+	return nil, fmt.Errorf("request %s not found", id)
+}
+
+// listNote is the note written next to a domain whitelisted by an approved request
+func (r *AccessRequest) listNote(decisionNote string) string {
+	if note := singleLine(decisionNote, MaxJustificationLength); note != "" {
+		return note
+	}
+	return singleLine(fmt.Sprintf("requested by %s: %s", r.Requester, r.Justification), MaxJustificationLength)
+}
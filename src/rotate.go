@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentTimeFormat is the UTC timestamp appended to rotated log segments,
+// e.g. access-regular.log.20240403T120000Z.gz. It sorts chronologically as a string.
+// A second segment of the same second gets a -N suffix (20240403T120000Z-2).
+const segmentTimeFormat = "20060102T150405Z"
+
+// logMu serializes rotation and clearing of the categorized logs
+var logMu sync.Mutex
+
+// logSegment is a rotated (and normally gzip-compressed) piece of an access log
+type logSegment struct {
+	Path      string
+	RotatedAt time.Time
+	seq       int // -N suffix of segments rotated in the same second, 1 without one
+}
+
+// startLogRotator runs rotateLogs periodically in the background
+func startLogRotator(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := rotateLogs(time.Now(), false); err != nil {
+				fmt.Printf("Warning: log rotation: %v\n", err)
+			}
+		}
+	}()
+}
+
+// rotationConfirmed holds the uncompressed segments squid was told to reopen its logs
+// after. squid reopens them asynchronously and keeps appending to the renamed file until
+// then, so a segment is only compressed on a later pass.
+var rotationConfirmed = make(map[string]bool)
+
+// rotateLogs rotates every categorized log that exceeds the size or age limit
+// (or every non-empty log when force is set), asks squid to reopen its logs,
+// compresses the segments of earlier confirmed rotations and applies the retention
+// limits. Segments stay uncompressed, and squid is asked again on the next pass, while
+// squid cannot be told to reopen its logs. It returns the paths of the segments created.
+func rotateLogs(now time.Time, force bool) ([]string, error) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	var errs []string
+	var ready, unconfirmed []string
+	for _, src := range logSources() {
+		for _, seg := range listLogSegments(src.path) {
+			if strings.HasSuffix(seg.Path, ".gz") {
+				continue
+			}
+			if rotationConfirmed[seg.Path] {
+				ready = append(ready, seg.Path)
+			} else {
+				unconfirmed = append(unconfirmed, seg.Path)
+			}
+		}
+	}
+
+	var renamed []string
+	for _, src := range logSources() {
+		if !force && !needsRotation(src.path, now) {
+			continue
+		}
+		seg, err := renameLogForRotation(src.path, now)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if seg != "" {
+			renamed = append(renamed, seg)
+		}
+	}
+
+	if pending := append(unconfirmed, renamed...); len(pending) > 0 {
+		// squid keeps writing to the renamed file until it reopens its logs
+		if err := squidBackend.Rotate(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			for _, seg := range pending {
+				rotationConfirmed[seg] = true
+			}
+		}
+	}
+
+	for _, seg := range ready {
+		if _, err := compressSegment(seg); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(rotationConfirmed, seg)
+	}
+
+	for _, src := range logSources() {
+		if err := pruneLogSegments(src.path, now); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return renamed, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return renamed, nil
+}
+
+// logReopenWait is how long squid is given to reopen its logs after squid -k rotate;
+// tests shorten it
+var logReopenWait = LogReopenWait
+
+// waitForLogReopen waits until squid stopped writing to renamed logs (log path ->
+// segment): their sizes must stay the same for logReopenWait, checked a few times at most
+func waitForLogReopen(segments map[string]string) {
+	sizes := func() map[string]int64 {
+		out := make(map[string]int64)
+		for _, seg := range segments {
+			if info, err := os.Stat(seg); err == nil {
+				out[seg] = info.Size()
+			}
+		}
+		return out
+	}
+	before := sizes()
+	for i := 0; i < LogReopenChecks; i++ {
+		time.Sleep(logReopenWait)
+		after := sizes()
+		stable := true
+		for seg, size := range after {
+			stable = stable && before[seg] == size
+		}
+		if stable {
+			return
+		}
+		before = after
+	}
+}
+
+// needsRotation reports whether a log is over LogRotateMaxSize or its oldest entry is older than LogRotateMaxAge
+func needsRotation(path string, now time.Time) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	if info.Size() >= LogRotateMaxSize {
+		return true
+	}
+	first, ok := firstLogTimestamp(path)
+	if !ok {
+		return false
+	}
+	return now.Sub(first) >= LogRotateMaxAge
+}
+
+// firstLogTimestamp returns the timestamp of the first parseable line in a log
+func firstLogTimestamp(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if ts, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			return unixFloatToTime(ts), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// renameLogForRotation moves a non-empty log aside and recreates an empty one in its place
+func renameLogForRotation(path string, now time.Time) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if info.Size() == 0 {
+		return "", nil
+	}
+	// A segment of the same second, compressed or not, must not be overwritten
+	base := path + "." + now.UTC().Format(segmentTimeFormat)
+	seg := base
+	for n := 2; fileExists(seg) || fileExists(seg+".gz"); n++ {
+		seg = fmt.Sprintf("%s-%d", base, n)
+	}
+	if err := os.Rename(path, seg); err != nil {
+		return "", fmt.Errorf("rotate %s: %v", filepath.Base(path), err)
+	}
+	if err := writeFile(path, ""); err != nil {
+		return seg, fmt.Errorf("recreate %s: %v", filepath.Base(path), err)
+	}
+	return seg, nil
+}
+
+// compressSegment gzips a rotated segment and removes the uncompressed file. The
+// compressed file is written aside and linked into place, so an existing .gz is never
+// overwritten.
+func compressSegment(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	gzPath := path + ".gz"
+	tmpPath := gzPath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, FilePermissions)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return "", fmt.Errorf("compress %s: %v", filepath.Base(path), err)
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return "", fmt.Errorf("compress %s: %v", filepath.Base(path), err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Link(tmpPath, gzPath); err != nil {
+		return "", fmt.Errorf("compress %s: %v", filepath.Base(path), err)
+	}
+	in.Close()
+	if err := os.Remove(path); err != nil {
+		return gzPath, err
+	}
+	return gzPath, nil
+}
+
+// listLogSegments returns the rotated segments of a log, oldest first
+func listLogSegments(path string) []logSegment {
+	matches, _ := filepath.Glob(path + ".*")
+	var segments []logSegment
+	for _, m := range matches {
+		stamp := strings.TrimPrefix(m, path+".")
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		seq := 1
+		if i := strings.IndexByte(stamp, '-'); i >= 0 {
+			n, err := strconv.Atoi(stamp[i+1:])
+			if err != nil || n < 2 {
+				continue
+			}
+			stamp, seq = stamp[:i], n
+		}
+		t, err := time.Parse(segmentTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, logSegment{Path: m, RotatedAt: t, seq: seq})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if !segments[i].RotatedAt.Equal(segments[j].RotatedAt) {
+			return segments[i].RotatedAt.Before(segments[j].RotatedAt)
+		}
+		return segments[i].seq < segments[j].seq
+	})
+	return segments
+}
+
+// pruneLogSegments deletes compressed segments beyond LogRetentionSegments or older than LogRetentionMaxAge
+func pruneLogSegments(path string, now time.Time) error {
+	segments := listLogSegments(path)
+	var errs []string
+	for i, seg := range segments {
+		// Segments waiting for compression may still be written to by squid
+		if !strings.HasSuffix(seg.Path, ".gz") {
+			continue
+		}
+		tooMany := len(segments)-i > LogRetentionSegments
+		tooOld := now.Sub(seg.RotatedAt) > LogRetentionMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(seg.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("prune %s: %s", filepath.Base(path), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// openLogSegment opens a log or rotated segment, transparently decompressing .gz files
+func openLogSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{zr, f}, nil
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying file
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// unixFloatToTime converts a squid "seconds.millis" timestamp to time.Time
+func unixFloatToTime(ts float64) time.Time {
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*1e9))
+}
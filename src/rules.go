@@ -0,0 +1,660 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rules classify unknown (RG) hosts as the log ingester sees them, so recurring
+// decisions are made automatically. Rules are tried in priority order and the first
+// one whose conditions all match a host decides it; each rule acts on a host once.
+
+// Rule actions
+const (
+	RuleWhitelist = "whitelist" // add the host to the whitelist
+	RuleBlacklist = "blacklist" // add the host to the blacklist
+	RuleNotify    = "notify"    // send a rule.matched webhook event
+	RuleReview    = "review"    // file a pending access request for an editor to decide
+	RuleNote      = "note"      // annotate the host in the summary, leaving it unknown
+)
+
+// ruleActions lists the actions a rule can take
+var ruleActions = []string{RuleWhitelist, RuleBlacklist, RuleNotify, RuleReview, RuleNote}
+
+// Rule matches unknown hosts and acts on them. Every condition that is set must match.
+type Rule struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Enabled     bool      `json:"enabled"`
+	Priority    int       `json:"priority"`               // lower runs first
+	Suffix      string    `json:"suffix,omitempty"`       // the domain itself or any subdomain
+	Regex       string    `json:"regex,omitempty"`        // Go regular expression matched against the host
+	Category    string    `json:"category,omitempty"`     // category from the datasets ("recreation" includes "recreation/sports")
+	Clients     []string  `json:"clients,omitempty"`      // client group: addresses and CIDR ranges
+	MinRequests int       `json:"min_requests,omitempty"` // requests in the live logs, from the client group when set
+	Actions     []string  `json:"actions"`
+	Note        string    `json:"note,omitempty"` // list note, review justification and notification text
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// validate checks a rule and brings its fields into canonical form
+func (r *Rule) validate() error {
+	r.Name = singleLine(r.Name, 100)
+	r.Note = singleLine(r.Note, MaxJustificationLength)
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Suffix != "" {
+		suffix, err := normalizeListDomain(r.Suffix)
+		if err != nil {
+			return fmt.Errorf("suffix: %v", err)
+		}
+		if isIPEntry(suffix) {
+			return fmt.Errorf("suffix must be a domain")
+		}
+		r.Suffix = strings.TrimPrefix(suffix, ".")
+	}
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("regex: %v", err)
+		}
+	}
+	r.Category = categoryName(r.Category)
+	for i, client := range r.Clients {
+		entry, err := normalizeIPEntry(strings.TrimSpace(client))
+		if err != nil {
+			return fmt.Errorf("clients: %v", err)
+		}
+		r.Clients[i] = entry
+	}
+	if r.MinRequests < 0 {
+		return fmt.Errorf("min_requests must not be negative")
+	}
+	if r.Suffix == "" && r.Regex == "" && r.Category == "" && len(r.Clients) == 0 && r.MinRequests == 0 {
+		return fmt.Errorf("a rule needs at least one condition")
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("a rule needs at least one action")
+	}
+	for _, a := range r.Actions {
+		if !containsString(ruleActions, a) {
+			return fmt.Errorf("unknown action %q", a)
+		}
+	}
+	if containsString(r.Actions, RuleWhitelist) && containsString(r.Actions, RuleBlacklist) {
+		return fmt.Errorf("a rule cannot both whitelist and blacklist")
+	}
+	return nil
+}
+
+// ruleHost is what the logs tell about an unknown host
+type ruleHost struct {
+	requests map[string]int // client -> requests
+	url      string         // latest URL
+}
+
+// clientRequests counts the requests from clients in a group, or from everyone
+func (h *ruleHost) clientRequests(group []string) (count int, top string) {
+	most := 0
+	for client, n := range h.requests {
+		if len(group) > 0 && !clientInGroup(client, group) {
+			continue
+		}
+		count += n
+		if n > most || (n == most && client < top) {
+			most, top = n, client
+		}
+	}
+	return count, top
+}
+
+// clientInGroup reports whether a client address is in a list of addresses and ranges
+func clientInGroup(client string, group []string) bool {
+	ip := ipRange(client)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range group {
+		if r := ipRange(entry); r != nil && rangeContains(r, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether every condition of a rule holds for a host. regexps
+// caches compiled expressions.
+func (r *Rule) matches(host string, h *ruleHost, regexps map[string]*regexp.Regexp) bool {
+	if r.Suffix != "" && !matchesDstdomain(host, "."+r.Suffix) {
+		return false
+	}
+	if r.Regex != "" {
+		re, ok := regexps[r.Regex]
+		if !ok {
+			re, _ = regexp.Compile(r.Regex)
+			regexps[r.Regex] = re
+		}
+		if re == nil || !re.MatchString(host) {
+			return false
+		}
+	}
+	if r.Category != "" {
+		found := false
+		for _, c := range categories.lookup(host) {
+			if matchesCategory(c, r.Category) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	count, _ := h.clientRequests(r.Clients)
+	if len(r.Clients) > 0 && count == 0 {
+		return false
+	}
+	return count >= r.MinRequests
+}
+
+// ruleStore persists rules as JSON in the data directory
+type ruleStore struct {
+	mu sync.Mutex
+}
+
+// ruleConfig is the process-wide rule store
+var ruleConfig = &ruleStore{}
+
+// rulesPath returns the location of the rule configuration
+func rulesPath() string {
+	return filepath.Join(dataDir, "rules.json")
+}
+
+func (s *ruleStore) load() ([]Rule, error) {
+	data, err := os.ReadFile(rulesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Rule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(rulesPath()), err)
+	}
+	return list, nil
+}
+
+func (s *ruleStore) save(list []Rule) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rulesPath(), data, 0600)
+}
+
+// list returns every rule in evaluation order
+func (s *ruleStore) list() ([]Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Priority < list[j].Priority })
+	return list, nil
+}
+
+// put validates and stores a rule, creating it when it has no ID
+func (s *ruleStore) put(r Rule) (*Rule, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if r.ID == "" {
+		r.ID = randomToken(9)
+		r.CreatedAt = time.Now().UTC()
+		list = append(list, r)
+		return &r, s.save(list)
+	}
+	for i := range list {
+		if list[i].ID == r.ID {
+			r.CreatedAt = list[i].CreatedAt
+			list[i] = r
+			return &r, s.save(list)
+		}
+	}
+	return nil, fmt.Errorf("rule %s not found", r.ID)
+}
+
+// remove deletes a rule
+func (s *ruleStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].ID == id {
+			return s.save(append(list[:i], list[i+1:]...))
+		}
+	}
+	return fmt.Errorf("rule %s not found", id)
+}
+
+// ruleAction is one rule acting on one host, as kept in the rule history
+type ruleAction struct {
+	Time     time.Time `json:"time"`
+	RuleID   string    `json:"rule_id"`
+	RuleName string    `json:"rule_name"`
+	Domain   string    `json:"domain"`
+	Actions  []string  `json:"actions"`
+	Requests int       `json:"requests"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// ruleHostNote is the annotation a note rule left on an unknown host
+type ruleHostNote struct {
+	Note     string    `json:"note"`
+	RuleID   string    `json:"rule_id"`
+	RuleName string    `json:"rule_name"`
+	Time     time.Time `json:"time"`
+}
+
+// ruleState is stored in rule-state.json so rules do not act twice after a restart,
+// when the ingester reads the live logs again
+type ruleState struct {
+	Applied map[string]time.Time    `json:"applied"`         // "<rule id> <host>" -> when the rule acted
+	History []ruleAction            `json:"history"`         // newest last, at most RuleHistorySize
+	Notes   map[string]ruleHostNote `json:"notes,omitempty"` // host -> note, at most RuleHistorySize
+}
+
+// ruleStatePath returns the location of the rule state
+func ruleStatePath() string {
+	return filepath.Join(dataDir, "rule-state.json")
+}
+
+// ruleEngine evaluates the rules against the unknown hosts the ingester reports
+type ruleEngine struct {
+	mu      sync.Mutex
+	hosts   map[string]*ruleHost
+	state   *ruleState
+	path    string // file state was loaded from
+	regexps map[string]*regexp.Regexp
+}
+
+// rulesEngine is the process-wide rule engine fed by the log ingester
+var rulesEngine = newRuleEngine()
+
+func newRuleEngine() *ruleEngine {
+	return &ruleEngine{hosts: make(map[string]*ruleHost), regexps: make(map[string]*regexp.Regexp)}
+}
+
+// loadState reads the rule state on first use and after the data directory changed
+func (e *ruleEngine) loadState() error {
+	if e.state != nil && e.path == ruleStatePath() {
+		return nil
+	}
+	state := &ruleState{Applied: make(map[string]time.Time)}
+	data, err := os.ReadFile(ruleStatePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return fmt.Errorf("parse %s: %v", filepath.Base(ruleStatePath()), err)
+		}
+		if state.Applied == nil {
+			state.Applied = make(map[string]time.Time)
+		}
+	}
+	e.state, e.path = state, ruleStatePath()
+	return nil
+}
+
+func (e *ruleEngine) saveState() error {
+	data, err := json.Marshal(e.state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ruleStatePath(), data, FilePermissions)
+}
+
+// ruleHit is one RG request reported by the ingester
+type ruleHit struct {
+	Host     string
+	URL      string
+	ClientIP string
+}
+
+// observe records unknown requests and applies the rules to the hosts they went to
+func (e *ruleEngine) observe(hits []ruleHit, now time.Time) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	touched := make(map[string]bool)
+	for _, hit := range hits {
+		h := e.hosts[hit.Host]
+		if h == nil {
+			h = &ruleHost{requests: make(map[string]int)}
+			e.hosts[hit.Host] = h
+		}
+		h.requests[hit.ClientIP]++
+		h.url = hit.URL
+		touched[hit.Host] = true
+	}
+
+	list, err := ruleConfig.list()
+	if err != nil {
+		return err
+	}
+	var enabled []Rule
+	for _, r := range list {
+		if r.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+	if err := e.loadState(); err != nil {
+		return err
+	}
+
+	hosts := make([]string, 0, len(touched))
+	for host := range touched {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var pending []pendingRuleAction
+	for _, host := range hosts {
+		h := e.hosts[host]
+		r := firstMatchingRule(enabled, host, h, e.regexps)
+		if r == nil {
+			continue
+		}
+		key := r.ID + " " + host
+		if _, done := e.state.Applied[key]; done {
+			continue
+		}
+		// Hosts listed since they were logged are no longer unknown
+		if list, _ := domainPolicy(host); list != "unknown" {
+			continue
+		}
+		e.state.Applied[key] = now.UTC()
+		pending = append(pending, pendingRuleAction{rule: *r, host: host, info: h})
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	for _, p := range pending {
+		if containsString(p.rule.Actions, RuleNote) {
+			e.addNote(p.host, ruleHostNote{Note: ruleNote(p.rule), RuleID: p.rule.ID, RuleName: p.rule.Name, Time: now.UTC()})
+		}
+	}
+	for _, action := range applyRuleActions(pending, now) {
+		e.state.History = append(e.state.History, action)
+	}
+	if n := len(e.state.History) - RuleHistorySize; n > 0 {
+		e.state.History = e.state.History[n:]
+	}
+	return e.saveState()
+}
+
+// addNote annotates a host, dropping the oldest notes beyond RuleHistorySize
+func (e *ruleEngine) addNote(host string, note ruleHostNote) {
+	if e.state.Notes == nil {
+		e.state.Notes = make(map[string]ruleHostNote)
+	}
+	e.state.Notes[host] = note
+	for len(e.state.Notes) > RuleHistorySize {
+		oldest := ""
+		for h, n := range e.state.Notes {
+			if oldest == "" || n.Time.Before(e.state.Notes[oldest].Time) || (n.Time.Equal(e.state.Notes[oldest].Time) && h < oldest) {
+				oldest = h
+			}
+		}
+		delete(e.state.Notes, oldest)
+	}
+}
+
+// notes returns the notes rules left on hosts
+func (e *ruleEngine) notes() map[string]ruleHostNote {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.loadState(); err != nil {
+		return nil
+	}
+	out := make(map[string]ruleHostNote, len(e.state.Notes))
+	for host, note := range e.state.Notes {
+		out[host] = note
+	}
+	return out
+}
+
+// firstMatchingRule returns the rule that decides a host, or nil
+func firstMatchingRule(rules []Rule, host string, h *ruleHost, regexps map[string]*regexp.Regexp) *Rule {
+	for i := range rules {
+		if rules[i].matches(host, h, regexps) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// pendingRuleAction is a rule about to act on a host
+type pendingRuleAction struct {
+	rule Rule
+	host string
+	info *ruleHost
+}
+
+// ruleActor names a rule in the audit log and in notifications
+func ruleActor(r Rule) string {
+	return "rule:" + r.Name
+}
+
+// ruleRequestKey files the reviews of a rule in place of a client address, so they
+// do not count toward the per-client limit of the access request queue
+func ruleRequestKey(r Rule) string {
+	return "rule:" + r.ID
+}
+
+// ruleNote is the note a rule writes next to the hosts it lists or annotates
+func ruleNote(r Rule) string {
+	if r.Note != "" {
+		return r.Note
+	}
+	return "rule " + r.Name
+}
+
+// applyRuleActions carries out the actions of matched rules. List changes are made
+// with one write and reload per list.
+func applyRuleActions(pending []pendingRuleAction, now time.Time) []ruleAction {
+	results := make([]ruleAction, len(pending))
+	byTarget := map[string][]int{}
+	for i, p := range pending {
+		count, client := p.info.clientRequests(p.rule.Clients)
+		results[i] = ruleAction{Time: now.UTC(), RuleID: p.rule.ID, RuleName: p.rule.Name, Domain: p.host, Actions: p.rule.Actions, Requests: count}
+		var errs []string
+		for _, action := range p.rule.Actions {
+			switch action {
+			case RuleWhitelist, RuleBlacklist:
+				byTarget[action] = append(byTarget[action], i)
+			case RuleNotify:
+				text := fmt.Sprintf("rule %s matched unknown domain %s (%d requests)", p.rule.Name, p.host, count)
+				if p.rule.Note != "" {
+					text += ": " + p.rule.Note
+				}
+				webhooks.notify(EventRuleMatched, text, map[string]string{
+					"rule":      p.rule.Name,
+					"rule_id":   p.rule.ID,
+					"domain":    p.host,
+					"url":       p.info.url,
+					"client_ip": client,
+					"requests":  strconv.Itoa(count),
+					"actions":   strings.Join(p.rule.Actions, ","),
+					"note":      p.rule.Note,
+				})
+			case RuleReview:
+				req := AccessRequest{Domain: p.host, Requester: ruleActor(p.rule), Justification: ruleNote(p.rule), ClientIP: ruleRequestKey(p.rule)}
+				if _, _, err := accessRequests.create(req, now); err != nil {
+					errs = append(errs, "review: "+err.Error())
+				}
+			case RuleNote:
+				// kept in the rule state by observe
+			}
+		}
+		results[i].Error = strings.Join(errs, "; ")
+	}
+
+	for _, target := range []string{RuleWhitelist, RuleBlacklist} {
+		indexes := byTarget[target]
+		if len(indexes) == 0 {
+			continue
+		}
+		entries := make([]DomainEntry, len(indexes))
+		for j, i := range indexes {
+			entries[j] = DomainEntry{Domain: pending[i].host, Note: ruleNote(pending[i].rule)}
+		}
+		// Entry metadata records the rules engine; the audit trail names each rule
+		moves, err := moveDomains("rules", entries, target)
+		for j, move := range moves {
+			actor := ruleActor(pending[indexes[j]].rule)
+			entry := AuditEntry{Actor: actor, SourceIP: "rules", Action: AuditMoveDomain, Domain: move.Domain, From: move.From, To: move.To, Note: move.Note, Covered: move.Covered, Result: AuditSuccess}
+			if err != nil {
+				entry.Result, entry.Error = AuditError, err.Error()
+			} else {
+				entry.Reload = reloadOutcome(move.ReloadErr)
+				notifyListChange(actor, move)
+			}
+			if _, aerr := auditTrail.append(entry, now); aerr != nil {
+				fmt.Printf("Warning: failed to write audit log: %v\n", aerr)
+			}
+		}
+		if err != nil {
+			for _, i := range indexes {
+				results[i].Error = strings.TrimPrefix(results[i].Error+"; "+target+": "+err.Error(), "; ")
+			}
+		}
+	}
+	return results
+}
+
+// history returns the newest rule actions first
+func (e *ruleEngine) history(limit int) ([]ruleAction, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.loadState(); err != nil {
+		return nil, err
+	}
+	out := []ruleAction{}
+	for i := len(e.state.History) - 1; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		out = append(out, e.state.History[i])
+	}
+	return out, nil
+}
+
+// applied reports whether a rule already acted on a host
+func (e *ruleEngine) applied(ruleID, host string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.loadState(); err != nil {
+		return false
+	}
+	_, ok := e.state.Applied[ruleID+" "+host]
+	return ok
+}
+
+// ruleDryRunMatch is a host a rule would act on
+type ruleDryRunMatch struct {
+	Domain   string `json:"domain"`
+	Display  string `json:"display,omitempty"`
+	Requests int    `json:"requests"`
+	Applied  bool   `json:"applied"` // the rule already acted on this host
+}
+
+// ruleDryRunResult is what one rule would have done on the current log
+type ruleDryRunResult struct {
+	Rule    Rule              `json:"rule"`
+	Matches []ruleDryRunMatch `json:"matches"`
+}
+
+// ruleDryRun is the answer of GET /rules/dry-run
+type ruleDryRun struct {
+	Hosts     int                `json:"hosts"`     // unknown hosts in the live logs
+	Unmatched int                `json:"unmatched"` // unknown hosts no rule matches
+	Rules     []ruleDryRunResult `json:"rules"`
+}
+
+// dryRunRules evaluates rules against the unknown hosts of a merged log without acting.
+// Disabled rules are included, so a rule can be tried before it is enabled.
+func dryRunRules(logText string, rules []Rule) ruleDryRun {
+	hosts := make(map[string]*ruleHost)
+	for _, line := range strings.Split(logText, "\n") {
+		entry, err := ParseLogEntry(line)
+		if err != nil || entry.Tag != "RG" || entry.Host == "" {
+			continue
+		}
+		h := hosts[entry.Host]
+		if h == nil {
+			h = &ruleHost{requests: make(map[string]int)}
+			hosts[entry.Host] = h
+		}
+		h.requests[entry.ClientIP]++
+		h.url = entry.URL
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Slice(names, func(i, j int) bool { return sortDomainsByParts(names[i], names[j]) })
+
+	report := ruleDryRun{Rules: make([]ruleDryRunResult, len(rules))}
+	for i, r := range rules {
+		report.Rules[i] = ruleDryRunResult{Rule: r, Matches: []ruleDryRunMatch{}}
+	}
+	regexps := make(map[string]*regexp.Regexp)
+	for _, host := range names {
+		if list, _ := domainPolicy(host); list != "unknown" {
+			continue
+		}
+		report.Hosts++
+		h := hosts[host]
+		matched := false
+		for i := range rules {
+			if !rules[i].matches(host, h, regexps) {
+				continue
+			}
+			count, _ := h.clientRequests(rules[i].Clients)
+			report.Rules[i].Matches = append(report.Rules[i].Matches, ruleDryRunMatch{
+				Domain:   host,
+				Display:  displayDomain(host),
+				Requests: count,
+				Applied:  rulesEngine.applied(rules[i].ID, host),
+			})
+			matched = true
+			break
+		}
+		if !matched {
+			report.Unmatched++
+		}
+	}
+	return report
+}
@@ -7,10 +7,53 @@ import (
 	"time"
 )
 
+// squidController is the backend used to signal the squid process.
+// The default implementation drives the squid container through the docker CLI;
+// tests swap it out for a fake.
+type squidController interface {
+	Reconfigure() error // re-read squid.conf and the domain lists
+	Rotate() error      // close and reopen the access logs
+}
+
+// dockerSquid controls squid running in a sibling container via the docker CLI
+type dockerSquid struct {
+	container string
+}
+
+// squidBackend is the reload backend used by reloadSquid and the log rotator
+var squidBackend squidController = dockerSquid{container: SquidHost}
+
+// Reconfigure sends HUP to the container, falling back to squid -k reconfigure
+func (d dockerSquid) Reconfigure() error {
+	// Try graceful HUP first
+	cmd := exec.Command("docker", "kill", "-s", "HUP", d.container)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	// Fallback to reconfigure
+	cmd2 := exec.Command("docker", "exec", d.container, "squid", "-k", "reconfigure")
+	out2, err2 := cmd2.CombinedOutput()
+	if err2 != nil {
+		return fmt.Errorf("reload failed: %v output1: %s output2: %s", err2, string(out), string(out2))
+	}
+	return nil
+}
+
+// Rotate runs squid -k rotate so squid reopens its access logs after they were renamed
+func (d dockerSquid) Rotate() error {
+	cmd := exec.Command("docker", "exec", d.container, "squid", "-k", "rotate")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rotate failed: %v output: %s", err, string(out))
+	}
+	return nil
+}
+
 // squidStatus checks TCP connectivity to squid service (container hostname) port 3128
 func squidStatus() string {
-	address := fmt.Sprintf("%s:%s", SquidHost, SquidPort)
-	conn, err := net.DialTimeout("tcp", address, time.Duration(ConnectionTimeout)*time.Millisecond)
+	conn, err := net.DialTimeout("tcp", squidAddress(), time.Duration(ConnectionTimeout)*time.Millisecond)
 	if err != nil {
 		return "DOWN"
 	}
@@ -21,20 +64,20 @@ func squidStatus() string {
 	return "UP"
 }
 
-// reloadSquid executes squid -k reconfigure inside the squid container via docker CLI
+// squidAddress returns host:port of the squid proxy
+func squidAddress() string {
+	return net.JoinHostPort(SquidHost, SquidPort)
+}
+
+// reloadSquid asks the squid backend to re-read its configuration and lists.
+// The reload stays unverified in the health checker until squid answers a probe afterwards.
 func reloadSquid() error {
-	// Try graceful HUP first
-	cmd := exec.Command("docker", "kill", "-s", "HUP", SquidHost)
-	out, err := cmd.CombinedOutput()
-	if err == nil {
-		return nil
-	}
-	
-	// Fallback to reconfigure
-	cmd2 := exec.Command("docker", "exec", SquidHost, "squid", "-k", "reconfigure")
-	out2, err2 := cmd2.CombinedOutput()
-	if err2 != nil {
-		return fmt.Errorf("reload failed: %v output1: %s output2: %s", err2, string(out), string(out2))
+	start := time.Now()
+	err := squidBackend.Reconfigure()
+	metrics.observeReload(start, err)
+	health.recordReload(start, err)
+	if err != nil {
+		webhooks.notify(EventReloadFailed, "squid reload failed: "+err.Error(), map[string]string{"error": err.Error()})
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiTokenPrefix marks editor API tokens so they are easy to spot in secret scanners
+const apiTokenPrefix = "sqe_"
+
+// APIToken is a scoped, revocable credential for automation clients.
+// Only the SHA-256 hash of the secret is stored.
+type APIToken struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Owner       string     `json:"owner"`
+	Hash        string     `json:"hash"`
+	Permissions []string   `json:"permissions"`
+	Lists       []string   `json:"lists,omitempty"` // lists the token may change; empty means any its permissions allow
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP  string     `json:"last_used_ip,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// active reports whether the token may still be used
+func (t *APIToken) active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// allowsList reports whether the token's list scope includes a list
+func (t *APIToken) allowsList(list string) bool {
+	if len(t.Lists) == 0 {
+		return true
+	}
+	for _, l := range t.Lists {
+		if l == list {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenStore persists API tokens as JSON in the data directory
+type tokenStore struct {
+	mu sync.Mutex
+}
+
+// tokens is the process-wide token store
+var tokens = &tokenStore{}
+
+// tokensPath returns the location of the token database
+func tokensPath() string {
+	return filepath.Join(dataDir, "tokens.json")
+}
+
+func (s *tokenStore) load() ([]APIToken, error) {
+	data, err := os.ReadFile(tokensPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(tokensPath()), err)
+	}
+	return list, nil
+}
+
+func (s *tokenStore) save(list []APIToken) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tokensPath(), data, 0600)
+}
+
+// hashToken returns the stored form of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// create issues a token and returns it with its secret, which is never stored
+func (s *tokenStore) create(t APIToken) (*APIToken, string, error) {
+	if strings.TrimSpace(t.Name) == "" {
+		return nil, "", fmt.Errorf("token name is required")
+	}
+	if len(t.Permissions) == 0 {
+		return nil, "", fmt.Errorf("at least one permission is required")
+	}
+	for _, l := range t.Lists {
+		if !knownList(l) {
+			return nil, "", fmt.Errorf("invalid list: %s", l)
+		}
+	}
+	secret := apiTokenPrefix + randomToken(32)
+	t.ID = randomToken(9)
+	t.Hash = hashToken(secret)
+	t.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.save(append(list, t)); err != nil {
+		return nil, "", err
+	}
+	return &t, secret, nil
+}
+
+// list returns the tokens of one owner, or all tokens when owner is empty
+func (s *tokenStore) list(owner string) ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]APIToken, 0, len(all))
+	for _, t := range all {
+		if owner == "" || t.Owner == owner {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// revoke marks a token revoked; owner restricts which tokens may be revoked unless empty
+func (s *tokenStore) revoke(id, owner string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].ID != id || (owner != "" && list[i].Owner != owner) {
+			continue
+		}
+		if list[i].RevokedAt == nil {
+			at := now.UTC()
+			list[i].RevokedAt = &at
+		}
+		return s.save(list)
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+// authenticate finds the active token matching a secret and records its use
+func (s *tokenStore) authenticate(secret, clientIP string, now time.Time) (*APIToken, bool) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, false
+	}
+	hash := []byte(hashToken(secret))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, false
+	}
+	for i := range list {
+		t := &list[i]
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) != 1 {
+			continue
+		}
+		if !t.active(now) {
+			return nil, false
+		}
+		// Only persist "last used" once a minute to keep busy clients from rewriting the file
+		if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > time.Minute || t.LastUsedIP != clientIP {
+			at := now.UTC()
+			t.LastUsedAt = &at
+			t.LastUsedIP = clientIP
+			if err := s.save(list); err != nil {
+				fmt.Printf("Warning: failed to record token use: %v\n", err)
+			}
+		}
+		found := *t
+		return &found, true
+	}
+	return nil, false
+}
+
+// bearerToken extracts the secret from an "Authorization: Bearer ..." header
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// currentToken returns the API token that authenticated the request, if any
+func currentToken(c *gin.Context) *APIToken {
+	if v, ok := c.Get("token"); ok {
+		return v.(*APIToken)
+	}
+	return nil
+}
+
+// requireSession rejects requests authenticated by an API token, e.g. for token management
+func requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authEnabled && currentToken(c) != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "error", "error": "this endpoint requires a browser session"})
+			return
+		}
+		c.Next()
+	}
+}
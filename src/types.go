@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Emoji constants for status indicators
@@ -16,10 +17,26 @@ const (
 
 // Row represents a domain entry with access statistics
 type Row struct {
-	Domain string `json:"domain"`
-	Count  int    `json:"count"`
-	Status string `json:"status"`
-	Url    string `json:"url"`
+	Domain  string `json:"domain"`
+	Display string `json:"display,omitempty"` // Unicode form of an internationalized (punycode) domain
+	Count   int    `json:"count"`
+	Status  string `json:"status"`
+	Url     string `json:"url"`
+	IP      bool   `json:"ip,omitempty"`    // destination is an IP address rather than a domain
+	Range   string `json:"range,omitempty"` // CIDR entry of an IP list matching the address
+	Note    string `json:"note,omitempty"`  // left by a note rule on an unknown host
+	// Categories of the most specific category dataset domain covering the host
+	Categories []string `json:"categories,omitempty"`
+}
+
+// RowGroup rolls up the summary rows of one registrable domain (eTLD+1)
+type RowGroup struct {
+	Domain   string `json:"domain"`            // registrable domain, e.g. example.co.uk
+	Display  string `json:"display,omitempty"` // Unicode form of an internationalized domain
+	Count    int    `json:"count"`             // requests to all hosts below it
+	Status   string `json:"status"`            // status shared by every host, empty when they differ
+	List     string `json:"list,omitempty"`    // list holding a wildcard entry for the whole domain
+	Children []Row  `json:"children"`
 }
 
 // LogEntry represents a parsed squid log line
@@ -56,8 +73,12 @@ func ParseLogEntry(line string) (*LogEntry, error) {
 // File paths for configuration and logs
 // These are variables so they can be overridden for testing
 var (
+	dataDir                = "/data"
 	whitelistPath          = "/data/whitelist.txt"
 	blacklistPath          = "/data/blacklist.txt"
+	whitelistIPPath        = "/data/whitelist-ip.txt" // squid dst ACLs for IP addresses and CIDR ranges
+	blacklistIPPath        = "/data/blacklist-ip.txt"
+	blacklistCategoryPath  = "/data/blacklist-categories.txt" // generated from blacklisted categories
 	accessLogRegularPath   = "/data/access-regular.log"
 	accessLogWhitelistPath = "/data/access-whitelist.log"
 	accessLogBlacklistPath = "/data/access-blacklist.log"
@@ -65,12 +86,21 @@ var (
 )
 
 // Helper function to set test data directory
-func setTestDataDir(dataDir string) {
-	whitelistPath = filepath.Join(dataDir, "whitelist.txt")
-	blacklistPath = filepath.Join(dataDir, "blacklist.txt")
-	accessLogRegularPath = filepath.Join(dataDir, "access-regular.log")
-	accessLogWhitelistPath = filepath.Join(dataDir, "access-whitelist.log")
-	accessLogBlacklistPath = filepath.Join(dataDir, "access-blacklist.log")
+func setTestDataDir(dir string) {
+	setDataDir(dir)
+}
+
+// setDataDir points every data file at dir (the CLI's -data-dir)
+func setDataDir(dir string) {
+	dataDir = dir
+	whitelistPath = filepath.Join(dir, "whitelist.txt")
+	blacklistPath = filepath.Join(dir, "blacklist.txt")
+	whitelistIPPath = filepath.Join(dir, "whitelist-ip.txt")
+	blacklistIPPath = filepath.Join(dir, "blacklist-ip.txt")
+	blacklistCategoryPath = filepath.Join(dir, "blacklist-categories.txt")
+	accessLogRegularPath = filepath.Join(dir, "access-regular.log")
+	accessLogWhitelistPath = filepath.Join(dir, "access-whitelist.log")
+	accessLogBlacklistPath = filepath.Join(dir, "access-blacklist.log")
 }
 
 // Application constants
@@ -82,4 +112,104 @@ const (
 	SquidHost       = "squid-whitelist-proxy"
 	SquidPort       = "3128"
 	ConnectionTimeout = 400 // milliseconds
+	// SquidProbeURL is fetched through squid by the health checker; squid.conf allows it
+	SquidProbeURL = "http://squid-editor:8080/squid/probe"
+)
+
+// Authentication
+const (
+	SessionCookieName  = "squid_editor_session"
+	SessionTTL         = 12 * time.Hour
+	MinPasswordLength  = 8
+	BootstrapAdminUser = "admin"
+)
+
+// OpenID Connect single sign-on
+const (
+	OIDCStateCookieName    = "squid_editor_oidc_state"
+	OIDCLoginTimeout       = 10 * time.Minute // time allowed between redirect and callback
+	OIDCHTTPTimeout        = 10 * time.Second
+	OIDCKeyRefreshInterval = time.Minute // minimum time between JWKS refetches for unknown key IDs
+	OIDCClockSkew          = time.Minute
+)
+
+// Access requests
+const (
+	MaxPendingRequests          = 500
+	MaxPendingRequestsPerClient = 5
+	MaxJustificationLength      = 1000
+	DecidedRequestRetention     = 1000 // decided requests kept in requests.json, newest first
+)
+
+// Bulk list changes (POST /move-domains, CLI import)
+const MaxBulkMove = 5000
+
+// Dependency discovery (GET /dependencies)
+const (
+	DependencyWindow         = 10 * time.Second // default time around a visit searched for co-requests
+	MaxDependencyWindow      = 5 * time.Minute
+	DependencySuggestions    = 20 // default number of suggestions
+	MaxDependencySuggestions = 200
+)
+
+// Lists: squid evaluates the built-in and named lists by priority, lowest first
+const (
+	BlacklistPriority = 100
+	WhitelistPriority = 200
+	MaxListPriority   = 1000
+	MaxNamedLists     = 100
+	MaxListNameLength = 50
+)
+
+// List entry metadata
+const (
+	MaxTags      = 20 // tags per entry
+	MaxTagLength = 50
+)
+
+// Environment profiles
+const (
+	MaxProfiles          = 20
+	PromotionHistorySize = 500 // promotions kept in promotions.json
+)
+
+// Auto-classification rules
+const RuleHistorySize = 1000 // rule actions kept in rule-state.json
+
+// Webhooks
+const (
+	WebhookQueueSize       = 1000
+	WebhookWorkers         = 4
+	WebhookMaxAttempts     = 5
+	WebhookRetryBase       = 2 * time.Second // doubled after every failed attempt
+	WebhookTimeout         = 10 * time.Second
+	WebhookDeliveryLogSize = 500 // deliveries kept in memory for /webhooks/deliveries
+	CLIWebhookWait         = time.Minute // how long the command-line tool waits for its deliveries
+)
+
+// Email digest
+const (
+	DigestMaxLogEntries = 200000 // newest unknown or blocked entries counted per digest
+	DigestSMTPTimeout   = 30 * time.Second
+)
+
+// Squid health checking
+const (
+	HealthCheckInterval = 10 * time.Second
+	HealthProbeTimeout  = 3 * time.Second
+	HealthHistorySize   = 100 // up/down transitions kept
+	CacheManagerTimeout = 3 * time.Second
+)
+
+// Log rotation and retention limits
+const (
+	LogRotateMaxSize       = 8 * 1024 * 1024 // rotate before a log reaches MaxFileSize
+	LogRotateMaxAge        = 24 * time.Hour  // rotate when the oldest entry is older than this
+	LogRetentionSegments   = 14              // rotated segments kept per log
+	LogRetentionMaxAge     = 30 * 24 * time.Hour
+	LogRotateCheckInterval = time.Minute
+	LogReopenWait          = time.Second // for squid to reopen its logs before a cleared log is archived
+	LogReopenChecks        = 5
+	MaxSearchResults       = 500
+	LogIngestInterval      = 2 * time.Second
 )
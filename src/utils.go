@@ -2,8 +2,20 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 // isDomainLike does a lightweight check for domain style tokens (example.com or example.com:443)
@@ -31,6 +43,10 @@ func isDomainLike(s string) bool {
 		case r >= 'A' && r <= 'Z':
 			hasAlpha = true
 			pureNumeric = false
+		case r >= utf8.RuneSelf && unicode.IsLetter(r):
+			// internationalized domain label
+			hasAlpha = true
+			pureNumeric = false
 		case r >= '0' && r <= '9':
 			// still possibly numeric
 		case r == '.' || r == '-':
@@ -73,11 +89,127 @@ func extractDomain(url string) string {
 	return url
 }
 
+// normalizeListDomain turns user input into a list entry: a squid dstdomain entry that is
+// lowercase, without scheme, path, port or trailing dot, and in punycode, or a canonical
+// IP address or CIDR range for the dst lists. A leading "." (or "*.") is kept as the
+// subdomain wildcard. Every list change goes through here.
+func normalizeListDomain(input string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(input))
+	if s == "" {
+		return "", fmt.Errorf("domain is required")
+	}
+	if strings.ContainsAny(s, " \t\r\n") {
+		return "", fmt.Errorf("invalid domain %q: contains whitespace", input)
+	}
+	if strings.Contains(s, "/") && !strings.Contains(s, "://") {
+		if prefix := s[:strings.Index(s, "/")]; net.ParseIP(prefix) != nil {
+			return normalizeIPEntry(s)
+		}
+	}
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Hostname() == "" {
+			return "", fmt.Errorf("invalid domain %q: not a valid URL", input)
+		}
+		s = u.Hostname()
+	} else {
+		if i := strings.IndexAny(s, "/?"); i >= 0 {
+			s = s[:i]
+		}
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			if _, err := strconv.Atoi(port); err != nil {
+				return "", fmt.Errorf("invalid domain %q: invalid port %q", input, port)
+			}
+			s = host
+		} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+			s = s[1 : len(s)-1]
+		}
+	}
+	if strings.Contains(s, "#") {
+		return "", fmt.Errorf("invalid domain %q: '#' starts a note in the list files", input)
+	}
+	s = strings.TrimSuffix(s, ".")
+	if strings.HasPrefix(s, "*.") {
+		s = s[1:]
+	}
+	wildcard := strings.HasPrefix(s, ".")
+	s = strings.TrimPrefix(s, ".")
+	if ip := net.ParseIP(s); ip != nil {
+		if wildcard {
+			return "", fmt.Errorf("invalid domain %q: an IP address cannot have a subdomain wildcard", input)
+		}
+		return normalizeIPEntry(s)
+	}
+	if !isASCII(s) {
+		ascii, err := toASCIIDomain(s)
+		if err != nil {
+			return "", err
+		}
+		s = ascii
+	}
+	if err := validateHostname(s); err != nil {
+		return "", fmt.Errorf("invalid domain %q: %v", input, err)
+	}
+	if wildcard {
+		if suffix, icann := publicsuffix.PublicSuffix(s); icann && suffix == s {
+			return "", fmt.Errorf("invalid domain %q: a wildcard for the public suffix %s would match every site below it", input, s)
+		}
+		s = "." + s
+	}
+	return s, nil
+}
+
+// validateHostname checks the length limits and characters of a lowercase ASCII host name.
+// Underscores are accepted because squid and real host names (e.g. _dmarc) use them.
+func validateHostname(host string) error {
+	if host == "" {
+		return fmt.Errorf("empty host name")
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("longer than 253 characters")
+	}
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("empty label")
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("label %q is longer than 63 characters", label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("label %q contains %q", label, r)
+			}
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("label %q starts or ends with a hyphen", label)
+		}
+	}
+	last := labels[len(labels)-1]
+	if strings.Trim(last, "0123456789") == "" {
+		return fmt.Errorf("top-level label %q is numeric", last)
+	}
+	return nil
+}
+
+// listDomainFor normalizes the domain of a list change. Entries written before validation
+// existed may not pass it; those can still be removed (target "unknown") as written.
+func listDomainFor(domain, target string) (string, error) {
+	normalized, err := normalizeListDomain(domain)
+	if target == "unknown" && (err != nil || normalized != domain) {
+		if len(domainLists(domain)) > 0 {
+			return domain, nil
+		}
+	}
+	return normalized, err
+}
+
 // DomainEntry represents a domain list entry with domain and optional note
 type DomainEntry struct {
 	Domain string
 	Note   string
-	Full   string // The full line including note
+	Full   string     // The full line including note
+	Meta   *EntryMeta // tags, owner and ticket to set when moving the entry
 }
 
 // parseDomainEntry parses a domain list line into domain and note parts
@@ -102,19 +234,54 @@ func parseDomainEntry(line string) DomainEntry {
 	}
 }
 
-// sortDomainsByParts sorts domains by reverse domain parts, ignoring TLD
+// publicSuffix returns the public suffix of a host according to the Public Suffix List
+// compiled into golang.org/x/net/publicsuffix, e.g. "co.uk" for "foo.co.uk". Unlisted TLDs
+// count as suffixes; IP addresses have none.
+func publicSuffix(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(host), ".")
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	suffix, _ := publicsuffix.PublicSuffix(host)
+	return suffix
+}
+
+// registrableDomain returns the registrable domain (eTLD+1) of a host, e.g. "example.co.uk"
+// for "cdn.example.co.uk". IP addresses, single labels and bare suffixes are returned as is.
+func registrableDomain(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// sortDomainsByParts sorts domains by reverse domain parts, ignoring the public suffix,
+// so that foo.co.uk and foo.com sort together and bar.co.uk does not sort under "co"
 func sortDomainsByParts(a, b string) bool {
+	// IP addresses and ranges sort numerically, after domains
+	aIP, bIP := ipRange(a), ipRange(b)
+	if aIP != nil || bIP != nil {
+		if aIP == nil || bIP == nil {
+			return bIP != nil
+		}
+		return compareIPEntries(aIP, bIP) < 0
+	}
 	split := func(domain string) ([]string, string) {
-		parts := strings.Split(domain, ".")
-		if len(parts) < 2 {
-			return parts, ""
+		suffix := publicSuffix(domain)
+		rest := domain
+		if suffix != "" && strings.HasSuffix(strings.ToLower(domain), suffix) {
+			rest = strings.TrimSuffix(domain[:len(domain)-len(suffix)], ".")
 		}
-		tld := parts[len(parts)-1]
-		sub := parts[:len(parts)-1]
+		sub := strings.Split(rest, ".")
 		for l, r := 0, len(sub)-1; l < r; l, r = l+1, r-1 {
 			sub[l], sub[r] = sub[r], sub[l]
 		}
-		return sub, tld
+		return sub, suffix
 	}
 	
 	aSub, aTld := split(a)
@@ -178,22 +345,328 @@ func sortAndJoinDomainList(domains []string) string {
 	return strings.Join(result, "\n")
 }
 
-// writeDomainList handles all whitelist/blacklist file writes with consistent sorting
-func writeDomainList(listType string, domains []string) error {
-	var filePath string
-	switch listType {
-	case "whitelist":
-		filePath = whitelistPath
-	case "blacklist":
-		filePath = blacklistPath
-	default:
-		return fmt.Errorf("invalid list type: %s", listType)
+// saveDomainList handles all list file writes (whitelist, blacklist and their -ip lists)
+// with consistent sorting. It does not reload squid; moveDomain reloads once after writing.
+func saveDomainList(listType string, domains []string) error {
+	filePath, err := listPath(listType)
+	if err != nil {
+		return err
 	}
-	
-	sortedContent := sortAndJoinDomainList(domains)
-	err := writeFile(filePath, sortedContent)
-	if err == nil {
-		_ = reloadSquid() // Always reload after successful write
+	return writeFile(filePath, formatDomainList(domains))
+}
+
+// formatDomainList renders list lines as a list file
+func formatDomainList(domains []string) string {
+	// squid matches punycode, so Unicode entries are stored in that form
+	normalized := make([]string, len(domains))
+	for i, line := range domains {
+		normalized[i] = asciiListLine(line)
+	}
+	return sortAndJoinDomainList(normalized)
+}
+
+// matchesDstdomain reports whether host matches a list entry the way squid's dstdomain
+// ACL does: "example.com" matches only itself, ".example.com" also matches subdomains
+func matchesDstdomain(host, entry string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	entry = strings.ToLower(entry)
+	if strings.HasPrefix(entry, ".") {
+		return host == entry[1:] || strings.HasSuffix(host, entry)
+	}
+	return host == entry
+}
+
+// domainPolicy returns which list decides a host, in squid's order (lowest priority
+// first, so the blacklist before the whitelist), and the matching entry; list is
+// "unknown" when none matches. IP-literal hosts are also checked against the IP lists;
+// squid additionally matches those against the addresses host names resolve to, which
+// is not evaluated here.
+func domainPolicy(host string) (list string, entry string) {
+	ip := hostIP(host)
+	for _, l := range orderedLists() {
+		path, _ := listPath(l.Name)
+		for _, line := range parseDomainList(readFile(path)) {
+			if e := parseDomainEntry(line); matchesDstdomain(host, e.Domain) {
+				return l.Name, e.Domain
+			}
+		}
+		if l.Name == "blacklist" {
+			if e, category := categories.blockedBy(host); e != "" {
+				return l.Name, fmt.Sprintf("%s in category %s", e, category)
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		if list, entry := ipPolicy(ip); list == l.Name {
+			return list, entry
+		}
+	}
+	return "unknown", ""
+}
+
+// listMu serializes read-modify-write changes to the domain lists, in this process and with
+// the command-line tool working on the same data directory
+var listMu listLock
+
+// listLock is a mutex that also holds an exclusive flock on .lists.lock in the data directory
+// while locked, since the server and the command-line tool are separate processes
+type listLock struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func listLockPath() string {
+	return filepath.Join(dataDir, ".lists.lock")
+}
+
+// Lock takes the lock. When the lock file cannot be locked it returns the error without
+// holding anything, and the caller must not write.
+func (l *listLock) Lock() error {
+	l.mu.Lock()
+	f, err := os.OpenFile(listLockPath(), os.O_RDWR|os.O_CREATE, FilePermissions)
+	if err != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("list lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		l.mu.Unlock()
+		return fmt.Errorf("list lock: %v", err)
+	}
+	l.file = f
+	return nil
+}
+
+func (l *listLock) Unlock() {
+	if l.file != nil {
+		syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+		l.file.Close()
+		l.file = nil
+	}
+	l.mu.Unlock()
+}
+
+// domainMove is the outcome of moving a domain between lists
+type domainMove struct {
+	Domain    string
+	From      string // the lists that held it ("whitelist", "whitelist,blacklist-malware") or unknown
+	To        string // a list or unknown
+	Note      string
+	Covered   []string // entries on the target list removed because the new wildcard entry covers them
+	Overlaps  []string // "list entry" IP entries sharing addresses with a new IP entry
+	ReloadErr error    // squid reload failure after the lists were written
+}
+
+// domainLists returns the lists currently holding domain (or IP entry)
+func domainLists(domain string) []string {
+	var holding []string
+	for _, name := range listNames() {
+		file := name
+		if isIPEntry(domain) {
+			file = ipListFor(name)
+		}
+		path, _ := listPath(file)
+		entries := parseDomainList(readFile(path))
+		if len(removeDomainFromList(entries, domain)) != len(entries) {
+			holding = append(holding, name)
+		}
+	}
+	return holding
+}
+
+// movesAllowList reports whether a move adds an entry to or takes one from a list that
+// allows requests
+func movesAllowList(move *domainMove) bool {
+	if listAction(move.To) == ListAllow {
+		return true
+	}
+	for _, from := range strings.Split(move.From, ",") {
+		if listAction(from) == ListAllow {
+			return true
+		}
+	}
+	return false
+}
+
+// moveDomain removes domain from every list, adds it to target with an optional note
+// unless target is "unknown", and reloads squid once. Every list change goes through
+// here or through moveDomains; actor is recorded in the entry metadata.
+func moveDomain(actor, domain, target, note string) (*domainMove, error) {
+	moves, err := moveDomains(actor, []DomainEntry{{Domain: domain, Note: note}}, target)
+	if len(moves) == 0 {
+		return nil, err
+	}
+	return moves[0], err
+}
+
+// moveDomains moves several domains to target in one write of each list and one reload
+func moveDomains(actor string, entries []DomainEntry, target string) ([]*domainMove, error) {
+	if target != "unknown" && !knownList(target) {
+		return nil, fmt.Errorf("target must be a list or unknown")
+	}
+	normalized := make([]DomainEntry, len(entries))
+	given := make(map[string]*EntryMeta)
+	for i, e := range entries {
+		domain, err := listDomainFor(e.Domain, target)
+		if err != nil {
+			return nil, err
+		}
+		normalized[i] = DomainEntry{Domain: domain, Note: singleLine(e.Note, MaxJustificationLength)}
+		if e.Meta != nil {
+			m := *e.Meta
+			if err := m.validate(); err != nil {
+				return nil, fmt.Errorf("%s: %v", domain, err)
+			}
+			given[domain] = &m
+		}
+	}
+	entries = normalized
+	if err := listMu.Lock(); err != nil {
+		return nil, err
+	}
+	defer listMu.Unlock()
+	meta, err := loadListMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	names := listNames()
+	lists := make(map[string][]string)
+	for _, name := range names {
+		for _, file := range []string{name, ipListFor(name)} {
+			path, _ := listPath(file)
+			lists[file] = parseDomainList(readFile(path))
+		}
+	}
+	moves := moveEntries(names, lists, entries, target)
+
+	var errs []string
+	for _, name := range names {
+		for _, file := range []string{name, ipListFor(name)} {
+			if err := saveDomainList(file, lists[file]); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	meta.applyMoves(actor, moves, given, lists, time.Now())
+	if err := saveListMetadata(meta); err != nil {
+		errs = append(errs, err.Error())
+	}
+	// Domains on allow lists are left out of the category blacklist
+	for _, move := range moves {
+		if !isIPEntry(move.Domain) && movesAllowList(move) {
+			if _, err := categories.writeBlacklist(); err != nil {
+				errs = append(errs, err.Error())
+			}
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return moves, fmt.Errorf("write error: %s", strings.Join(errs, "; "))
+	}
+	reloadErr := reloadSquid()
+	for _, move := range moves {
+		move.ReloadErr = reloadErr
+	}
+	return moves, nil
+}
+
+// commitDomainMoves is the write path of the move handlers and the local command-line
+// tool: it moves entries with moveDomains, hands an audit entry per domain to record and
+// sends list.changed webhooks once the lists are written
+func commitDomainMoves(actor string, entries []DomainEntry, target string, record func(AuditEntry)) ([]*domainMove, error) {
+	moves, err := moveDomains(actor, entries, target)
+	if err != nil && len(moves) == 0 {
+		for _, e := range entries {
+			record(AuditEntry{Action: AuditMoveDomain, Domain: e.Domain, To: target, Note: e.Note, Result: AuditError, Error: err.Error()})
+		}
+		return nil, err
+	}
+	for _, move := range moves {
+		entry := AuditEntry{Action: AuditMoveDomain, Domain: move.Domain, From: move.From, To: move.To, Note: move.Note, Covered: move.Covered, Result: AuditSuccess}
+		if err != nil {
+			entry.Result, entry.Error = AuditError, err.Error()
+		} else {
+			entry.Reload = reloadOutcome(move.ReloadErr)
+			notifyListChange(actor, move)
+		}
+		record(entry)
+	}
+	return moves, err
+}
+
+// moveEntries takes entries off every list in lists (list and IP list files by name) and
+// adds them to target unless it is "unknown". The caller writes the lists.
+func moveEntries(names []string, lists map[string][]string, entries []DomainEntry, target string) []*domainMove {
+	moves := make([]*domainMove, 0, len(entries))
+	for _, e := range entries {
+		move := &domainMove{Domain: e.Domain, To: target, Note: e.Note}
+		// IP addresses and ranges live on the -ip lists behind the whitelist and blacklist
+		file := func(list string) string { return list }
+		if isIPEntry(e.Domain) {
+			file = ipListFor
+		}
+
+		// Remove domain from every list first (strip any existing notes when removing)
+		var from []string
+		for _, list := range names {
+			if kept := removeDomainFromList(lists[file(list)], e.Domain); len(kept) != len(lists[file(list)]) {
+				from = append(from, list)
+				lists[file(list)] = kept
+			}
+		}
+		move.From = "unknown"
+		if len(from) > 0 {
+			move.From = strings.Join(from, ",")
+		}
+
+		entry := e.Domain
+		if e.Note != "" {
+			entry = fmt.Sprintf("%s #%s", e.Domain, e.Note)
+		}
+		// "unknown" means just remove from both lists (already done above)
+		if target != "unknown" {
+			lists[file(target)], move.Covered = removeCoveredEntries(lists[file(target)], e.Domain)
+			lists[file(target)] = append(lists[file(target)], entry)
+		}
+		moves = append(moves, move)
+	}
+	// Overlaps are reported once every entry is in place
+	for _, move := range moves {
+		if move.To != "unknown" && isIPEntry(move.Domain) {
+			for _, list := range names {
+				move.Overlaps = append(move.Overlaps, overlappingRanges(list, lists[ipListFor(list)], move.Domain)...)
+			}
+		}
+	}
+	return moves
+}
+
+// removeCoveredEntries drops the entries a ".example.com" style entry or a CIDR range makes
+// redundant (squid warns about them when loading the list) and returns them
+func removeCoveredEntries(domains []string, wildcard string) (kept []string, covered []string) {
+	if isIPEntry(wildcard) {
+		return removeCoveredRanges(domains, wildcard)
+	}
+	if !strings.HasPrefix(wildcard, ".") {
+		return domains, nil
+	}
+	for _, line := range domains {
+		d := parseDomainEntry(line).Domain
+		if d != wildcard && matchesDstdomain(strings.TrimPrefix(d, "."), wildcard) {
+			covered = append(covered, d)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept, covered
+}
+
+// policyAction is what squid does with a request decided by list
+func policyAction(list string) string {
+	if list == "unknown" {
+		return ListDeny
 	}
-	return err
+	return listAction(list)
 }
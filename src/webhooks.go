@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Webhook event types
+const (
+	EventListChanged     = "list.changed"
+	EventReloadFailed    = "squid.reload_failed"
+	EventSquidDown       = "squid.down"
+	EventSquidUp         = "squid.up"
+	EventDomainFirstSeen = "domain.first_seen"
+	EventRuleMatched     = "rule.matched"
+	EventTest            = "webhook.test" // sent by POST /webhooks/:id/test only
+)
+
+// webhookEvents lists the events a webhook can subscribe to
+var webhookEvents = []string{EventListChanged, EventReloadFailed, EventSquidDown, EventSquidUp, EventDomainFirstSeen, EventRuleMatched}
+
+// Webhook is an outgoing HTTP notification target
+type Webhook struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`             // empty subscribes to every event
+	Secret    string    `json:"secret,omitempty"`   // HMAC-SHA256 signing key
+	Template  string    `json:"template,omitempty"` // text/template rendering the JSON body; empty sends the event as is
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants reports whether the webhook subscribes to an event
+func (w *Webhook) wants(event string) bool {
+	if !w.Enabled {
+		return false
+	}
+	return len(w.Events) == 0 || containsString(w.Events, event)
+}
+
+// redactedSecret stands in for a webhook's secret in responses. Sent back on update it
+// keeps the stored secret, so a webhook read and saved again stays signed the same way.
+const redactedSecret = "********"
+
+// redacted returns a copy that is safe to show: the secret is masked
+func (w Webhook) redacted() Webhook {
+	if w.Secret != "" {
+		w.Secret = redactedSecret
+	}
+	return w
+}
+
+// webhookEvent is what happened; it is the default payload and the template's data
+type webhookEvent struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Time time.Time         `json:"time"`
+	Text string            `json:"text"` // one-line summary for chat receivers
+	Data map[string]string `json:"data"`
+}
+
+// webhookTemplateFuncs are available in payload templates; json quotes a value as a JSON string
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// renderWebhookPayload builds the request body for a webhook and checks it is valid JSON
+func renderWebhookPayload(hook *Webhook, event webhookEvent) ([]byte, error) {
+	if hook.Template == "" {
+		return json.Marshal(event)
+	}
+	tmpl, err := template.New("payload").Funcs(webhookTemplateFuncs).Option("missingkey=zero").Parse(hook.Template)
+	if err != nil {
+		return nil, fmt.Errorf("template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("template: %v", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// signWebhook returns the signature header value for a body sent at timestamp
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookStore persists webhooks as JSON in the data directory
+type webhookStore struct {
+	mu sync.Mutex
+}
+
+// webhookConfig is the process-wide webhook store
+var webhookConfig = &webhookStore{}
+
+// webhooksPath returns the location of the webhook configuration
+func webhooksPath() string {
+	return filepath.Join(dataDir, "webhooks.json")
+}
+
+func (s *webhookStore) load() ([]Webhook, error) {
+	data, err := os.ReadFile(webhooksPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []Webhook
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filepath.Base(webhooksPath()), err)
+	}
+	return list, nil
+}
+
+func (s *webhookStore) save(list []Webhook) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(webhooksPath(), data, 0600)
+}
+
+// list returns every configured webhook
+func (s *webhookStore) list() ([]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// get returns one webhook, or nil when it does not exist
+func (s *webhookStore) get(id string) (*Webhook, error) {
+	list, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range list {
+		if w.ID == id {
+			return &w, nil
+		}
+	}
+	return nil, nil
+}
+
+// put validates and stores a webhook, creating it when it has no ID. An empty or
+// masked secret on update keeps the stored one.
+func (s *webhookStore) put(w Webhook) (*Webhook, error) {
+	if w.Secret == redactedSecret {
+		w.Secret = ""
+	}
+	if w.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http or https URL")
+	}
+	for _, e := range w.Events {
+		if !containsString(webhookEvents, e) {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+	sample := webhookEvent{ID: "sample", Type: EventListChanged, Time: time.Now().UTC(), Text: "sample", Data: map[string]string{}}
+	if _, err := renderWebhookPayload(&w, sample); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if w.ID == "" {
+		w.ID = randomToken(9)
+		w.CreatedAt = time.Now().UTC()
+		list = append(list, w)
+		return &w, s.save(list)
+	}
+	for i := range list {
+		if list[i].ID == w.ID {
+			if w.Secret == "" {
+				w.Secret = list[i].Secret
+			}
+			w.CreatedAt = list[i].CreatedAt
+			list[i] = w
+			return &w, s.save(list)
+		}
+	}
+	return nil, fmt.Errorf("webhook %s not found", w.ID)
+}
+
+// remove deletes a webhook
+func (s *webhookStore) remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		if list[i].ID == id {
+			return s.save(append(list[:i], list[i+1:]...))
+		}
+	}
+	return fmt.Errorf("webhook %s not found", id)
+}
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryDropped   = "dropped" // the queue was full
+)
+
+// webhookDelivery is one event sent to one webhook, with its retries
+type webhookDelivery struct {
+	ID           string    `json:"id"`
+	WebhookID    string    `json:"webhook_id"`
+	WebhookName  string    `json:"webhook_name"`
+	Event        string    `json:"event"`
+	EventID      string    `json:"event_id"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// webhookJob is a queued delivery
+type webhookJob struct {
+	hook       Webhook
+	event      webhookEvent
+	deliveryID string
+}
+
+// webhookDispatcher queues events and delivers them with retries in the background.
+// The delivery log is kept in memory.
+type webhookDispatcher struct {
+	queue      chan webhookJob
+	client     *http.Client
+	retryBase  time.Duration // delay before the first retry, doubled for each further one
+	mu         sync.Mutex
+	deliveries []webhookDelivery
+}
+
+// webhooks is the process-wide dispatcher; main starts its workers
+var webhooks = newWebhookDispatcher()
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		queue:     make(chan webhookJob, WebhookQueueSize),
+		client:    &http.Client{Timeout: WebhookTimeout},
+		retryBase: WebhookRetryBase,
+	}
+}
+
+// start runs delivery workers
+func (d *webhookDispatcher) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range d.queue {
+				d.deliver(job)
+			}
+		}()
+	}
+}
+
+// notify sends an event to every enabled webhook subscribed to it
+func (d *webhookDispatcher) notify(eventType, text string, data map[string]string) {
+	hooks, err := webhookConfig.list()
+	if err != nil {
+		fmt.Printf("Warning: webhooks: %v\n", err)
+		return
+	}
+	event := webhookEvent{ID: randomToken(9), Type: eventType, Time: time.Now().UTC(), Text: text, Data: data}
+	for _, h := range hooks {
+		if h.wants(eventType) {
+			d.enqueue(h, event)
+		}
+	}
+}
+
+// enqueue records a pending delivery and queues it, or records it dropped when the queue is full
+func (d *webhookDispatcher) enqueue(hook Webhook, event webhookEvent) string {
+	now := time.Now().UTC()
+	rec := webhookDelivery{
+		ID:          randomToken(9),
+		WebhookID:   hook.ID,
+		WebhookName: hook.Name,
+		Event:       event.Type,
+		EventID:     event.ID,
+		Status:      DeliveryPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	// The record must exist before a worker can pick up the job and update it
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case d.queue <- webhookJob{hook: hook, event: event, deliveryID: rec.ID}:
+	default:
+		rec.Status, rec.Error = DeliveryDropped, "delivery queue is full"
+	}
+	d.deliveries = append(d.deliveries, rec)
+	if len(d.deliveries) > WebhookDeliveryLogSize {
+		d.deliveries = d.deliveries[len(d.deliveries)-WebhookDeliveryLogSize:]
+	}
+	return rec.ID
+}
+
+// deliver sends a job, retrying network errors, 429 and 5xx answers with exponential backoff
+func (d *webhookDispatcher) deliver(job webhookJob) {
+	body, err := renderWebhookPayload(&job.hook, job.event)
+	if err != nil {
+		d.update(job.deliveryID, func(r *webhookDelivery) { r.Status, r.Error = DeliveryFailed, err.Error() })
+		return
+	}
+	delay := d.retryBase
+	for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+		code, err := d.post(job, body)
+		retry := err != nil || code == http.StatusTooManyRequests || code >= 500
+		d.update(job.deliveryID, func(r *webhookDelivery) {
+			r.Attempts, r.ResponseCode, r.Error = attempt, code, ""
+			switch {
+			case err != nil:
+				r.Error = err.Error()
+			case code >= 300:
+				r.Error = fmt.Sprintf("receiver answered %d", code)
+			}
+			if !retry {
+				r.Status = DeliveryDelivered
+				if code >= 300 {
+					r.Status = DeliveryFailed
+				}
+			} else if attempt == WebhookMaxAttempts {
+				r.Status = DeliveryFailed
+			}
+		})
+		if !retry {
+			return
+		}
+		if attempt < WebhookMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// post makes one delivery attempt
+func (d *webhookDispatcher) post(job webhookJob, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", job.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "squid-editor-webhook")
+	req.Header.Set("X-Squid-Editor-Event", job.event.Type)
+	req.Header.Set("X-Squid-Editor-Delivery", job.deliveryID)
+	req.Header.Set("X-Squid-Editor-Timestamp", timestamp)
+	if job.hook.Secret != "" {
+		req.Header.Set("X-Squid-Editor-Signature", signWebhook(job.hook.Secret, timestamp, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
+
+// drain waits until no delivery is pending, at most for timeout. The command-line tool calls
+// it before exiting so its deliveries are not cut off.
+func (d *webhookDispatcher) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := 0
+		d.mu.Lock()
+		for i := range d.deliveries {
+			if d.deliveries[i].Status == DeliveryPending {
+				pending++
+			}
+		}
+		d.mu.Unlock()
+		if pending == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// update changes a delivery record in place
+func (d *webhookDispatcher) update(id string, fn func(r *webhookDelivery)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.deliveries {
+		if d.deliveries[i].ID == id {
+			fn(&d.deliveries[i])
+			d.deliveries[i].UpdatedAt = time.Now().UTC()
+			return
+		}
+	}
+}
+
+// recent returns the newest deliveries first, optionally for one webhook
+func (d *webhookDispatcher) recent(webhookID string, limit int) []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []webhookDelivery{}
+	for i := len(d.deliveries) - 1; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		if webhookID == "" || d.deliveries[i].WebhookID == webhookID {
+			out = append(out, d.deliveries[i])
+		}
+	}
+	return out
+}
+
+// notifyListChange announces a domain moved between lists
+func notifyListChange(actor string, move *domainMove) {
+	text := fmt.Sprintf("%s moved %s from %s to %s", actor, move.Domain, move.From, move.To)
+	if move.Note != "" {
+		text += " (" + move.Note + ")"
+	}
+	webhooks.notify(EventListChanged, text, map[string]string{
+		"actor":   actor,
+		"domain":  move.Domain,
+		"from":    move.From,
+		"to":      move.To,
+		"note":    move.Note,
+		"covered": strings.Join(move.Covered, ","),
+		"reload":  reloadOutcome(move.ReloadErr),
+	})
+}